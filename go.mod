@@ -5,13 +5,11 @@ go 1.22
 toolchain go1.22.5
 
 require (
+	github.com/djherbis/times v1.6.0
 	github.com/iafan/cwalk v0.0.0-20210125030640-586a8832a711
 	github.com/suyashkumar/dicom v1.0.7
+	golang.org/x/sys v0.0.0-20220615213510-4f61da869c0c
 	golang.org/x/text v0.16.0
 )
 
-require (
-	github.com/djherbis/times v1.6.0 // indirect
-	github.com/google/go-cmp v0.6.0 // indirect
-	golang.org/x/sys v0.0.0-20220615213510-4f61da869c0c // indirect
-)
+require github.com/google/go-cmp v0.6.0 // indirect
@@ -5,39 +5,25 @@
 package main
 
 import (
-	"bytes"
-	_ "embed"
-	"errors"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
-	"regexp"
-	"runtime"
 	"sort"
-	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"flag"
-	"sync/atomic"
-
-	"github.com/iafan/cwalk"
-
-	"github.com/suyashkumar/dicom"
-	//"github.com/haukebartsch/dicom"
-	//"github.com/haukebartsch/dicom/pkg/tag"
-
-	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/HaukeBartsch/sdcm/sorter"
 
 	"golang.org/x/text/message"
 
-	"github.com/djherbis/times"
-
 	_ "net/http/pprof"
 )
 
@@ -49,637 +35,191 @@ var compileDate string = ".unknown"
 
 //var own_name string = "sdcm"
 
-var counter int32
-var counterError int32
-var bytesWritten int64
-var ProcessDataPath string
-var InputDataPath string
-var startTime time.Time
-var spinner_c int = 0
 var spinner = []string{"⣾ ", "⣽ ", "⣻ ", "⢿ ", "⡿ ", "⣟ ", "⣯ ", "⣷ "}
-var listPatients sync.Map
-var listStudies sync.Map
-var listSeries sync.Map
-var listStructure = make(map[string][]string, 0) // map of SeriesInstanceUIDs of [PatientID, StudyDate, StudyInstanceUID, Modality]
-var modalities = make(map[string]int, 0)
-var listStructureMutex sync.Mutex // mutex to protect listStructure and modalities
-
-var dicomTags map[tag.Tag]string
-var preserve map[string]bool
-
-// listStructuresChan is a channel to collect patient, study, series and modality information into listStructure
-var listStructuresChan = make(chan []string, 1000)
 
 var fmt_local *message.Printer
 
-// based on Wikipedia: / \ ? * : | " < >
-// replace characters to create a valid directory name on all systems
-var sanitizeFilenameReplacer *strings.Replacer = strings.NewReplacer("/", " ", "\\", "", "?", " ", "*", " ", ":", " ", "|", " ", "\"", " ", "<", " ", ">", " ")
-
-// known DICOM modality codes (https://www.dicomlibrary.com/dicom/modality/, https://dicom.innolitics.com/ciods/digital-x-ray-image/dx-series/00080060)
-var dicomModalityCodes = map[string]string{
-	"AR":         "Autorefraction",
-	"AS":         "Angioscopy",
-	"ASMT":       "Content Assessment Results",
-	"AU":         "Audio",
-	"BDUS":       "Bone Densitometry (ultrasound)",
-	"BI":         "Biomagnetic imaging",
-	"BMD":        "Bone Densitometry (X-Ray)",
-	"CD":         "Color flow Doppler",
-	"CF":         "Cinefluorography",
-	"CP":         "Colposcopy",
-	"CR":         "Computed Radiography",
-	"CS":         "Cystoscopy",
-	"CT":         "Computed Tomography",
-	"CTPROTOCOL": "CT Protocol Performed",
-	"DD":         "Duplex Doppler",
-	"DF":         "Digital fluoroscopy",
-	"DG":         "Diaphanography",
-	"DM":         "Digital microscopy",
-	"DMS":        "Dermoscopy",
-	"DOC":        "Document",
-	"DS":         "Digital Subtraction Angiography",
-	"DX":         "Digital Radiography",
-	"EC":         "Echocardiography",
-	"ECG":        "Electrocardiography",
-	"EMG":        "Electromyography",
-	"EOG":        "Electrooculography",
-	"EPS":        "Cardiac Electrophysiology",
-	"ES":         "Endoscopy",
-	"FA":         "Fluorescein angiography",
-	"FID":        "Fiducials",
-	"FS":         "Fundoscopy",
-	"GM":         "General Microscopy",
-	"HC":         "Hard Copy",
-	"HD":         "Hemodynamic Waveform",
-	"IO":         "Intra-Oral Radiography",
-	"IOL":        "Intraocular Lens Data",
-	"IVOCT":      "Intravascular Optical Coherence Tomography",
-	"IVUS":       "Intravascular Ultrasound",
-	"KER":        "Keratometry",
-	"KO":         "Key Object Selection",
-	"LEN":        "Lensometry",
-	"LP":         "Laparoscopy",
-	"LS":         "Laser surface scan",
-	"M3D":        "Model for 3D Manufacturing",
-	"MA":         "Magnetic resonance angiography",
-	"MG":         "Mammography",
-	"MR":         "Magnetic Resonance",
-	"MS":         "Magnetic resonance spectroscopy",
-	"NM":         "Nuclear Medicine",
-	"OAM":        "Ophthalmic Axial Measurements",
-	"OCT":        "Optical Coherence Tomography (non-Ophthalmic)",
-	"OP":         "Ophthalmic Photography",
-	"OPM":        "Ophthalmic Mapping",
-	"OPR":        "Ophthalmic Refraction",
-	"OPT":        "Ophthalmic Tomography",
-	"OPTBSV":     "Ophthalmic Tomography B-scan Volume Analysis",
-	"OPTENF":     "Ophthalmic Tomography En Face",
-	"OPV":        "Ophthalmic Visual Field",
-	"OSS":        "Optical Surface Scan",
-	"OT":         "Other",
-	"PLAN":       "Plan",
-	"PR":         "Presentation State",
-	"PT":         "Positron emission tomography - PET",
-	"PX":         "Panoramic X-Ray",
-	"REG":        "Registration",
-	"RESP":       "Respiratory Waveform",
-	"RF":         "Radio Fluoroscopy",
-	"RG":         "Radiographic imaging (conventional film/screen)",
-	"RTDOSE":     "Radiotherapy Dose",
-	"RTIMAGE":    "Radiotherapy Image",
-	"RTPLAN":     "Radiotherapy Plan",
-	"RTRECORD":   "RT Treatment Record",
-	"RTSTRUCT":   "Radiotherapy Structure Set",
-	"RWV":        "Real World Value Map",
-	"SEG":        "Segmentation",
-	"SM":         "Slide Microscopy",
-	"SMR":        "Stereometric Relationship",
-	"SR":         "SR Document",
-	"SRF":        "Subjective Refraction",
-	"ST":         "Single-photon emission computed tomography - SPECT",
-	"STAIN":      "Automated Slide Stainer",
-	"TG":         "Thermography",
-	"US":         "Ultrasound",
-	"VA":         "Visual Acuity",
-	"VF":         "Videofluorography",
-	"XA":         "X-Ray Angiography",
-	"XC":         "External-camera Photography",
-}
-
 var (
-	methodFlag       string
-	verboseFlag      bool
-	versionFlag      bool
-	quietFlag        bool
 	outputFolderFlag string
 	outputFormatFlag string
-	thoroughFlag     bool
-	braveFlag        bool
-	debugFlag        bool
-	num_workers      int
-	preserveFlag     string
+	versionFlag      bool
+	serveMode        bool
+	indexMode        bool
+	queryMode        bool
+	tagsMode         bool
 )
 
-func UpdateCounter(counters *sync.Map, key string) {
-	val, _ := counters.LoadOrStore(key, new(int64))
-	ptr := val.(*int64)
-	atomic.AddInt64(ptr, 1)
-}
-
 func exitGracefully(err error) {
 	fmt.Fprintf(os.Stderr, "error: %v\n", err)
 	os.Exit(1)
 }
 
-func check(e error) {
-	if e != nil {
-		exitGracefully(e)
-	}
+// warningPrinter prints the warnings of a run and the files that could not be sorted, also with -quiet
+type warningPrinter struct {
+	sorter.NoEvents
 }
 
-var nonAlphanumericRegex = regexp.MustCompile(`[^a-zA-Z0-9 ]+`)
-
-func clearString(str string) string {
-	return nonAlphanumericRegex.ReplaceAllString(strings.Trim(str, " "), "-")
-}
-
-func copyFileContents(src, dst string) (bytesWritten int64, err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return 0, err
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return 0, err
-	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
-		}
-	}()
-	if bytesWritten, err = io.Copy(out, in); err != nil {
-		return 0, err
+// Skipped prints why a file is not sorted, non-DICOM and filtered files are only counted
+func (warningPrinter) Skipped(path string, reason error) {
+	switch reason {
+	case sorter.ErrNotDICOM, sorter.ErrExcluded, sorter.ErrFiltered, sorter.ErrDICOMDIR:
+		return
 	}
-	err = out.Sync()
-	return bytesWritten, err
+	fmt.Fprintf(os.Stderr, "Warning: %s is not sorted (%s)\n", path, reason)
 }
 
-func printMem() {
-	var ms runtime.MemStats
-	runtime.ReadMemStats(&ms)
-	log.Printf("System: %8d Inuse: %8d Released: %8d Objects: %6d\n", ms.HeapSys, ms.HeapInuse, ms.HeapReleased, ms.HeapObjects)
+// Warning prints a problem that does not stop the run
+func (warningPrinter) Warning(err error) {
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
 }
 
-func populate(keyMap *map[tag.Tag]string, in_file string) {
-	// put all values into the keyMap, overwrite previous values
-	// reset the keyMap
-	var numKeys int = len(*keyMap)
-
-	dcm, err := os.Open(in_file)
-	if err != nil {
-		exitGracefully(fmt.Errorf("unable to open %s. Error: %v", in_file, err))
-	}
-	defer dcm.Close()
-
-	data, err := io.ReadAll(dcm)
-	if err != nil {
-		exitGracefully(fmt.Errorf("unable to read file into memory for benchmark: %v", err))
-	}
-
-	r := bytes.NewReader(data)
-	p, _ := dicom.NewParser(r, int64(len(data)), nil, dicom.SkipPixelData())
-
-	var cc int = 0
-	for err == nil {
-		t, err := p.Next() // there is still a copy of this tag in p.Elements after this call, not needed...
-		if err != nil {
-			break
-		}
-		// t is a dicom.Element
-		val, ok := (*keyMap)[t.Tag]
-		if ok {
-			if val == "" {
-				v := t.Value.GetValue().([]string)
-				if len(v) > 0 {
-					(*keyMap)[t.Tag] = v[0]
-				}
-				cc = cc + 1 // we will use this even if the value is an empty string
-				if cc == numKeys {
-					break // we are done
-				}
-			}
-		}
-	}
+// progressPrinter prints the progress of a run on the terminal
+type progressPrinter struct {
+	warningPrinter
+	method string
+	serve  bool
+	opts   *sorter.Options
 }
 
-func splitPath(path string) []string {
-	dir, last := filepath.Split(path)
-	if dir == "" {
-		return []string{last}
-	}
-	return append(splitPath(filepath.Clean(dir)), last)
-}
-
-func isNum(s string) bool {
-	for _, v := range s {
-		if v < '0' || v > '9' {
-			return false
-		}
+// Started prints what is sorted
+func (pp progressPrinter) Started() {
+	opts := pp.opts
+	if pp.serve {
+		if opts.Port > 0 {
+			fmt.Printf("Receive on port %d as %s ...\n", opts.Port, opts.AET)
+		}
+		if opts.HTTPPort > 0 {
+			fmt.Printf("Receive STOW-RS on http://localhost:%d/studies ...\n", opts.HTTPPort)
+		}
+		fmt.Println()
+	} else if opts.Watch {
+		fmt.Printf("Watch %v ...\n\n", opts.Input)
+	} else if opts.FilesFrom != "" {
+		fmt.Printf("Parse %v and the files listed in %s ...\n\n", opts.Input, opts.FilesFrom)
+	} else {
+		fmt.Printf("Parse %v ...\n\n", opts.Input)
 	}
-	return true
 }
 
-func processDataset(dataset dicom.Dataset, path string, oOrderPath string, in_file string) error {
-	// in some special cases we want to skip this DICOM, e.g. DICOMDIR
-	val, err := dataset.FindElementByTag(tag.MediaStorageSOPClassUID)
-	if err == nil {
-		var vs string = dicom.MustGetStrings(val.Value)[0]
-		if vs == "1.2.840.10008.1.3.10" {
-			// skip MediaStorageDirectoryStorage
-			atomic.AddInt32(&counterError, 1)
-			if debugFlag {
-				fmt.Fprintf(os.Stderr, "[%d] ignore DICOMDIR file: \"%s\"\n\n", counterError, path)
-			}
-			return nil
-		}
-	}
-
-	// go through all tags we need and pull those, use a map of tag.Tag as key and string as value
-	// use together with dicomTags (tag.Tag as key and "{bla}" as value).
-	dicomVals := make(map[tag.Tag]string, 0)
-	for key := range dicomTags {
-		val, err = dataset.FindElementByTag(key)
-		if err == nil {
-			var vs string = dicom.MustGetStrings(val.Value)[0]
-			// this is used as a filename, we should sanitize them
-			dicomVals[key] = sanitizeFilenameReplacer.Replace(vs)
-			// we should check if vs is a safe string for a directory name
-		} else {
-			dicomVals[key] = ""
-		}
-	}
-
-	//printMem()
-
-	// if we filter we might not like this file
-	var skipThisFile bool = false
-
-	// now create the folder structure based on outputFolderFlag, treat the last entry as filename
-	pps := outputFolderFlag
-	for t := range dicomVals {
-		// if we have a dicomTags[t] that contains an "==" we need to filter, only allow matching entries
-		// TODO: could be done faster if we cache the regular expressions for each tag they are needed
-		if strings.Contains(dicomTags[t], "==") {
-			r := strings.Split(dicomTags[t], "==")[1]
-			r = strings.TrimSuffix(r, "}")
-			re := regexp.MustCompile(r)
-			if !(re.MatchString(dicomVals[t])) {
-				skipThisFile = true
-				break
-			}
-		} else if strings.Contains(dicomTags[t], "=") {
-			r := strings.Split(dicomTags[t], "=")[1]
-			r = strings.TrimSuffix(r, "}")
-			re := regexp.MustCompile(r)
-			if !(re.MatchString(dicomVals[t])) {
-				skipThisFile = true
-				break
-			}
-		}
-
-		if t == tag.SeriesNumber {
-			sn, err := strconv.Atoi(dicomVals[tag.SeriesNumber])
-			if err == nil {
-				pps = strings.Replace(pps, "{SeriesNumber}", fmt.Sprintf("%03d", sn), -1)
-			} else {
-				pps = strings.Replace(pps, "{SeriesNumber}", dicomVals[tag.SeriesNumber], -1)
-			}
-		} else {
-			pps = strings.Replace(pps, dicomTags[t], dicomVals[t], -1)
-		}
+func (pp progressPrinter) Progress(p sorter.Progress) {
+	// print progress every second at least
+	spinner_c := int(math.Round(p.Elapsed.Seconds()))
+	sizeStr := ""
+	if pp.method != "link" {
+		sizeStr = fmt.Sprintf("%s, ", sorter.FormatFileSize(float64(p.BytesWritten), 1024.0))
 	}
-	if skipThisFile {
-		atomic.AddInt32(&counterError, 1)
-		if debugFlag {
-			fmt.Fprintf(os.Stderr, "[%d] ignore file, cannot read as DICOM: \"%s\"\n\n", counterError, path)
-		}
-		return nil
+	queueStr := ""
+	if p.QueueCapacity > 0 {
+		queueStr = fmt.Sprintf(" R %d W %d/%d", p.Reading, p.Queued, p.QueueCapacity)
 	}
+	// go to beginning of line, clear the line and change color, print the spinner and other information
+	fmt_local.Printf("\033[1F\033[2K\033[94;49m%s%d\033[37m [%s%.0f files / s] P %d S %d S %d [S %d]%s\033[39m\033[49m\n", spinner[(spinner_c)%len(spinner)], p.Files, sizeStr, (float64(p.Files))/p.Elapsed.Seconds(), p.Patients, p.Studies, p.Series, p.Skipped, queueStr)
 
-	// keep track of the patients, studies and series but only if we use verbose mode
-	if !quietFlag {
-		UpdateCounter(&listPatients, dicomVals[tag.PatientID])
-		UpdateCounter(&listStudies, dicomVals[tag.StudyInstanceUID])
-		UpdateCounter(&listSeries, dicomVals[tag.SeriesInstanceUID])
-		// TODO: what if the variables do not exist? Does this fail?
-		listStructuresChan <- []string{dicomVals[tag.PatientID], dicomVals[tag.StudyDate], dicomVals[tag.StudyInstanceUID], dicomVals[tag.SeriesInstanceUID], dicomVals[tag.Modality]}
+	mo := p.Modalities
+	var mods []string
+	for m := range mo {
+		mods = append(mods, m)
 	}
-
-	pps = strings.Replace(pps, "{counter}", fmt.Sprintf("%06d", counter), -1) // use the global counter
-	pps = strings.Replace(pps, " ", "-", -1)                                  // remove spaces
-
-	pathPieces := splitPath(pps)
-	piece := 0
-	oOrderPatientPath := oOrderPath
-	for piece < len(pathPieces)-1 {
-		// this loop will concurrently try to create these folders, maybe they exist already even if we get an error in Mkdir
-		oOrderPatientPath = filepath.Join(oOrderPatientPath, pathPieces[piece])
-		if _, err := os.Stat(oOrderPatientPath); os.IsNotExist(err) {
-			err := os.Mkdir(oOrderPatientPath, 0755)
-			if err != nil {
-				if _, err2 := os.Stat(oOrderPatientPath); os.IsNotExist(err2) {
-					exitGracefully(fmt.Errorf("could not create data directory %s (%s)", oOrderPatientPath, err))
-				}
-			}
+	sort.Slice(mods[:], func(i, j int) bool {
+		if mo[mods[i]] == mo[mods[j]] {
+			// sort by name
+			return mods[i] < mods[j]
 		}
-		piece = piece + 1
-	}
-	// filename is
-	fname := pathPieces[len(pathPieces)-1]
-
-	outputPath := oOrderPatientPath
-
-	outputPathFileName := fmt.Sprintf("%s/%s", outputPath, fname)
-	_, err = os.Stat(outputPathFileName)
-	var c int = 0
-	atomic.AddInt32(&counter, 1)
-	for !os.IsNotExist(err) {
-		c = c + 1 // make filename unique by adding a number
-		fname := fmt.Sprintf("%s_%03d%s", strings.TrimSuffix(fname, filepath.Ext(fname)), c, filepath.Ext(fname))
-		outputPathFileName = fmt.Sprintf("%s/%s", outputPath, fname)
-		//outputPathFileName := fmt.Sprintf("%s/%s_%03d.dcm", outputPath, SOPInstanceUID, c)
-		_, err = os.Stat(outputPathFileName)
-	}
-	if debugFlag && c != 0 {
-		fmt.Fprintf(os.Stderr, "[%d] make file name unique: \"%s\"\n\n", counterError, outputPathFileName)
+		return mo[mods[i]] > mo[mods[j]]
+	})
+	// we want to align the output lines for each modality to a unified max length, compute the length max length first
+	var max_length int = 0
+	for i := range mods {
+		mods_tmp := fmt_local.Sprintf("\033[2K\033[42m %s (%s) %d \033[49m\n", sorter.ModalityName(mods[i]), mods[i], mo[mods[i]])
+		if len(mods_tmp) > max_length {
+			max_length = len(mods_tmp)
+		}
+	}
+	// fill up to max length
+	for i := range mods {
+		m := sorter.ModalityName(mods[i])
+		// to compute the number of missing spaces
+		mods_tmp := fmt_local.Sprintf("\033[2K\033[42m %s (%s) %d \033[49m\n", m, mods[i], mo[mods[i]])
+		// now add the spaces in the middle
+		mods[i] = fmt_local.Sprintf("\033[2K\033[42m %s (%s) %s%d \033[49m\n", m, mods[i], strings.Repeat(" ", max_length-len(mods_tmp)), mo[mods[i]])
+	}
+	if len(mods) > 0 {
+		fmt_local.Printf(" %s", strings.Join(mods, " "))
+		fmt_local.Printf("\033[%dA\033[1G", len(mods))
 	}
+}
 
-	var bw int64 = 0
-	err = nil
-	if methodFlag == "copy" {
-		bw, err = copyFileContents(in_file, outputPathFileName)
-		// if we really copy the file we can also check for preserve
-		_, ok := preserve["timestamp"]
-		if ok {
-			t, err := times.Stat(in_file)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error, could not stat the output file")
-			} else {
-				os.Chtimes(outputPathFileName, t.AccessTime(), t.ModTime())
-			}
-		}
-	} else if methodFlag == "link" {
-		// TODO: this can fail, we test for the file above but here some time went by
-		if err = os.Symlink(in_file, outputPathFileName); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: could not create symlink %s for %s, %s\n", in_file, outputPathFileName, err)
-		}
-	} else if methodFlag == "emptyfile" { // TODO: do we keep this option?
-		// don't do anything else
-		emptyfile, e := os.Create(outputPathFileName)
-		if e != nil {
-			log.Fatal(e)
-		}
-		log.Println(emptyfile)
-		emptyfile.Close()
-	} else if methodFlag == "dirs_only" { // TODO: do we keep this option?
-		// don't do anything else
-		// remove the filename (keep the directory)
-		opfn := filepath.Dir(outputPathFileName)
-		os.MkdirAll(opfn, os.ModePerm)
-	} else {
-		// instead of copy we assume we want a symbolic link
-		exitGracefully(fmt.Errorf("unknown option \"%s\" for method flag, we support only \"copy\" (default), \"link\" and \"dirs_only\"", methodFlag))
+// printFailures lists the files or commands that failed
+func printFailures(failures []string) {
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "  failed: %s\n", f)
 	}
-	if err != nil {
-		fmt.Println(err)
-	}
-	atomic.AddInt64(&bytesWritten, bw)
-	return nil
 }
 
-// the path we get does not have the input path prefixed
-func walkFunc(path string, info os.FileInfo, err error) error {
-	if info == nil {
-		// might happen if the directory name does not exist...
-		return nil
+// printSummary prints the result of a run
+func printSummary(opts sorter.Options, r sorter.Result) {
+	plural := func(n int64) string { return map[bool]string{true: "", false: "s"}[n == 1] }
+	sizeStr := ""
+	if opts.Method != "link" {
+		sizeStr = fmt.Sprintf("[%s]", sorter.FormatFileSize(float64(r.BytesWritten), 1000.0)) // need MB not MiB
 	}
-
-	// func(path string, info os.FileInfo, err error) error {
-	if info.IsDir() {
-		return nil
+	fmt.Printf("\033[2Kdone in %s %s\n", r.Duration, sizeStr)
+	fmt_local.Printf("\033[2K✓ sorted %d file%s [%d non-DICOM files ignored or filtered]\n", r.Files, plural(int64(r.Files)), r.Skipped)
+	if opts.OrderSlices {
+		fmt_local.Printf("  ordered the files of %d series [%d with duplicate, %d with missing slice positions]\n", r.FoldersOrdered, r.FoldersDuplicateSlices, r.FoldersMissingSlices)
 	}
-	if err != nil {
-		return err
+	if opts.SeriesReport != "" {
+		fmt_local.Printf("  series check: %d complete, %d suspect [%s]\n", r.SeriesComplete, r.SeriesSuspect, opts.SeriesReport)
 	}
-
-	// print progress every second at least
-	//spinner_c = int(math.Round(time.Since(startTime).Seconds()))
-	//if !quietFlag && ((counter+counterError)%100 == 0) || (spinner_c != old_spinner_c) {
-	//	numPatients := 0
-	//	listPatients.Range(func(key, value interface{}) bool {
-	//		numPatients = numPatients + 1
-	//		return true
-	//	})
-	//	numStudies := 0
-	//	listStudies.Range(func(key, value interface{}) bool {
-	//		numStudies = numStudies + 1
-	//		return true
-	//	})
-	//	numSeries := 0
-	//	listSeries.Range(func(key, value interface{}) bool {
-	//		numSeries = numSeries + 1
-	//		return true
-	//	})
-	//	fmt_local.Printf("\033[A\033[2K\033[94;49m%s%d\033[37m [%.0f files / s] P %d S %d S %d [S %d]\033[39m\033[49m\n", spinner[(spinner_c)%len(spinner)], counter, (float64(counter))/time.Since(startTime).Seconds(), numPatients, numStudies, numSeries, counterError)
-	//}
-	//old_spinner_c = spinner_c
-
-	// we can filter out files that take a long time if we allow only
-	//  - files without an extension, or
-	//  - files with .dcm as extension
-	//  - files with an extension that contains only numbers (files named by UID)
-	if !thoroughFlag && filepath.Ext(path) != "" {
-		if strings.ToLower(filepath.Ext(path)) != ".dcm" && !isNum(filepath.Ext(path)[1:]) && len(filepath.Ext(path)) < 5 {
-			atomic.AddInt32(&counterError, 1)
-			if debugFlag {
-				fmt.Fprintf(os.Stderr, "[%d] ignore file due to file extension: \"%s\"\n", counterError, path)
-			}
-			return nil // ignore this file
-		}
+	if opts.ConsistencyReport != "" {
+		fmt_local.Printf("  identifier check: %d issue%s [%s]\n", r.ConsistencyIssues, plural(int64(r.ConsistencyIssues)), opts.ConsistencyReport)
 	}
-
-	//fmt.Printf("\033[2J\n")
-
-	dest_path := ProcessDataPath
-	//fmt.Println("look at file: ", path)
-
-	// Create the output path in some standard way
-	oOrderPath := dest_path
-	if _, err := os.Stat(oOrderPath); os.IsNotExist(err) {
-		err := os.Mkdir(oOrderPath, 0755)
-		if err != nil {
-			exitGracefully(fmt.Errorf("could not create output data directory %s", oOrderPath))
-		}
-		//} else if errors.Is(err, fs.ErrPermission) {
-		//	exitGracefully(fmt.Errorf("could not create output data directory %s, %s", oOrderPath, err))
-	} else if err != nil {
-		exitGracefully(fmt.Errorf("could not create output data directory %s, %s", oOrderPath, err))
+	if opts.UseIndex {
+		fmt_local.Printf("  %d file%s sorted using the index, %d parsed (new or changed)\n", r.FromIndex, plural(int64(r.FromIndex)), r.IndexStale)
 	}
-	in_file := filepath.Join(InputDataPath, path)
-
-	// Ok, we can try to be faster if we do not read the whole set, we would like
-	// to also stop parsing after we have all the keys we need.
-	// BenchmarkParser_NextAPI
-
-	// Detect the filetype first
-	if filepath.Ext(path) == ".tgz" {
-
+	if r.FromDicomdir+r.DicomdirParsed > 0 {
+		fmt_local.Printf("  %d file%s sorted using DICOMDIR records, %d parsed\n", r.FromDicomdir, plural(int64(r.FromDicomdir)), r.DicomdirParsed)
 	}
-
-	dataset, err := dicom.ParseFile(in_file, nil, dicom.SkipPixelData()) // See also: dicom.Parse which has a generic io.Reader API.
-
-	/*	TODO: switch to dicom.Parse as it can work with an io.Reader.
-		    TODO: add the ability to detect tgz as file extension and get an io.Reader
-			      from in-memory extraction of a tgz file. Check each DICOM file inside.
-		    f, err := os.Open(filepath)
-			if err != nil {
-				return Dataset{}, err
-			}
-			defer f.Close()
-
-			info, err := f.Stat()
-			if err != nil {
-				return Dataset{}, err
-			}
-
-			return Parse(f, info.Size(), frameChan, opts...) */
-
-	//fmt.Printf("ParseFile time: %v %s\n", time.Since(sT), path)
-	if err == nil { // switch in_file to an io.Reader? We could create a copy from inside a tgz... but links do not work anymore...
-		if processDataset(dataset, path, oOrderPath, in_file) == nil {
-			return nil
-		}
-	} else {
-		atomic.AddInt32(&counterError, 1)
-		if debugFlag {
-			fmt.Fprintf(os.Stderr, "[%d] ignore file, cannot read as DICOM: \"%s\"\n\n", counterError, path)
-		}
+	if serveMode {
+		fmt_local.Printf("  received %d instance%s in %d association%s and %d STOW-RS request%s\n", r.Received, plural(int64(r.Received)), r.Associations, plural(int64(r.Associations)), r.StowRequests, plural(int64(r.StowRequests)))
 	}
-
-	return nil
-}
-
-var sizes = []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
-
-func FormatFileSize(s float64, base float64) string {
-	unitsLimit := len(sizes)
-	i := 0
-	for s >= base && i < unitsLimit {
-		s = s / base
-		i++
+	if opts.Watch {
+		fmt_local.Printf("  %d series complete\n", r.SeriesCompleted)
 	}
-
-	f := "%.0f %s"
-	if i > 1 {
-		f = "%.2f %s"
+	if r.Hooks > 0 {
+		fmt_local.Printf("  ran %d hook%s [%d failed]\n", r.Hooks, plural(int64(r.Hooks)), r.HooksFailed)
+		printFailures(r.HookFailures)
 	}
-
-	return fmt.Sprintf(f, s, sizes[i])
-}
-
-func sort_dicoms(source_paths []string, dest_path string) int32 {
-	destination_path := dest_path
-
-	if _, err := os.Stat(destination_path); os.IsNotExist(err) {
-		err := os.Mkdir(destination_path, 0755)
-		if err != nil {
-			exitGracefully(fmt.Errorf("could not create output directory \"%s\", %s", destination_path, err.Error()))
-		}
+	if opts.Method == "cstore" {
+		fmt_local.Printf("  sent %d instance%s to %s@%s [%d with warnings, %d failed]\n", r.Sent, plural(int64(r.Sent)), opts.CalledAET, opts.Output, r.SentWarning, r.SendFailed)
+		printFailures(r.SendFailures)
 	}
-	// storing information in global objects
-	counter = 0 // we are using this to name DICOM files, not possible here!
-	counterError = 0
-	bytesWritten = 0
-	ProcessDataPath = dest_path
-	startTime = time.Now()
-	//if !quietFlag {
-	//	fmt.Printf("\n")
-	//}
-	for _, source_path := range source_paths {
-		InputDataPath = source_path
-
-		cwalk.NumWorkers = num_workers
-		cwalk.BufferSize = cwalk.NumWorkers
-		err := cwalk.WalkWithSymlinks(source_path, walkFunc)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: input directory does not exist (%s). Internal error: \"%s\", skip folder\n", source_path, err.Error())
-			/*for i, errors := range err.(cwalk.WalkerErrorList).ErrorList {
-				fmt.Printf("Error [%d]: %s\n", i, errors)
-			}*/
-		}
+	if opts.Method == "stow" {
+		fmt_local.Printf("  sent %d instance%s to %s in %d request%s [%d with warnings, %d failed]\n", r.Sent, plural(int64(r.Sent)), strings.TrimSuffix(strings.TrimSuffix(opts.Output, "/"), "/studies"), r.StowRequests, plural(int64(r.StowRequests)), r.SentWarning, r.SendFailed)
+		printFailures(r.SendFailures)
 	}
-	if !quietFlag {
-		sizeStr := ""
-		if methodFlag != "link" {
-			sizeStr = fmt.Sprintf("[%s]", FormatFileSize(float64(bytesWritten), 1000.0)) // need MB not MiB
+	if opts.Method == "copy" {
+		switch opts.Sync {
+		case "per-directory":
+			fmt_local.Printf("  files synced per folder (%d folder%s)\n", r.SyncedFolders, plural(int64(r.SyncedFolders)))
+		case "end":
+			fmt_local.Printf("  files synced once at the end (%s)\n", r.SyncDuration.Round(time.Millisecond))
+		case "none":
+			fmt_local.Printf("  files not synced (-sync none), the operating system writes them later\n")
+		default:
+			fmt_local.Printf("  files synced after each file\n")
 		}
-		fmt.Printf("\033[2Kdone in %s %s\n", time.Since(startTime), sizeStr)
 	}
-
-	return counter
-}
-
-type SeriesInstanceUIDWithName struct {
-	SeriesInstanceUID string
-	StudyInstanceUID  string
-	PatientName       string
-	Name              string
-	Order             int
-}
-
-func IsEmpty(name string) (bool, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return false, err
+	if opts.Verify {
+		fmt_local.Printf("  verified %d cop%s [%d failed]\n", r.Verified, map[bool]string{true: "y", false: "ies"}[r.Verified == 1], r.VerifyFailed)
+		printFailures(r.VerifyFailures)
 	}
-	defer f.Close()
-
-	_, err = f.Readdirnames(1) // Or f.Readdir(1)
-	if err == io.EOF {
-		return true, nil
+	if r.Manifests > 0 {
+		fmt_local.Printf("  wrote checksums of the copies into %d %s file%s\n", r.Manifests, sorter.ManifestName, plural(int64(r.Manifests)))
 	}
-	return false, err // Either not empty or error, suits both cases
-}
-
-func translateStringOrFile(outputFolderFlag string) string {
-	outputFolderFlag = strings.Trim(outputFolderFlag, " ") // remove any leading or trailing spaces
-	if outputFolderFlag[0] == '@' {                        // should we read this as a filename?
-		outputFolderFlag = outputFolderFlag[1:]
-		if _, err := os.Stat(outputFolderFlag); errors.Is(err, os.ErrNotExist) {
-			exitGracefully(fmt.Errorf("the path to folder file \"%s\" could not be found", outputFolderFlag))
-		}
-		b, err := os.ReadFile(outputFolderFlag) // just pass the file name
-		if err != nil {
-			exitGracefully(fmt.Errorf("file %s could not be read (%s)", outputFolderFlag, err))
-		}
-		outputFolderFlag = string(b)
-		// remove lines that start with '#'
-		s_list := strings.Split(strings.ReplaceAll(outputFolderFlag, "\r\n", "\n"), "\n")
-		var new_list []string
-		for _, ss := range s_list {
-			ar := strings.Split(ss, "#")
-			new_list = append(new_list, ar[0]) // remember the part before the comment character
-		}
-		outputFolderFlag = strings.Join(new_list, "")
+	if r.NotTranscoded > 0 {
+		fmt_local.Printf("  %d file%s copied without transcoding (unsupported transfer syntax)\n", r.NotTranscoded, plural(int64(r.NotTranscoded)))
 	}
-	re := regexp.MustCompile(`\r?\n`) // remove new lines
-	outputFolderFlag = re.ReplaceAllString(outputFolderFlag, "")
-	outputFolderFlag = strings.Replace(outputFolderFlag, "\t", "", -1) // do not allow tabs
-	outputFolderFlag = strings.Replace(outputFolderFlag, " ", "", -1)  // do not allow spaces
-	return outputFolderFlag
 }
 
 // -- string Value
@@ -787,14 +327,20 @@ func main() {
 	//}()
 
 	fmt_local = message.NewPrinter(message.MatchLanguage("en"))
+	opts := sorter.DefaultOptions()
 
 	//rand.Seed(time.Now().UnixNano())
 	// disable logging
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\n\033[1mNAME\033[0m\n\t%s - sort DICOM files into folders\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\033[1mUSAGE\033[0m\n\t%s (input folder) [(input folder N) ...] (output folder)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\t%s serve [-port 11112] [-aet SDCM] (output folder)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\t%s index [-index-tags (tags)] (input folder) [(input folder N) ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\t%s query [-where (conditions)] [-group series] [-output-format text] (input folder) [(input folder N) ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\t%s tags [-sample 0] [-examples 3] [-output-format text] (input folder) [(input folder N) ...]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\n\033[1mDESCRIPTION\033[0m\n\t\033[1msdcm\033[0m copies DICOM files from one directory to another. The output directory tree structure is user defined and based on DICOM meta-data.\n")
-		fmt.Fprintf(os.Stderr, "\tAdditionally to named DICOM tags a numeric '{counter}' variable can be used. The argument to option 'folder' will be interpreted\n")
+		fmt.Fprintf(os.Stderr, "\tAdditionally to named DICOM tags a numeric '{counter}' variable and the short name of the transfer syntax '{TransferSyntax}'\n")
+		fmt.Fprintf(os.Stderr, "\tcan be used. The argument to option 'folder' will be interpreted\n")
 		fmt.Fprintf(os.Stderr, "\tas a filename if it starts with an '@'-character. The file may contain the folder path as text.\n\n")
 		fmt.Fprintf(os.Stderr, "\t\t# Example format path file for sdcm\n")
 		fmt.Fprintf(os.Stderr, "\t\t# Text after a '#' character is ignored. Spaces are also ignored.\n")
@@ -820,18 +366,84 @@ func main() {
 	log.SetFlags(0)
 	log.SetOutput(io.Discard /*ioutil.Discard*/)
 
-	flag.IntVar(&num_workers, "cpus", int(runtime.GOMAXPROCS(0)), "number of worker threads used for processing")
-	flag.StringVar(&methodFlag, "method", "copy", "create either symbolic links (faster) or copy files. If dirs_only is used no files are created [copy|link|dirs_only]")
-	defaultFolderFormat := "{PatientID}_{PatientName}/{StudyDate}_{StudyTime}/{SeriesNumber}_{SeriesDescription}/{Modality}_{SOPInstanceUID}.dcm"
-	flag.StringVar(&outputFolderFlag, "folder", defaultFolderFormat, "specify the requested output folder path\n")
-	flag.StringVar(&outputFormatFlag, "format", defaultFolderFormat, "same as -folder\n")
-	flag.BoolVar(&verboseFlag, "verbose", false, "print more verbose output")
-	flag.BoolVar(&quietFlag, "quiet", false, "do not print anything")
-	flag.BoolVar(&thoroughFlag, "thorough", false, "do not filter files by extension, process all files (slower)")
-	flag.BoolVar(&braveFlag, "brave", false, "write files even if the output folder already exists and it is not empty")
-	flag.BoolVar(&debugFlag, "debug", false, "print verbose and add messages for skipped files")
+	flag.IntVar(&opts.Workers, "cpus", opts.Workers, "number of worker threads used for processing")
+	flag.StringVar(&opts.Method, "method", opts.Method, "create either symbolic links (faster) or copy files. If dirs_only is used no files are created. With cstore the files\nare sent to the DICOM node given as host:port, with stow to the DICOMweb service given as URL instead of the output folder [copy|link|dirs_only|cstore|stow]")
+	flag.StringVar(&outputFolderFlag, "folder", sorter.DefaultFolder, "specify the requested output folder path\n")
+	flag.StringVar(&outputFormatFlag, "format", sorter.DefaultFolder, "same as -folder\n")
+	flag.BoolVar(&opts.Verbose, "verbose", opts.Verbose, "print more verbose output")
+	flag.BoolVar(&opts.Quiet, "quiet", opts.Quiet, "do not print anything")
+	flag.StringVar(&opts.Manifest, "manifest", opts.Manifest, "write the SHA-256 of the copies into SHA256SUMS files, one in the output folder (root) or one in each folder with files (folder) [root|folder]")
+	flag.BoolVar(&opts.Verify, "verify", opts.Verify, "read each copy again and compare its SHA-256 with the checksum computed while writing")
+	flag.StringVar(&opts.Sync, "sync", opts.Sync, "when copies are flushed to disk, per-file is safe but slow [per-file|per-directory|end|none]")
+	flag.IntVar(&opts.ReadWorkers, "read-workers", opts.ReadWorkers, "number of workers that parse input files (default: -cpus)")
+	flag.IntVar(&opts.WriteWorkers, "write-workers", opts.WriteWorkers, "number of workers that write output files, set higher for slow or network output folders (default: -cpus)")
+	flag.BoolVar(&opts.FullHeader, "full-header", opts.FullHeader, "parse the whole header of each file instead of stopping after the last tag that is needed (slower)")
+	flag.BoolVar(&opts.Thorough, "thorough", opts.Thorough, "do not check the first bytes of a file for DICOM, try to parse all files (slower)")
+	flag.StringVar(&opts.Include, "include", opts.Include, "comma separated glob patterns (e.g. \"*.ima,raw/*\") of files that are parsed even if their first bytes do not look like DICOM")
+	flag.StringVar(&opts.Exclude, "exclude", opts.Exclude, "comma separated glob patterns (e.g. \"*.txt,*.xml\") of files that are never parsed")
+	flag.BoolVar(&opts.Brave, "brave", opts.Brave, "write files even if the output folder already exists and it is not empty")
+	flag.BoolVar(&opts.Debug, "debug", opts.Debug, "print verbose and add messages for skipped files")
 	flag.BoolVar(&versionFlag, "version", false, "print the version number")
-	flag.StringVar(&preserveFlag, "preserve", "", "preserves the timestamp if called with '-preserve timestamp'. This option only works together with '-method copy'")
+	flag.StringVar(&opts.Preserve, "preserve", opts.Preserve, "preserves the timestamp if called with '-preserve timestamp'. This option only works together with '-method copy'")
+	flag.BoolVar(&opts.StripPrivate, "strip-private", opts.StripPrivate, "remove all private tags from the copied files. This option only works together with '-method copy'")
+	flag.StringVar(&opts.KeepPrivate, "keep-private", opts.KeepPrivate, "comma separated list of private creators that are kept with -strip-private (e.g. \"SIEMENS CSA HEADER\")")
+	flag.BoolVar(&opts.StripOverlays, "strip-overlays", opts.StripOverlays, "remove overlay (60xx) and curve (50xx) groups from the copied files. This option only works together with '-method copy'")
+	flag.StringVar(&opts.RemoveTags, "remove-tags", opts.RemoveTags, "comma separated list of tags removed from the copied files, either names or group,element pairs (e.g. \"PatientBirthDate,(0010,1010)\")")
+	flag.StringVar(&opts.Transcode, "transcode", opts.Transcode, "re-write copied files with an uncompressed transfer syntax [explicit|implicit]. Supports\nimplicit VR, big endian, deflated, RLE and JPEG baseline input, other files are copied unchanged. This option only works together with '-method copy'")
+	flag.BoolVar(&opts.SplitFrames, "split-frames", opts.SplitFrames, "copy each frame of an enhanced multi-frame object as a single-frame instance with a new SOPInstanceUID.\nThis option only works together with '-method copy'")
+	flag.StringVar(&opts.Subseries, "subseries", opts.Subseries, "split series by the values of these tags, available as {subseries} in the folder path\n(e.g. \"ImageOrientationPatient,EchoTime,ImageType,AcquisitionNumber,DiffusionBValue\")")
+	flag.BoolVar(&opts.OrderSlices, "order-slices", opts.OrderSlices, "rename the files in each output folder (0001.dcm, ...) by their position along the slice normal\n(fallback to InstanceNumber and AcquisitionTime) and report duplicate or missing slice positions")
+	flag.StringVar(&opts.SeriesReport, "series-report", opts.SeriesReport, "check each series for missing instances, irregular slice spacing, changing image sizes and mixed\norientations and write the result to this file (.json or .csv)")
+	flag.StringVar(&opts.ConsistencyReport, "consistency-report", opts.ConsistencyReport, "check patient, study and series identifiers (series in several studies, studies with several PatientIDs, ...)\nand write the problems found to this file (.json or .csv)")
+	flag.BoolVar(&opts.Dicomdir, "dicomdir", opts.Dicomdir, "write a DICOMDIR at the root of the output folder. File names are replaced by media file IDs\n(DICOM/PA000001/ST000001/SE000001/IM000001)")
+	flag.BoolVar(&opts.UseDicomdir, "use-dicomdir", opts.UseDicomdir, "use the DICOMDIR of an input folder instead of parsing each file. Files are parsed only if a tag\nneeded for the folder path is missing in the directory records")
+	flag.StringVar(&opts.CalledAET, "called-aet", opts.CalledAET, "application entity title of the DICOM node that receives the files with '-method cstore'")
+	flag.IntVar(&opts.Associations, "associations", opts.Associations, "number of parallel associations used by '-method cstore'")
+	flag.IntVar(&opts.Retry, "retry", opts.Retry, "number of times '-method cstore' and '-method stow' try again to send a file after a failure")
+	flag.StringVar(&opts.FilesFrom, "files-from", opts.FilesFrom, "sort the files listed in this file (newline or NUL separated), use '-' to read the list from stdin")
+	flag.BoolVar(&opts.Watch, "watch", opts.Watch, "keep running and sort new files that appear in the input folders until interrupted (Ctrl-C)")
+	flag.IntVar(&opts.WatchStable, "watch-stable", opts.WatchStable, "seconds a new file has to stay unchanged before '-watch' sorts it")
+	flag.IntVar(&opts.WatchIdle, "watch-idle", opts.WatchIdle, "seconds without a new file after which '-watch' reports a series as complete")
+	flag.BoolVar(&opts.WatchPoll, "watch-poll", opts.WatchPoll, "scan the input folders every second instead of using file system events (e.g. for network shares)")
+	flag.BoolVar(&opts.WatchDelete, "watch-delete", opts.WatchDelete, "delete input files that '-watch' sorted")
+	flag.StringVar(&opts.WatchArchive, "watch-archive", opts.WatchArchive, "move input files that '-watch' sorted into this folder")
+	flag.StringVar(&opts.OnSeriesComplete, "on-series-complete", opts.OnSeriesComplete, "shell command to run for each complete series, e.g. \"dcm2niix {SeriesFolder}\". Placeholders are template\nvalues like {PatientID} and {SeriesFolder}, {StudyFolder}, {NumberOfFiles}, also available as environment variables (SDCM_SeriesFolder)")
+	flag.StringVar(&opts.OnStudyComplete, "on-study-complete", opts.OnStudyComplete, "shell command to run for each complete study (after its series hooks), e.g. \"qc.sh {StudyFolder}\"")
+	flag.IntVar(&opts.HookJobs, "hook-jobs", opts.HookJobs, "maximum number of hook commands that run at the same time")
+	flag.IntVar(&opts.Port, "port", opts.Port, "port used by 'sdcm serve' to receive DICOM files (C-STORE), 0 to disable")
+	flag.IntVar(&opts.HTTPPort, "http-port", opts.HTTPPort, "port used by 'sdcm serve' to receive DICOM files with DICOMweb STOW-RS (POST /studies)")
+	flag.IntVar(&opts.StowBatch, "stow-batch", opts.StowBatch, "maximum number of instances of a study sent in a single request by '-method stow'")
+	flag.StringVar(&opts.AET, "aet", opts.AET, "application entity title of 'sdcm serve', calling AE title of '-method cstore'")
+	flag.StringVar(&opts.Where, "where", opts.Where, "conditions of 'sdcm query' for the files, e.g. \"{Modality==CT}{SliceThickness<1}\" (regular expressions with == and !=,\nnumbers with <, <=, >, >=)")
+	flag.StringVar(&opts.Without, "without", opts.Without, "'sdcm query' lists only groups without a file that matches these conditions, e.g. \"{SeriesDescription==(?i)t1}\"")
+	flag.StringVar(&opts.Group, "group", opts.Group, "rows of 'sdcm query' [patient|study|series]")
+	flag.StringVar(&opts.Columns, "columns", opts.Columns, "comma separated columns of 'sdcm query', tags or NumberOfStudies, NumberOfSeries, NumberOfFiles")
+	flag.StringVar(&opts.OutputFormat, "output-format", opts.OutputFormat, "output of 'sdcm query' and 'sdcm tags' [text|csv|json]")
+	flag.IntVar(&opts.Sample, "sample", opts.Sample, "number of files read by 'sdcm tags', 0 reads all files")
+	flag.IntVar(&opts.Examples, "examples", opts.Examples, "number of example values (the most common) listed by 'sdcm tags'")
+	flag.BoolVar(&opts.UseIndex, "use-index", opts.UseIndex, "take the values of unchanged files from the index written by 'sdcm index' instead of parsing them")
+	flag.StringVar(&opts.IndexFile, "index", opts.IndexFile, "index file of 'sdcm index' and -use-index (default: .sdcm-index in the input folder)")
+	flag.StringVar(&opts.IndexTags, "index-tags", opts.IndexTags, "comma separated tags that 'sdcm index' stores in addition to the default tags and the tags of -folder")
+	// 'sdcm serve <output folder>' receives files over the network instead of reading input folders
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMode = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	// 'sdcm index <input folder>' stores the values of all files for -use-index
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		indexMode = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	// 'sdcm query <input folder>' prints a table of the patients, studies or series
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		queryMode = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	// 'sdcm tags <input folder>' lists the tags found in the files
+	if len(os.Args) > 1 && os.Args[1] == "tags" {
+		tagsMode = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
 	if outputFormatFlag != "" {
@@ -845,45 +457,7 @@ func main() {
 			outputFolderFlag = env_folder_path
 		}
 	}
-	// allow the outputFolderFlag to point to a file instead
-	outputFolderFlag = translateStringOrFile(outputFolderFlag)
-
-	// try to extract the tags requested in the outputFolderFlag
-	dicomTags = make(map[tag.Tag]string, 0)
-	re := regexp.MustCompile(`{[^{}]*}`)
-	matches := re.FindAllString(outputFolderFlag, -1)
-	for a := range matches {
-		e := matches[a][1 : len(matches[a])-1]
-		// we could be counter here, ignore and add later
-		if e == "counter" {
-			continue
-		}
-		// feature: if we find an == sign we use a regexp to filter, for now just extract the first part
-		if strings.Contains(e, "==") {
-			e = strings.Split(e, "==")[0]
-		} else if strings.Contains(e, "=") {
-			e = strings.Split(e, "=")[0]
-		}
-
-		// TODO: we should allow tags specified by group and element as well
-		// e.g. {0010,0020} for PatientID
-		if t, err := tag.FindByName(e); err == nil {
-			dicomTags[t.Tag] = matches[a]
-		} else {
-			fmt.Fprintf(os.Stderr, "Warning, unknown DICOM tag with name \"%s\", cannot be used as a path variable, (%s)\n", matches[a], err)
-		}
-	}
-
-	if debugFlag {
-		quietFlag = false
-	}
-
-	if !quietFlag {
-		// add three tags we need for book keeping
-		dicomTags[tag.PatientID] = "{PatientID}"
-		dicomTags[tag.StudyInstanceUID] = "{StudyInstanceUID}"
-		dicomTags[tag.SeriesInstanceUID] = "{SeriesInstanceUID}"
-	}
+	opts.Folder = outputFolderFlag
 
 	if versionFlag {
 		timeThen := time.Now()
@@ -906,179 +480,90 @@ func main() {
 		os.Exit(0)
 	}
 
-	// check preserveFlag
-	preserve = make(map[string]bool, 0)
-	if preserveFlag != "" {
-		if methodFlag != "copy" {
-			fmt.Println("warning: preserve is only supported for method 'copy'")
-		}
-		// allowed modes are timestamp
-		pieces := strings.Split(preserveFlag, ",")
-		for a := range pieces {
-			//fmt.Printf("preserve request %s\n", pieces[a])
-			if pieces[a] == "timestamp" {
-				preserve[pieces[a]] = true
-			} else {
-				exitGracefully(fmt.Errorf("unknown preserve \"%s\"", pieces[a]))
-			}
-		}
+	if opts.Debug {
+		opts.Quiet = false
+	}
+
+	// Ctrl-C stops 'sdcm serve' and -watch, the files received so far are sorted
+	ctx := context.Background()
+	if serveMode || opts.Watch {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
 	}
 
-	//own_name = os.Args[0]
+	// warnings are printed by all modes
+	opts.Events = warningPrinter{}
 
-	if len(os.Args) < 3 {
+	if queryMode {
+		if flag.NArg() < 1 || (opts.IndexFile != "" && flag.NArg() > 1) {
+			fmt.Fprintln(os.Stderr, "SDCM - sort DICOM files into folders\nUSAGE: sdcm query [-where (conditions)] [-without (conditions)] [-group series] [-columns (tags)] [-output-format text] (input folder or file) [(input folder or file N) ...]")
+			os.Exit(-1)
+		}
+		opts.Input = flag.Args()
+		if err := sorter.New(opts).Query(ctx, os.Stdout); err != nil {
+			exitGracefully(err)
+		}
+		return
+	}
+	if tagsMode {
+		if flag.NArg() < 1 {
+			fmt.Fprintln(os.Stderr, "SDCM - sort DICOM files into folders\nUSAGE: sdcm tags [-sample 0] [-examples 3] [-output-format text] (input folder or file) [(input folder or file N) ...]")
+			os.Exit(-1)
+		}
+		opts.Input = flag.Args()
+		if err := sorter.New(opts).Tags(ctx, os.Stdout); err != nil {
+			exitGracefully(err)
+		}
+		return
+	}
+	if indexMode {
+		if flag.NArg() < 1 || (opts.IndexFile != "" && flag.NArg() > 1) {
+			fmt.Fprintln(os.Stderr, "SDCM - sort DICOM files into folders\nUSAGE: sdcm index [-index-tags (tags)] [-index (index file)] (input folder) [(input folder N) ...]\n       -index can only be used with a single input folder")
+			os.Exit(-1)
+		}
+		opts.Input = flag.Args()
+		if err := sorter.New(opts).Index(ctx); err != nil {
+			exitGracefully(err)
+		}
+		return
+	}
+	if serveMode && flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "SDCM - sort DICOM files into folders\nUSAGE: sdcm serve [-port 11112] [-aet SDCM] [-http-port 8080] (output folder)")
+		os.Exit(-1)
+	}
+	if (len(os.Args) < 3 || flag.NArg() < 1) && !serveMode {
 		//flag.Usage()
-		fmt.Fprintln(os.Stderr, "SDCM - sort DICOM files into folders\nUSAGE: sdcm (input folder) [(input folder N) ...] (output folder)")
+		fmt.Fprintln(os.Stderr, "SDCM - sort DICOM files into folders\nUSAGE: sdcm (input folder or file) [(input folder or file N) ...] (output folder)\n       sdcm -files-from (file list or -) (output folder)")
 		os.Exit(-1)
 	}
-	var input []string
 	pos_args := flag.Args()
 	for i := range pos_args[:len(pos_args)-1] {
 		in, err := filepath.Abs(pos_args[i])
 		if err != nil {
 			exitGracefully(fmt.Errorf("input path \"%s\" could not be found", pos_args[i]))
 		}
-		input = append(input, in)
-	}
-	// we will error out of the output path already exists and is not empty
-	if _, err := os.Stat(pos_args[len(pos_args)-1]); err == nil {
-		isEmpty, _ := IsEmpty(pos_args[len(pos_args)-1])
-		if !isEmpty && !braveFlag {
-			exitGracefully(fmt.Errorf("output path %s already exists, cowardly refusing to continue. Clear its content, specify a new directory or be -brave", pos_args[len(pos_args)-1]))
-		}
+		opts.Input = append(opts.Input, in)
 	}
+	opts.Output = pos_args[len(pos_args)-1]
 
-	// check num_workers
-	if num_workers < 1 {
-		num_workers = 1
-	}
-
-	if !quietFlag {
-		fmt.Printf("Parse %v ...\n\n", input)
-	}
-
-	// print output every couple of milliseconds
-	done := make(chan bool)
-	if !quietFlag {
-		ticker := time.NewTicker(250 * time.Millisecond)
-		defer ticker.Stop()
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					// print progress every second at least
-					spinner_c = int(math.Round(time.Since(startTime).Seconds()))
-					if !quietFlag {
-						numPatients := 0
-						listPatients.Range(func(key, value interface{}) bool {
-							numPatients = numPatients + 1
-							return true
-						})
-						numStudies := 0
-						listStudies.Range(func(key, value interface{}) bool {
-							numStudies = numStudies + 1
-							return true
-						})
-						numSeries := 0
-						listSeries.Range(func(key, value interface{}) bool {
-							numSeries = numSeries + 1
-							return true
-						})
-						sizeStr := ""
-						if methodFlag != "link" {
-							sizeStr = fmt.Sprintf("%s, ", FormatFileSize(float64(bytesWritten), 1024.0))
-						}
-						// go to beginning of line, clear the line and change color, print the spinner and other information
-						fmt_local.Printf("\033[1F\033[2K\033[94;49m%s%d\033[37m [%s%.0f files / s] P %d S %d S %d [S %d]\033[39m\033[49m\n", spinner[(spinner_c)%len(spinner)], counter, sizeStr, (float64(counter))/time.Since(startTime).Seconds(), numPatients, numStudies, numSeries, counterError)
-
-						// compute number of modalities from listStructure
-						var mods []string
-						mo := modalities
-						// use a mutex to protect modalities
-						listStructureMutex.Lock()
-						// we use a dedicated mutex unlick at the end of this section
-						//defer listStructureMutex.Unlock()
-
-						for m := range mo {
-							mods = append(mods, m)
-						}
-						sort.Slice(mods[:], func(i, j int) bool {
-							if mo[mods[i]] == mo[mods[j]] { // concurrent map read and write can happen here
-								// sort by name
-								return mods[i] < mods[j]
-							}
-							return mo[mods[i]] > mo[mods[j]]
-						})
-						// we want to align the output lines for each modality to a unified max length, compute the length max length first
-						var max_length int = 0
-						for i := range mods {
-							m := mods[i]
-							if val, ok := dicomModalityCodes[mods[i]]; ok {
-								m = val
-							}
-							mods_tmp := fmt_local.Sprintf("\033[2K\033[42m %s (%s) %d \033[49m\n", m, mods[i], mo[mods[i]])
-							if len(mods_tmp) > max_length {
-								max_length = len(mods_tmp)
-							}
-						}
-						// fill up to max length
-						for i := range mods {
-							m := mods[i]
-							if val, ok := dicomModalityCodes[mods[i]]; ok {
-								m = val
-							}
-							// to compute the number of missing spaces
-							mods_tmp := fmt_local.Sprintf("\033[2K\033[42m %s (%s) %d \033[49m\n", m, mods[i], mo[mods[i]])
-							// now add the spaces in the middle
-							mods[i] = fmt_local.Sprintf("\033[2K\033[42m %s (%s) %s%d \033[49m\n", m, mods[i], strings.Repeat(" ", max_length-len(mods_tmp)), mo[mods[i]])
-						}
-						listStructureMutex.Unlock()
-
-						if len(mods) > 0 {
-							fmt_local.Printf(" %s", strings.Join(mods, " "))
-							fmt_local.Printf("\033[%dA\033[1G", len(mods))
-						}
-					}
-				case <-done:
-					return
-				}
-			}
-		}()
-	}
-
-	// use a channel listStructuresChan to store global information on the parsed DICOM files
-	if !quietFlag {
-		go func() {
-			for entry := range listStructuresChan {
-				SeriesInstanceUID := entry[3]
-				if _, ok := listStructure[SeriesInstanceUID]; !ok { // assumption is that every series has a unique modality
-					// use a mutex to separate write a read to listStructure and modalities together
-					listStructureMutex.Lock()
-					listStructure[SeriesInstanceUID] = []string{entry[0], entry[1], entry[2], entry[4]}
-					if _, ok := modalities[entry[4]]; !ok {
-						modalities[entry[4]] = 1 // store the modality
-					} else {
-						modalities[entry[4]]++ // increment the count
-					}
-					listStructureMutex.Unlock()
-				}
-			}
-		}()
+	if !opts.Quiet {
+		opts.Events = progressPrinter{method: opts.Method, serve: serveMode, opts: &opts}
 	}
 
 	// all the work is done here
-	numFiles := sort_dicoms(input, pos_args[len(pos_args)-1])
-
-	if !quietFlag {
-		close(listStructuresChan) // close the channel to signal that we are done
-		done <- true
+	s := sorter.New(opts)
+	var result sorter.Result
+	var err error
+	if serveMode {
+		result, err = s.Serve(ctx)
+	} else {
+		result, err = s.Run(ctx)
 	}
-
-	if !quietFlag {
-		s := "s"
-		if numFiles == 1 {
-			s = ""
-		}
-		fmt_local.Printf("\033[2K✓ sorted %d file%s [%d non-DICOM files ignored or filtered]\n", numFiles, s, counterError)
+	if err != nil {
+		exitGracefully(err)
+	}
+	if !opts.Quiet {
+		printSummary(opts, result)
 	}
 }
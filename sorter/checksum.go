@@ -0,0 +1,302 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The SHA-256 of each copy is computed while it is written. With -verify the
+// copy is read again and compared, with -manifest the checksums are written
+// into SHA256SUMS files (one in the output folder or one per folder with files)
+// that can be checked with 'sha256sum -c SHA256SUMS'. The copies are read back
+// from the disk where the cache of the operating system can be dropped (Linux).
+
+// checksumState holds the checksums of the copies for -verify and -manifest
+type checksumState struct {
+	manifestFlag string
+	verifyFlag   bool
+
+	// checksums of the written files that are not in a manifest yet, by folder and file name
+	checksums      map[string]map[string]string
+	checksumsMutex sync.Mutex
+
+	// number of copies verified and copies that differ, the manifest files written
+	counterVerified     int32
+	counterVerifyFailed int32
+	verifyFailures      []string
+	verifyFailuresMutex sync.Mutex
+	manifestFiles       map[string]bool
+	manifestFilesMutex  sync.Mutex
+}
+
+// ManifestName is the name of the checksum manifest files
+const ManifestName = "SHA256SUMS"
+
+// initChecksums checks the -manifest and -verify options
+func (e *engine) initChecksums() error {
+	if e.manifestFlag != "" && e.manifestFlag != "root" && e.manifestFlag != "folder" {
+		return fmt.Errorf("unknown option \"%s\" for -manifest, use root or folder", e.manifestFlag)
+	}
+	if e.checksumsRequested() && e.methodFlag != "copy" {
+		return fmt.Errorf("-manifest and -verify need '-method copy'")
+	}
+	return nil
+}
+
+// checksumsRequested returns true if copies are hashed
+func (e *engine) checksumsRequested() bool {
+	return e.manifestFlag != "" || e.verifyFlag
+}
+
+// outputHash returns the hash for a file that is written into the output folder, nil if no hash is needed
+func (e *engine) outputHash(dst string) hash.Hash {
+	if !e.checksumsRequested() {
+		return nil
+	}
+	if rel, err := filepath.Rel(e.processDataPath, dst); err != nil || strings.HasPrefix(rel, "..") {
+		// other copies, e.g. into the -watch-archive folder
+		return nil
+	}
+	return sha256.New()
+}
+
+// hashWriter returns a writer that writes to out and h (if not nil)
+func hashWriter(out io.Writer, h hash.Hash) io.Writer {
+	if h == nil {
+		return out
+	}
+	return io.MultiWriter(out, h)
+}
+
+// recordChecksum remembers the checksum of a written file
+func (e *engine) recordChecksum(dst string, h hash.Hash) {
+	if h == nil {
+		return
+	}
+	folder, name := filepath.Split(dst)
+	folder = filepath.Clean(folder)
+	e.checksumsMutex.Lock()
+	defer e.checksumsMutex.Unlock()
+	if e.checksums[folder] == nil {
+		e.checksums[folder] = make(map[string]string, 0)
+	}
+	e.checksums[folder][name] = hex.EncodeToString(h.Sum(nil))
+}
+
+// renameChecksums moves checksums to the new file names of a folder (old name -> new name)
+func (e *engine) renameChecksums(folder string, renamed map[string]string) {
+	e.checksumsMutex.Lock()
+	defer e.checksumsMutex.Unlock()
+	sums := e.checksums[folder]
+	if sums == nil {
+		return
+	}
+	moved := make(map[string]string, len(renamed))
+	for oldName, newName := range renamed {
+		if sum, ok := sums[oldName]; ok {
+			moved[newName] = sum
+			delete(sums, oldName)
+		}
+	}
+	for name, sum := range moved {
+		sums[name] = sum
+	}
+}
+
+// fileChecksum computes the SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	return readChecksum(path, false)
+}
+
+// readChecksum returns the SHA-256 of a file, with uncached the file is read from the disk if the system allows it
+func readChecksum(path string, uncached bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if uncached {
+		if err := dropCache(f); err != nil {
+			return "", err
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyCopy reads a written file again and compares it with the checksum computed while writing
+func (e *engine) verifyCopy(in_file string, dst string) {
+	if !e.verifyFlag {
+		return
+	}
+	folder, name := filepath.Split(dst)
+	folder = filepath.Clean(folder)
+	e.checksumsMutex.Lock()
+	expected, ok := e.checksums[folder][name]
+	if e.manifestFlag == "" {
+		// only needed for the manifest
+		delete(e.checksums[folder], name)
+		if len(e.checksums[folder]) == 0 {
+			delete(e.checksums, folder)
+		}
+	}
+	e.checksumsMutex.Unlock()
+	if !ok {
+		return
+	}
+	atomic.AddInt32(&e.counterVerified, 1)
+	sum, err := readChecksum(dst, true)
+	if err == nil && sum != expected {
+		err = fmt.Errorf("checksum %s, expected %s", sum, expected)
+	}
+	if err != nil {
+		atomic.AddInt32(&e.counterVerifyFailed, 1)
+		e.verifyFailuresMutex.Lock()
+		e.verifyFailures = append(e.verifyFailures, fmt.Sprintf("%s (copy of %s): %s", dst, in_file, err))
+		e.verifyFailuresMutex.Unlock()
+		e.warn("the copy %s of %s could not be verified (%s)", dst, in_file, err)
+	}
+}
+
+// readManifest returns the lines of an existing manifest by path, lines of files that do not exist
+// anymore are dropped
+func readManifest(root string) map[string]string {
+	entries := make(map[string]string, 0)
+	data, err := os.ReadFile(filepath.Join(root, ManifestName))
+	if err != nil {
+		return entries
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// checksum, a space and ' ' (text) or '*' (binary), the path
+		if len(line) < 67 || line[64] != ' ' {
+			continue
+		}
+		rel := line[66:]
+		if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+			continue
+		}
+		entries[rel] = line + "\n"
+	}
+	return entries
+}
+
+// writeManifest merges the checksums of files below root into root/SHA256SUMS, folders limits the
+// folders that are written (all if nil). The manifest is replaced, lines of files written again are updated.
+func (e *engine) writeManifest(root string, folders []string) error {
+	e.checksumsMutex.Lock()
+	if folders == nil {
+		for folder := range e.checksums {
+			folders = append(folders, folder)
+		}
+	}
+	lines := make(map[string]string, 0)
+	for _, folder := range folders {
+		sums := e.checksums[folder]
+		delete(e.checksums, folder)
+		for name, sum := range sums {
+			rel, err := filepath.Rel(root, filepath.Join(folder, name))
+			if err != nil {
+				rel = filepath.Join(folder, name)
+			}
+			// sha256sum format: checksum, two spaces (text mode) and the path
+			lines[filepath.ToSlash(rel)] = fmt.Sprintf("%s  %s\n", sum, filepath.ToSlash(rel))
+		}
+	}
+	e.checksumsMutex.Unlock()
+	if len(lines) == 0 {
+		return nil
+	}
+
+	e.manifestFilesMutex.Lock()
+	defer e.manifestFilesMutex.Unlock()
+	entries := readManifest(root)
+	for rel, line := range lines {
+		entries[rel] = line
+	}
+	paths := make([]string, 0, len(entries))
+	for rel := range entries {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	var content strings.Builder
+	for _, rel := range paths {
+		content.WriteString(entries[rel])
+	}
+
+	// write a new file and rename it, a crash leaves the old or the new manifest
+	name := filepath.Join(root, ManifestName)
+	f, err := os.CreateTemp(root, ManifestName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := e.syncOutputFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	e.manifestFiles[name] = true
+	return nil
+}
+
+// writeFolderManifest writes the manifest of the folder of a complete series
+func (e *engine) writeFolderManifest(folder string) {
+	if e.manifestFlag != "folder" || e.orderSlicesFlag {
+		// with -order-slices the file names change at the end of the run
+		return
+	}
+	if err := e.writeManifest(folder, []string{folder}); err != nil {
+		e.warn("could not write %s in %s (%s)", ManifestName, folder, err)
+	}
+}
+
+// writeManifests writes the checksums that are not in a manifest yet
+func (e *engine) writeManifests(dest_path string) {
+	switch e.manifestFlag {
+	case "root":
+		if err := e.writeManifest(dest_path, nil); err != nil {
+			e.warn("could not write %s in %s (%s)", ManifestName, dest_path, err)
+		}
+	case "folder":
+		e.checksumsMutex.Lock()
+		folders := make([]string, 0, len(e.checksums))
+		for folder := range e.checksums {
+			folders = append(folders, folder)
+		}
+		e.checksumsMutex.Unlock()
+		for _, folder := range folders {
+			if err := e.writeManifest(folder, []string{folder}); err != nil {
+				e.warn("could not write %s in %s (%s)", ManifestName, folder, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sha256Hex returns the SHA-256 of a string as it is written into a manifest
+func sha256Hex(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+func TestWriteManifest(t *testing.T) {
+	old := strings.Repeat("0", 64)
+	tests := []struct {
+		name     string
+		existing string            // SHA256SUMS before the run
+		files    map[string]string // files written during the run (path below root to content)
+		others   map[string]string // files on disk that are not written during the run
+		folders  []string          // folders written into the manifest, nil for all
+		want     []string          // lines of the manifest, nil if no manifest is written
+		wantLeft int               // folders with checksums that are not in the manifest
+	}{
+		{
+			name:  "new manifest",
+			files: map[string]string{"a/1.dcm": "one", "a/2.dcm": "two", "b/1.dcm": "three"},
+			want:  []string{sha256Hex("one") + "  a/1.dcm", sha256Hex("two") + "  a/2.dcm", sha256Hex("three") + "  b/1.dcm"},
+		},
+		{
+			name:     "merge with an existing manifest",
+			existing: old + "  a/0.dcm\n" + old + " *b/0.dcm\n",
+			others:   map[string]string{"a/0.dcm": "zero", "b/0.dcm": "zero"},
+			files:    map[string]string{"a/1.dcm": "one"},
+			want:     []string{old + "  a/0.dcm", sha256Hex("one") + "  a/1.dcm", old + " *b/0.dcm"},
+		},
+		{
+			name:     "files written again are updated",
+			existing: old + "  a/1.dcm\n",
+			files:    map[string]string{"a/1.dcm": "one"},
+			want:     []string{sha256Hex("one") + "  a/1.dcm"},
+		},
+		{
+			name:     "lines of removed files and broken lines are dropped",
+			existing: old + "  a/removed.dcm\nnot a checksum line\n\n" + old + "\ta/1.dcm\n",
+			files:    map[string]string{"a/1.dcm": "one"},
+			want:     []string{sha256Hex("one") + "  a/1.dcm"},
+		},
+		{
+			name:     "only some folders",
+			files:    map[string]string{"a/1.dcm": "one", "b/1.dcm": "two"},
+			folders:  []string{"a"},
+			want:     []string{sha256Hex("one") + "  a/1.dcm"},
+			wantLeft: 1,
+		},
+		{
+			name: "nothing written",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			e := newTestEngine()
+			e.manifestFlag = "root"
+			write := func(rel string, content string) string {
+				path := filepath.Join(root, filepath.FromSlash(rel))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			}
+			for rel, content := range tt.others {
+				write(rel, content)
+			}
+			if tt.existing != "" {
+				write(ManifestName, tt.existing)
+			}
+			for rel, content := range tt.files {
+				h := sha256.New()
+				h.Write([]byte(content))
+				e.recordChecksum(write(rel, content), h)
+			}
+			var folders []string
+			for _, f := range tt.folders {
+				folders = append(folders, filepath.Join(root, f))
+			}
+			if err := e.writeManifest(root, folders); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(root, ManifestName))
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("manifest written: %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("manifest\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if len(e.checksums) != tt.wantLeft {
+				t.Errorf("%d folders left, want %d", len(e.checksums), tt.wantLeft)
+			}
+			if !e.manifestFiles[filepath.Join(root, ManifestName)] {
+				t.Error("the manifest is not counted")
+			}
+			if matches, _ := filepath.Glob(filepath.Join(root, ManifestName+".*")); len(matches) > 0 {
+				t.Errorf("temporary files left: %v", matches)
+			}
+		})
+	}
+}
+
+// checkManifest compares the lines of a manifest with the checksums of the files, returns the paths in the manifest
+func checkManifest(t testing.TB, root string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(root, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		sum, rel, ok := strings.Cut(line, "  ")
+		if !ok {
+			t.Errorf("%s: line %q is not in the sha256sum format", root, line)
+			continue
+		}
+		got, err := fileChecksum(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil || got != sum {
+			t.Errorf("%s: checksum of %s is %s, the manifest has %s (%v)", root, rel, got, sum, err)
+		}
+		paths = append(paths, rel)
+	}
+	return paths
+}
+
+func TestManifestRun(t *testing.T) {
+	in := t.TempDir()
+	for _, series := range []string{"1.2.3.1", "1.2.3.2"} {
+		for n := 1; n <= 2; n++ {
+			writeTestFile(t, filepath.Join(in, fmt.Sprintf("%s.%d.dcm", series, n)), newTestInstance(t, series, n))
+		}
+	}
+	tests := []struct {
+		manifest    string
+		folder      string
+		orderSlices bool
+		want        map[string][]string // manifest folder to the paths in the manifest
+	}{
+		{
+			manifest: "root",
+			want:     map[string][]string{".": {"1.2.3.1/1.2.3.1.1.dcm", "1.2.3.1/1.2.3.1.2.dcm", "1.2.3.2/1.2.3.2.1.dcm", "1.2.3.2/1.2.3.2.2.dcm"}},
+		},
+		{
+			manifest: "folder",
+			want: map[string][]string{
+				"1.2.3.1": {"1.2.3.1.1.dcm", "1.2.3.1.2.dcm"},
+				"1.2.3.2": {"1.2.3.2.1.dcm", "1.2.3.2.2.dcm"},
+			},
+		},
+		{
+			// both series are sorted into the folder of the patient
+			manifest: "folder",
+			folder:   "{PatientID}/{SOPInstanceUID}.dcm",
+			want:     map[string][]string{"P1": {"1.2.3.1.1.dcm", "1.2.3.1.2.dcm", "1.2.3.2.1.dcm", "1.2.3.2.2.dcm"}},
+		},
+		{
+			// the manifest has the names after ordering
+			manifest:    "root",
+			orderSlices: true,
+			want:        map[string][]string{".": {"1.2.3.1/0001.dcm", "1.2.3.1/0002.dcm", "1.2.3.2/0001.dcm", "1.2.3.2/0002.dcm"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s order %v", tt.manifest, tt.folder, tt.orderSlices), func(t *testing.T) {
+			out := t.TempDir()
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.Brave = []string{in}, out, true, "none", true
+			opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+			if tt.folder != "" {
+				opts.Folder = tt.folder
+			}
+			opts.Manifest, opts.Verify, opts.OrderSlices = tt.manifest, true, tt.orderSlices
+			result, err := New(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != 4 || result.Verified != 4 || result.VerifyFailed != 0 || result.Manifests != len(tt.want) {
+				t.Errorf("%d files, %d verified, %d failed and %d manifests, want 4, 4, 0 and %d",
+					result.Files, result.Verified, result.VerifyFailed, result.Manifests, len(tt.want))
+			}
+			var manifests []string
+			for _, f := range listFiles(t, out) {
+				if filepath.Base(f) == ManifestName {
+					manifests = append(manifests, filepath.Dir(f))
+				}
+			}
+			var wantManifests []string
+			for folder := range tt.want {
+				wantManifests = append(wantManifests, folder)
+			}
+			sort.Strings(wantManifests)
+			if !reflect.DeepEqual(manifests, wantManifests) {
+				t.Fatalf("manifests in %v, want %v", manifests, wantManifests)
+			}
+			for folder, want := range tt.want {
+				if got := checkManifest(t, filepath.Join(out, folder)); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s lists %v, want %v", filepath.Join(folder, ManifestName), got, want)
+				}
+			}
+		})
+	}
+}
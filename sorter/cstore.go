@@ -0,0 +1,404 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// With '-method cstore' the output is a DICOM node instead of a folder, the last
+// argument is the address of the node (host:port). Matching instances are sent
+// with C-STORE over up to -associations parallel associations. Each association
+// proposes a presentation context for every SOP class and transfer syntax seen
+// so far, a new file with an unknown combination re-opens the association. An
+// association has at most 128 presentation contexts, further combinations start
+// a new set of contexts and a file re-opens the association with its set.
+
+// cstoreState holds the associations and counters of -method cstore
+type cstoreState struct {
+	calledAETFlag    string
+	associationsFlag int
+	retryFlag        int
+
+	// address (host:port) of the storage service
+	cstoreAddress string
+
+	// idle associations, nil entries are associations that still have to be opened
+	cstorePool chan *association
+
+	// SOP class and transfer syntax combinations sent so far, in sets of up to 128 contexts
+	cstoreContexts      [][]presentationContext
+	cstoreContextsMutex sync.Mutex
+
+	// number of instances sent, sent with a warning and failed, failed files with their status
+	counterSent        int32
+	counterSentWarning int32
+	counterSendFailed  int32
+	sendFailures       []string
+	sendFailuresMutex  sync.Mutex
+}
+
+// a permanent rejection of the association is not retried
+var errAssociationRejected = errors.New("association rejected")
+
+// initCStore checks the options for '-method cstore'
+func (e *engine) initCStore(address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("'-method cstore' expects host:port as the last argument (%s)", err)
+	}
+	if e.dicomdirFlag || e.orderSlicesFlag {
+		return fmt.Errorf("-dicomdir and -order-slices cannot be used with '-method cstore'")
+	}
+	if e.associationsFlag < 1 {
+		e.associationsFlag = 1
+	}
+	e.cstoreAddress = address
+	e.cstorePool = make(chan *association, e.associationsFlag)
+	for i := 0; i < e.associationsFlag; i++ {
+		e.cstorePool <- nil
+	}
+	return nil
+}
+
+// fileMeta returns the SOP class, SOP instance, transfer syntax and the start of the data set of a DICOM file
+func fileMeta(path string) (sopClassUID, sopInstanceUID, transferSyntaxUID string, offset int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	header := make([]byte, 144)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return
+	}
+	if string(header[128:132]) != "DICM" {
+		err = fmt.Errorf("no DICOM file meta information")
+		return
+	}
+	r := &rawReader{b: header, pos: 132}
+	t, _, _, _ := r.header()
+	groupLength, _ := r.uint32()
+	if t != tag.FileMetaInformationGroupLength {
+		err = fmt.Errorf("no file meta information group length")
+		return
+	}
+	meta := make([]byte, groupLength)
+	if _, err = io.ReadFull(f, meta); err != nil {
+		return
+	}
+	r = &rawReader{b: meta}
+	for r.pos < len(meta) {
+		t, vr, length, e := r.header()
+		if e != nil || r.pos+int(length) > len(meta) {
+			err = fmt.Errorf("invalid file meta information")
+			return
+		}
+		value := trimUID(meta[r.pos : r.pos+int(length)])
+		switch t {
+		case tag.MediaStorageSOPClassUID:
+			sopClassUID = value
+		case tag.MediaStorageSOPInstanceUID:
+			sopInstanceUID = value
+		case tag.TransferSyntaxUID:
+			transferSyntaxUID = value
+		}
+		r.skipValue(vr, length)
+	}
+	offset = 144 + int64(groupLength)
+	return
+}
+
+// openAssociation connects to the storage service and proposes the presentation contexts
+func (e *engine) openAssociation(contexts []presentationContext) (*association, error) {
+	conn, err := net.DialTimeout("tcp", e.cstoreAddress, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	rq := associateRQ{calledAE: e.calledAETFlag, callingAE: e.aetFlag, contexts: contexts}
+	if err := writePDU(conn, pduAssociateRQ, encodeAssociate(rq, false)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	a := &association{conn: conn, reader: bufio.NewReader(conn), callingAE: e.aetFlag, calledAE: e.calledAETFlag, contexts: make(map[byte]*presentationContext, 0)}
+	conn.SetReadDeadline(time.Now().Add(associationTimeout))
+	pduType, data, err := readPDU(a.reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if pduType == pduAssociateRJ {
+		conn.Close()
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w by %s", errAssociationRejected, e.cstoreAddress)
+		}
+		if data[1] == 1 {
+			return nil, fmt.Errorf("%w by %s (source %d, reason %d)", errAssociationRejected, e.cstoreAddress, data[2], data[3])
+		}
+		return nil, fmt.Errorf("association rejected by %s for now (source %d, reason %d)", e.cstoreAddress, data[2], data[3])
+	}
+	if pduType != pduAssociateAC {
+		conn.Close()
+		return nil, fmt.Errorf("expected A-ASSOCIATE-AC, got PDU type %d", pduType)
+	}
+	ac, err := parseAssociate(data)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	a.maxPDULength = ac.maxPDULength
+	for _, pc := range ac.contexts {
+		for _, proposed := range contexts {
+			if proposed.id == pc.id {
+				accepted := pc
+				accepted.abstractSyntax = proposed.abstractSyntax
+				accepted.transferSyntaxes = proposed.transferSyntaxes
+				a.contexts[pc.id] = &accepted
+			}
+		}
+	}
+	return a, nil
+}
+
+// releaseAssociation ends an association, the connection is closed even if the peer does not answer
+func releaseAssociation(a *association) {
+	if a == nil {
+		return
+	}
+	if err := writePDU(a.conn, pduReleaseRQ, []byte{0, 0, 0, 0}); err == nil {
+		a.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		readPDU(a.reader)
+	}
+	a.conn.Close()
+}
+
+// contextID returns the accepted presentation context of an association for a SOP class and transfer syntax
+func (a *association) contextID(sopClassUID, transferSyntaxUID string) (byte, bool) {
+	for id, pc := range a.contexts {
+		if pc.abstractSyntax == sopClassUID && pc.transferSyntax == transferSyntaxUID && pc.result == 0 {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// proposes returns true if the association has proposed the SOP class and transfer syntax (accepted or not)
+func (a *association) proposes(sopClassUID, transferSyntaxUID string) bool {
+	for _, pc := range a.contexts {
+		if pc.abstractSyntax == sopClassUID && len(pc.transferSyntaxes) > 0 && pc.transferSyntaxes[0] == transferSyntaxUID {
+			return true
+		}
+	}
+	return false
+}
+
+// proposedContexts adds a SOP class and transfer syntax to the known combinations and returns
+// the set of contexts that contains it
+func (e *engine) proposedContexts(sopClassUID, transferSyntaxUID string) []presentationContext {
+	e.cstoreContextsMutex.Lock()
+	defer e.cstoreContextsMutex.Unlock()
+	for _, set := range e.cstoreContexts {
+		for _, pc := range set {
+			if pc.abstractSyntax == sopClassUID && pc.transferSyntaxes[0] == transferSyntaxUID {
+				return append([]presentationContext{}, set...)
+			}
+		}
+	}
+	// presentation context ids are odd numbers below 256
+	if len(e.cstoreContexts) == 0 || len(e.cstoreContexts[len(e.cstoreContexts)-1]) >= 128 {
+		e.cstoreContexts = append(e.cstoreContexts, nil)
+	}
+	last := len(e.cstoreContexts) - 1
+	e.cstoreContexts[last] = append(e.cstoreContexts[last], presentationContext{
+		id:               byte(2*len(e.cstoreContexts[last]) + 1),
+		abstractSyntax:   sopClassUID,
+		transferSyntaxes: []string{transferSyntaxUID},
+	})
+	return append([]presentationContext{}, e.cstoreContexts[last]...)
+}
+
+// storeInstance sends the data set of a file on an association, returns the status of the C-STORE-RSP
+func storeInstance(a *association, contextID byte, path string, sopClassUID, sopInstanceUID string, offset int64) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	a.messageID++
+	cmd := make(dimseCommand, 0)
+	cmd.setUID(tag.AffectedSOPClassUID, sopClassUID)
+	cmd.setUS(tag.CommandField, commandCStoreRQ)
+	cmd.setUS(tag.MessageID, a.messageID)
+	cmd.setUS(tag.Priority, 0)
+	cmd.setUS(tag.CommandDataSetType, 0)
+	cmd.setUID(tag.AffectedSOPInstanceUID, sopInstanceUID)
+	if err := a.sendCommand(contextID, cmd); err != nil {
+		return 0, err
+	}
+	if err := a.sendPDV(contextID, false, bufio.NewReader(f)); err != nil {
+		return 0, err
+	}
+	rsp, err := a.readCommand()
+	if err != nil {
+		return 0, err
+	}
+	if rsp.us(tag.MessageIDBeingRespondedTo) != a.messageID {
+		return 0, fmt.Errorf("response for message %d, expected %d", rsp.us(tag.MessageIDBeingRespondedTo), a.messageID)
+	}
+	return rsp.us(tag.Status), nil
+}
+
+// isRetryStatus returns true for C-STORE status codes that might succeed later (out of resources)
+func isRetryStatus(status uint16) bool {
+	return status&0xFF00 == 0xA700
+}
+
+// isWarningStatus returns true for C-STORE status codes that mean stored with a warning
+func isWarningStatus(status uint16) bool {
+	return status == 0x0001 || status&0xF000 == 0xB000
+}
+
+// sendFile sends a file to the storage service with retries, returns the number of bytes sent
+func (e *engine) sendFile(path string) (int64, error) {
+	sopClassUID, sopInstanceUID, transferSyntaxUID, offset, err := fileMeta(path)
+	if err != nil {
+		return 0, err
+	}
+	a := <-e.cstorePool
+	defer func() { e.cstorePool <- a }()
+
+	var status uint16
+	for attempt := 0; attempt <= e.retryFlag; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+			e.logf("retry %d for %s\n", attempt, path)
+		}
+		if a != nil && !a.proposes(sopClassUID, transferSyntaxUID) {
+			// this association does not know about this SOP class and transfer syntax yet
+			releaseAssociation(a)
+			a = nil
+		}
+		if a == nil {
+			if a, err = e.openAssociation(e.proposedContexts(sopClassUID, transferSyntaxUID)); err != nil {
+				a = nil
+				if errors.Is(err, errAssociationRejected) {
+					break
+				}
+				continue
+			}
+		}
+		contextID, ok := a.contextID(sopClassUID, transferSyntaxUID)
+		if !ok {
+			return 0, fmt.Errorf("no presentation context accepted for %s with %s", sopClassUID, transferSyntaxName(transferSyntaxUID))
+		}
+		status, err = storeInstance(a, contextID, path, sopClassUID, sopInstanceUID, offset)
+		if err != nil {
+			// the association cannot be used anymore
+			a.conn.Close()
+			a = nil
+			continue
+		}
+		if isRetryStatus(status) {
+			err = fmt.Errorf("status 0x%04X", status)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != statusSuccess && !isWarningStatus(status) {
+		return 0, fmt.Errorf("status 0x%04X", status)
+	}
+	if isWarningStatus(status) {
+		atomic.AddInt32(&e.counterSentWarning, 1)
+		e.logf("stored %s with warning 0x%04X\n", path, status)
+	}
+	info, _ := os.Stat(path)
+	if info == nil {
+		return 0, nil
+	}
+	return info.Size() - offset, nil
+}
+
+// remoteOutput returns true if the files are sent to another node instead of being written to the output folder
+func (e *engine) remoteOutput() bool {
+	return e.methodFlag == "cstore" || e.methodFlag == "stow"
+}
+
+// instanceFile returns the file to send for a data set, a temporary file is written if the content
+// changes or if the file has no file meta information (it is sent as implicit VR little endian)
+func (e *engine) instanceFile(in_file string, content *dicom.Dataset) (path string, temporary bool, err error) {
+	if content == nil && !e.transformRequested() && hasFileMeta(in_file) {
+		return in_file, false, nil
+	}
+	tmp, err := os.CreateTemp("", "sdcm-send-*.dcm")
+	if err != nil {
+		return "", false, err
+	}
+	tmp.Close()
+	if content != nil {
+		_, err = e.writeDatasetContents(content, "", tmp.Name())
+	} else {
+		_, err = e.transformFileContents(in_file, tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", false, err
+	}
+	return tmp.Name(), true, nil
+}
+
+// recordSendFailure remembers a file that could not be sent for the summary
+func (e *engine) recordSendFailure(in_file string, err error) {
+	atomic.AddInt32(&e.counterSendFailed, 1)
+	e.sendFailuresMutex.Lock()
+	e.sendFailures = append(e.sendFailures, fmt.Sprintf("%s: %s", in_file, err))
+	e.sendFailuresMutex.Unlock()
+	if e.verboseFlag || e.debugFlag {
+		fmt.Fprintf(os.Stderr, "could not send %s (%s)\n", in_file, err)
+	}
+}
+
+// sendInstance sends a data set that matched the folder path filters, content is sent instead of in_file if not nil
+func (e *engine) sendInstance(dataset *dicom.Dataset, dicomVals map[tag.Tag]string, in_file string, content *dicom.Dataset) error {
+	path, temporary, err := e.instanceFile(in_file, content)
+	if err != nil {
+		return err
+	}
+	if temporary {
+		defer os.Remove(path)
+	}
+	bw, err := e.sendFile(path)
+	if err != nil {
+		e.recordSendFailure(in_file, err)
+		return nil
+	}
+	atomic.AddInt32(&e.counterSent, 1)
+	atomic.AddInt32(&e.counter, 1)
+	atomic.AddInt64(&e.bytesWritten, bw)
+	e.recordSorted(dataset, dicomVals, in_file, "")
+	return nil
+}
+
+// closeAssociations releases all open associations, called after all files have been sent
+func (e *engine) closeAssociations() {
+	for i := 0; i < cap(e.cstorePool); i++ {
+		releaseAssociation(<-e.cstorePool)
+	}
+}
@@ -0,0 +1,243 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+// skippedHook calls a function for each file that is not sorted
+type skippedHook struct {
+	NoEvents
+	skipped func(path string, reason error)
+}
+
+func (h skippedHook) Skipped(path string, reason error) {
+	h.skipped(path, reason)
+}
+
+// cstoreClient returns the options to send the files of a folder to a node
+func cstoreClient(in, address, calledAET string) Options {
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Method, opts.CalledAET, opts.Quiet = []string{in}, address, "cstore", calledAET, true
+	return opts
+}
+
+func TestProposedContexts(t *testing.T) {
+	e := newTestEngine()
+	for i := 0; i < 130; i++ {
+		set := e.proposedContexts(fmt.Sprintf("%s.%d", ctImageStorage, i), uid.ExplicitVRLittleEndian)
+		want := i%128 + 1
+		if len(set) != want {
+			t.Fatalf("combination %d is proposed in a set of %d contexts, want %d", i, len(set), want)
+		}
+		if last := set[len(set)-1]; last.id != byte(2*(i%128)+1) {
+			t.Errorf("combination %d has the context id %d, want %d", i, last.id, 2*(i%128)+1)
+		}
+	}
+	if len(e.cstoreContexts) != 2 {
+		t.Fatalf("%d sets of contexts, want 2", len(e.cstoreContexts))
+	}
+	// a known combination returns its set and is not added again
+	if set := e.proposedContexts(ctImageStorage+".3", uid.ExplicitVRLittleEndian); len(set) != 128 || set[3].abstractSyntax != ctImageStorage+".3" {
+		t.Errorf("known combination in a set of %d contexts", len(set))
+	}
+	if set := e.proposedContexts(ctImageStorage+".3", uid.ImplicitVRLittleEndian); len(set) != 3 {
+		t.Errorf("new transfer syntax in a set of %d contexts, want 3", len(set))
+	}
+}
+
+func TestCStoreRetry(t *testing.T) {
+	// the folder of the patient cannot be created until the first attempt failed
+	out := t.TempDir()
+	blocker := filepath.Join(out, "P1")
+	if err := os.WriteFile(blocker, []byte("not a folder"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	opts := DefaultOptions()
+	opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = out, port, "SDCM", true, "none"
+	opts.Folder = "{PatientID}/{SOPInstanceUID}.dcm"
+	opts.Events = skippedHook{skipped: func(path string, reason error) { os.Remove(blocker) }}
+	stop := startServe(t, opts)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	waitForEcho(t, address, "SDCM")
+
+	in := t.TempDir()
+	writeTestFile(t, filepath.Join(in, "a.dcm"), newTestInstance(t, "1.2.3.1", 1))
+	client := cstoreClient(in, address, "SDCM")
+	client.Retry = 1
+	result, err := New(client).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 1 || result.SendFailed != 0 {
+		t.Errorf("%d sent and %d failed (%v), want 1 and 0", result.Sent, result.SendFailed, result.SendFailures)
+	}
+	if served := stop(); served.Received != 2 || served.Files != 1 {
+		t.Errorf("%d instances received and %d sorted, want 2 and 1", served.Received, served.Files)
+	}
+	if got := listFiles(t, out); fmt.Sprint(got) != "[P1/1.2.3.1.1.dcm]" {
+		t.Errorf("received files %v", got)
+	}
+}
+
+func TestCStoreRejected(t *testing.T) {
+	port := freePort(t)
+	opts := DefaultOptions()
+	opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = t.TempDir(), port, "SDCM", true, "none"
+	stop := startServe(t, opts)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	waitForEcho(t, address, "SDCM")
+
+	in := t.TempDir()
+	writeTestFile(t, filepath.Join(in, "a.dcm"), newTestInstance(t, "1.2.3.1", 1))
+	client := cstoreClient(in, address, "OTHER")
+	client.Retry = 3
+	start := time.Now()
+	result, err := New(client).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a permanent rejection is not retried, a retry waits at least a second
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the rejected association was retried (%s)", d)
+	}
+	if result.Sent != 0 || result.SendFailed != 1 || len(result.SendFailures) != 1 || !strings.Contains(result.SendFailures[0], errAssociationRejected.Error()) {
+		t.Errorf("%d sent and %d failed (%v), want 0 and 1 rejected", result.Sent, result.SendFailed, result.SendFailures)
+	}
+	if served := stop(); served.Received != 0 {
+		t.Errorf("%d instances received, want 0", served.Received)
+	}
+}
+
+func TestCStoreContextRollover(t *testing.T) {
+	port := freePort(t)
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = out, port, "SDCM", true, "none"
+	opts.Folder = "{SOPInstanceUID}.dcm"
+	stop := startServe(t, opts)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	waitForEcho(t, address, "SDCM")
+
+	// more SOP classes than fit into the presentation contexts of one association
+	in := t.TempDir()
+	const n = 130
+	for i := 0; i < n; i++ {
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("%03d.dcm", i)), newTestInstance(t, "1.2.3.1", i+1,
+			newTestElement(t, tag.SOPClassUID, []string{fmt.Sprintf("%s.%d", ctImageStorage, i)})))
+	}
+	client := cstoreClient(in, address, "SDCM")
+	client.Associations = 1
+	result, err := New(client).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != n || result.SendFailed != 0 {
+		t.Errorf("%d sent and %d failed (%v), want %d and 0", result.Sent, result.SendFailed, result.SendFailures, n)
+	}
+	if served := stop(); served.Received != n || served.Files != n {
+		t.Errorf("%d instances received and %d sorted, want %d", served.Received, served.Files, n)
+	}
+	if got := len(listFiles(t, out)); got != n {
+		t.Errorf("%d files received, want %d", got, n)
+	}
+}
+
+// writeWithoutFileMeta writes an implicit VR little endian data set without preamble and file meta information
+func writeWithoutFileMeta(t *testing.T, path string, series string, number int) {
+	t.Helper()
+	part10 := path + ".part10"
+	writeTestFile(t, part10, newTestInstance(t, series, number,
+		newTestElement(t, tag.TransferSyntaxUID, []string{uid.ImplicitVRLittleEndian})))
+	content, err := os.ReadFile(part10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(part10)
+	// the value of the group length element follows the preamble and its header
+	groupLength := binary.LittleEndian.Uint32(content[140:144])
+	if err := os.WriteFile(path, content[144+groupLength:], 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstanceFile(t *testing.T) {
+	dir := t.TempDir()
+	part10 := filepath.Join(dir, "part10.dcm")
+	writeTestFile(t, part10, newTestInstance(t, "1.2.3.1", 1))
+	bare := filepath.Join(dir, "bare.dcm")
+	writeWithoutFileMeta(t, bare, "1.2.3.1", 2)
+	if hasFileMeta(bare) {
+		t.Fatalf("%s has file meta information", bare)
+	}
+
+	e := newTestEngine()
+	path, temporary, err := e.instanceFile(part10, nil)
+	if err != nil || temporary || path != part10 {
+		t.Errorf("a part 10 file is sent as %s (temporary %v, %v)", path, temporary, err)
+	}
+
+	path, temporary, err = e.instanceFile(bare, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !temporary || path == bare {
+		t.Fatalf("a file without file meta information is sent as %s (temporary %v)", path, temporary)
+	}
+	defer os.Remove(path)
+	sopClassUID, sopInstanceUID, transferSyntaxUID, _, err := fileMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sopClassUID != ctImageStorage || sopInstanceUID != "1.2.3.1.2" || transferSyntaxUID != uid.ImplicitVRLittleEndian {
+		t.Errorf("file meta %s, %s and %s, want %s, 1.2.3.1.2 and %s", sopClassUID, sopInstanceUID, transferSyntaxUID, ctImageStorage, uid.ImplicitVRLittleEndian)
+	}
+}
+
+func TestCStoreWithoutFileMeta(t *testing.T) {
+	port := freePort(t)
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = out, port, "SDCM", true, "none"
+	opts.Folder = "{SOPInstanceUID}.dcm"
+	stop := startServe(t, opts)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	waitForEcho(t, address, "SDCM")
+
+	in := t.TempDir()
+	writeWithoutFileMeta(t, filepath.Join(in, "bare.dcm"), "1.2.3.1", 1)
+	result, err := New(cstoreClient(in, address, "SDCM")).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 1 || result.SendFailed != 0 {
+		t.Errorf("%d sent and %d failed (%v), want 1 and 0", result.Sent, result.SendFailed, result.SendFailures)
+	}
+	if served := stop(); served.Files != 1 {
+		t.Errorf("%d instances sorted, want 1", served.Files)
+	}
+	ds, err := readDatasetFile(filepath.Join(out, "1.2.3.1.1.dcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := getString(&ds, tag.TransferSyntaxUID); ts != uid.ImplicitVRLittleEndian {
+		t.Errorf("received file has transfer syntax %s, want %s", ts, uid.ImplicitVRLittleEndian)
+	}
+	if got := getString(&ds, tag.MediaStorageSOPInstanceUID); got != "1.2.3.1.1" {
+		t.Errorf("received file has MediaStorageSOPInstanceUID %s, want 1.2.3.1.1", got)
+	}
+}
@@ -0,0 +1,414 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// With -dicomdir the output uses file IDs that fit on media (at most 8 levels
+// of at most 8 upper-case characters) and a DICOMDIR with patient, study,
+// series and image records is written at the root of the output folder:
+//
+//	DICOMDIR
+//	DICOM/PA000001/ST000001/SE000001/IM000001
+//
+// The offsets between directory records depend on the size of all records,
+// the DICOMDIR is therefore encoded here (explicit VR little endian) instead
+// of using dicom.Write (see also part10Header).
+
+// dicomdirState collects the records of the DICOMDIR files
+type dicomdirState struct {
+	dicomdirFlag bool
+
+	dicomdirEntries map[string]*dicomdirEntry
+	dicomdirRoot    *dicomdirEntry
+	dicomdirMutex   sync.Mutex
+
+	dicomdirFiles []dicomdirFile
+}
+
+const mediaStorageDirectoryStorage = "1.2.840.10008.1.3.10"
+const explicitVRLittleEndian = "1.2.840.10008.1.2.1"
+
+// UID (derived from the name "sdcm", 2.25 root) and version name written into the file meta information of the DICOMDIR
+const sdcmImplementationClassUID = "2.25.164655491415029924362784829186707833222"
+const sdcmImplementationVersionName = "SDCM"
+
+// one level of the directory (patient, study or series) with the number of its children
+type dicomdirEntry struct {
+	id       string
+	children map[string]string // key of the child (e.g. SeriesInstanceUID) to its id
+	images   int
+}
+
+// dicomdirFile keeps the values of a written file needed for its directory records
+type dicomdirFile struct {
+	fileID  []string
+	patient []string // PatientID, PatientName, SpecificCharacterSet
+	study   []string // StudyInstanceUID, StudyDate, StudyTime, StudyDescription, StudyID, AccessionNumber
+	series  []string // SeriesInstanceUID, Modality, SeriesNumber
+	image   []string // SOPClassUID, SOPInstanceUID, TransferSyntaxUID, InstanceNumber, Modality
+}
+
+// initDicomdir checks if -dicomdir can be used with the other options
+func (e *engine) initDicomdir() error {
+	if !e.dicomdirFlag {
+		return nil
+	}
+	if e.methodFlag == "dirs_only" {
+		return fmt.Errorf("-dicomdir needs files in the output folder, cannot be used with '-method dirs_only'")
+	}
+	if e.orderSlicesFlag {
+		return fmt.Errorf("-dicomdir cannot be combined with -order-slices, the file IDs are fixed")
+	}
+	return nil
+}
+
+// childID returns the id of the child key of an entry, a new id is created with prefix if needed
+func (e *engine) childID(parent *dicomdirEntry, key string, prefix string) *dicomdirEntry {
+	id, ok := parent.children[key]
+	if !ok {
+		id = fmt.Sprintf("%s%06d", prefix, len(parent.children)+1)
+		parent.children[key] = id
+	}
+	path := parent.id + "/" + id
+	entry, ok := e.dicomdirEntries[path]
+	if !ok {
+		entry = &dicomdirEntry{id: path, children: make(map[string]string, 0)}
+		e.dicomdirEntries[path] = entry
+	}
+	return entry
+}
+
+// dicomdirFileID returns the output path (relative to oOrderPath) of a data set in the DICOMDIR naming mode
+func (e *engine) dicomdirFileID(ds *dicom.Dataset, oOrderPath string) string {
+	e.dicomdirMutex.Lock()
+	defer e.dicomdirMutex.Unlock()
+	patient := e.childID(e.dicomdirRoot, getString(ds, tag.PatientID), "PA")
+	study := e.childID(patient, getString(ds, tag.StudyInstanceUID), "ST")
+	series := e.childID(study, getString(ds, tag.SeriesInstanceUID), "SE")
+	for {
+		series.images++
+		fileID := fmt.Sprintf("%s/IM%06d", series.id, series.images)
+		if _, err := os.Stat(filepath.Join(oOrderPath, fileID)); os.IsNotExist(err) {
+			return fileID
+		}
+	}
+}
+
+// fileTransferSyntax returns the transfer syntax of a file from its meta information
+func fileTransferSyntax(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	p, err := dicom.NewParser(f, info.Size(), nil, dicom.SkipPixelData())
+	if err != nil {
+		return ""
+	}
+	meta := p.GetMetadata()
+	return getString(&meta, tag.TransferSyntaxUID)
+}
+
+// recordDicomdirFile remembers the values of a file written below the output folder
+func (e *engine) recordDicomdirFile(ds *dicom.Dataset, oOrderPath string, outputPathFileName string) {
+	rel, err := filepath.Rel(oOrderPath, outputPathFileName)
+	if err != nil {
+		return
+	}
+	value := func(t tag.Tag) string {
+		return strings.TrimSpace(elementValueString(findElement(ds, t)))
+	}
+	transferSyntaxUID := fileTransferSyntax(outputPathFileName)
+	if transferSyntaxUID == "" {
+		// a symbolic link to a file without file meta information
+		e.warn("%s has no file meta information and is not added to the DICOMDIR", outputPathFileName)
+		return
+	}
+	f := dicomdirFile{
+		fileID:  strings.Split(filepath.ToSlash(rel), "/"),
+		patient: []string{value(tag.PatientID), value(tag.PatientName), strings.Join(elementValues(findElement(ds, tag.SpecificCharacterSet)), "\\")},
+		study:   []string{value(tag.StudyInstanceUID), value(tag.StudyDate), value(tag.StudyTime), value(tag.StudyDescription), value(tag.StudyID), value(tag.AccessionNumber)},
+		series:  []string{value(tag.SeriesInstanceUID), value(tag.Modality), value(tag.SeriesNumber)},
+		image:   []string{value(tag.SOPClassUID), value(tag.SOPInstanceUID), transferSyntaxUID, value(tag.InstanceNumber), value(tag.Modality)},
+	}
+	e.dicomdirMutex.Lock()
+	e.dicomdirFiles = append(e.dicomdirFiles, f)
+	e.dicomdirMutex.Unlock()
+}
+
+// element of a directory record, already encoded
+type dirElement struct {
+	tag   tag.Tag
+	vr    string
+	value []byte
+}
+
+type dirRecord struct {
+	recordType string
+	elements   []dirElement
+	children   []*dirRecord
+	offset     uint32
+}
+
+func ulValue(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func usValue(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+// stringElement pads the value to an even length (UI with 0, all others with a space)
+func stringElement(t tag.Tag, vr string, value string) dirElement {
+	if len(value)%2 == 1 {
+		if vr == "UI" {
+			value += "\x00"
+		} else {
+			value += " "
+		}
+	}
+	return dirElement{t, vr, []byte(value)}
+}
+
+func encodeElement(buf *bytes.Buffer, e dirElement) {
+	binary.Write(buf, binary.LittleEndian, e.tag.Group)
+	binary.Write(buf, binary.LittleEndian, e.tag.Element)
+	buf.WriteString(e.vr)
+	switch e.vr {
+	case "OB", "OW", "SQ", "UN", "UT":
+		buf.Write([]byte{0, 0})
+		binary.Write(buf, binary.LittleEndian, uint32(len(e.value)))
+	default:
+		binary.Write(buf, binary.LittleEndian, uint16(len(e.value)))
+	}
+	buf.Write(e.value)
+}
+
+// encodeRecord returns a directory record item, the size does not depend on the offsets
+func encodeRecord(r *dirRecord, next uint32) []byte {
+	var lower uint32
+	if len(r.children) > 0 {
+		lower = r.children[0].offset
+	}
+	var body bytes.Buffer
+	encodeElement(&body, dirElement{tag.OffsetOfTheNextDirectoryRecord, "UL", ulValue(next)})
+	encodeElement(&body, dirElement{tag.RecordInUseFlag, "US", usValue(0xFFFF)})
+	encodeElement(&body, dirElement{tag.OffsetOfReferencedLowerLevelDirectoryEntity, "UL", ulValue(lower)})
+	encodeElement(&body, stringElement(tag.DirectoryRecordType, "CS", r.recordType))
+	sort.SliceStable(r.elements, func(i, j int) bool { return r.elements[i].tag.Compare(r.elements[j].tag) < 0 })
+	for _, e := range r.elements {
+		encodeElement(&body, e)
+	}
+	var item bytes.Buffer
+	binary.Write(&item, binary.LittleEndian, uint16(0xFFFE))
+	binary.Write(&item, binary.LittleEndian, uint16(0xE000))
+	binary.Write(&item, binary.LittleEndian, uint32(body.Len()))
+	item.Write(body.Bytes())
+	return item.Bytes()
+}
+
+// imageRecordType returns the directory record type for the modality of a composite object
+func imageRecordType(modality string) string {
+	switch modality {
+	case "SR":
+		return "SR DOCUMENT"
+	case "PR":
+		return "PRESENTATION"
+	case "KO":
+		return "KEY OBJECT DOC"
+	case "RTSTRUCT":
+		return "RT STRUCTURE SET"
+	case "RTPLAN":
+		return "RT PLAN"
+	case "RTDOSE":
+		return "RT DOSE"
+	}
+	return "IMAGE"
+}
+
+// buildDirectory creates the patient, study, series and image records sorted by their identifiers
+func buildDirectory(files []dicomdirFile) []*dirRecord {
+	var patients []*dirRecord
+	records := make(map[string]*dirRecord, 0)
+	keys := make(map[*dirRecord]string, 0) // sort key of each record
+	add := func(list *[]*dirRecord, key string, sortKey string, create func() *dirRecord) *dirRecord {
+		if r, ok := records[key]; ok {
+			return r
+		}
+		r := create()
+		records[key] = r
+		keys[r] = sortKey
+		*list = append(*list, r)
+		return r
+	}
+	withCharset := func(elements []dirElement, charset string) []dirElement {
+		if charset != "" {
+			elements = append(elements, stringElement(tag.SpecificCharacterSet, "CS", charset))
+		}
+		return elements
+	}
+	for _, f := range files {
+		patient := add(&patients, "P"+f.patient[0], f.patient[0], func() *dirRecord {
+			return &dirRecord{recordType: "PATIENT", elements: withCharset([]dirElement{
+				stringElement(tag.PatientID, "LO", f.patient[0]),
+				stringElement(tag.PatientName, "PN", f.patient[1]),
+			}, f.patient[2])}
+		})
+		study := add(&patient.children, "T"+f.patient[0]+"\\"+f.study[0], f.study[1]+f.study[2]+"\\"+f.study[0], func() *dirRecord {
+			return &dirRecord{recordType: "STUDY", elements: withCharset([]dirElement{
+				stringElement(tag.StudyInstanceUID, "UI", f.study[0]),
+				stringElement(tag.StudyDate, "DA", f.study[1]),
+				stringElement(tag.StudyTime, "TM", f.study[2]),
+				stringElement(tag.StudyDescription, "LO", f.study[3]),
+				stringElement(tag.StudyID, "SH", f.study[4]),
+				stringElement(tag.AccessionNumber, "SH", f.study[5]),
+			}, f.patient[2])}
+		})
+		series := add(&study.children, "S"+f.patient[0]+"\\"+f.study[0]+"\\"+f.series[0], f.series[2], func() *dirRecord {
+			return &dirRecord{recordType: "SERIES", elements: withCharset([]dirElement{
+				stringElement(tag.SeriesInstanceUID, "UI", f.series[0]),
+				stringElement(tag.Modality, "CS", f.series[1]),
+				stringElement(tag.SeriesNumber, "IS", f.series[2]),
+			}, f.patient[2])}
+		})
+		image := &dirRecord{recordType: imageRecordType(f.image[4]), elements: []dirElement{
+			stringElement(tag.ReferencedFileID, "CS", strings.Join(f.fileID, "\\")),
+			stringElement(tag.ReferencedSOPClassUIDInFile, "UI", f.image[0]),
+			stringElement(tag.ReferencedSOPInstanceUIDInFile, "UI", f.image[1]),
+			stringElement(tag.ReferencedTransferSyntaxUIDInFile, "UI", f.image[2]),
+			stringElement(tag.InstanceNumber, "IS", f.image[3]),
+		}}
+		keys[image] = f.image[3]
+		series.children = append(series.children, image)
+	}
+
+	// sort each level, numbers (SeriesNumber, InstanceNumber) by their value
+	less := func(a, b string) bool {
+		na, errA := strconv.Atoi(a)
+		nb, errB := strconv.Atoi(b)
+		if errA == nil && errB == nil && na != nb {
+			return na < nb
+		}
+		return a < b
+	}
+	var sortRecords func(list []*dirRecord)
+	sortRecords = func(list []*dirRecord) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return less(keys[list[i]], keys[list[j]])
+		})
+		for _, r := range list {
+			sortRecords(r.children)
+		}
+	}
+	sortRecords(patients)
+	return patients
+}
+
+// newUID creates a random UID (2.25 root)
+func newUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "2.25." + new(big.Int).SetBytes(b).String()
+}
+
+// writeDicomdir writes the DICOMDIR file for all files recorded below the output folder
+func (e *engine) writeDicomdir(oOrderPath string) error {
+	e.dicomdirMutex.Lock()
+	defer e.dicomdirMutex.Unlock()
+
+	patients := buildDirectory(e.dicomdirFiles)
+
+	// records are stored depth-first: patient, its studies, their series, their images, next patient
+	var order []*dirRecord
+	var flatten func(list []*dirRecord)
+	flatten = func(list []*dirRecord) {
+		for _, r := range list {
+			order = append(order, r)
+			flatten(r.children)
+		}
+	}
+	flatten(patients)
+
+	header := part10Header(mediaStorageDirectoryStorage, newUID(), explicitVRLittleEndian)
+
+	// the offsets are measured from the start of the file, the elements before the records have a fixed size
+	fileSetID := stringElement(tag.FileSetID, "CS", "SDCM")
+	var tmp bytes.Buffer
+	encodeElement(&tmp, fileSetID)
+	encodeElement(&tmp, dirElement{tag.OffsetOfTheFirstDirectoryRecordOfTheRootDirectoryEntity, "UL", ulValue(0)})
+	encodeElement(&tmp, dirElement{tag.OffsetOfTheLastDirectoryRecordOfTheRootDirectoryEntity, "UL", ulValue(0)})
+	encodeElement(&tmp, dirElement{tag.FileSetConsistencyFlag, "US", usValue(0)})
+	offset := uint32(len(header)+tmp.Len()) + 12 // sequence tag, VR and length
+	for _, r := range order {
+		r.offset = offset
+		offset += uint32(len(encodeRecord(r, 0)))
+	}
+
+	// offset of the next record on the same level
+	next := make(map[*dirRecord]uint32, 0)
+	var link func(list []*dirRecord)
+	link = func(list []*dirRecord) {
+		for i, r := range list {
+			if i+1 < len(list) {
+				next[r] = list[i+1].offset
+			}
+			link(r.children)
+		}
+	}
+	link(patients)
+
+	var items bytes.Buffer
+	for _, r := range order {
+		items.Write(encodeRecord(r, next[r]))
+	}
+	var first, last uint32
+	if len(patients) > 0 {
+		first = patients[0].offset
+		last = patients[len(patients)-1].offset
+	}
+	var body bytes.Buffer
+	encodeElement(&body, fileSetID)
+	encodeElement(&body, dirElement{tag.OffsetOfTheFirstDirectoryRecordOfTheRootDirectoryEntity, "UL", ulValue(first)})
+	encodeElement(&body, dirElement{tag.OffsetOfTheLastDirectoryRecordOfTheRootDirectoryEntity, "UL", ulValue(last)})
+	encodeElement(&body, dirElement{tag.FileSetConsistencyFlag, "US", usValue(0)})
+	encodeElement(&body, dirElement{tag.DirectoryRecordSequence, "SQ", items.Bytes()})
+
+	f, err := os.Create(filepath.Join(oOrderPath, "DICOMDIR"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(header); err != nil {
+		return err
+	}
+	if _, err = f.Write(body.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
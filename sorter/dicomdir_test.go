@@ -0,0 +1,317 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestImageRecordType(t *testing.T) {
+	tests := map[string]string{
+		"CT":       "IMAGE",
+		"MR":       "IMAGE",
+		"":         "IMAGE",
+		"SR":       "SR DOCUMENT",
+		"PR":       "PRESENTATION",
+		"KO":       "KEY OBJECT DOC",
+		"RTSTRUCT": "RT STRUCTURE SET",
+		"RTPLAN":   "RT PLAN",
+		"RTDOSE":   "RT DOSE",
+	}
+	for modality, want := range tests {
+		if got := imageRecordType(modality); got != want {
+			t.Errorf("imageRecordType(%q) = %q, want %q", modality, got, want)
+		}
+	}
+}
+
+func TestStringElement(t *testing.T) {
+	tests := []struct {
+		vr, value string
+		want      string
+	}{
+		{vr: "UI", value: "1.2.3", want: "1.2.3\x00"},
+		{vr: "UI", value: "1.23", want: "1.23"},
+		{vr: "CS", value: "IMAGE", want: "IMAGE "},
+		{vr: "PN", value: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := stringElement(tag.PatientID, tt.vr, tt.value); string(got.value) != tt.want {
+			t.Errorf("stringElement(%s, %q) = %q, want %q", tt.vr, tt.value, got.value, tt.want)
+		}
+	}
+}
+
+func TestDicomdirFileID(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEngine()
+	e.dicomdirFlag = true
+	instance := func(patient, study, series string, number int) dicom.Dataset {
+		return newTestInstance(t, series, number,
+			newTestElement(t, tag.PatientID, []string{patient}),
+			newTestElement(t, tag.StudyInstanceUID, []string{study}))
+	}
+	tests := []struct {
+		ds   dicom.Dataset
+		want string
+	}{
+		{ds: instance("P1", "1.1", "1.1.1", 1), want: "DICOM/PA000001/ST000001/SE000001/IM000001"},
+		{ds: instance("P1", "1.1", "1.1.1", 2), want: "DICOM/PA000001/ST000001/SE000001/IM000002"},
+		{ds: instance("P1", "1.1", "1.1.2", 1), want: "DICOM/PA000001/ST000001/SE000002/IM000001"},
+		{ds: instance("P1", "1.2", "1.2.1", 1), want: "DICOM/PA000001/ST000002/SE000001/IM000001"},
+		{ds: instance("P2", "2.1", "2.1.1", 1), want: "DICOM/PA000002/ST000001/SE000001/IM000001"},
+		{ds: instance("P1", "1.1", "1.1.1", 3), want: "DICOM/PA000001/ST000001/SE000001/IM000003"},
+	}
+	for i, tt := range tests {
+		if got := e.dicomdirFileID(&tt.ds, dir); got != tt.want {
+			t.Errorf("file %d: dicomdirFileID = %s, want %s", i+1, got, tt.want)
+		}
+	}
+
+	// existing files are not overwritten
+	if err := os.MkdirAll(filepath.Join(dir, "DICOM/PA000002/ST000001/SE000001"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "DICOM/PA000002/ST000001/SE000001/IM000002"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ds := instance("P2", "2.1", "2.1.1", 2)
+	if got, want := e.dicomdirFileID(&ds, dir), "DICOM/PA000002/ST000001/SE000001/IM000003"; got != want {
+		t.Errorf("dicomdirFileID = %s next to an existing file, want %s", got, want)
+	}
+}
+
+// dicomdirRecord is what we expect of a directory record
+type dicomdirRecord struct {
+	recordType string
+	key        string // PatientID, StudyInstanceUID, SeriesInstanceUID or ReferencedFileID
+	lower      bool   // has a lower level
+	next       bool   // has a next record on the same level
+}
+
+func TestWriteDicomdir(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEngine()
+	e.dicomdirFlag = true
+	type file struct {
+		patient, study, series, seriesNumber, modality string
+		number                                         int
+	}
+	// files are recorded out of order, the DICOMDIR sorts them by study date, SeriesNumber and InstanceNumber
+	files := []file{
+		{patient: "P2", study: "2.1", series: "2.1.1", seriesNumber: "1", modality: "MR", number: 1},
+		{patient: "P1", study: "1.1", series: "1.1.2", seriesNumber: "10", modality: "CT", number: 1},
+		{patient: "P1", study: "1.1", series: "1.1.1", seriesNumber: "2", modality: "CT", number: 10},
+		{patient: "P1", study: "1.1", series: "1.1.1", seriesNumber: "2", modality: "CT", number: 9},
+		{patient: "P1", study: "1.1", series: "1.1.3", seriesNumber: "3", modality: "SR", number: 1},
+	}
+	var paths []string
+	for _, f := range files {
+		ds := newTestInstance(t, f.series, f.number,
+			newTestElement(t, tag.PatientID, []string{f.patient}),
+			newTestElement(t, tag.StudyInstanceUID, []string{f.study}),
+			newTestElement(t, tag.StudyDate, []string{"20240101"}),
+			newTestElement(t, tag.SeriesNumber, []string{f.seriesNumber}),
+			newTestElement(t, tag.Modality, []string{f.modality}),
+			newTestElement(t, tag.SpecificCharacterSet, []string{"ISO_IR 100"}))
+		path := filepath.Join(dir, filepath.FromSlash(e.dicomdirFileID(&ds, dir)))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, path, ds)
+		e.recordDicomdirFile(&ds, dir, path)
+		paths = append(paths, path)
+	}
+	if err := e.writeDicomdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	dicomdirPath := filepath.Join(dir, "DICOMDIR")
+	ds, err := dicom.ParseFile(dicomdirPath, nil)
+	if err != nil {
+		t.Fatalf("could not parse the DICOMDIR (%s)", err)
+	}
+	if got := getString(&ds, tag.MediaStorageSOPClassUID); got != mediaStorageDirectoryStorage {
+		t.Errorf("MediaStorageSOPClassUID %s, want %s", got, mediaStorageDirectoryStorage)
+	}
+	if got := getString(&ds, tag.FileSetID); got != "SDCM" {
+		t.Errorf("FileSetID %q, want SDCM", got)
+	}
+	recordSequence, err := ds.FindElementByTag(tag.DirectoryRecordSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dicomdirRecord{
+		{recordType: "PATIENT", key: "P1", lower: true, next: true},
+		{recordType: "STUDY", key: "1.1", lower: true},
+		{recordType: "SERIES", key: "1.1.1", lower: true, next: true},
+		{recordType: "IMAGE", key: "DICOM\\PA000002\\ST000001\\SE000002\\IM000002", next: true},
+		{recordType: "IMAGE", key: "DICOM\\PA000002\\ST000001\\SE000002\\IM000001"},
+		{recordType: "SERIES", key: "1.1.3", lower: true, next: true},
+		{recordType: "SR DOCUMENT", key: "DICOM\\PA000002\\ST000001\\SE000003\\IM000001"},
+		{recordType: "SERIES", key: "1.1.2", lower: true},
+		{recordType: "IMAGE", key: "DICOM\\PA000002\\ST000001\\SE000001\\IM000001"},
+		{recordType: "PATIENT", key: "P2", lower: true},
+		{recordType: "STUDY", key: "2.1", lower: true},
+		{recordType: "SERIES", key: "2.1.1", lower: true},
+		{recordType: "IMAGE", key: "DICOM\\PA000001\\ST000001\\SE000001\\IM000001"},
+	}
+	var got []dicomdirRecord
+	for _, item := range sequenceItems(recordSequence) {
+		record := dicom.Dataset{Elements: item}
+		r := dicomdirRecord{
+			recordType: getString(&record, tag.DirectoryRecordType),
+			lower:      elementUint32(findElement(&record, tag.OffsetOfReferencedLowerLevelDirectoryEntity)) != 0,
+			next:       elementUint32(findElement(&record, tag.OffsetOfTheNextDirectoryRecord)) != 0,
+		}
+		for _, tg := range []tag.Tag{tag.PatientID, tag.StudyInstanceUID, tag.SeriesInstanceUID, tag.ReferencedFileID} {
+			if elem := findElement(&record, tg); elem != nil {
+				r.key = strings.Join(elementValues(elem), "\\")
+			}
+		}
+		got = append(got, r)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records\n%v\nwant\n%v", got, want)
+	}
+
+	// the offsets point to the records, following them finds every file with the values of its parent records
+	indexed, err := readDicomdirIndex(dicomdirPath)
+	if err != nil {
+		t.Fatalf("could not follow the directory records (%s)", err)
+	}
+	if len(indexed) != len(files) {
+		t.Fatalf("found %d files, want %d", len(indexed), len(files))
+	}
+	found := make(map[string]bool, len(indexed))
+	for _, f := range indexed {
+		found[f.path] = true
+		path := f.path
+		for i, p := range paths {
+			if p != path {
+				continue
+			}
+			if got := getString(&f.dataset, tag.PatientID); got != files[i].patient {
+				t.Errorf("%s has PatientID %s, want %s", path, got, files[i].patient)
+			}
+			if got := getString(&f.dataset, tag.SeriesInstanceUID); got != files[i].series {
+				t.Errorf("%s has SeriesInstanceUID %s, want %s", path, got, files[i].series)
+			}
+			if got, want := getString(&f.dataset, tag.SOPInstanceUID), fmt.Sprintf("%s.%d", files[i].series, files[i].number); got != want {
+				t.Errorf("%s has SOPInstanceUID %s, want %s", path, got, want)
+			}
+			if got := getString(&f.dataset, tag.TransferSyntaxUID); got != explicitVRLittleEndian {
+				t.Errorf("%s has TransferSyntaxUID %s, want %s", path, got, explicitVRLittleEndian)
+			}
+		}
+	}
+	for _, p := range paths {
+		if !found[p] {
+			t.Errorf("%s is not referenced by the DICOMDIR", p)
+		}
+	}
+}
+
+// files written with -dicomdir are sorted back with -use-dicomdir
+func TestUseDicomdir(t *testing.T) {
+	in := t.TempDir()
+	files := []struct {
+		patient, series, modality string
+		number                    int
+	}{
+		{patient: "P1", series: "1.2.3.1", modality: "CT", number: 1},
+		{patient: "P1", series: "1.2.3.1", modality: "CT", number: 2},
+		{patient: "P1", series: "1.2.3.2", modality: "SR", number: 1},
+		{patient: "P2", series: "1.2.4.1", modality: "MR", number: 1},
+	}
+	for i, f := range files {
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("%d.dcm", i)), newTestInstance(t, f.series, f.number,
+			newTestElement(t, tag.PatientID, []string{f.patient}),
+			newTestElement(t, tag.Modality, []string{f.modality}),
+			newTestElement(t, tag.ProtocolName, []string{"protocol " + f.modality})))
+	}
+	media := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.Dicomdir = []string{in}, media, true, "none", true
+	if _, err := New(opts).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// a file that is not referenced by the DICOMDIR
+	if err := os.MkdirAll(filepath.Join(media, "extra"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(media, "extra", "x.dcm"), newTestInstance(t, "1.2.5.1", 1,
+		newTestElement(t, tag.PatientID, []string{"P3"}),
+		newTestElement(t, tag.Modality, []string{"US"}),
+		newTestElement(t, tag.ProtocolName, []string{"protocol US"})))
+	// the second CT image is excluded by its path on the media
+	indexed, err := readDicomdirIndex(filepath.Join(media, "DICOMDIR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude := ""
+	for _, f := range indexed {
+		if getString(&f.dataset, tag.SOPInstanceUID) == "1.2.3.1.2" {
+			rel, _ := filepath.Rel(media, f.path)
+			exclude = "/" + filepath.ToSlash(rel)
+		}
+	}
+	if exclude == "" {
+		t.Fatal("1.2.3.1.2 is not referenced by the DICOMDIR")
+	}
+
+	tests := []struct {
+		name                 string
+		folder               string
+		want                 []string
+		fromDicomdir, parsed int32
+	}{
+		{
+			// PatientID and Modality are inherited from the patient and series records
+			name:         "records",
+			folder:       "{PatientID}/{Modality}/{SOPInstanceUID}.dcm",
+			want:         []string{"P1/CT/1.2.3.1.1.dcm", "P1/SR/1.2.3.2.1.dcm", "P2/MR/1.2.4.1.1.dcm", "P3/US/1.2.5.1.1.dcm"},
+			fromDicomdir: 3,
+		},
+		{
+			// the records do not contain the ProtocolName, the files are parsed
+			name:   "missing tag",
+			folder: "{PatientID}/{ProtocolName}/{SOPInstanceUID}.dcm",
+			want:   []string{"P1/protocol-CT/1.2.3.1.1.dcm", "P1/protocol-SR/1.2.3.2.1.dcm", "P2/protocol-MR/1.2.4.1.1.dcm", "P3/protocol-US/1.2.5.1.1.dcm"},
+			parsed: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.UseDicomdir = []string{media}, out, true, "none", true
+			opts.Folder, opts.Exclude = tt.folder, exclude
+			result, err := New(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := listFiles(t, out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("output %v, want %v", got, tt.want)
+			}
+			if result.FromDicomdir != tt.fromDicomdir || result.DicomdirParsed != tt.parsed {
+				t.Errorf("%d files from the records and %d parsed, want %d and %d", result.FromDicomdir, result.DicomdirParsed, tt.fromDicomdir, tt.parsed)
+			}
+			// the excluded file, the DICOMDIR is not counted
+			if result.Skipped != 1 {
+				t.Errorf("%d files skipped, want 1", result.Skipped)
+			}
+		})
+	}
+}
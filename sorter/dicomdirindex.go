@@ -0,0 +1,419 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// With -use-dicomdir the patient, study, series and image records of the DICOMDIR
+// of an input folder are used as the values of each referenced file. A file is
+// only parsed if a tag needed for the folder path (or for another option) is
+// missing in its records. Files that are not referenced by the DICOMDIR are
+// sorted like the files of any other folder afterwards. If the DICOMDIR cannot
+// be read the input folder is walked as usual.
+
+// dicomdirIndexState counts the files sorted from DICOMDIR records
+type dicomdirIndexState struct {
+	useDicomdirFlag bool
+
+	// number of files sorted from the DICOMDIR records only and files that had to be parsed
+	counterIndexed       int32
+	counterIndexedParsed int32
+}
+
+// explicit VR little endian reader for the raw bytes of a DICOMDIR, used to find the offsets of the records
+type rawReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *rawReader) uint16() (uint16, error) {
+	if r.pos+2 > len(r.b) {
+		return 0, fmt.Errorf("unexpected end of DICOMDIR at %d", r.pos)
+	}
+	v := binary.LittleEndian.Uint16(r.b[r.pos:])
+	r.pos += 2
+	return v, nil
+}
+
+func (r *rawReader) uint32() (uint32, error) {
+	if r.pos+4 > len(r.b) {
+		return 0, fmt.Errorf("unexpected end of DICOMDIR at %d", r.pos)
+	}
+	v := binary.LittleEndian.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+// header reads a tag with its VR and value length (items and delimiters have no VR)
+func (r *rawReader) header() (t tag.Tag, vr string, length uint32, err error) {
+	if t.Group, err = r.uint16(); err != nil {
+		return
+	}
+	if t.Element, err = r.uint16(); err != nil {
+		return
+	}
+	if t.Group == 0xFFFE {
+		length, err = r.uint32()
+		return
+	}
+	if r.pos+2 > len(r.b) {
+		return t, "", 0, fmt.Errorf("unexpected end of DICOMDIR at %d", r.pos)
+	}
+	vr = string(r.b[r.pos : r.pos+2])
+	r.pos += 2
+	switch vr {
+	case "OB", "OD", "OF", "OL", "OV", "OW", "SQ", "SV", "UC", "UN", "UR", "UT", "UV":
+		r.pos += 2
+		length, err = r.uint32()
+	default:
+		var l uint16
+		l, err = r.uint16()
+		length = uint32(l)
+	}
+	return
+}
+
+// skipItems skips the items of a sequence with undefined length including the sequence delimiter
+func (r *rawReader) skipItems() error {
+	for {
+		t, _, length, err := r.header()
+		if err != nil {
+			return err
+		}
+		if t == tag.SequenceDelimitationItem {
+			return nil
+		}
+		if err := r.skipItem(length); err != nil {
+			return err
+		}
+	}
+}
+
+// skipItem skips the elements of an item after its header
+func (r *rawReader) skipItem(length uint32) error {
+	if length != tag.VLUndefinedLength {
+		r.pos += int(length)
+		return nil
+	}
+	for {
+		t, vr, length, err := r.header()
+		if err != nil {
+			return err
+		}
+		if t == tag.ItemDelimitationItem {
+			return nil
+		}
+		if err := r.skipValue(vr, length); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *rawReader) skipValue(vr string, length uint32) error {
+	if length == tag.VLUndefinedLength {
+		if vr != "SQ" && vr != "UN" {
+			return fmt.Errorf("undefined length for VR %s at %d", vr, r.pos)
+		}
+		return r.skipItems()
+	}
+	r.pos += int(length)
+	return nil
+}
+
+// dicomdirItemOffsets returns the file offset of each item of the DirectoryRecordSequence
+func dicomdirItemOffsets(raw []byte) ([]uint32, error) {
+	if len(raw) < 144 || string(raw[128:132]) != "DICM" {
+		return nil, fmt.Errorf("not a DICOM file")
+	}
+	r := &rawReader{b: raw, pos: 132}
+	t, _, _, err := r.header()
+	if err != nil || t != tag.FileMetaInformationGroupLength {
+		return nil, fmt.Errorf("no file meta information group length")
+	}
+	groupLength, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	r.pos += int(groupLength)
+	for r.pos < len(raw) {
+		t, vr, length, err := r.header()
+		if err != nil {
+			return nil, err
+		}
+		if t != tag.DirectoryRecordSequence {
+			if err := r.skipValue(vr, length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var offsets []uint32
+		end := len(raw)
+		if length != tag.VLUndefinedLength {
+			end = r.pos + int(length)
+		}
+		for r.pos < end {
+			start := r.pos
+			t, _, length, err := r.header()
+			if err != nil {
+				return nil, err
+			}
+			if t == tag.SequenceDelimitationItem {
+				break
+			}
+			offsets = append(offsets, uint32(start))
+			if err := r.skipItem(length); err != nil {
+				return nil, err
+			}
+		}
+		return offsets, nil
+	}
+	return nil, fmt.Errorf("no directory record sequence")
+}
+
+// indexedFile is a file referenced by a DICOMDIR with the values of its directory records
+type indexedFile struct {
+	path    string
+	dataset dicom.Dataset
+}
+
+func elementUint32(e *dicom.Element) uint32 {
+	if e == nil || e.Value == nil {
+		return 0
+	}
+	if v, ok := e.Value.GetValue().([]int); ok && len(v) > 0 {
+		return uint32(v[0])
+	}
+	return 0
+}
+
+// findDicomdir returns the DICOMDIR of an input folder (or the input itself if it is a DICOMDIR)
+func findDicomdir(source string) string {
+	if strings.EqualFold(filepath.Base(source), "DICOMDIR") {
+		return source
+	}
+	for _, name := range []string{"DICOMDIR", "dicomdir"} {
+		if info, err := os.Stat(filepath.Join(source, name)); err == nil && !info.IsDir() {
+			return filepath.Join(source, name)
+		}
+	}
+	return ""
+}
+
+// readDicomdirIndex returns all files referenced by a DICOMDIR
+func readDicomdirIndex(dicomdirPath string) ([]indexedFile, error) {
+	raw, err := os.ReadFile(dicomdirPath)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := dicomdirItemOffsets(raw)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := dicom.ParseFile(dicomdirPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if getString(&ds, tag.MediaStorageSOPClassUID) != mediaStorageDirectoryStorage {
+		return nil, fmt.Errorf("%s is not a DICOMDIR", dicomdirPath)
+	}
+	recordSequence, err := ds.FindElementByTag(tag.DirectoryRecordSequence)
+	if err != nil {
+		return nil, err
+	}
+	records := sequenceItems(recordSequence)
+	if len(records) != len(offsets) {
+		return nil, fmt.Errorf("found %d directory records but %d items", len(records), len(offsets))
+	}
+	recordAt := make(map[uint32]int, len(offsets))
+	for i, o := range offsets {
+		recordAt[o] = i
+	}
+	root := filepath.Dir(dicomdirPath)
+
+	var files []indexedFile
+	visited := make(map[uint32]bool, 0)
+	// follow the records of a level, each record inherits the values of its parent records
+	var visit func(offset uint32, inherited []*dicom.Element) error
+	visit = func(offset uint32, inherited []*dicom.Element) error {
+		for offset != 0 {
+			i, ok := recordAt[offset]
+			if !ok || visited[offset] {
+				return fmt.Errorf("invalid directory record offset %d", offset)
+			}
+			visited[offset] = true
+			record := dicom.Dataset{Elements: append([]*dicom.Element{}, inherited...)}
+			var next, lower uint32
+			var fileID []string
+			for _, e := range records[i] {
+				switch e.Tag {
+				case tag.OffsetOfTheNextDirectoryRecord:
+					next = elementUint32(e)
+				case tag.OffsetOfReferencedLowerLevelDirectoryEntity:
+					lower = elementUint32(e)
+				case tag.ReferencedFileID:
+					fileID = elementValues(e)
+				case tag.ReferencedSOPClassUIDInFile:
+					setElement(&record, tag.SOPClassUID, []string{elementValueString(e)})
+					setElement(&record, tag.MediaStorageSOPClassUID, []string{elementValueString(e)})
+				case tag.ReferencedSOPInstanceUIDInFile:
+					setElement(&record, tag.SOPInstanceUID, []string{elementValueString(e)})
+					setElement(&record, tag.MediaStorageSOPInstanceUID, []string{elementValueString(e)})
+				case tag.ReferencedTransferSyntaxUIDInFile:
+					setElement(&record, tag.TransferSyntaxUID, []string{elementValueString(e)})
+				default:
+					if e.Tag.Group != 0x0004 {
+						putElement(&record, e)
+					}
+				}
+			}
+			if len(fileID) > 0 {
+				files = append(files, indexedFile{path: referencedFilePath(root, fileID), dataset: record})
+			}
+			if lower != 0 {
+				if err := visit(lower, record.Elements); err != nil {
+					return err
+				}
+			}
+			offset = next
+		}
+		return nil
+	}
+	first, err := ds.FindElementByTag(tag.OffsetOfTheFirstDirectoryRecordOfTheRootDirectoryEntity)
+	if err != nil {
+		return nil, err
+	}
+	if err := visit(elementUint32(first), nil); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// referencedFilePath returns the path of a file ID, media are often mounted with lower-case names
+func referencedFilePath(root string, fileID []string) string {
+	path := filepath.Join(append([]string{root}, fileID...)...)
+	if _, err := os.Stat(path); err != nil {
+		lower := filepath.Join(append([]string{root}, strings.Split(strings.ToLower(strings.Join(fileID, "/")), "/")...)...)
+		if _, err := os.Stat(lower); err == nil {
+			return lower
+		}
+	}
+	return path
+}
+
+// indexRequiredTags returns the tags that need to be known for each file without parsing it
+func (e *engine) indexRequiredTags() []tag.Tag {
+	var tags []tag.Tag
+	for t := range e.dicomTags {
+		tags = append(tags, t)
+	}
+	tags = append(tags, e.subseriesTags...)
+	if e.orderSlicesFlag || e.seriesReportFlag != "" {
+		tags = append(tags, tag.ImagePositionPatient, tag.ImageOrientationPatient, tag.InstanceNumber)
+	}
+	if e.seriesReportFlag != "" {
+		tags = append(tags, tag.Rows, tag.Columns, tag.PixelSpacing)
+	}
+	if e.consistencyReportFlag != "" {
+		tags = append(tags, tag.PatientName, tag.PatientBirthDate, tag.Modality, tag.ImageType)
+	}
+	if e.splitFramesFlag {
+		tags = append(tags, tag.NumberOfFrames, tag.SOPClassUID)
+	}
+	return tags
+}
+
+func hasElements(ds *dicom.Dataset, tags []tag.Tag) bool {
+	for _, t := range tags {
+		if findElement(ds, t) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// sortDicomdirIndex sorts the files referenced by the DICOMDIR of source_path, returns an error if the DICOMDIR cannot be used
+func (e *engine) sortDicomdirIndex(source_path string, dest_path string) error {
+	dicomdirPath := findDicomdir(source_path)
+	if dicomdirPath == "" {
+		return fmt.Errorf("no DICOMDIR in %s", source_path)
+	}
+	files, err := readDicomdirIndex(dicomdirPath)
+	if err != nil {
+		return err
+	}
+	required := e.indexRequiredTags()
+
+	jobs := make(chan indexedFile, e.num_workers)
+	var wg sync.WaitGroup
+	for w := 0; w < e.num_workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				dataset := f.dataset
+				if hasElements(&dataset, required) {
+					atomic.AddInt32(&e.counterIndexed, 1)
+				} else {
+					// the records do not contain all values, read the file instead
+					ds, err := e.readInputFile(f.path)
+					if err != nil {
+						e.skipFile(f.path, ErrNotDICOM)
+						if e.debugFlag {
+							fmt.Fprintf(os.Stderr, "[%d] ignore file referenced by DICOMDIR, cannot read as DICOM: \"%s\"\n\n", e.counterError, f.path)
+						}
+						continue
+					}
+					dataset = ds
+					atomic.AddInt32(&e.counterIndexedParsed, 1)
+				}
+				e.processDataset(dataset, f.path, dest_path, f.path)
+			}
+		}()
+	}
+	for _, f := range files {
+		if rel, err := filepath.Rel(source_path, f.path); err == nil && matchGlobs(e.excludeGlobs, rel) {
+			e.skipFile(f.path, ErrExcluded)
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			e.skipFile(f.path, err)
+			if e.debugFlag {
+				fmt.Fprintf(os.Stderr, "[%d] ignore missing file referenced by DICOMDIR: \"%s\"\n\n", e.counterError, f.path)
+			}
+			continue
+		}
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+
+	// the other files of the folder, media are often mounted with lower-case names
+	referenced := make(map[string]bool, len(files)+1)
+	referenced[strings.ToLower(dicomdirPath)] = true
+	for _, f := range files {
+		referenced[strings.ToLower(f.path)] = true
+	}
+	err = e.walkFiles(source_path, func(path string, info os.FileInfo, err error) error {
+		if info != nil && !info.IsDir() && referenced[strings.ToLower(filepath.Join(source_path, path))] {
+			return nil
+		}
+		return e.walkFunc(path, info, err)
+	})
+	if err != nil {
+		e.warn("could not read all files in %s (%s)", source_path, err)
+	}
+	return nil
+}
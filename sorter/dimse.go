@@ -0,0 +1,449 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// A minimal implementation of the DICOM upper layer protocol (PS3.8) and of the
+// DIMSE messages C-ECHO and C-STORE (PS3.7) used by 'sdcm serve' and by
+// '-method cstore'. Command sets are always encoded implicit VR little endian,
+// data sets are transferred in the negotiated transfer syntax without changes.
+
+// protocol data unit types
+const (
+	pduAssociateRQ = 0x01
+	pduAssociateAC = 0x02
+	pduAssociateRJ = 0x03
+	pduDataTF      = 0x04
+	pduReleaseRQ   = 0x05
+	pduReleaseRP   = 0x06
+	pduAbort       = 0x07
+)
+
+// DIMSE command fields and status codes
+const (
+	commandCStoreRQ  = 0x0001
+	commandCStoreRSP = 0x8001
+	commandCEchoRQ   = 0x0030
+	commandCEchoRSP  = 0x8030
+
+	commandNoDataSet = 0x0101
+
+	statusSuccess          = 0x0000
+	statusOutOfResources   = 0xA700
+	statusCannotUnderstand = 0xC000
+)
+
+const applicationContextName = "1.2.840.10008.3.1.1.1"
+const verificationSOPClass = "1.2.840.10008.1.1"
+const storageSOPClassPrefix = "1.2.840.10008.5.1.4.1.1."
+
+// maximum length of a P-DATA-TF PDU we receive
+const maxPDULength = 1048576
+
+// an association is aborted if the peer does not send anything for this long
+var associationTimeout = 5 * time.Minute
+
+// transfer syntaxes accepted for storage, in the order of preference
+var acceptedTransferSyntaxes = []string{
+	"1.2.840.10008.1.2.1",    // explicit VR little endian
+	"1.2.840.10008.1.2",      // implicit VR little endian
+	"1.2.840.10008.1.2.1.99", // deflated explicit VR little endian
+	"1.2.840.10008.1.2.2",    // explicit VR big endian
+	"1.2.840.10008.1.2.4.50", // JPEG baseline
+	"1.2.840.10008.1.2.4.51", // JPEG extended
+	"1.2.840.10008.1.2.4.57", // JPEG lossless
+	"1.2.840.10008.1.2.4.70", // JPEG lossless, first-order prediction
+	"1.2.840.10008.1.2.4.80", // JPEG-LS lossless
+	"1.2.840.10008.1.2.4.81", // JPEG-LS near-lossless
+	"1.2.840.10008.1.2.4.90", // JPEG 2000 lossless
+	"1.2.840.10008.1.2.4.91", // JPEG 2000
+	"1.2.840.10008.1.2.5",    // RLE lossless
+}
+
+// presentationContext is a proposed (transferSyntaxes) or accepted (transferSyntax) presentation context
+type presentationContext struct {
+	id               byte
+	abstractSyntax   string
+	transferSyntaxes []string
+	transferSyntax   string
+	result           byte // 0 acceptance, 3 abstract syntax not supported, 4 transfer syntax not supported
+}
+
+// associateRQ holds the values of an A-ASSOCIATE-RQ or A-ASSOCIATE-AC PDU
+type associateRQ struct {
+	calledAE     string
+	callingAE    string
+	contexts     []presentationContext
+	maxPDULength uint32
+}
+
+// association is an established connection between two application entities
+type association struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	callingAE    string
+	calledAE     string
+	maxPDULength uint32 // maximum length of the PDUs we send
+	contexts     map[byte]*presentationContext
+	messageID    uint16
+}
+
+func readPDU(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > 64*maxPDULength {
+		return 0, nil, fmt.Errorf("PDU too large (%d bytes)", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+func writePDU(w io.Writer, pduType byte, data []byte) error {
+	header := []byte{pduType, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[2:], uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// encodeItem returns a variable item (type, reserved, 2 bytes length, value)
+func encodeItem(itemType byte, value []byte) []byte {
+	b := []byte{itemType, 0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(value)))
+	return append(b, value...)
+}
+
+type pduItem struct {
+	itemType byte
+	value    []byte
+}
+
+func parseItems(data []byte) ([]pduItem, error) {
+	var items []pduItem
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated item")
+		}
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("truncated item")
+		}
+		items = append(items, pduItem{data[0], data[4 : 4+length]})
+		data = data[4+length:]
+	}
+	return items, nil
+}
+
+// aeTitle pads an application entity title to 16 characters
+func aeTitle(ae string) []byte {
+	b := []byte(fmt.Sprintf("%-16s", ae))
+	return b[:16]
+}
+
+func trimUID(b []byte) string {
+	return strings.Trim(string(b), " \x00")
+}
+
+// encodeAssociate creates an A-ASSOCIATE-RQ (contexts with transferSyntaxes) or -AC (contexts with result) PDU
+func encodeAssociate(rq associateRQ, accept bool) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 1, 0, 0})
+	b.Write(aeTitle(rq.calledAE))
+	b.Write(aeTitle(rq.callingAE))
+	b.Write(make([]byte, 32))
+	b.Write(encodeItem(0x10, []byte(applicationContextName)))
+	for _, pc := range rq.contexts {
+		var v bytes.Buffer
+		if accept {
+			v.Write([]byte{pc.id, 0, pc.result, 0})
+			ts := pc.transferSyntax
+			if ts == "" {
+				ts = acceptedTransferSyntaxes[0]
+			}
+			v.Write(encodeItem(0x40, []byte(ts)))
+			b.Write(encodeItem(0x21, v.Bytes()))
+		} else {
+			v.Write([]byte{pc.id, 0, 0, 0})
+			v.Write(encodeItem(0x30, []byte(pc.abstractSyntax)))
+			for _, ts := range pc.transferSyntaxes {
+				v.Write(encodeItem(0x40, []byte(ts)))
+			}
+			b.Write(encodeItem(0x20, v.Bytes()))
+		}
+	}
+	var user bytes.Buffer
+	maxLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(maxLength, maxPDULength)
+	user.Write(encodeItem(0x51, maxLength))
+	user.Write(encodeItem(0x52, []byte(sdcmImplementationClassUID)))
+	user.Write(encodeItem(0x55, []byte(sdcmImplementationVersionName)))
+	b.Write(encodeItem(0x50, user.Bytes()))
+	return b.Bytes()
+}
+
+// parseAssociate reads an A-ASSOCIATE-RQ or -AC PDU
+func parseAssociate(data []byte) (associateRQ, error) {
+	var rq associateRQ
+	if len(data) < 68 {
+		return rq, fmt.Errorf("association PDU too short")
+	}
+	rq.calledAE = strings.TrimSpace(string(data[4:20]))
+	rq.callingAE = strings.TrimSpace(string(data[20:36]))
+	items, err := parseItems(data[68:])
+	if err != nil {
+		return rq, err
+	}
+	for _, item := range items {
+		switch item.itemType {
+		case 0x20, 0x21:
+			if len(item.value) < 4 {
+				return rq, fmt.Errorf("presentation context item too short")
+			}
+			pc := presentationContext{id: item.value[0], result: item.value[2]}
+			subItems, err := parseItems(item.value[4:])
+			if err != nil {
+				return rq, err
+			}
+			for _, sub := range subItems {
+				switch sub.itemType {
+				case 0x30:
+					pc.abstractSyntax = trimUID(sub.value)
+				case 0x40:
+					pc.transferSyntaxes = append(pc.transferSyntaxes, trimUID(sub.value))
+					pc.transferSyntax = trimUID(sub.value)
+				}
+			}
+			rq.contexts = append(rq.contexts, pc)
+		case 0x50:
+			subItems, err := parseItems(item.value)
+			if err != nil {
+				return rq, err
+			}
+			for _, sub := range subItems {
+				if sub.itemType == 0x51 && len(sub.value) == 4 {
+					rq.maxPDULength = binary.BigEndian.Uint32(sub.value)
+				}
+			}
+		}
+	}
+	return rq, nil
+}
+
+// dimseCommand is a command set, element number of group 0000 to the encoded value
+type dimseCommand map[uint16][]byte
+
+func (c dimseCommand) setUID(t tag.Tag, uid string) {
+	if len(uid)%2 == 1 {
+		uid += "\x00"
+	}
+	c[t.Element] = []byte(uid)
+}
+
+func (c dimseCommand) setUS(t tag.Tag, v uint16) {
+	c[t.Element] = usValue(v)
+}
+
+func (c dimseCommand) uid(t tag.Tag) string {
+	return trimUID(c[t.Element])
+}
+
+func (c dimseCommand) us(t tag.Tag) uint16 {
+	if v, ok := c[t.Element]; ok && len(v) >= 2 {
+		return binary.LittleEndian.Uint16(v)
+	}
+	return 0
+}
+
+// encode returns the command set (implicit VR little endian) with its group length
+func (c dimseCommand) encode() []byte {
+	var elements []uint16
+	for e := range c {
+		if e != 0 {
+			elements = append(elements, e)
+		}
+	}
+	sort.Slice(elements, func(i, j int) bool { return elements[i] < elements[j] })
+	var body bytes.Buffer
+	for _, e := range elements {
+		binary.Write(&body, binary.LittleEndian, uint16(0))
+		binary.Write(&body, binary.LittleEndian, e)
+		binary.Write(&body, binary.LittleEndian, uint32(len(c[e])))
+		body.Write(c[e])
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint16{0, 0})
+	binary.Write(&b, binary.LittleEndian, uint32(4))
+	binary.Write(&b, binary.LittleEndian, uint32(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func decodeCommand(data []byte) (dimseCommand, error) {
+	c := make(dimseCommand, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated command set")
+		}
+		group := binary.LittleEndian.Uint16(data)
+		element := binary.LittleEndian.Uint16(data[2:])
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if group != 0 || len(data) < 8+length {
+			return nil, fmt.Errorf("invalid command set")
+		}
+		c[element] = data[8 : 8+length]
+		data = data[8+length:]
+	}
+	return c, nil
+}
+
+// pdv is a presentation data value item of a P-DATA-TF PDU
+type pdv struct {
+	contextID byte
+	command   bool
+	last      bool
+	data      []byte
+}
+
+func parsePDVs(data []byte) ([]pdv, error) {
+	var pdvs []pdv
+	for len(data) > 0 {
+		if len(data) < 6 {
+			return nil, fmt.Errorf("truncated presentation data value")
+		}
+		length := int(binary.BigEndian.Uint32(data))
+		if length < 2 || len(data) < 4+length {
+			return nil, fmt.Errorf("truncated presentation data value")
+		}
+		pdvs = append(pdvs, pdv{contextID: data[4], command: data[5]&1 != 0, last: data[5]&2 != 0, data: data[6 : 4+length]})
+		data = data[4+length:]
+	}
+	return pdvs, nil
+}
+
+// sendPDV sends data as one or more fragments that fit into the PDUs accepted by the peer
+func (a *association) sendPDV(contextID byte, command bool, r io.Reader) error {
+	fragmentSize := 16384
+	if a.maxPDULength > 6 {
+		fragmentSize = int(a.maxPDULength) - 6
+	}
+	if fragmentSize > maxPDULength {
+		fragmentSize = maxPDULength
+	}
+	buf := make([]byte, fragmentSize)
+	n, err := io.ReadFull(r, buf)
+	for {
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		// read ahead to know if this is the last fragment
+		next := make([]byte, fragmentSize)
+		var m int
+		var nextErr error
+		if err == nil {
+			m, nextErr = io.ReadFull(r, next)
+		}
+		last := err != nil || m == 0
+		control := byte(0)
+		if command {
+			control |= 1
+		}
+		if last {
+			control |= 2
+		}
+		item := make([]byte, 6, 6+n)
+		binary.BigEndian.PutUint32(item, uint32(n+2))
+		item[4] = contextID
+		item[5] = control
+		if err := writePDU(a.conn, pduDataTF, append(item, buf[:n]...)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf, n, err = next, m, nextErr
+	}
+}
+
+// sendCommand sends a command set, the data set follows with sendPDV
+func (a *association) sendCommand(contextID byte, c dimseCommand) error {
+	return a.sendPDV(contextID, true, bytes.NewReader(c.encode()))
+}
+
+// readCommand returns the next command set received on the association
+func (a *association) readCommand() (dimseCommand, error) {
+	var command []byte
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(associationTimeout))
+		pduType, data, err := readPDU(a.reader)
+		if err != nil {
+			return nil, err
+		}
+		switch pduType {
+		case pduDataTF:
+		case pduAbort:
+			return nil, fmt.Errorf("association aborted by %s", a.calledAE)
+		default:
+			return nil, fmt.Errorf("unexpected PDU type %d", pduType)
+		}
+		pdvs, err := parsePDVs(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pdvs {
+			if !p.command {
+				continue // no data sets expected for the responses of C-ECHO and C-STORE
+			}
+			command = append(command, p.data...)
+			if p.last {
+				return decodeCommand(command)
+			}
+		}
+	}
+}
+
+// part10Header returns the preamble and the file meta information (explicit VR little endian) of a DICOM file
+func part10Header(sopClassUID, sopInstanceUID, transferSyntaxUID string) []byte {
+	var meta bytes.Buffer
+	encodeElement(&meta, dirElement{tag.FileMetaInformationVersion, "OB", []byte{0, 1}})
+	encodeElement(&meta, stringElement(tag.MediaStorageSOPClassUID, "UI", sopClassUID))
+	encodeElement(&meta, stringElement(tag.MediaStorageSOPInstanceUID, "UI", sopInstanceUID))
+	encodeElement(&meta, stringElement(tag.TransferSyntaxUID, "UI", transferSyntaxUID))
+	encodeElement(&meta, stringElement(tag.ImplementationClassUID, "UI", sdcmImplementationClassUID))
+	encodeElement(&meta, stringElement(tag.ImplementationVersionName, "SH", sdcmImplementationVersionName))
+	var header bytes.Buffer
+	header.Write(make([]byte, 128))
+	header.WriteString("DICM")
+	encodeElement(&header, dirElement{tag.FileMetaInformationGroupLength, "UL", ulValue(uint32(meta.Len()))})
+	header.Write(meta.Bytes())
+	return header.Bytes()
+}
+
+// logf prints messages of the network services if requested
+func (e *engine) logf(format string, a ...interface{}) {
+	if e.verboseFlag || e.debugFlag {
+		fmt.Fprintf(os.Stderr, format, a...)
+	}
+}
@@ -0,0 +1,63 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Output folders are created once and remembered. Files of the same series
+// share their folders, so after the first file no Stat or Mkdir calls are
+// needed (these are slow on network file systems). Workers that need the same
+// folder wait for the worker that creates it. A folder that cannot be created
+// is reported for each file, failures are not remembered so later files try
+// again.
+
+// dirState is a folder below the output folder
+type dirState struct {
+	mutex   sync.Mutex
+	created bool
+}
+
+// makeDir creates a folder and its parents if they do not exist yet
+func (e *engine) makeDir(path string) error {
+	path = filepath.Clean(path)
+	v, _ := e.createdDirs.LoadOrStore(path, &dirState{})
+	d := v.(*dirState)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.created {
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := e.makeDir(parent); err != nil {
+			return err
+		}
+	}
+	err := os.Mkdir(path, 0755)
+	if err != nil {
+		// another program might have created it
+		if info, err2 := os.Stat(path); err2 != nil || !info.IsDir() {
+			return fmt.Errorf("could not create folder %s (%s)", path, err)
+		}
+	}
+	d.created = true
+	return nil
+}
+
+// forgetDir removes a folder and the folders below it from the cache, e.g. after it was
+// removed while sdcm serve or -watch are running
+func (e *engine) forgetDir(path string) {
+	path = filepath.Clean(path)
+	e.createdDirs.Range(func(key, value any) bool {
+		if p := key.(string); p == path || len(p) > len(path) && p[:len(path)+1] == path+string(os.PathSeparator) {
+			e.createdDirs.Delete(key)
+		}
+		return true
+	})
+}
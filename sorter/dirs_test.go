@@ -0,0 +1,140 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMakeDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, root string)
+		path    string
+		wantErr bool
+	}{
+		{name: "new folder with parents", path: "a/b/c"},
+		{name: "existing folder", setup: func(t *testing.T, root string) { os.MkdirAll(filepath.Join(root, "a/b"), 0755) }, path: "a/b"},
+		{name: "not clean", path: "a/./b/../c/"},
+		{
+			name:    "file in the way",
+			setup:   func(t *testing.T, root string) { os.WriteFile(filepath.Join(root, "a"), nil, 0644) },
+			path:    "a/b",
+			wantErr: true,
+		},
+		{
+			name:    "file with the name of the folder",
+			setup:   func(t *testing.T, root string) { os.WriteFile(filepath.Join(root, "a"), nil, 0644) },
+			path:    "a",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.setup != nil {
+				tt.setup(t, root)
+			}
+			e := newTestEngine()
+			path := filepath.Join(root, tt.path)
+			err := e.makeDir(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("makeDir error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if info, err := os.Stat(path); err != nil || !info.IsDir() {
+				t.Errorf("%s is not a folder (%v)", path, err)
+			}
+		})
+	}
+}
+
+func TestMakeDirCache(t *testing.T) {
+	root := t.TempDir()
+	e := newTestEngine()
+	path := filepath.Join(root, "a", "b")
+
+	// failures are not remembered
+	blocker := filepath.Join(root, "a")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.makeDir(path); err == nil {
+		t.Fatal("makeDir succeeded below a file")
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.makeDir(path); err != nil {
+		t.Fatalf("makeDir failed after the file was removed (%s)", err)
+	}
+
+	// created folders are remembered until they are forgotten
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.makeDir(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("makeDir did not use the cache for %s", path)
+	}
+	e.forgetDir(blocker)
+	if err := e.makeDir(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("%s was not created again after forgetDir (%v)", path, err)
+	}
+}
+
+func TestForgetDir(t *testing.T) {
+	e := newTestEngine()
+	root := t.TempDir()
+	for _, p := range []string{"a/b", "a/bc", "ab"} {
+		if err := e.makeDir(filepath.Join(root, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.forgetDir(filepath.Join(root, "a", "b"))
+	tests := map[string]bool{"a": true, "a/b": false, "a/bc": true, "ab": true}
+	for p, want := range tests {
+		if _, got := e.createdDirs.Load(filepath.Join(root, p)); got != want {
+			t.Errorf("%s remembered %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestMakeDirConcurrent(t *testing.T) {
+	root := t.TempDir()
+	e := newTestEngine()
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- e.makeDir(filepath.Join(root, "study", "series", fmt.Sprint(i%4)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if info, err := os.Stat(filepath.Join(root, "study", "series", fmt.Sprint(i))); err != nil || !info.IsDir() {
+			t.Errorf("folder %d was not created (%v)", i, err)
+		}
+	}
+}
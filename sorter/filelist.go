@@ -0,0 +1,103 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// With '-files-from <list>' (or '-files-from -' for stdin) the files in the
+// list are sorted, e.g. 'find /data -newer x -print0 | sdcm -files-from - out'.
+// Entries are separated by newlines or NUL characters. Files given as
+// positional arguments are sorted the same way, folders are walked as before.
+
+// splitFileList is a bufio.SplitFunc for newline or NUL separated lists, after
+// the first NUL only NUL separates entries (names can contain newlines)
+func splitFileList() bufio.SplitFunc {
+	nulSeparated := false
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		i := bytes.IndexByte(data, 0)
+		if !nulSeparated {
+			if n := bytes.IndexByte(data, '\n'); n >= 0 && (i < 0 || n < i) {
+				return n + 1, bytes.TrimSuffix(data[:n], []byte{'\r'}), nil
+			}
+		}
+		if i >= 0 {
+			nulSeparated = true
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return len(data), bytes.TrimSuffix(data, []byte{'\r'}), nil
+		}
+		return 0, nil, nil // request more data
+	}
+}
+
+// sortFileList sorts files and the entries of -files-from with num_workers workers
+func (e *engine) sortFileList(files []string) error {
+	var r io.Reader = os.Stdin
+	if e.filesFromFlag != "" && e.filesFromFlag != "-" {
+		f, err := os.Open(e.filesFromFlag)
+		if err != nil {
+			return fmt.Errorf("could not read the file list %s (%s)", e.filesFromFlag, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	paths := make(chan string, e.num_workers)
+	var wg sync.WaitGroup
+	for i := 0; i < e.num_workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				info, err := os.Stat(path)
+				if err != nil {
+					e.skipFile(path, err)
+					continue
+				}
+				if info.IsDir() {
+					e.warn("%s is a folder, folders in -files-from are skipped", path)
+					continue
+				}
+				e.walkFunc(path, info, nil)
+			}
+		}()
+	}
+	e.inputDataPath = "" // entries are absolute paths
+	for _, f := range files {
+		paths <- f
+	}
+	if e.filesFromFlag != "" {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		scanner.Split(splitFileList())
+		for scanner.Scan() {
+			entry := scanner.Text()
+			if entry == "" {
+				continue
+			}
+			if abs, err := filepath.Abs(entry); err == nil {
+				entry = abs
+			}
+			paths <- entry
+		}
+		if err := scanner.Err(); err != nil {
+			e.warn("could not read the file list %s (%s)", e.filesFromFlag, err)
+		}
+	}
+	close(paths)
+	wg.Wait()
+	return nil
+}
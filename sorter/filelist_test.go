@@ -0,0 +1,96 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSplitFileList(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{name: "newlines", in: "a.dcm\nb.dcm\n", want: []string{"a.dcm", "b.dcm"}},
+		{name: "no newline at the end", in: "a.dcm\nb.dcm", want: []string{"a.dcm", "b.dcm"}},
+		{name: "carriage returns", in: "a.dcm\r\nb.dcm\r\n", want: []string{"a.dcm", "b.dcm"}},
+		{name: "empty lines are entries", in: "a.dcm\n\nb.dcm\n", want: []string{"a.dcm", "", "b.dcm"}},
+		{name: "NUL separated", in: "a.dcm\x00b.dcm\x00", want: []string{"a.dcm", "b.dcm"}},
+		{name: "newlines in NUL separated names", in: "a\n1.dcm\x00b\n2.dcm\x00", want: []string{"a", "1.dcm", "b\n2.dcm"}},
+		{name: "NUL in the first entry", in: "a.dcm\x00b\n.dcm\x00c.dcm", want: []string{"a.dcm", "b\n.dcm", "c.dcm"}},
+		{name: "empty", in: "", want: nil},
+	}
+	for _, tt := range tests {
+		// a one byte reader makes the split function ask for more data
+		for _, r := range []io.Reader{strings.NewReader(tt.in), iotest.OneByteReader(strings.NewReader(tt.in))} {
+			scanner := bufio.NewScanner(r)
+			scanner.Split(splitFileList())
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Errorf("%s: %s", tt.name, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: entries %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestFilesFrom(t *testing.T) {
+	in := t.TempDir()
+	var entries []string
+	for n := 1; n <= 3; n++ {
+		// the separator is detected at the first newline or NUL, later names can contain newlines
+		dir := "dir with\nnewline"
+		if n == 1 {
+			dir = "dir"
+		}
+		path := filepath.Join(in, dir, string(rune('a'+n-1))+".dcm")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, path, newTestInstance(t, "1.2.3.1", n))
+		entries = append(entries, path)
+	}
+	// the positional file is sorted together with the list
+	positional := filepath.Join(in, "positional.dcm")
+	writeTestFile(t, positional, newTestInstance(t, "1.2.3.1", 4))
+	notListed := filepath.Join(in, "not-listed.dcm")
+	writeTestFile(t, notListed, newTestInstance(t, "1.2.3.1", 5))
+
+	// a missing file is skipped, a folder is ignored
+	entries = append(entries, filepath.Join(in, "missing.dcm"), in)
+	list := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(list, []byte(strings.Join(entries, "\x00")+"\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.FilesFrom, opts.Quiet, opts.Sync, opts.Brave = []string{positional}, out, list, true, "none", true
+	opts.Folder = "{InstanceNumber}.dcm"
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 4 || result.Skipped != 1 {
+		t.Errorf("%d files sorted and %d skipped, want 4 and 1", result.Files, result.Skipped)
+	}
+	if got, want := listFiles(t, out), []string{"1.dcm", "2.dcm", "3.dcm", "4.dcm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sorted files %v, want %v", got, want)
+	}
+}
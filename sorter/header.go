@@ -0,0 +1,90 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Elements of a data set are ordered by tag. The header reader stops after the
+// first element past the last tag used by the folder path template, the filters
+// and the book keeping. Only this prefix of the file is read. Options that look
+// at more of the header (-order-slices, -dicomdir, reports, {subseries}) and
+// -full-header read the whole header.
+
+// headerState tells the header reader where it can stop
+type headerState struct {
+	fullHeaderFlag bool
+
+	// the header reader stops after this tag if headerEarlyExit is set
+	headerStopTag   tag.Tag
+	headerEarlyExit bool
+}
+
+// initHeaderReader computes the last tag that has to be read
+func (e *engine) initHeaderReader() {
+	if e.fullHeaderFlag || e.orderSlicesFlag || e.dicomdirFlag || e.seriesReportFlag != "" || e.consistencyReportFlag != "" || strings.Contains(e.outputFolderFlag, "{subseries}") {
+		return
+	}
+	needed := []tag.Tag{tag.SOPClassUID, tag.StudyInstanceUID, tag.SeriesInstanceUID, tag.NumberOfFrames}
+	for t := range e.dicomTags {
+		needed = append(needed, t)
+	}
+	for _, t := range needed {
+		if tagAfter(t, e.headerStopTag) {
+			e.headerStopTag = t
+		}
+	}
+	e.headerEarlyExit = true
+}
+
+// tagAfter returns true if tag a comes after tag b in a data set
+func tagAfter(a, b tag.Tag) bool {
+	return a.Group > b.Group || (a.Group == b.Group && a.Element > b.Element)
+}
+
+// readHeader parses a file up to the first element after headerStopTag
+func (e *engine) readHeader(in_file string) (dicom.Dataset, error) {
+	f, err := os.Open(in_file)
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	p, err := dicom.NewParser(f, info.Size(), nil, dicom.SkipPixelData())
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	dataset := dicom.Dataset{Elements: append([]*dicom.Element{}, p.GetMetadata().Elements...)}
+	toEnd := false
+	for {
+		elem, err := p.Next()
+		if err != nil {
+			if errors.Is(err, dicom.ErrorEndOfDICOM) || errors.Is(err, io.EOF) {
+				break
+			}
+			return dataset, err
+		}
+		dataset.Elements = append(dataset.Elements, elem)
+		if !toEnd && tagAfter(elem.Tag, e.headerStopTag) {
+			// enhanced multi-frame objects store values in the functional groups at the end of the header
+			if getInt(&dataset, tag.NumberOfFrames, 1) > 1 {
+				toEnd = true
+				continue
+			}
+			break
+		}
+	}
+	return dataset, nil
+}
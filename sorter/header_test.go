@@ -0,0 +1,164 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// newLargeHeaderInstance returns an instance with a private group of n blocks of 4 kB and 512x512 16 bit pixel data
+// after the tags of the default template
+func newLargeHeaderInstance(t testing.TB, frames int, n int) dicom.Dataset {
+	t.Helper()
+	elems := []*dicom.Element{
+		newTestElement(t, tag.Rows, []int{512}),
+		newTestElement(t, tag.Columns, []int{512}),
+		newTestElement(t, tag.BitsAllocated, []int{16}),
+		newTestElement(t, tag.NumberOfFrames, []string{fmt.Sprint(frames)}),
+		newRawElement(t, tag.Tag{Group: 0x0029, Element: 0x0010}, "LO", []string{"SDCM TEST"}),
+		pixelValue(t, make([]byte, 512*512*2*frames), "OW"),
+	}
+	for i := 0; i < n; i++ {
+		elems = append(elems, newRawElement(t, tag.Tag{Group: 0x0029, Element: 0x1000 + uint16(i)}, "OB", make([]byte, 4096)))
+	}
+	return newTestInstance(t, "1.2.3.1", 1, elems...)
+}
+
+func TestReadHeader(t *testing.T) {
+	dir := t.TempDir()
+	single := filepath.Join(dir, "single.dcm")
+	writeTestFile(t, single, newLargeHeaderInstance(t, 1, 4))
+	multi := filepath.Join(dir, "multi.dcm")
+	writeTestFile(t, multi, newLargeHeaderInstance(t, 2, 4))
+
+	privateCreator := tag.Tag{Group: 0x0029, Element: 0x0010}
+	lastPrivate := tag.Tag{Group: 0x0029, Element: 0x1003}
+	tests := []struct {
+		name        string
+		file        string
+		tags        []tag.Tag
+		full        bool
+		wantStop    tag.Tag
+		wantExit    bool
+		wantRead    []tag.Tag
+		wantNotRead []tag.Tag
+	}{
+		{
+			// the first element after NumberOfFrames ends the header
+			name:        "book keeping tags",
+			file:        single,
+			tags:        []tag.Tag{tag.PatientID},
+			wantStop:    tag.NumberOfFrames,
+			wantExit:    true,
+			wantRead:    []tag.Tag{tag.TransferSyntaxUID, tag.PatientID, tag.SeriesInstanceUID, tag.NumberOfFrames, tag.Rows},
+			wantNotRead: []tag.Tag{tag.Columns, privateCreator, lastPrivate, tag.PixelData},
+		},
+		{
+			name:        "template tag in the private group",
+			file:        single,
+			tags:        []tag.Tag{{Group: 0x0029, Element: 0x1001}},
+			wantStop:    tag.Tag{Group: 0x0029, Element: 0x1001},
+			wantExit:    true,
+			wantRead:    []tag.Tag{privateCreator, {Group: 0x0029, Element: 0x1001}, {Group: 0x0029, Element: 0x1002}},
+			wantNotRead: []tag.Tag{lastPrivate, tag.PixelData},
+		},
+		{
+			// functional groups can be at the end of the header of a multi-frame object
+			name:     "multi-frame",
+			file:     multi,
+			tags:     []tag.Tag{tag.PatientID},
+			wantStop: tag.NumberOfFrames,
+			wantExit: true,
+			wantRead: []tag.Tag{privateCreator, lastPrivate},
+		},
+		{
+			name:     "full header",
+			file:     single,
+			tags:     []tag.Tag{tag.PatientID},
+			full:     true,
+			wantRead: []tag.Tag{privateCreator, lastPrivate},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine()
+			e.dicomTags = make(map[tag.Tag]string, 0)
+			for _, tg := range tt.tags {
+				e.dicomTags[tg] = ""
+			}
+			e.fullHeaderFlag = tt.full
+			e.initHeaderReader()
+			if e.headerEarlyExit != tt.wantExit || (tt.wantExit && e.headerStopTag != tt.wantStop) {
+				t.Fatalf("early exit %v after %s, want %v after %s", e.headerEarlyExit, e.headerStopTag, tt.wantExit, tt.wantStop)
+			}
+			ds, err := e.readInputFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tg := range tt.wantRead {
+				if _, err := ds.FindElementByTag(tg); err != nil {
+					t.Errorf("%s was not read", tg)
+				}
+			}
+			for _, tg := range tt.wantNotRead {
+				if _, err := ds.FindElementByTag(tg); err == nil {
+					t.Errorf("%s was read", tg)
+				}
+			}
+		})
+	}
+}
+
+func TestTagAfter(t *testing.T) {
+	tests := []struct {
+		a, b tag.Tag
+		want bool
+	}{
+		{a: tag.PatientID, b: tag.Modality, want: true},
+		{a: tag.Modality, b: tag.PatientID},
+		{a: tag.SeriesInstanceUID, b: tag.StudyInstanceUID, want: true},
+		{a: tag.PatientID, b: tag.PatientID},
+		{a: tag.Tag{}, b: tag.Tag{}},
+	}
+	for _, tt := range tests {
+		if got := tagAfter(tt.a, tt.b); got != tt.want {
+			t.Errorf("tagAfter(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkReadHeader compares the header reader with parsing the whole header
+// (dicom.ParseFile skips the pixel data in both cases) for a file with a
+// 256 kB private group after the tags of the default template
+func BenchmarkReadHeader(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "large.dcm")
+	writeTestFile(b, path, newLargeHeaderInstance(b, 1, 64))
+	e := newTestEngine()
+	e.dicomTags = make(map[tag.Tag]string, 0)
+	for _, tg := range []tag.Tag{tag.PatientID, tag.PatientName, tag.StudyDate, tag.Modality, tag.SeriesNumber, tag.SeriesDescription} {
+		e.dicomTags[tg] = ""
+	}
+	e.initHeaderReader()
+
+	b.Run("early exit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := e.readHeader(path); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("full header", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := dicom.ParseFile(path, nil, dicom.SkipPixelData()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
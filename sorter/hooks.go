@@ -0,0 +1,274 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Hooks are shell commands that run when a series or study is complete, e.g.
+//
+//	-on-series-complete "dcm2niix -o /data/nifti {SeriesFolder}"
+//
+// Placeholders are tag keywords with the values of the first file of the series ({PatientID},
+// {Modality}, ...) and {SeriesFolder}, {StudyFolder}, {NumberOfFiles} ({NumberOfSeries} for
+// studies). Tags used by a hook are read from each file like the tags of the template.
+// The same values are available as environment variables with the prefix SDCM_
+// (e.g. SDCM_SeriesFolder). With -watch a series is complete after -watch-idle
+// seconds without new files, otherwise after all files have been sorted. A study
+// is complete if none of its series are open, its hook runs after the series hooks.
+
+// hookState holds the running hooks and the activity of the studies
+type hookState struct {
+	onSeriesCompleteFlag string
+	onStudyCompleteFlag  string
+	hookJobsFlag         int
+
+	// limits the number of hook commands that run at the same time
+	hookSlots    chan bool
+	hooksRunning sync.WaitGroup
+
+	// number of hook commands that ran and failed, failed commands with their exit code
+	counterHooks       int32
+	counterHooksFailed int32
+	hookFailures       []string
+	hookFailuresMutex  sync.Mutex
+
+	completeStudies      map[string]*studyActivity
+	completeStudiesMutex sync.Mutex
+}
+
+// studyActivity collects the complete series of a study
+type studyActivity struct {
+	folders   []string
+	values    map[string]string
+	instances int
+	hooks     sync.WaitGroup // series hooks of this study
+}
+
+// hookPlaceholderRegex matches {Keyword} placeholders, ${VAR} is left to the shell
+var hookPlaceholderRegex = regexp.MustCompile(`\$?{[A-Za-z][A-Za-z0-9]*}`)
+
+// placeholders of the hooks that are not tags
+var (
+	seriesHookValues = []string{"SeriesFolder", "StudyFolder", "NumberOfFiles"}
+	studyHookValues  = []string{"StudyFolder", "NumberOfFiles", "NumberOfSeries"}
+)
+
+// initHooks checks the hook options, the tags used as placeholders are read from each file
+func (e *engine) initHooks() error {
+	if e.hookJobsFlag < 1 {
+		e.hookJobsFlag = 1
+	}
+	e.hookSlots = make(chan bool, e.hookJobsFlag)
+	hooks := []struct {
+		option  string
+		command string
+		values  []string
+	}{
+		{"-on-series-complete", e.onSeriesCompleteFlag, seriesHookValues},
+		{"-on-study-complete", e.onStudyCompleteFlag, studyHookValues},
+	}
+	for _, h := range hooks {
+	placeholders:
+		for _, m := range hookPlaceholderRegex.FindAllString(h.command, -1) {
+			if strings.HasPrefix(m, "$") {
+				continue
+			}
+			name := m[1 : len(m)-1]
+			for _, v := range h.values {
+				if name == v {
+					continue placeholders
+				}
+			}
+			t, err := tag.FindByName(name)
+			if err != nil {
+				return fmt.Errorf("unknown placeholder %s in %s, use a tag keyword or {%s}", m, h.option, strings.Join(h.values, "}, {"))
+			}
+			if _, ok := e.dicomTags[t.Tag]; !ok {
+				e.dicomTags[t.Tag] = m
+			}
+		}
+	}
+	return nil
+}
+
+// trackSeries returns true if the series of sorted files are needed for -watch or the hooks
+func (e *engine) trackSeries() bool {
+	return e.watchFlag || e.onSeriesCompleteFlag != "" || e.onStudyCompleteFlag != ""
+}
+
+// shellQuote quotes a placeholder value for the shell that runs the hook
+func shellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return "\"" + s + "\""
+	}
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
+
+// commonFolder returns the longest common parent folder of the series folders of a study
+func commonFolder(folders []string) string {
+	if len(folders) == 0 {
+		return ""
+	}
+	common := filepath.Dir(folders[0])
+	for _, f := range folders[1:] {
+		for common != filepath.Dir(common) && !strings.HasPrefix(f, common+string(os.PathSeparator)) {
+			common = filepath.Dir(common)
+		}
+	}
+	return common
+}
+
+// expandHook replaces all placeholders of a hook command in a single pass, a value that contains
+// a placeholder is not expanded again (it would end up outside of its quotes)
+func expandHook(command string, values map[string]string) string {
+	return hookPlaceholderRegex.ReplaceAllStringFunc(command, func(m string) string {
+		if strings.HasPrefix(m, "$") {
+			return m
+		}
+		if v, ok := values[m[1:len(m)-1]]; ok {
+			return shellQuote(v)
+		}
+		return m
+	})
+}
+
+// runHook runs a hook command with the placeholder values, the exit code is recorded for the summary
+func (e *engine) runHook(command string, values map[string]string) {
+	expanded := expandHook(command, values)
+	env := os.Environ()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("SDCM_%s=%s", k, values[k]))
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", expanded)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", expanded)
+	}
+	cmd.Env = env
+
+	e.hookSlots <- true
+	output, err := cmd.CombinedOutput()
+	<-e.hookSlots
+	atomic.AddInt32(&e.counterHooks, 1)
+	if e.debugFlag || e.verboseFlag {
+		fmt.Fprintf(os.Stderr, "hook: %s\n%s", expanded, output)
+	}
+	if err != nil {
+		atomic.AddInt32(&e.counterHooksFailed, 1)
+		var exitErr *exec.ExitError
+		reason := err.Error()
+		if errors.As(err, &exitErr) {
+			reason = fmt.Sprintf("exit code %d", exitErr.ExitCode())
+		}
+		e.hookFailuresMutex.Lock()
+		e.hookFailures = append(e.hookFailures, fmt.Sprintf("%s (%s)", expanded, reason))
+		e.hookFailuresMutex.Unlock()
+	}
+}
+
+// seriesComplete reports complete series and starts their hooks, the hook of a study starts once
+// none of its series is open
+func (e *engine) seriesComplete(done []*seriesActivity) {
+	var studies []string
+	seen := make(map[string]bool, 0)
+	for _, s := range done {
+		atomic.AddInt32(&e.counterSeriesComplete, 1)
+		if e.watchFlag && !e.quietFlag {
+			fmt_local.Printf("\033[2Kseries complete: %s (%d file%s)\n\n", s.folder, s.instances, map[bool]string{true: "", false: "s"}[s.instances == 1])
+		}
+
+		e.writeFolderManifest(s.folder)
+		e.syncFolder(s.folder)
+
+		e.completeStudiesMutex.Lock()
+		study, ok := e.completeStudies[s.studyInstanceUID]
+		if !ok {
+			study = &studyActivity{values: s.values}
+			e.completeStudies[s.studyInstanceUID] = study
+		}
+		if !seen[s.studyInstanceUID] {
+			seen[s.studyInstanceUID] = true
+			studies = append(studies, s.studyInstanceUID)
+		}
+		study.folders = append(study.folders, s.folder)
+		study.instances += s.instances
+		e.completeStudiesMutex.Unlock()
+
+		if e.onSeriesCompleteFlag != "" {
+			values := make(map[string]string, len(s.values)+5)
+			for k, v := range s.values {
+				values[k] = v
+			}
+			values["SeriesFolder"] = s.folder
+			values["StudyFolder"] = filepath.Dir(s.folder)
+			values["SeriesInstanceUID"] = s.seriesInstanceUID
+			values["StudyInstanceUID"] = s.studyInstanceUID
+			values["NumberOfFiles"] = fmt.Sprintf("%d", s.instances)
+			study.hooks.Add(1)
+			e.hooksRunning.Add(1)
+			go func() {
+				defer e.hooksRunning.Done()
+				defer study.hooks.Done()
+				e.runHook(e.onSeriesCompleteFlag, values)
+			}()
+		}
+	}
+
+	for _, studyInstanceUID := range studies {
+		// is another series of this study still open?
+		open := false
+		e.activeSeriesMutex.Lock()
+		for _, other := range e.activeSeries {
+			if other.studyInstanceUID == studyInstanceUID {
+				open = true
+			}
+		}
+		e.activeSeriesMutex.Unlock()
+		if open {
+			continue
+		}
+
+		e.completeStudiesMutex.Lock()
+		study, ok := e.completeStudies[studyInstanceUID]
+		delete(e.completeStudies, studyInstanceUID)
+		e.completeStudiesMutex.Unlock()
+		if ok && e.onStudyCompleteFlag != "" {
+			values := make(map[string]string, len(study.values)+4)
+			for k, v := range study.values {
+				values[k] = v
+			}
+			values["StudyFolder"] = commonFolder(study.folders)
+			values["StudyInstanceUID"] = studyInstanceUID
+			values["NumberOfFiles"] = fmt.Sprintf("%d", study.instances)
+			values["NumberOfSeries"] = fmt.Sprintf("%d", len(study.folders))
+			e.hooksRunning.Add(1)
+			go func() {
+				defer e.hooksRunning.Done()
+				study.hooks.Wait()
+				e.runHook(e.onStudyCompleteFlag, values)
+			}()
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestExpandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("values are quoted for /bin/sh")
+	}
+	values := map[string]string{"SeriesFolder": "/out/a b", "PatientName": "O'Brien", "Modality": "CT"}
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "convert {SeriesFolder}", want: "convert '/out/a b'"},
+		{command: "echo {PatientName} {Modality}{Modality}", want: `echo 'O'\''Brien' 'CT''CT'`},
+		{command: "echo ${SeriesFolder} $SDCM_SeriesFolder", want: "echo ${SeriesFolder} $SDCM_SeriesFolder"},
+		{command: "awk '{print $1}' {StudyFolder}", want: "awk '{print $1}' {StudyFolder}"},
+		{command: "no placeholders", want: "no placeholders"},
+	}
+	for _, tt := range tests {
+		if got := expandHook(tt.command, values); got != tt.want {
+			t.Errorf("expandHook(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+
+	// a value is never expanded again, whatever placeholders it contains
+	hostile := map[string]string{"PatientName": "{SeriesFolder}'; touch pwned; '", "SeriesFolder": "x"}
+	got := expandHook("echo {PatientName} {SeriesFolder}", hostile)
+	out, err := exec.Command("/bin/sh", "-c", got).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hostile["PatientName"] + " x\n"; string(out) != want {
+		t.Errorf("%q prints %q, want %q", got, out, want)
+	}
+}
+
+func TestInitHooks(t *testing.T) {
+	tests := []struct {
+		series, study string
+		template      string
+		wantTags      map[tag.Tag]string
+		wantErr       bool
+	}{
+		{series: "convert {SeriesFolder} {NumberOfFiles}", study: "qc {StudyFolder} {NumberOfSeries}", wantTags: map[tag.Tag]string{}},
+		{series: "echo {Modality} {SeriesInstanceUID}", wantTags: map[tag.Tag]string{tag.Modality: "{Modality}", tag.SeriesInstanceUID: "{SeriesInstanceUID}"}},
+		// the entry of the template (a filter) is kept
+		{series: "echo {Modality}", template: "{Modality==MR}", wantTags: map[tag.Tag]string{tag.Modality: "{Modality==MR}"}},
+		{study: "echo ${HOME} {PatientBirthDate}", wantTags: map[tag.Tag]string{tag.PatientBirthDate: "{PatientBirthDate}"}},
+		{series: "echo {Modalty}", wantErr: true},
+		{series: "echo {NumberOfSeries}", wantErr: true},
+		{study: "echo {SeriesFolder}", wantErr: true},
+	}
+	for _, tt := range tests {
+		e := newTestEngine()
+		e.onSeriesCompleteFlag, e.onStudyCompleteFlag, e.hookJobsFlag = tt.series, tt.study, 0
+		if tt.template != "" {
+			e.dicomTags[tag.Modality] = tt.template
+		}
+		err := e.initHooks()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("initHooks(%q, %q) error = %v, want error %v", tt.series, tt.study, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(e.dicomTags, tt.wantTags) {
+			t.Errorf("initHooks(%q, %q) tags %v, want %v", tt.series, tt.study, e.dicomTags, tt.wantTags)
+		}
+		if cap(e.hookSlots) != 1 {
+			t.Errorf("%d hook slots, want 1", cap(e.hookSlots))
+		}
+	}
+}
+
+// writeHookInput writes two series of one study, the PatientName can be chosen
+func writeHookInput(t *testing.T, patientName string) string {
+	t.Helper()
+	in := t.TempDir()
+	for _, series := range []string{"1.2.3.1", "1.2.3.2"} {
+		for n := 1; n <= 2; n++ {
+			ds := newTestInstance(t, series, n)
+			for _, e := range ds.Elements {
+				if e.Tag == tag.PatientName {
+					e.Value = newTestElement(t, tag.PatientName, []string{patientName}).Value
+				}
+			}
+			writeTestFile(t, filepath.Join(in, fmt.Sprintf("%s.%d.dcm", series, n)), ds)
+		}
+	}
+	return in
+}
+
+// readLines returns the sorted lines of a file written by the hooks
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestHookRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hooks use /bin/sh")
+	}
+	// the PatientName is a value of a tag that is only used by the hook
+	hostile := "{SeriesFolder}'; touch pwned; '$(touch pwned)"
+	in := writeHookInput(t, hostile)
+	hookDir := t.TempDir()
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.Brave = []string{in}, out, true, "none", true
+	opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+	opts.OnSeriesComplete = fmt.Sprintf("cd %s && printf '%%s|%%s|%%s|%%s\\n' {PatientName} {Modality} {NumberOfFiles} \"$SDCM_SeriesInstanceUID\" >> series.txt", shellQuote(hookDir))
+	opts.OnStudyComplete = fmt.Sprintf("cd %s && printf '%%s|%%s|%%s\\n' {StudyInstanceUID} {NumberOfSeries} {StudyFolder} >> study.txt", shellQuote(hookDir))
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hooks != 3 || result.HooksFailed != 0 {
+		t.Errorf("%d hooks and %d failed, want 3 and 0 (%v)", result.Hooks, result.HooksFailed, result.HookFailures)
+	}
+	if _, err := os.Stat(filepath.Join(hookDir, "pwned")); err == nil {
+		t.Error("the PatientName was run by the shell")
+	}
+	want := []string{hostile + "|CT|2|1.2.3.1", hostile + "|CT|2|1.2.3.2"}
+	if got := readLines(t, filepath.Join(hookDir, "series.txt")); !reflect.DeepEqual(got, want) {
+		t.Errorf("series hooks wrote\n%q\nwant\n%q", got, want)
+	}
+	want = []string{"1.2.826.0.1.3680043.2.1125.1|2|" + out}
+	if got := readLines(t, filepath.Join(hookDir, "study.txt")); !reflect.DeepEqual(got, want) {
+		t.Errorf("study hook wrote %q, want %q", got, want)
+	}
+
+	opts.OnSeriesComplete = "echo {Modalty}"
+	if _, err := New(opts).Run(context.Background()); err == nil || !strings.Contains(err.Error(), "{Modalty}") {
+		t.Errorf("unknown placeholder: error %v", err)
+	}
+}
+
+func TestHookFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hooks use /bin/sh")
+	}
+	in := writeHookInput(t, "Test^Patient")
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync = []string{in}, t.TempDir(), true, "none"
+	opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+	opts.OnSeriesComplete = "test {SeriesInstanceUID} = 1.2.3.1 || exit 3"
+	opts.OnStudyComplete = "kill -9 $$"
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hooks != 3 || result.HooksFailed != 2 {
+		t.Errorf("%d hooks and %d failed, want 3 and 2", result.Hooks, result.HooksFailed)
+	}
+	want := []string{"kill -9 $$ (exit code -1)", "test '1.2.3.2' = 1.2.3.1 || exit 3 (exit code 3)"}
+	if !reflect.DeepEqual(result.HookFailures, want) {
+		t.Errorf("failures %q, want %q", result.HookFailures, want)
+	}
+}
+
+func TestHookJobs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hooks use /bin/sh")
+	}
+	in := t.TempDir()
+	for s := 1; s <= 6; s++ {
+		series := fmt.Sprintf("1.2.3.%d", s)
+		writeTestFile(t, filepath.Join(in, series+".dcm"), newTestInstance(t, series, 1))
+	}
+	for _, jobs := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%d jobs", jobs), func(t *testing.T) {
+			log := filepath.Join(t.TempDir(), "log")
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.Quiet, opts.Sync = []string{in}, t.TempDir(), true, "none"
+			opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+			opts.OnSeriesComplete = fmt.Sprintf("echo start >> %[1]s; sleep 0.1; echo end >> %[1]s", shellQuote(log))
+			opts.HookJobs = jobs
+			result, err := New(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Hooks != 6 {
+				t.Errorf("%d hooks, want 6", result.Hooks)
+			}
+			data, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			running, most := 0, 0
+			for _, line := range strings.Fields(string(data)) {
+				if line == "start" {
+					running++
+				} else {
+					running--
+				}
+				if running > most {
+					most = running
+				}
+			}
+			if most > jobs {
+				t.Errorf("%d hooks ran at the same time, want at most %d", most, jobs)
+			}
+		})
+	}
+}
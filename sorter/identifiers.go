@@ -0,0 +1,191 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// A broken pseudonymization often shows up as identifiers that do not fit into
+// the patient/study/series hierarchy. With -consistency-report the identifiers
+// of all sorted files are collected and checked after sorting:
+//   - a series that appears in more than one study
+//   - a study that belongs to more than one PatientID
+//   - a PatientID with different PatientNames or PatientBirthDates
+//   - a series with more than one modality
+//   - a CT, MR or PET series with a single (single-frame) image
+
+// identifierState collects the identifiers for -consistency-report
+type identifierState struct {
+	consistencyReportFlag string
+
+	identifierPatientNames  map[string]valueSet
+	identifierBirthDates    map[string]valueSet
+	identifierStudyPatients map[string]valueSet
+	identifierSeriesInfo    map[string]*identifierSeries
+	identifierMutex         sync.Mutex
+
+	numConsistencyIssues int
+}
+
+// modalities that are expected to have more than one image per series
+var volumeModalities = map[string]bool{"CT": true, "MR": true, "PT": true}
+
+// set of values seen for an identifier
+type valueSet map[string]bool
+
+func (s valueSet) sorted() []string {
+	var values []string
+	for v := range s {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+type identifierSeries struct {
+	studies    valueSet
+	modalities valueSet
+	instances  int
+	multiFrame bool
+	localizer  bool
+}
+
+// ConsistencyIssue is one entry of the identifier consistency report
+type ConsistencyIssue struct {
+	Level      string   `json:"Level"` // Patient, Study or Series
+	Identifier string   `json:"Identifier"`
+	Check      string   `json:"Check"`
+	Values     []string `json:"Values"`
+}
+
+func addValue(m map[string]valueSet, key string, value string) {
+	if _, ok := m[key]; !ok {
+		m[key] = make(valueSet, 0)
+	}
+	m[key][value] = true
+}
+
+// recordIdentifiers remembers the patient, study and series identifiers of a sorted file
+func (e *engine) recordIdentifiers(ds *dicom.Dataset) {
+	value := func(t tag.Tag) string {
+		return strings.TrimSpace(elementValueString(findElement(ds, t)))
+	}
+	patientID := value(tag.PatientID)
+	studyInstanceUID := value(tag.StudyInstanceUID)
+	seriesInstanceUID := value(tag.SeriesInstanceUID)
+	imageType := strings.ToUpper(strings.Join(elementValues(findElement(ds, tag.ImageType)), "\\"))
+
+	e.identifierMutex.Lock()
+	defer e.identifierMutex.Unlock()
+	addValue(e.identifierPatientNames, patientID, value(tag.PatientName))
+	addValue(e.identifierBirthDates, patientID, value(tag.PatientBirthDate))
+	addValue(e.identifierStudyPatients, studyInstanceUID, patientID)
+	series, ok := e.identifierSeriesInfo[seriesInstanceUID]
+	if !ok {
+		series = &identifierSeries{studies: make(valueSet, 0), modalities: make(valueSet, 0)}
+		e.identifierSeriesInfo[seriesInstanceUID] = series
+	}
+	series.studies[studyInstanceUID] = true
+	series.modalities[value(tag.Modality)] = true
+	series.instances++
+	if getInt(ds, tag.NumberOfFrames, 1) > 1 {
+		series.multiFrame = true
+	}
+	if strings.Contains(imageType, "LOCALIZER") || strings.Contains(imageType, "SCOUT") {
+		series.localizer = true
+	}
+}
+
+// checkIdentifiers returns the list of problems found in the identifiers, sorted by level and identifier
+func (e *engine) checkIdentifiers() []ConsistencyIssue {
+	e.identifierMutex.Lock()
+	defer e.identifierMutex.Unlock()
+
+	var issues []ConsistencyIssue
+	for patientID, names := range e.identifierPatientNames {
+		if len(names) > 1 {
+			issues = append(issues, ConsistencyIssue{"Patient", patientID, "multiple PatientNames", names.sorted()})
+		}
+	}
+	for patientID, dates := range e.identifierBirthDates {
+		if len(dates) > 1 {
+			issues = append(issues, ConsistencyIssue{"Patient", patientID, "multiple PatientBirthDates", dates.sorted()})
+		}
+	}
+	for studyInstanceUID, patients := range e.identifierStudyPatients {
+		if len(patients) > 1 {
+			issues = append(issues, ConsistencyIssue{"Study", studyInstanceUID, "multiple PatientIDs", patients.sorted()})
+		}
+	}
+	for seriesInstanceUID, series := range e.identifierSeriesInfo {
+		if len(series.studies) > 1 {
+			issues = append(issues, ConsistencyIssue{"Series", seriesInstanceUID, "multiple StudyInstanceUIDs", series.studies.sorted()})
+		}
+		if len(series.modalities) > 1 {
+			issues = append(issues, ConsistencyIssue{"Series", seriesInstanceUID, "multiple Modalities", series.modalities.sorted()})
+		}
+		if series.instances == 1 && !series.multiFrame && !series.localizer {
+			for m := range series.modalities {
+				if volumeModalities[m] {
+					issues = append(issues, ConsistencyIssue{"Series", seriesInstanceUID, "single instance", []string{m}})
+				}
+			}
+		}
+	}
+	levels := map[string]int{"Patient": 0, "Study": 1, "Series": 2}
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Level != issues[j].Level {
+			return levels[issues[i].Level] < levels[issues[j].Level]
+		}
+		if issues[i].Identifier != issues[j].Identifier {
+			return issues[i].Identifier < issues[j].Identifier
+		}
+		return issues[i].Check < issues[j].Check
+	})
+	return issues
+}
+
+// verifyIdentifiers checks the identifiers and writes the report file, called after all files have been sorted
+func (e *engine) verifyIdentifiers() error {
+	issues := e.checkIdentifiers()
+	e.numConsistencyIssues = len(issues)
+	if e.verboseFlag || e.debugFlag {
+		for _, i := range issues {
+			fmt.Fprintf(os.Stderr, "%s %s: %s (%s)\n", i.Level, i.Identifier, i.Check, strings.Join(i.Values, ", "))
+		}
+	}
+
+	f, err := os.Create(e.consistencyReportFlag)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(e.consistencyReportFlag)) == ".csv" {
+		w := csv.NewWriter(f)
+		w.Write([]string{"Level", "Identifier", "Check", "Values"})
+		for _, i := range issues {
+			w.Write([]string{i.Level, i.Identifier, i.Check, strings.Join(i.Values, "; ")})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	if issues == nil {
+		issues = []ConsistencyIssue{}
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(issues)
+}
@@ -0,0 +1,171 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestCheckIdentifiers(t *testing.T) {
+	// series returns two instances of a series with the elements
+	series := func(uid string, elems ...*dicom.Element) []dicom.Dataset {
+		return []dicom.Dataset{newTestInstance(t, uid, 1, elems...), newTestInstance(t, uid, 2, elems...)}
+	}
+	patient := func(id string, name string) []*dicom.Element {
+		return []*dicom.Element{newTestElement(t, tag.PatientID, []string{id}), newTestElement(t, tag.PatientName, []string{name})}
+	}
+	study := func(uid string) *dicom.Element {
+		return newTestElement(t, tag.StudyInstanceUID, []string{uid})
+	}
+	join := func(sets ...[]dicom.Dataset) []dicom.Dataset {
+		var all []dicom.Dataset
+		for _, s := range sets {
+			all = append(all, s...)
+		}
+		return all
+	}
+	tests := []struct {
+		name     string
+		datasets []dicom.Dataset
+		want     []ConsistencyIssue
+	}{
+		{
+			name:     "consistent",
+			datasets: join(series("1.2.3.1"), series("1.2.3.2")),
+		},
+		{
+			name: "patient with two names",
+			datasets: join(
+				series("1.2.3.1", patient("P1", "Doe^Jane")...),
+				series("1.2.3.2", patient("P1", "Doe^Janet")...),
+			),
+			want: []ConsistencyIssue{{"Patient", "P1", "multiple PatientNames", []string{"Doe^Jane", "Doe^Janet"}}},
+		},
+		{
+			name: "patient with two birth dates",
+			datasets: join(
+				series("1.2.3.1", newTestElement(t, tag.PatientBirthDate, []string{"19700101"})),
+				series("1.2.3.2", newTestElement(t, tag.PatientBirthDate, []string{"19710101"})),
+			),
+			want: []ConsistencyIssue{{"Patient", "P1", "multiple PatientBirthDates", []string{"19700101", "19710101"}}},
+		},
+		{
+			name: "study shared by two patients",
+			datasets: join(
+				series("1.2.3.1", append(patient("P1", "A"), study("1.2.9"))...),
+				series("1.2.3.2", append(patient("P2", "B"), study("1.2.9"))...),
+			),
+			want: []ConsistencyIssue{{"Study", "1.2.9", "multiple PatientIDs", []string{"P1", "P2"}}},
+		},
+		{
+			name: "series shared by two studies",
+			datasets: []dicom.Dataset{
+				newTestInstance(t, "1.2.3.1", 1, study("1.2.8")),
+				newTestInstance(t, "1.2.3.1", 2, study("1.2.9")),
+			},
+			want: []ConsistencyIssue{{"Series", "1.2.3.1", "multiple StudyInstanceUIDs", []string{"1.2.8", "1.2.9"}}},
+		},
+		{
+			name: "series with two modalities",
+			datasets: []dicom.Dataset{
+				newTestInstance(t, "1.2.3.1", 1),
+				newTestInstance(t, "1.2.3.1", 2, newTestElement(t, tag.Modality, []string{"MR"})),
+			},
+			want: []ConsistencyIssue{{"Series", "1.2.3.1", "multiple Modalities", []string{"CT", "MR"}}},
+		},
+		{
+			name: "single instance",
+			datasets: []dicom.Dataset{
+				newTestInstance(t, "1.2.3.1", 1),
+				newTestInstance(t, "1.2.3.2", 1, newTestElement(t, tag.ImageType, []string{"ORIGINAL", "PRIMARY", "LOCALIZER"})),
+				newTestInstance(t, "1.2.3.3", 1, newTestElement(t, tag.Modality, []string{"OT"})),
+			},
+			want: []ConsistencyIssue{{"Series", "1.2.3.1", "single instance", []string{"CT"}}},
+		},
+		{
+			name: "issues are sorted by level",
+			datasets: join(
+				series("1.2.3.2", append(patient("P2", "B"), study("1.2.9"))...),
+				[]dicom.Dataset{newTestInstance(t, "1.2.3.2", 3, append(patient("P2", "C"), study("1.2.8"))...)},
+				series("1.2.3.1", append(patient("P1", "A"), study("1.2.9"))...),
+			),
+			want: []ConsistencyIssue{
+				{"Patient", "P2", "multiple PatientNames", []string{"B", "C"}},
+				{"Study", "1.2.9", "multiple PatientIDs", []string{"P1", "P2"}},
+				{"Series", "1.2.3.2", "multiple StudyInstanceUIDs", []string{"1.2.8", "1.2.9"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine()
+			for i := range tt.datasets {
+				e.recordIdentifiers(&tt.datasets[i])
+			}
+			if got := e.checkIdentifiers(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsistencyReportRun(t *testing.T) {
+	in := t.TempDir()
+	for n := 1; n <= 2; n++ {
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("a%d.dcm", n)), newTestInstance(t, "1.2.3.1", n,
+			newTestElement(t, tag.PatientName, []string{"Doe^Jane"})))
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("b%d.dcm", n)), newTestInstance(t, "1.2.3.2", n,
+			newTestElement(t, tag.PatientName, []string{"Doe^Janet"})))
+	}
+	want := []ConsistencyIssue{{"Patient", "P1", "multiple PatientNames", []string{"Doe^Jane", "Doe^Janet"}}}
+	for _, ext := range []string{".json", ".csv"} {
+		t.Run(ext, func(t *testing.T) {
+			report := filepath.Join(t.TempDir(), "report"+ext)
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.Quiet, opts.Sync = []string{in}, t.TempDir(), true, "none"
+			opts.ConsistencyReport = report
+			result, err := New(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ConsistencyIssues != 1 {
+				t.Errorf("%d consistency issues, want 1", result.ConsistencyIssues)
+			}
+			f, err := os.Open(report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if ext == ".csv" {
+				records, err := csv.NewReader(f).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantRecords := [][]string{{"Level", "Identifier", "Check", "Values"}, {"Patient", "P1", "multiple PatientNames", "Doe^Jane; Doe^Janet"}}
+				if !reflect.DeepEqual(records, wantRecords) {
+					t.Errorf("report %v, want %v", records, wantRecords)
+				}
+				return
+			}
+			var issues []ConsistencyIssue
+			if err := json.NewDecoder(f).Decode(&issues); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(issues, want) {
+				t.Errorf("report %v, want %v", issues, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// 'sdcm index <input folder>' parses all files once and stores path, size,
+// modification time and the values of a set of tags in an index file (gzip
+// compressed JSON lines, by default .sdcm-index in the input folder). Sorting
+// with -use-index takes the values from the index and only parses files that
+// are new or whose size or modification time changed. Running 'sdcm index'
+// again updates the index the same way. Add tags with -index-tags, the index
+// has to contain all tags needed by the folder path template.
+
+// indexState holds the settings and the current index of -use-index
+type indexState struct {
+	indexMode     bool
+	indexFileFlag string
+	indexTagsFlag string
+	useIndexFlag  bool
+
+	// index of the input folder that is walked right now, nil if there is none
+	currentIndex *scanIndex
+
+	// number of files sorted with values from the index and files that had to be parsed
+	counterFromIndex  int32
+	counterIndexStale int32
+}
+
+// default name of the index file in the input folder
+const indexFileName = ".sdcm-index"
+
+// tags stored in the index in addition to the tags of the folder path and -index-tags
+var defaultIndexTags = []tag.Tag{
+	tag.PatientID, tag.PatientName, tag.PatientBirthDate, tag.PatientSex, tag.PatientAge,
+	tag.StudyInstanceUID, tag.StudyDate, tag.StudyTime, tag.StudyDescription, tag.StudyID, tag.AccessionNumber, tag.ReferringPhysicianName,
+	tag.SeriesInstanceUID, tag.SeriesNumber, tag.SeriesDescription, tag.SeriesDate, tag.SeriesTime, tag.Modality, tag.ProtocolName, tag.BodyPartExamined,
+	tag.SOPInstanceUID, tag.SOPClassUID, tag.MediaStorageSOPClassUID, tag.TransferSyntaxUID, tag.InstanceNumber, tag.ImageType,
+	tag.AcquisitionNumber, tag.AcquisitionDate, tag.AcquisitionTime, tag.ContentDate, tag.ContentTime,
+	tag.ImagePositionPatient, tag.ImageOrientationPatient, tag.PixelSpacing, tag.SliceThickness, tag.SliceLocation, tag.Rows, tag.Columns, tag.NumberOfFrames,
+	tag.EchoTime, tag.EchoNumbers, tag.RepetitionTime, tag.InversionTime, tag.DiffusionBValue, tag.TemporalPositionIdentifier,
+	tag.Manufacturer, tag.ManufacturerModelName, tag.StationName, tag.InstitutionName, tag.FrameOfReferenceUID,
+}
+
+// indexHeader is the first line of an index file
+type indexHeader struct {
+	Version int      `json:"version"`
+	Created string   `json:"created"`
+	Tags    []string `json:"tags"` // group and element as in the DICOM JSON model, e.g. 00100020
+}
+
+// indexEntry is a file of the input folder, values are only stored for DICOM files
+type indexEntry struct {
+	Path     string              `json:"path"` // below the input folder, '/' separated
+	Size     int64               `json:"size"`
+	ModTime  int64               `json:"mtime"` // nanoseconds since 1970
+	NotDICOM bool                `json:"not_dicom,omitempty"`
+	Values   map[string][]string `json:"values,omitempty"`
+}
+
+// scanIndex is an index file in memory
+type scanIndex struct {
+	header  indexHeader
+	entries map[string]*indexEntry
+}
+
+func indexTagKey(t tag.Tag) string {
+	return fmt.Sprintf("%04X%04X", t.Group, t.Element)
+}
+
+func parseIndexTagKey(key string) (tag.Tag, error) {
+	v, err := strconv.ParseUint(key, 16, 32)
+	if err != nil || len(key) != 8 {
+		return tag.Tag{}, fmt.Errorf("invalid tag \"%s\" in index", key)
+	}
+	return tag.Tag{Group: uint16(v >> 16), Element: uint16(v)}, nil
+}
+
+// indexPath returns the index file of an input folder
+func (e *engine) indexPath(source_path string) string {
+	if e.indexFileFlag != "" {
+		return e.indexFileFlag
+	}
+	return filepath.Join(source_path, indexFileName)
+}
+
+// isIndexFile returns true for the index file of the input folder that is walked
+func (e *engine) isIndexFile(path string) bool {
+	return filepath.Base(path) == indexFileName || (e.indexFileFlag != "" && filepath.Join(e.inputDataPath, path) == e.indexFileFlag)
+}
+
+// indexTags returns the tags that 'sdcm index' stores
+func (e *engine) indexTags() ([]tag.Tag, error) {
+	tags := append([]tag.Tag{}, defaultIndexTags...)
+	tags = append(tags, e.indexRequiredTags()...)
+	for _, s := range tagListRegex.FindAllString(e.indexTagsFlag, -1) {
+		t, err := parseTagString(s)
+		if err != nil {
+			return nil, fmt.Errorf("unknown tag \"%s\" in -index-tags (%s)", s, err)
+		}
+		tags = append(tags, t)
+	}
+	seen := make(map[tag.Tag]bool, len(tags))
+	var unique []tag.Tag
+	for _, t := range tags {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return tagAfter(unique[j], unique[i]) })
+	return unique, nil
+}
+
+// readIndex reads an index file
+func readIndex(path string) (*scanIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	d := json.NewDecoder(bufio.NewReader(z))
+	index := &scanIndex{entries: make(map[string]*indexEntry, 0)}
+	if err := d.Decode(&index.header); err != nil {
+		return nil, err
+	}
+	if index.header.Version != 1 {
+		return nil, fmt.Errorf("unknown index version %d", index.header.Version)
+	}
+	for d.More() {
+		var e indexEntry
+		if err := d.Decode(&e); err != nil {
+			return nil, err
+		}
+		index.entries[e.Path] = &e
+	}
+	return index, nil
+}
+
+// writeIndex writes an index file, the old index is replaced once the new one is complete
+func writeIndex(path string, index *scanIndex) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	z := gzip.NewWriter(f)
+	e := json.NewEncoder(z)
+	err = e.Encode(index.header)
+	paths := make([]string, 0, len(index.entries))
+	for p := range index.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err != nil {
+			break
+		}
+		err = e.Encode(index.entries[p])
+	}
+	if err == nil {
+		err = z.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lookupIndex returns the entry of a file in the current index if its size and modification time did not change
+func (e *engine) lookupIndex(path string, info os.FileInfo) (*indexEntry, bool) {
+	if e.currentIndex == nil {
+		return nil, false
+	}
+	entry, ok := e.currentIndex.entries[filepath.ToSlash(path)]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return nil, false
+	}
+	return entry, true
+}
+
+// rawElementValues returns the values of an element as strings, strings are not trimmed (the folder path
+// uses the values as they are)
+func rawElementValues(e *dicom.Element) []string {
+	if e.Value != nil {
+		if v, ok := e.Value.GetValue().([]string); ok {
+			return v
+		}
+	}
+	return elementValues(e)
+}
+
+// indexedDataset creates a data set with the values of an index entry
+func indexedDataset(e *indexEntry) dicom.Dataset {
+	ds := dicom.Dataset{}
+	for key, values := range e.Values {
+		t, err := parseIndexTagKey(key)
+		if err != nil {
+			continue
+		}
+		info, err := tag.Find(t)
+		if err != nil {
+			continue
+		}
+		var data interface{} = values
+		switch tag.GetVRKind(t, info.VR) {
+		case tag.VRUInt16List, tag.VRUInt32List, tag.VRInt16List, tag.VRInt32List:
+			ints := make([]int, 0, len(values))
+			for _, v := range values {
+				if i, err := strconv.Atoi(v); err == nil {
+					ints = append(ints, i)
+				}
+			}
+			data = ints
+		case tag.VRFloat32List, tag.VRFloat64List:
+			floats := make([]float64, 0, len(values))
+			for _, v := range values {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					floats = append(floats, f)
+				}
+			}
+			data = floats
+		case tag.VRSequence, tag.VRItem, tag.VRBytes, tag.VRTagList, tag.VRPixelData:
+			continue
+		}
+		setElement(&ds, t, data)
+	}
+	return ds
+}
+
+// loadIndex reads the index of an input folder for -use-index, nil if it cannot be used
+func (e *engine) loadIndex(source_path string) *scanIndex {
+	path := e.indexPath(source_path)
+	index, err := readIndex(path)
+	if err != nil {
+		e.warn("could not read the index %s, parse all files (%s)", path, err)
+		return nil
+	}
+	if e.dicomdirFlag {
+		// the directory records need more values than the index has
+		e.warn("-dicomdir needs the whole header, the index %s is not used", path)
+		return nil
+	}
+	stored := make(map[string]bool, len(index.header.Tags))
+	for _, k := range index.header.Tags {
+		stored[k] = true
+	}
+	required := append(e.indexRequiredTags(), tag.SOPClassUID, tag.StudyInstanceUID, tag.SeriesInstanceUID, tag.MediaStorageSOPClassUID)
+	if strings.Contains(e.outputFolderFlag, "{TransferSyntax}") {
+		required = append(required, tag.TransferSyntaxUID)
+	}
+	for _, t := range required {
+		if !stored[indexTagKey(t)] {
+			name := indexTagKey(t)
+			if info, err := tag.Find(t); err == nil {
+				name = info.Name
+			}
+			e.warn("the index %s does not contain %s, parse all files (add it with 'sdcm index -index-tags %s')", path, name, name)
+			return nil
+		}
+	}
+	return index
+}
+
+// buildIndex parses the files of the input folders and writes (or updates) their index files
+func (e *engine) buildIndex(source_paths []string) error {
+	tags, err := e.indexTags()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(tags))
+	for i, t := range tags {
+		keys[i] = indexTagKey(t)
+	}
+	e.headerEarlyExit = false // values can be anywhere in the header
+	for _, source_path := range source_paths {
+		e.startTime = time.Now()
+		path := e.indexPath(source_path)
+		old, err := readIndex(path)
+		if err != nil || fmt.Sprint(old.header.Tags) != fmt.Sprint(keys) {
+			// a new index or other tags, all files are parsed
+			old = nil
+		}
+		index := &scanIndex{header: indexHeader{Version: 1, Created: time.Now().Format(time.RFC3339), Tags: keys}, entries: make(map[string]*indexEntry, 0)}
+		var mutex sync.Mutex
+		var parsed, unchanged, notDicom int32
+		e.inputDataPath = source_path
+		err = e.walkFiles(source_path, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info == nil || info.IsDir() || e.isIndexFile(p) || matchGlobs(e.excludeGlobs, p) || e.canceled() {
+				return nil
+			}
+			key := filepath.ToSlash(p)
+			entry := &indexEntry{Path: key, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+			if old != nil {
+				if o, ok := old.entries[key]; ok && o.Size == entry.Size && o.ModTime == entry.ModTime {
+					atomic.AddInt32(&unchanged, 1)
+					mutex.Lock()
+					index.entries[key] = o
+					mutex.Unlock()
+					return nil
+				}
+			}
+			in_file := filepath.Join(source_path, p)
+			var dataset dicom.Dataset
+			if !e.thoroughFlag && !matchGlobs(e.includeGlobs, p) && !sniffDicom(in_file) {
+				err = fmt.Errorf("not DICOM")
+			} else {
+				dataset, err = e.readInputFile(in_file)
+			}
+			if err != nil {
+				entry.NotDICOM = true
+				atomic.AddInt32(&notDicom, 1)
+			} else {
+				entry.Values = make(map[string][]string, len(tags))
+				for i, t := range tags {
+					if el := findElement(&dataset, t); el != nil {
+						entry.Values[keys[i]] = rawElementValues(el)
+					}
+				}
+				atomic.AddInt32(&parsed, 1)
+			}
+			mutex.Lock()
+			index.entries[key] = entry
+			mutex.Unlock()
+			return nil
+		})
+		if err != nil {
+			e.warn("could not read all files in %s (%s)", source_path, err)
+		}
+		if err := e.runContext.Err(); err != nil {
+			// an incomplete index would mark the files that were not read as removed
+			return err
+		}
+		if err := writeIndex(path, index); err != nil {
+			return fmt.Errorf("could not write the index %s (%s), use -index to write it somewhere else", path, err)
+		}
+		if !e.quietFlag {
+			fmt_local.Printf("✓ indexed %d file%s in %s [%d parsed, %d unchanged, %d non-DICOM] into %s\n", len(index.entries), map[bool]string{true: "", false: "s"}[len(index.entries) == 1], time.Since(e.startTime).Round(time.Millisecond), parsed, unchanged, notDicom, path)
+		}
+	}
+	return nil
+}
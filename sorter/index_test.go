@@ -0,0 +1,183 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestIndexTagKey(t *testing.T) {
+	for _, tg := range []tag.Tag{tag.PatientID, tag.PixelData, {Group: 0x0029, Element: 0x1010}} {
+		got, err := parseIndexTagKey(indexTagKey(tg))
+		if err != nil || got != tg {
+			t.Errorf("%s is %s after the round trip (%v)", tg, got, err)
+		}
+	}
+	if key := indexTagKey(tag.PatientID); key != "00100020" {
+		t.Errorf("key of PatientID is %s, want 00100020", key)
+	}
+	for _, key := range []string{"0010002", "001000200", "0010002G", "PatientID", ""} {
+		if _, err := parseIndexTagKey(key); err == nil {
+			t.Errorf("parseIndexTagKey(%q) did not fail", key)
+		}
+	}
+}
+
+func TestReadWriteIndex(t *testing.T) {
+	index := &scanIndex{
+		header: indexHeader{Version: 1, Created: "2024-01-01T00:00:00Z", Tags: []string{"00100020", "00200013"}},
+		entries: map[string]*indexEntry{
+			"a/1.dcm":   {Path: "a/1.dcm", Size: 1000, ModTime: 1700000000000000001, Values: map[string][]string{"00100020": {"P1 "}, "00200013": {"1"}}},
+			"a/2.dcm":   {Path: "a/2.dcm", Size: 2000, ModTime: 1700000000000000002, Values: map[string][]string{"00100020": {"P1"}, "00280030": {"0.5", "0.5"}}},
+			"notes.txt": {Path: "notes.txt", Size: 10, ModTime: 1700000000000000003, NotDICOM: true},
+		},
+	}
+	path := filepath.Join(t.TempDir(), indexFileName)
+	if err := writeIndex(path, index); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was not renamed (%v)", err)
+	}
+	got, err := readIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, index) {
+		t.Errorf("index after the round trip\n%+v\nwant\n%+v", got, index)
+	}
+
+	// an index is replaced as a whole
+	delete(index.entries, "a/2.dcm")
+	if err := writeIndex(path, index); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readIndex(path); err != nil || len(got.entries) != 2 {
+		t.Errorf("%d entries after writing the index again, want 2 (%v)", len(got.entries), err)
+	}
+}
+
+func TestReadIndexErrors(t *testing.T) {
+	gz := func(content string) []byte {
+		path := filepath.Join(t.TempDir(), "index")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z := gzip.NewWriter(f)
+		z.Write([]byte(content))
+		z.Close()
+		f.Close()
+		b, _ := os.ReadFile(path)
+		return b
+	}
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "not compressed", content: []byte(`{"version":1}`)},
+		{name: "unknown version", content: gz(`{"version":2,"tags":[]}`)},
+		{name: "broken entry", content: gz(`{"version":1,"tags":[]}` + "\n" + `{"path":"a",`)},
+		{name: "empty", content: gz("")},
+		{name: "truncated", content: gz(`{"version":1,"tags":[]}` + "\n" + `{"path":"a"}`)[:20]},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, fmt.Sprint(i))
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readIndex(path); err == nil {
+			t.Errorf("%s: readIndex did not fail", tt.name)
+		}
+	}
+	if _, err := readIndex(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readIndex did not fail for a missing file")
+	}
+}
+
+func TestIndexedDataset(t *testing.T) {
+	entry := &indexEntry{Values: map[string][]string{
+		indexTagKey(tag.PatientName):             {"Test^Patient "},
+		indexTagKey(tag.Rows):                    {"512"},
+		indexTagKey(tag.PixelSpacing):            {"0.5", "0.25"},
+		indexTagKey(tag.ImageType):               {"ORIGINAL", "PRIMARY"},
+		"00291010":                               {"private"},
+		"nonsense":                               {"x"},
+		indexTagKey(tag.ReferencedImageSequence): {"a sequence"},
+	}}
+	ds := indexedDataset(entry)
+	if got := getString(&ds, tag.PatientName); got != "Test^Patient" {
+		t.Errorf("PatientName %q", got)
+	}
+	if got := getInt(&ds, tag.Rows, 0); got != 512 {
+		t.Errorf("Rows %d, want 512", got)
+	}
+	if got := elementValues(findElement(&ds, tag.PixelSpacing)); !reflect.DeepEqual(got, []string{"0.5", "0.25"}) {
+		t.Errorf("PixelSpacing %q", got)
+	}
+	if got := elementValues(findElement(&ds, tag.ImageType)); !reflect.DeepEqual(got, []string{"ORIGINAL", "PRIMARY"}) {
+		t.Errorf("ImageType %q", got)
+	}
+	if got := len(ds.Elements); got != 4 {
+		t.Errorf("%d elements (%v), want 4", got, elementTags(ds.Elements, ""))
+	}
+}
+
+func TestIndexRun(t *testing.T) {
+	in := t.TempDir()
+	for n := 1; n <= 3; n++ {
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("%d.dcm", n)), newTestInstance(t, "1.2.3.1", n))
+	}
+	if err := os.WriteFile(filepath.Join(in, "notes.txt"), []byte("not DICOM"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Input, opts.Quiet, opts.Sync = []string{in}, true, "none"
+	opts.Folder = "{PatientID}/{SeriesInstanceUID}/{InstanceNumber}.dcm"
+	if err := New(opts).Index(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	index, err := readIndex(filepath.Join(in, indexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.entries) != 4 || !index.entries["notes.txt"].NotDICOM {
+		t.Fatalf("index has %d entries, want 4 with notes.txt as non-DICOM", len(index.entries))
+	}
+	if got := index.entries["2.dcm"].Values[indexTagKey(tag.InstanceNumber)]; !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("InstanceNumber of 2.dcm in the index is %q", got)
+	}
+
+	// a changed file is parsed again
+	changed := filepath.Join(in, "3.dcm")
+	writeTestFile(t, changed, newTestInstance(t, "1.2.3.1", 4))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(changed, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Output, opts.UseIndex = t.TempDir(), true
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 3 || result.FromIndex != 2 || result.IndexStale != 1 {
+		t.Errorf("%d files, %d from the index and %d parsed, want 3, 2 and 1", result.Files, result.FromIndex, result.IndexStale)
+	}
+	want := []string{"P1/1.2.3.1/1.dcm", "P1/1.2.3.1/2.dcm", "P1/1.2.3.1/4.dcm"}
+	if got := listFiles(t, opts.Output); !reflect.DeepEqual(got, want) {
+		t.Errorf("sorted files %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,378 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/frame"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Enhanced (multi-frame) objects store most per-image values in functional group
+// sequences. Template values are looked up at the top-level first, then in the
+// shared and at last in the per-frame functional groups (first frame). With
+// -split-frames each frame of an enhanced object is copied as its own single-frame
+// instance, enhanced CT, MR and PET frames become instances of the classic SOP class.
+// Other multi-frame objects (e.g. ultrasound cine loops) are copied as they are.
+
+// values that have a different name inside the functional groups
+var functionalGroupAliases = map[tag.Tag]tag.Tag{
+	tag.EchoTime: tag.EffectiveEchoTime,
+}
+
+// Enhanced SOP classes with a classic single-frame counterpart, split frames are converted to it
+var classicSOPClasses = map[string]string{
+	"1.2.840.10008.5.1.4.1.1.2.1":   "1.2.840.10008.5.1.4.1.1.2",   // Enhanced CT
+	"1.2.840.10008.5.1.4.1.1.2.2":   "1.2.840.10008.5.1.4.1.1.2",   // Legacy Converted Enhanced CT
+	"1.2.840.10008.5.1.4.1.1.4.1":   "1.2.840.10008.5.1.4.1.1.4",   // Enhanced MR
+	"1.2.840.10008.5.1.4.1.1.4.4":   "1.2.840.10008.5.1.4.1.1.4",   // Legacy Converted Enhanced MR
+	"1.2.840.10008.5.1.4.1.1.130":   "1.2.840.10008.5.1.4.1.1.128", // Enhanced PET
+	"1.2.840.10008.5.1.4.1.1.128.1": "1.2.840.10008.5.1.4.1.1.128", // Legacy Converted Enhanced PET
+}
+
+// Enhanced SOP classes without a classic counterpart, their frames keep the SOP class
+var enhancedSOPClasses = map[string]bool{
+	"1.2.840.10008.5.1.4.1.1.4.3":      true, // Enhanced MR Color
+	"1.2.840.10008.5.1.4.1.1.6.2":      true, // Enhanced US Volume
+	"1.2.840.10008.5.1.4.1.1.12.1.1":   true, // Enhanced XA
+	"1.2.840.10008.5.1.4.1.1.12.2.1":   true, // Enhanced XRF
+	"1.2.840.10008.5.1.4.1.1.13.1.3":   true, // Breast Tomosynthesis
+	"1.2.840.10008.5.1.4.1.1.77.1.5.4": true, // Ophthalmic Tomography
+}
+
+// errNotEnhanced is returned by splitFrames for multi-frame objects without functional groups
+var errNotEnhanced = errors.New("not an enhanced multi-frame object")
+
+// isEnhanced returns true for enhanced SOP classes and objects with functional groups
+func isEnhanced(ds *dicom.Dataset) bool {
+	sopClassUID := getString(ds, tag.SOPClassUID)
+	if _, ok := classicSOPClasses[sopClassUID]; ok || enhancedSOPClasses[sopClassUID] {
+		return true
+	}
+	for _, t := range []tag.Tag{tag.SharedFunctionalGroupsSequence, tag.PerFrameFunctionalGroupsSequence} {
+		if _, err := ds.FindElementByTag(t); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// frameCounter numbers the split frames of a series if the InstanceNumber of the object cannot be used
+type frameCounter struct {
+	mutex sync.Mutex
+	next  map[string]int
+}
+
+// reserve returns the first of n InstanceNumbers for the frames of an object in a series
+func (c *frameCounter) reserve(seriesInstanceUID string, n int) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.next == nil {
+		c.next = make(map[string]int, 0)
+	}
+	first := c.next[seriesInstanceUID] + 1
+	c.next[seriesInstanceUID] += n
+	return first
+}
+
+// multi-frame elements removed from classic instances
+var enhancedOnlyTags = map[tag.Tag]bool{
+	tag.SharedFunctionalGroupsSequence:   true,
+	tag.PerFrameFunctionalGroupsSequence: true,
+	tag.NumberOfFrames:                   true,
+	tag.DimensionOrganizationSequence:    true,
+	tag.DimensionIndexSequence:           true,
+	tag.DimensionOrganizationType:        true,
+	tag.ConcatenationUID:                 true,
+	tag.InConcatenationNumber:            true,
+}
+
+// values copied from the functional groups to the top-level of each split frame
+var flattenTags = []tag.Tag{
+	tag.ImagePositionPatient,
+	tag.ImageOrientationPatient,
+	tag.PixelSpacing,
+	tag.SliceThickness,
+	tag.SpacingBetweenSlices,
+	tag.RepetitionTime,
+	tag.InversionTime,
+	tag.DiffusionBValue,
+}
+
+// elementValueString returns the first value of an element as a string
+func elementValueString(e *dicom.Element) string {
+	if e == nil || e.Value == nil {
+		return ""
+	}
+	switch v := e.Value.GetValue().(type) {
+	case []string:
+		if len(v) > 0 {
+			return v[0]
+		}
+	case []int:
+		if len(v) > 0 {
+			return strconv.Itoa(v[0])
+		}
+	case []float64:
+		if len(v) > 0 {
+			return strconv.FormatFloat(v[0], 'f', -1, 64)
+		}
+	case []byte:
+		return strings.TrimRight(string(v), " \x00")
+	}
+	return ""
+}
+
+// sequenceItems returns the elements of each item of a sequence element
+func sequenceItems(e *dicom.Element) [][]*dicom.Element {
+	var items [][]*dicom.Element
+	if e == nil || e.Value == nil || e.Value.ValueType() != dicom.Sequences {
+		return items
+	}
+	for _, item := range e.Value.GetValue().([]*dicom.SequenceItemValue) {
+		items = append(items, item.GetValue().([]*dicom.Element))
+	}
+	return items
+}
+
+// findInFunctionalGroup searches the macros (sequences with a single item) of a functional group item
+func findInFunctionalGroup(group []*dicom.Element, t tag.Tag) *dicom.Element {
+	for _, macro := range group {
+		for _, item := range sequenceItems(macro) {
+			for _, e := range item {
+				if e.Tag == t {
+					return e
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// findFunctionalGroupElement returns the element for frame (0-based) from the per-frame or the shared functional groups
+func findFunctionalGroupElement(ds *dicom.Dataset, t tag.Tag, frameIdx int) *dicom.Element {
+	if perFrame, err := ds.FindElementByTag(tag.PerFrameFunctionalGroupsSequence); err == nil {
+		items := sequenceItems(perFrame)
+		if frameIdx < len(items) {
+			if e := findInFunctionalGroup(items[frameIdx], t); e != nil {
+				return e
+			}
+		}
+	}
+	if shared, err := ds.FindElementByTag(tag.SharedFunctionalGroupsSequence); err == nil {
+		for _, item := range sequenceItems(shared) {
+			if e := findInFunctionalGroup(item, t); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// findElement returns the element for a tag from the top-level or from the functional groups of the first frame
+func findElement(ds *dicom.Dataset, t tag.Tag) *dicom.Element {
+	if e, err := ds.FindElementByTag(t); err == nil {
+		return e
+	}
+	if e := findFunctionalGroupElement(ds, t, 0); e != nil {
+		return e
+	}
+	if alias, ok := functionalGroupAliases[t]; ok {
+		return findFunctionalGroupElement(ds, alias, 0)
+	}
+	return nil
+}
+
+// findElementValue returns the value of a tag used in the folder path
+func findElementValue(ds *dicom.Dataset, t tag.Tag) (string, bool) {
+	if e := findElement(ds, t); e != nil {
+		return elementValueString(e), true
+	}
+	return "", false
+}
+
+// frameUID creates a reproducible UID (2.25 root) for a frame of an instance
+func frameUID(sopInstanceUID string, frameNumber int) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s.%d", sopInstanceUID, frameNumber)))
+	return "2.25." + new(big.Int).SetBytes(h[:16]).String()
+}
+
+// splitFrames reads an enhanced multi-frame file and returns a single-frame data set for each frame,
+// counter numbers the frames of objects without a usable InstanceNumber
+func splitFrames(in_file string, counter *frameCounter) ([]dicom.Dataset, error) {
+	ds, err := readDatasetFile(in_file)
+	if err != nil {
+		return nil, err
+	}
+	if !isEnhanced(&ds) {
+		return nil, errNotEnhanced
+	}
+	numberOfFrames := getInt(&ds, tag.NumberOfFrames, 1)
+	pixelElement, err := ds.FindElementByTag(tag.PixelData)
+	if err != nil {
+		return nil, err
+	}
+	info := dicom.MustGetPixelDataInfo(pixelElement.Value)
+
+	var frameData [][]byte
+	if info.IsEncapsulated {
+		if frameData, err = frameFragments(&ds, info); err != nil {
+			return nil, err
+		}
+	} else if info.IntentionallyUnprocessed {
+		bitsAllocated := getInt(&ds, tag.BitsAllocated, 8)
+		if bitsAllocated%8 != 0 {
+			return nil, fmt.Errorf("cannot split frames with %d bits allocated", bitsAllocated)
+		}
+		frameSize := getInt(&ds, tag.Rows, 0) * getInt(&ds, tag.Columns, 0) * getInt(&ds, tag.SamplesPerPixel, 1) * bitsAllocated / 8
+		if frameSize == 0 || frameSize*numberOfFrames > len(info.UnprocessedValueData) {
+			return nil, fmt.Errorf("pixel data too short for %d frames", numberOfFrames)
+		}
+		for i := 0; i < numberOfFrames; i++ {
+			frameData = append(frameData, info.UnprocessedValueData[i*frameSize:(i+1)*frameSize])
+		}
+	} else {
+		return nil, errUnsupportedTransferSyntax
+	}
+
+	var perFrameItems [][]*dicom.Element
+	if perFrame, err := ds.FindElementByTag(tag.PerFrameFunctionalGroupsSequence); err == nil {
+		perFrameItems = sequenceItems(perFrame)
+	}
+	sopInstanceUID := getString(&ds, tag.SOPInstanceUID)
+	classic := classicSOPClasses[getString(&ds, tag.SOPClassUID)]
+	instanceNumber := getInt(&ds, tag.InstanceNumber, 0)
+	first := 0
+	if frameInstanceNumber(instanceNumber, 1, numberOfFrames) == 0 {
+		first = counter.reserve(getString(&ds, tag.SeriesInstanceUID), numberOfFrames)
+	}
+
+	var frames []dicom.Dataset
+	for i := 0; i < numberOfFrames; i++ {
+		var elems []*dicom.Element
+		for _, e := range ds.Elements {
+			switch e.Tag {
+			case tag.PixelData:
+				elems = append(elems, framePixelElement(pixelElement, info.IsEncapsulated, frameData[i]))
+			case tag.PerFrameFunctionalGroupsSequence:
+				if i < len(perFrameItems) {
+					v, err := dicom.NewValue([][]*dicom.Element{perFrameItems[i]})
+					if err != nil {
+						return nil, err
+					}
+					elems = append(elems, &dicom.Element{Tag: e.Tag, ValueRepresentation: e.ValueRepresentation, RawValueRepresentation: e.RawValueRepresentation, ValueLength: tag.VLUndefinedLength, Value: v})
+				}
+			default:
+				elems = append(elems, e)
+			}
+		}
+		f := dicom.Dataset{Elements: elems}
+		uid := frameUID(sopInstanceUID, i+1)
+		setElement(&f, tag.MediaStorageSOPInstanceUID, []string{uid})
+		setElement(&f, tag.SOPInstanceUID, []string{uid})
+		number := frameInstanceNumber(instanceNumber, i+1, numberOfFrames)
+		if number == 0 {
+			number = first + i
+		}
+		setElement(&f, tag.InstanceNumber, []string{strconv.Itoa(number)})
+		if e := findFunctionalGroupElement(&f, tag.EffectiveEchoTime, 0); e != nil {
+			setElement(&f, tag.EchoTime, []string{elementValueString(e)})
+		}
+		if classic != "" {
+			f = classicFrame(f, classic)
+		} else {
+			setElement(&f, tag.NumberOfFrames, []string{"1"})
+			for _, t := range flattenTags {
+				if e := findFunctionalGroupElement(&f, t, 0); e != nil {
+					putElement(&f, e)
+				}
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames, nil
+}
+
+// frameInstanceNumber keeps the frames of different instances of a series apart, the frame
+// number is appended to the original InstanceNumber (instance 3, frame 12 becomes 30012).
+// Returns 0 if the InstanceNumber is missing or too large, the frames are then numbered per series.
+func frameInstanceNumber(instanceNumber, frameNumber, numberOfFrames int) int {
+	if instanceNumber <= 0 || numberOfFrames >= 10000 || instanceNumber >= 200000 {
+		return 0
+	}
+	return instanceNumber*10000 + frameNumber
+}
+
+// classicFrame converts a single frame of an enhanced object into an instance of the classic
+// SOP class. The values of the functional groups (per-frame before shared) move to the top-level.
+func classicFrame(f dicom.Dataset, sopClassUID string) dicom.Dataset {
+	var groups [][]*dicom.Element
+	if perFrame, err := f.FindElementByTag(tag.PerFrameFunctionalGroupsSequence); err == nil {
+		groups = append(groups, sequenceItems(perFrame)...)
+	}
+	if shared, err := f.FindElementByTag(tag.SharedFunctionalGroupsSequence); err == nil {
+		groups = append(groups, sequenceItems(shared)...)
+	}
+	var elems []*dicom.Element
+	for _, e := range f.Elements {
+		if !enhancedOnlyTags[e.Tag] {
+			elems = append(elems, e)
+		}
+	}
+	c := dicom.Dataset{Elements: elems}
+	flattened := make(map[tag.Tag]bool, 0)
+	for _, group := range groups {
+		for _, macro := range group {
+			if macro.Tag == tag.FrameContentSequence {
+				continue // frame numbers and dimension indices only make sense in a multi-frame object
+			}
+			for _, item := range sequenceItems(macro) {
+				for _, e := range item {
+					if !flattened[e.Tag] {
+						putElement(&c, e)
+						flattened[e.Tag] = true
+					}
+				}
+			}
+		}
+	}
+	setElement(&c, tag.MediaStorageSOPClassUID, []string{sopClassUID})
+	setElement(&c, tag.SOPClassUID, []string{sopClassUID})
+	return c
+}
+
+func framePixelElement(pixelElement *dicom.Element, encapsulated bool, data []byte) *dicom.Element {
+	var info dicom.PixelDataInfo
+	vl := uint32(len(data))
+	if encapsulated {
+		info = dicom.PixelDataInfo{IsEncapsulated: true, Frames: []*frame.Frame{{Encapsulated: true, EncapsulatedData: frame.EncapsulatedFrame{Data: data}}}}
+		vl = tag.VLUndefinedLength
+	} else {
+		info = dicom.PixelDataInfo{IntentionallyUnprocessed: true, UnprocessedValueData: data}
+	}
+	v, _ := dicom.NewValue(info)
+	return &dicom.Element{
+		Tag:                    tag.PixelData,
+		ValueRepresentation:    pixelElement.ValueRepresentation,
+		RawValueRepresentation: pixelElement.RawValueRepresentation,
+		ValueLength:            vl,
+		Value:                  v,
+	}
+}
+
+// initSplitFrames warns if -split-frames cannot be used
+func (e *engine) initSplitFrames() {
+	if e.splitFramesFlag && e.methodFlag != "copy" {
+		e.warn("-split-frames only works together with '-method copy'")
+	}
+}
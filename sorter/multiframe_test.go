@@ -0,0 +1,292 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestFrameInstanceNumber(t *testing.T) {
+	tests := []struct {
+		instance, frame, frames int
+		want                    int
+	}{
+		{instance: 3, frame: 12, frames: 20, want: 30012},
+		{instance: 1, frame: 1, frames: 1, want: 10001},
+		// the frames are numbered per series
+		{instance: 0, frame: 5, frames: 10, want: 0},
+		{instance: -1, frame: 5, frames: 10, want: 0},
+		{instance: 2, frame: 7, frames: 10000, want: 0},
+		{instance: 200000, frame: 7, frames: 10, want: 0},
+		{instance: 199999, frame: 7, frames: 10, want: 1999990007},
+	}
+	for _, tt := range tests {
+		if got := frameInstanceNumber(tt.instance, tt.frame, tt.frames); got != tt.want {
+			t.Errorf("frameInstanceNumber(%d, %d, %d) = %d, want %d", tt.instance, tt.frame, tt.frames, got, tt.want)
+		}
+	}
+}
+
+// multiFrame returns a multi-frame instance with 1x2 pixels of 8 bit per frame
+func multiFrame(t testing.TB, sopClass string, instanceNumber string, pixels *dicom.Element, frames int, extra ...*dicom.Element) dicom.Dataset {
+	t.Helper()
+	return newTestInstance(t, "1.2.3.5", 1, append([]*dicom.Element{
+		newTestElement(t, tag.SOPClassUID, []string{sopClass}),
+		newTestElement(t, tag.InstanceNumber, []string{instanceNumber}),
+		newTestElement(t, tag.NumberOfFrames, []string{fmt.Sprint(frames)}),
+		newTestElement(t, tag.Rows, []int{1}),
+		newTestElement(t, tag.Columns, []int{2}),
+		newTestElement(t, tag.SamplesPerPixel, []int{1}),
+		newTestElement(t, tag.BitsAllocated, []int{8}),
+		newTestElement(t, tag.BitsStored, []int{8}),
+		newTestElement(t, tag.HighBit, []int{7}),
+		newTestElement(t, tag.PixelRepresentation, []int{0}),
+		pixels,
+	}, extra...)...)
+}
+
+// functionalGroups returns the shared and per-frame functional groups of an enhanced image
+func functionalGroups(t testing.TB, positions []string, echoTimes []float64) []*dicom.Element {
+	t.Helper()
+	var perFrame [][]*dicom.Element
+	for i, p := range positions {
+		item := []*dicom.Element{
+			newTestElement(t, tag.FrameContentSequence, [][]*dicom.Element{{newTestElement(t, tag.DimensionIndexValues, []int{i + 1})}}),
+			newTestElement(t, tag.PlanePositionSequence, [][]*dicom.Element{{newTestElement(t, tag.ImagePositionPatient, []string{p, "0", "0"})}}),
+		}
+		if i < len(echoTimes) {
+			item = append(item, newTestElement(t, tag.MREchoSequence, [][]*dicom.Element{{newTestElement(t, tag.EffectiveEchoTime, []float64{echoTimes[i]})}}))
+		}
+		perFrame = append(perFrame, item)
+	}
+	shared := [][]*dicom.Element{{
+		newTestElement(t, tag.PixelMeasuresSequence, [][]*dicom.Element{{
+			newTestElement(t, tag.PixelSpacing, []string{"0.5", "0.5"}),
+			newTestElement(t, tag.SliceThickness, []string{"2"}),
+		}}),
+		newTestElement(t, tag.PlanePositionSequence, [][]*dicom.Element{{newTestElement(t, tag.ImagePositionPatient, []string{"99", "0", "0"})}}),
+	}}
+	return []*dicom.Element{
+		newTestElement(t, tag.SharedFunctionalGroupsSequence, shared),
+		newTestElement(t, tag.PerFrameFunctionalGroupsSequence, perFrame),
+		newTestElement(t, tag.DimensionOrganizationType, []string{"3D"}),
+	}
+}
+
+// splitFrame is what we expect of a frame
+type splitFrame struct {
+	sopClass       string
+	numberOfFrames string // empty if the element is removed
+	instanceNumber string
+	position       string // first value of ImagePositionPatient
+	pixelSpacing   string
+	echoTime       string
+	pixels         []byte
+}
+
+func TestSplitFrames(t *testing.T) {
+	const (
+		enhancedCT      = "1.2.840.10008.5.1.4.1.1.2.1"
+		enhancedMR      = "1.2.840.10008.5.1.4.1.1.4.1"
+		mrImageStorage  = "1.2.840.10008.5.1.4.1.1.4"
+		enhancedUS      = "1.2.840.10008.5.1.4.1.1.6.2"
+		ultrasoundMulti = "1.2.840.10008.5.1.4.1.1.3.1"
+	)
+	tests := []struct {
+		name    string
+		ds      dicom.Dataset
+		want    []splitFrame
+		wantErr bool
+	}{
+		{
+			name: "enhanced CT becomes classic CT",
+			ds: multiFrame(t, enhancedCT, "2", pixelValue(t, []byte{1, 2, 3, 4, 5, 6}, "OB"), 3,
+				functionalGroups(t, []string{"10", "20", "30"}, nil)...),
+			want: []splitFrame{
+				{sopClass: ctImageStorage, instanceNumber: "20001", position: "10", pixelSpacing: "0.5", pixels: []byte{1, 2}},
+				{sopClass: ctImageStorage, instanceNumber: "20002", position: "20", pixelSpacing: "0.5", pixels: []byte{3, 4}},
+				{sopClass: ctImageStorage, instanceNumber: "20003", position: "30", pixelSpacing: "0.5", pixels: []byte{5, 6}},
+			},
+		},
+		{
+			name: "enhanced MR sets the echo time",
+			ds: multiFrame(t, enhancedMR, "1", pixelValue(t, []byte{1, 2, 3, 4}, "OB"), 2,
+				functionalGroups(t, []string{"-5", "5"}, []float64{12.5, 80})...),
+			want: []splitFrame{
+				{sopClass: mrImageStorage, instanceNumber: "10001", position: "-5", pixelSpacing: "0.5", echoTime: "12.5", pixels: []byte{1, 2}},
+				{sopClass: mrImageStorage, instanceNumber: "10002", position: "5", pixelSpacing: "0.5", echoTime: "80", pixels: []byte{3, 4}},
+			},
+		},
+		{
+			name: "other enhanced classes keep their SOP class",
+			ds:   multiFrame(t, enhancedUS, "", pixelValue(t, []byte{7, 8, 9, 10}, "OB"), 2),
+			want: []splitFrame{
+				{sopClass: enhancedUS, numberOfFrames: "1", instanceNumber: "1", pixels: []byte{7, 8}},
+				{sopClass: enhancedUS, numberOfFrames: "1", instanceNumber: "2", pixels: []byte{9, 10}},
+			},
+		},
+		{
+			name: "functional groups of any class",
+			ds: multiFrame(t, ultrasoundMulti, "3", pixelValue(t, []byte{7, 8, 9, 10}, "OB"), 2,
+				functionalGroups(t, []string{"1", "2"}, nil)...),
+			want: []splitFrame{
+				{sopClass: ultrasoundMulti, numberOfFrames: "1", instanceNumber: "30001", position: "1", pixelSpacing: "0.5", pixels: []byte{7, 8}},
+				{sopClass: ultrasoundMulti, numberOfFrames: "1", instanceNumber: "30002", position: "2", pixelSpacing: "0.5", pixels: []byte{9, 10}},
+			},
+		},
+		{
+			name: "one fragment per frame",
+			ds: multiFrame(t, enhancedUS, "4", encapsulatedPixelValue(t, []byte{1, 1}, []byte{2, 2}), 2,
+				newTestElement(t, tag.TransferSyntaxUID, []string{rleLosslessTransferSyntax})),
+			want: []splitFrame{
+				{sopClass: enhancedUS, numberOfFrames: "1", instanceNumber: "40001"},
+				{sopClass: enhancedUS, numberOfFrames: "1", instanceNumber: "40002"},
+			},
+		},
+		{
+			name:    "multi-frame without functional groups",
+			ds:      multiFrame(t, ultrasoundMulti, "1", pixelValue(t, []byte{1, 2, 3, 4}, "OB"), 2),
+			wantErr: true,
+		},
+		{
+			name:    "pixel data too short",
+			ds:      multiFrame(t, enhancedUS, "1", pixelValue(t, []byte{1, 2, 3, 4}, "OB"), 3),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "multiframe.dcm")
+			writeTestFile(t, path, tt.ds)
+			frames, err := splitFrames(path, &frameCounter{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(frames) != len(tt.want) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(tt.want))
+			}
+			sopInstanceUID := getString(&tt.ds, tag.SOPInstanceUID)
+			for i, f := range frames {
+				got := splitFrame{
+					sopClass:       getString(&f, tag.SOPClassUID),
+					numberOfFrames: getString(&f, tag.NumberOfFrames),
+					instanceNumber: getString(&f, tag.InstanceNumber),
+					pixelSpacing:   getString(&f, tag.PixelSpacing),
+					echoTime:       getString(&f, tag.EchoTime),
+				}
+				if e, err := f.FindElementByTag(tag.ImagePositionPatient); err == nil {
+					got.position = elementValueString(e)
+				}
+				if tt.want[i].pixels != nil {
+					got.pixels = elementBytes(t, f.Elements, tag.PixelData)
+				}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("frame %d is %+v, want %+v", i+1, got, tt.want[i])
+				}
+				if uid := getString(&f, tag.SOPInstanceUID); uid != frameUID(sopInstanceUID, i+1) || getString(&f, tag.MediaStorageSOPInstanceUID) != uid {
+					t.Errorf("frame %d has SOPInstanceUID %s, want %s in the data set and the file meta information", i+1, uid, frameUID(sopInstanceUID, i+1))
+				}
+				if getString(&f, tag.MediaStorageSOPClassUID) != got.sopClass {
+					t.Errorf("frame %d has MediaStorageSOPClassUID %s, want %s", i+1, getString(&f, tag.MediaStorageSOPClassUID), got.sopClass)
+				}
+				if got.sopClass == ctImageStorage || got.sopClass == mrImageStorage {
+					for _, tg := range []tag.Tag{tag.SharedFunctionalGroupsSequence, tag.PerFrameFunctionalGroupsSequence, tag.DimensionOrganizationType, tag.DimensionIndexValues} {
+						if _, err := f.FindElementByTag(tg); err == nil {
+							t.Errorf("frame %d of a classic instance has %s", i+1, tg)
+						}
+					}
+				}
+				// each frame has to be a valid file
+				var buf bytes.Buffer
+				if err := dicom.Write(&buf, f, dicom.SkipVRVerification(), dicom.SkipValueTypeVerification()); err != nil {
+					t.Errorf("could not write frame %d (%s)", i+1, err)
+				} else if _, err := dicom.Parse(&buf, int64(buf.Len()), nil, dicom.SkipPixelData()); err != nil {
+					t.Errorf("could not parse frame %d (%s)", i+1, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitFramesNumbering(t *testing.T) {
+	const enhancedCT = "1.2.840.10008.5.1.4.1.1.2.1"
+	dir := t.TempDir()
+	counter := &frameCounter{}
+	// objects without a usable InstanceNumber continue the numbers of their series
+	tests := []struct {
+		series         string
+		instanceNumber string
+		frames         int
+		want           []string
+	}{
+		{series: "1.2.3.5", instanceNumber: "", frames: 2, want: []string{"1", "2"}},
+		{series: "1.2.3.5", instanceNumber: "0", frames: 3, want: []string{"3", "4", "5"}},
+		{series: "1.2.3.5", instanceNumber: "7", frames: 2, want: []string{"70001", "70002"}},
+		{series: "1.2.3.5", instanceNumber: "200000", frames: 1, want: []string{"6"}},
+		{series: "1.2.3.6", instanceNumber: "", frames: 2, want: []string{"1", "2"}},
+	}
+	for i, tt := range tests {
+		ds := multiFrame(t, enhancedCT, tt.instanceNumber, pixelValue(t, make([]byte, 2*tt.frames), "OB"), tt.frames)
+		setElement(&ds, tag.SeriesInstanceUID, []string{tt.series})
+		path := filepath.Join(dir, fmt.Sprintf("%d.dcm", i))
+		writeTestFile(t, path, ds)
+		frames, err := splitFrames(path, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range frames {
+			got = append(got, getString(&f, tag.InstanceNumber))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("object %d of series %s has InstanceNumbers %v, want %v", i, tt.series, got, tt.want)
+		}
+	}
+}
+
+func TestRunSplitFrames(t *testing.T) {
+	in := t.TempDir()
+	enhanced := multiFrame(t, "1.2.840.10008.5.1.4.1.1.2.1", "", pixelValue(t, []byte{1, 2, 3, 4}, "OB"), 2)
+	writeTestFile(t, filepath.Join(in, "enhanced.dcm"), enhanced)
+	// a second object of the series without InstanceNumber, the frames must not get the same numbers
+	setElement(&enhanced, tag.SOPInstanceUID, []string{"1.2.3.5.2"})
+	setElement(&enhanced, tag.MediaStorageSOPInstanceUID, []string{"1.2.3.5.2"})
+	writeTestFile(t, filepath.Join(in, "enhanced2.dcm"), enhanced)
+	cine := multiFrame(t, "1.2.840.10008.5.1.4.1.1.3.1", "1", pixelValue(t, []byte{1, 2, 3, 4}, "OB"), 2)
+	setElement(&cine, tag.SeriesInstanceUID, []string{"1.2.3.6"})
+	writeTestFile(t, filepath.Join(in, "cine.dcm"), cine)
+
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.SplitFrames = []string{in}, out, true, "none", true
+	opts.Folder = "{SeriesInstanceUID}/{InstanceNumber}.dcm"
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.2.3.5/1.dcm", "1.2.3.5/2.dcm", "1.2.3.5/3.dcm", "1.2.3.5/4.dcm", "1.2.3.6/1.dcm"}
+	if got := listFiles(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("output %v, want %v", got, want)
+	}
+	if result.Files != 5 {
+		t.Errorf("%d files sorted, want 5", result.Files)
+	}
+	// the cine loop is copied as it is
+	ds, err := readDatasetFile(filepath.Join(out, "1.2.3.6/1.dcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := getInt(&ds, tag.NumberOfFrames, 1); n != 2 {
+		t.Errorf("the cine loop has %d frames, want 2", n)
+	}
+}
@@ -0,0 +1,396 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// 'sdcm query <input folder>' reads the headers of all files (nothing is
+// written) and prints one row per patient, study or series (-group). Files
+// are selected with -where, conditions use the syntax of the folder path
+// filters: {Modality==CT} matches a regular expression, {Modality!=CT} its
+// negation and {SliceThickness<1} (also <=, >, >=) compares numbers.
+// Several conditions must all match. With -without only groups are listed
+// that do not contain a file matching the conditions, e.g. studies without
+// a T1 series. -columns selects the tags of the table, the counts
+// NumberOfStudies, NumberOfSeries and NumberOfFiles can be added as well.
+
+// queryState holds the conditions, columns and groups of a query
+type queryState struct {
+	queryMode             bool
+	whereFlag             string
+	withoutFlag           string
+	groupFlag             string
+	columnsFlag           string
+	outputFormatQueryFlag string
+
+	whereConditions   []queryCondition
+	withoutConditions []queryCondition
+	queryColumns      []string
+	queryColumnTags   map[string]tag.Tag
+	queryGroups       map[string]*queryGroup
+	queryGroupsMutex  sync.Mutex
+}
+
+// queryCondition is a single {Tag op value} condition
+type queryCondition struct {
+	tag    tag.Tag
+	op     string
+	re     *regexp.Regexp
+	number float64
+}
+
+// queryGroup is a row of the result
+type queryGroup struct {
+	values   map[tag.Tag]string // values of the first file
+	studies  map[string]bool
+	series   map[string]bool
+	files    int
+	excluded bool // a file matched -without
+}
+
+var queryConditionRegex = regexp.MustCompile(`{([^{}]*?)(==|!=|<=|>=|=|<|>)([^{}]*)}`)
+
+// count columns that are not tags
+var queryCounts = []string{"NumberOfStudies", "NumberOfSeries", "NumberOfFiles"}
+
+// names of the groups in the summary
+var queryGroupNames = map[string][2]string{"patient": {"patient", "patients"}, "study": {"study", "studies"}, "series": {"series", "series"}}
+
+// default columns of each group
+var queryDefaultColumns = map[string]string{
+	"patient": "PatientID,PatientName,NumberOfStudies,NumberOfSeries,NumberOfFiles",
+	"study":   "PatientID,StudyDate,StudyDescription,AccessionNumber,StudyInstanceUID,NumberOfSeries,NumberOfFiles",
+	"series":  "PatientID,StudyDate,Modality,SeriesNumber,SeriesDescription,SeriesInstanceUID,NumberOfFiles",
+}
+
+// parseConditions parses a list of {Tag op value} conditions
+func parseConditions(s string) ([]queryCondition, error) {
+	var conditions []queryCondition
+	matches := queryConditionRegex.FindAllStringSubmatch(s, -1)
+	if strings.TrimSpace(queryConditionRegex.ReplaceAllString(s, "")) != "" {
+		return nil, fmt.Errorf("could not parse \"%s\", use conditions like {Modality==CT}{SliceThickness<1}", s)
+	}
+	for _, m := range matches {
+		t, err := parseTagString(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("unknown tag \"%s\" (%s)", m[1], err)
+		}
+		c := queryCondition{tag: t, op: m[2]}
+		switch c.op {
+		case "==", "=", "!=":
+			if c.re, err = regexp.Compile(m[3]); err != nil {
+				return nil, fmt.Errorf("invalid regular expression \"%s\" (%s)", m[3], err)
+			}
+		default:
+			if c.number, err = strconv.ParseFloat(strings.TrimSpace(m[3]), 64); err != nil {
+				return nil, fmt.Errorf("%s needs a number, not \"%s\"", c.op, m[3])
+			}
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// initQuery checks the options of 'sdcm query' and adds the tags it needs to the tags that are read
+func (e *engine) initQuery() error {
+	var err error
+	if e.whereConditions, err = parseConditions(e.whereFlag); err != nil {
+		return fmt.Errorf("-where: %s", err)
+	}
+	if e.withoutConditions, err = parseConditions(e.withoutFlag); err != nil {
+		return fmt.Errorf("-without: %s", err)
+	}
+	if _, ok := queryDefaultColumns[e.groupFlag]; !ok {
+		return fmt.Errorf("unknown option \"%s\" for -group, use patient, study or series", e.groupFlag)
+	}
+	switch e.outputFormatQueryFlag {
+	case "text", "csv", "json":
+	default:
+		return fmt.Errorf("unknown option \"%s\" for -output-format, use text, csv or json", e.outputFormatQueryFlag)
+	}
+	columns := e.columnsFlag
+	if columns == "" {
+		columns = queryDefaultColumns[e.groupFlag]
+	}
+	e.queryColumnTags = make(map[string]tag.Tag, 0)
+	needed := []tag.Tag{tag.PatientID, tag.StudyInstanceUID, tag.SeriesInstanceUID}
+	for _, c := range strings.Split(columns, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		e.queryColumns = append(e.queryColumns, c)
+		if isQueryCount(c) {
+			continue
+		}
+		t, err := parseTagString(c)
+		if err != nil {
+			return fmt.Errorf("unknown tag \"%s\" in -columns (%s)", c, err)
+		}
+		e.queryColumnTags[c] = t
+		needed = append(needed, t)
+	}
+	for _, c := range append(append([]queryCondition{}, e.whereConditions...), e.withoutConditions...) {
+		needed = append(needed, c.tag)
+	}
+	for _, t := range needed {
+		if _, ok := e.dicomTags[t]; !ok {
+			e.dicomTags[t] = ""
+		}
+	}
+	return nil
+}
+
+// isQueryCount returns true for the columns that count studies, series or files
+func isQueryCount(column string) bool {
+	for _, n := range queryCounts {
+		if column == n {
+			return true
+		}
+	}
+	return false
+}
+
+// matchConditions returns true if a data set matches all conditions
+func matchConditions(ds *dicom.Dataset, conditions []queryCondition) bool {
+	for _, c := range conditions {
+		e := findElement(ds, c.tag)
+		value := strings.Join(elementValues(e), "\\")
+		switch c.op {
+		case "==", "=":
+			if !c.re.MatchString(value) {
+				return false
+			}
+		case "!=":
+			if c.re.MatchString(value) {
+				return false
+			}
+		default:
+			v, err := strconv.ParseFloat(strings.TrimSpace(elementValueString(e)), 64)
+			if err != nil {
+				return false
+			}
+			if (c.op == "<" && !(v < c.number)) || (c.op == "<=" && !(v <= c.number)) ||
+				(c.op == ">" && !(v > c.number)) || (c.op == ">=" && !(v >= c.number)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryDataset adds a data set to its group
+func (e *engine) queryDataset(ds *dicom.Dataset) {
+	if !matchConditions(ds, e.whereConditions) {
+		return
+	}
+	studyInstanceUID, _ := findElementValue(ds, tag.StudyInstanceUID)
+	seriesInstanceUID, _ := findElementValue(ds, tag.SeriesInstanceUID)
+	key, _ := findElementValue(ds, tag.PatientID)
+	switch e.groupFlag {
+	case "study":
+		key = studyInstanceUID
+	case "series":
+		key = seriesInstanceUID
+	}
+	excluded := len(e.withoutConditions) > 0 && matchConditions(ds, e.withoutConditions)
+
+	e.queryGroupsMutex.Lock()
+	defer e.queryGroupsMutex.Unlock()
+	g, ok := e.queryGroups[key]
+	if !ok {
+		g = &queryGroup{values: make(map[tag.Tag]string, len(e.queryColumnTags)), studies: make(map[string]bool, 0), series: make(map[string]bool, 0)}
+		for _, t := range e.queryColumnTags {
+			g.values[t] = strings.TrimSpace(strings.Join(elementValues(findElement(ds, t)), "\\"))
+		}
+		e.queryGroups[key] = g
+	}
+	g.studies[studyInstanceUID] = true
+	g.series[seriesInstanceUID] = true
+	g.files++
+	g.excluded = g.excluded || excluded
+}
+
+// scanFile reads a file (or takes its values from the index) and passes its header to handle
+func (e *engine) scanFile(path string, info os.FileInfo, handle func(ds *dicom.Dataset)) {
+	if e.isIndexFile(path) || matchGlobs(e.excludeGlobs, path) || e.canceled() {
+		return
+	}
+	in_file := filepath.Join(e.inputDataPath, path)
+	if entry, ok := e.lookupIndex(path, info); ok {
+		if ds := indexedDataset(entry); !entry.NotDICOM && getString(&ds, tag.MediaStorageSOPClassUID) != mediaStorageDirectoryStorage {
+			handle(&ds)
+		}
+		return
+	}
+	if e.tagsSampleFlag > 0 && atomic.LoadInt32(&e.counterScanned) >= int32(e.tagsSampleFlag) {
+		return
+	}
+	if !e.thoroughFlag && !matchGlobs(e.includeGlobs, path) && !sniffDicom(in_file) {
+		return
+	}
+	if e.tagsSampleFlag > 0 && atomic.AddInt32(&e.counterScanned, 1) > int32(e.tagsSampleFlag) {
+		return
+	}
+	ds, err := e.readInputFile(in_file)
+	if err != nil {
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "ignore file, cannot read as DICOM: \"%s\"\n", in_file)
+		}
+		return
+	}
+	if getString(&ds, tag.MediaStorageSOPClassUID) == mediaStorageDirectoryStorage {
+		return
+	}
+	handle(&ds)
+}
+
+// scanHeaders reads the headers of all files of the input folders (nothing is written)
+func (e *engine) scanHeaders(source_paths []string, handle func(ds *dicom.Dataset)) {
+	for _, source_path := range source_paths {
+		if info, err := os.Stat(source_path); err == nil && !info.IsDir() {
+			e.inputDataPath = ""
+			e.currentIndex = nil
+			e.scanFile(source_path, info, handle)
+			continue
+		}
+		e.inputDataPath = source_path
+		e.currentIndex = nil
+		if e.useIndexFlag {
+			e.currentIndex = e.loadIndex(source_path)
+		}
+		err := e.walkFiles(source_path, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info != nil && !info.IsDir() {
+				e.scanFile(path, info, handle)
+			}
+			return nil
+		})
+		if err != nil {
+			e.warn("could not read all files in %s (%s)", source_path, err)
+		}
+	}
+}
+
+// queryFolders reads all files of the input folders and prints the groups to out
+func (e *engine) queryFolders(source_paths []string, out io.Writer) error {
+	e.scanHeaders(source_paths, e.queryDataset)
+	if err := e.runContext.Err(); err != nil {
+		return err
+	}
+	return e.printQuery(out)
+}
+
+// queryRows returns the cells of the groups in the order of -columns, sorted by the cells
+func (e *engine) queryRows() [][]string {
+	var rows [][]string
+	for _, g := range e.queryGroups {
+		if g.excluded {
+			continue
+		}
+		row := make([]string, len(e.queryColumns))
+		for i, c := range e.queryColumns {
+			switch c {
+			case "NumberOfStudies":
+				row[i] = strconv.Itoa(len(g.studies))
+			case "NumberOfSeries":
+				row[i] = strconv.Itoa(len(g.series))
+			case "NumberOfFiles":
+				row[i] = strconv.Itoa(g.files)
+			default:
+				row[i] = g.values[e.queryColumnTags[c]]
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		for i := range rows[a] {
+			if rows[a][i] != rows[b][i] {
+				return rows[a][i] < rows[b][i]
+			}
+		}
+		return false
+	})
+	return rows
+}
+
+// printQuery writes the result as a table, CSV or JSON
+func (e *engine) printQuery(output io.Writer) error {
+	rows := e.queryRows()
+	switch e.outputFormatQueryFlag {
+	case "csv":
+		w := csv.NewWriter(output)
+		w.Write(e.queryColumns)
+		w.WriteAll(rows)
+		return w.Error()
+	case "json":
+		// objects keep the order of -columns
+		var b bytes.Buffer
+		b.WriteString("[")
+		for r, row := range rows {
+			if r > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString("{")
+			for i, c := range e.queryColumns {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				key, _ := json.Marshal(c)
+				value, _ := json.Marshal(row[i])
+				if isQueryCount(c) {
+					value = []byte(row[i])
+				}
+				b.Write(key)
+				b.WriteString(":")
+				b.Write(value)
+			}
+			b.WriteString("}")
+		}
+		b.WriteString("]")
+		var out bytes.Buffer
+		if err := json.Indent(&out, b.Bytes(), "", "  "); err != nil {
+			return err
+		}
+		out.WriteString("\n")
+		_, err := out.WriteTo(output)
+		return err
+	}
+	w := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(e.queryColumns, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !e.quietFlag {
+		files := 0
+		for _, g := range e.queryGroups {
+			if !g.excluded {
+				files += g.files
+			}
+		}
+		fmt_local.Fprintf(os.Stderr, "%d %s, %d matching file%s\n", len(rows), queryGroupNames[e.groupFlag][map[bool]int{true: 0, false: 1}[len(rows) == 1]], files, map[bool]string{true: "", false: "s"}[files == 1])
+	}
+	return nil
+}
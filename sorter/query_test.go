@@ -0,0 +1,225 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestParseConditions(t *testing.T) {
+	type want struct {
+		tag    tag.Tag
+		op     string
+		re     string
+		number float64
+	}
+	tests := []struct {
+		in      string
+		want    []want
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "{Modality==CT}", want: []want{{tag: tag.Modality, op: "==", re: "CT"}}},
+		{in: "{Modality=CT|MR}", want: []want{{tag: tag.Modality, op: "=", re: "CT|MR"}}},
+		{in: "{SeriesDescription!=^T1}", want: []want{{tag: tag.SeriesDescription, op: "!=", re: "^T1"}}},
+		{
+			in: "{SliceThickness<1}{SliceThickness>=0.5} {Rows>256}{Columns<=512}",
+			want: []want{
+				{tag: tag.SliceThickness, op: "<", number: 1},
+				{tag: tag.SliceThickness, op: ">=", number: 0.5},
+				{tag: tag.Rows, op: ">", number: 256},
+				{tag: tag.Columns, op: "<=", number: 512},
+			},
+		},
+		{in: "{(0018,0050)< 2 }", want: []want{{tag: tag.SliceThickness, op: "<", number: 2}}},
+		{in: "{0010,0020==P.*}", want: []want{{tag: tag.PatientID, op: "==", re: "P.*"}}},
+		{in: "Modality==CT", wantErr: true},
+		{in: "{Modality==CT} and more", wantErr: true},
+		{in: "{Modality}", wantErr: true},
+		{in: "{NoSuchTag==CT}", wantErr: true},
+		{in: "{Modality==[}", wantErr: true},
+		{in: "{SliceThickness<thin}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseConditions(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseConditions(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseConditions(%q) has %d conditions, want %d", tt.in, len(got), len(tt.want))
+			continue
+		}
+		for i, w := range tt.want {
+			c := got[i]
+			re := ""
+			if c.re != nil {
+				re = c.re.String()
+			}
+			if c.tag != w.tag || c.op != w.op || re != w.re || c.number != w.number {
+				t.Errorf("parseConditions(%q) condition %d is {%s %s %q %g}, want {%s %s %q %g}",
+					tt.in, i, c.tag, c.op, re, c.number, w.tag, w.op, w.re, w.number)
+			}
+		}
+	}
+}
+
+func TestMatchConditions(t *testing.T) {
+	ds := newTestInstance(t, "1.2.3.1", 1,
+		newTestElement(t, tag.SeriesDescription, []string{"T1 MPRAGE "}),
+		newTestElement(t, tag.ImageType, []string{"ORIGINAL", "PRIMARY"}),
+		newTestElement(t, tag.SliceThickness, []string{"0.8"}),
+		newTestElement(t, tag.Rows, []int{256}))
+	tests := []struct {
+		where string
+		want  bool
+	}{
+		{where: "", want: true},
+		{where: "{Modality==CT}", want: true},
+		{where: "{Modality==MR}"},
+		{where: "{Modality!=MR}", want: true},
+		{where: "{Modality!=CT}"},
+		{where: "{SeriesDescription==^T1}", want: true},
+		{where: "{SeriesDescription==T2}"},
+		// multiple values are joined with a backslash
+		{where: `{ImageType==ORIGINAL\\PRIMARY}`, want: true},
+		{where: "{ImageType==^PRIMARY}"},
+		{where: "{SliceThickness<1}", want: true},
+		{where: "{SliceThickness<0.8}"},
+		{where: "{SliceThickness<=0.8}", want: true},
+		{where: "{SliceThickness>0.5}", want: true},
+		{where: "{SliceThickness>=1}"},
+		{where: "{Rows>=256}", want: true},
+		{where: "{Rows>256}"},
+		// a missing tag matches an empty string and no number
+		{where: "{SeriesNumber==1}{StudyDescription==^$}", want: true},
+		{where: "{StudyDescription!=^$}"},
+		{where: "{EchoTime<100}"},
+		// not a number
+		{where: "{Modality>0}"},
+		// all conditions must match
+		{where: "{Modality==CT}{SliceThickness<1}", want: true},
+		{where: "{Modality==CT}{SliceThickness>1}"},
+	}
+	for _, tt := range tests {
+		conditions, err := parseConditions(tt.where)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.where, err)
+		}
+		if got := matchConditions(&ds, conditions); got != tt.want {
+			t.Errorf("matchConditions(%q) = %v, want %v", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	in := t.TempDir()
+	// study 1 has a T1 and a T2 series, study 2 only a T2 series
+	files := []struct {
+		study, series, description string
+		thickness                  string
+	}{
+		{"1.2.3", "1.2.3.1", "T1 MPRAGE", "1"},
+		{"1.2.3", "1.2.3.1", "T1 MPRAGE", "1"},
+		{"1.2.3", "1.2.3.2", "T2 FLAIR", "3"},
+		{"1.2.4", "1.2.4.1", "T2 FLAIR", "3"},
+		{"1.2.4", "1.2.4.1", "T2 FLAIR", "3"},
+	}
+	for i, f := range files {
+		ds := newTestInstance(t, f.series, i+1,
+			newTestElement(t, tag.SeriesDescription, []string{f.description}),
+			newTestElement(t, tag.SliceThickness, []string{f.thickness}))
+		for _, e := range ds.Elements {
+			if e.Tag == tag.StudyInstanceUID {
+				e.Value = newTestElement(t, tag.StudyInstanceUID, []string{f.study}).Value
+			}
+		}
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("%d.dcm", i)), ds)
+	}
+	tests := []struct {
+		name                  string
+		where, without, group string
+		columns               string
+		want                  string
+	}{
+		{
+			name:    "series",
+			group:   "series",
+			columns: "SeriesInstanceUID,SeriesDescription,NumberOfFiles",
+			want:    "SeriesInstanceUID,SeriesDescription,NumberOfFiles\n1.2.3.1,T1 MPRAGE,2\n1.2.3.2,T2 FLAIR,1\n1.2.4.1,T2 FLAIR,2\n",
+		},
+		{
+			name:    "thin slices",
+			where:   "{SliceThickness<2}",
+			group:   "study",
+			columns: "StudyInstanceUID,NumberOfSeries,NumberOfFiles",
+			want:    "StudyInstanceUID,NumberOfSeries,NumberOfFiles\n1.2.3,1,2\n",
+		},
+		{
+			name:    "studies without a T1 series",
+			without: "{SeriesDescription==^T1}",
+			group:   "study",
+			columns: "StudyInstanceUID,NumberOfSeries",
+			want:    "StudyInstanceUID,NumberOfSeries\n1.2.4,1\n",
+		},
+		{
+			name:    "patients",
+			group:   "patient",
+			columns: "PatientID,NumberOfStudies,NumberOfSeries,NumberOfFiles",
+			want:    "PatientID,NumberOfStudies,NumberOfSeries,NumberOfFiles\nP1,2,3,5\n",
+		},
+		{
+			name:    "nothing matches",
+			where:   "{Modality==MR}",
+			group:   "series",
+			columns: "SeriesInstanceUID",
+			want:    "SeriesInstanceUID\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Input, opts.Quiet = []string{in}, true
+			opts.Where, opts.Without, opts.Group, opts.Columns, opts.OutputFormat = tt.where, tt.without, tt.group, tt.columns, "csv"
+			var out bytes.Buffer
+			if err := New(opts).Query(context.Background(), &out); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("query result\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(o *Options)
+		want  string
+	}{
+		{name: "where", apply: func(o *Options) { o.Where = "{Modality}" }, want: "-where"},
+		{name: "without", apply: func(o *Options) { o.Without = "{Rows<many}" }, want: "-without"},
+		{name: "group", apply: func(o *Options) { o.Group = "instance" }, want: "-group"},
+		{name: "output format", apply: func(o *Options) { o.OutputFormat = "xml" }, want: "-output-format"},
+		{name: "columns", apply: func(o *Options) { o.Columns = "PatientID,NoSuchTag" }, want: "-columns"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Input, opts.Quiet = []string{t.TempDir()}, true
+		tt.apply(&opts)
+		err := New(opts).Query(context.Background(), &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want an error about %s", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,705 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sync/atomic"
+
+	"github.com/suyashkumar/dicom"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+
+	"golang.org/x/text/message"
+
+	"github.com/djherbis/times"
+)
+
+// sortState holds the settings and counters of a sort
+type sortState struct {
+	counter            int32
+	counterError       int32
+	bytesWritten       int64
+	processDataPath    string
+	inputDataPath      string
+	startTime          time.Time
+	listPatients       sync.Map
+	listStudies        sync.Map
+	listSeries         sync.Map
+	listStructure      map[string][]string // map of SeriesInstanceUID\Modality of [PatientID, StudyDate, StudyInstanceUID, Modality]
+	modalities         map[string]int
+	listStructureMutex sync.Mutex // mutex to protect listStructure and modalities
+
+	dicomTags map[tag.Tag]string
+	preserve  map[string]bool
+
+	// listStructuresChan is a channel to collect patient, study, series and modality information into listStructure
+	listStructuresChan chan []string
+
+	methodFlag       string
+	verboseFlag      bool
+	quietFlag        bool
+	outputFolderFlag string
+	thoroughFlag     bool
+	braveFlag        bool
+	debugFlag        bool
+	num_workers      int
+	preserveFlag     string
+}
+
+var fmt_local = message.NewPrinter(message.MatchLanguage("en"))
+
+// based on Wikipedia: / \ ? * : | " < >
+// replace characters to create a valid directory name on all systems
+var sanitizeFilenameReplacer *strings.Replacer = strings.NewReplacer("/", " ", "\\", "", "?", " ", "*", " ", ":", " ", "|", " ", "\"", " ", "<", " ", ">", " ")
+
+// known DICOM modality codes (https://www.dicomlibrary.com/dicom/modality/, https://dicom.innolitics.com/ciods/digital-x-ray-image/dx-series/00080060)
+var dicomModalityCodes = map[string]string{
+	"AR":         "Autorefraction",
+	"AS":         "Angioscopy",
+	"ASMT":       "Content Assessment Results",
+	"AU":         "Audio",
+	"BDUS":       "Bone Densitometry (ultrasound)",
+	"BI":         "Biomagnetic imaging",
+	"BMD":        "Bone Densitometry (X-Ray)",
+	"CD":         "Color flow Doppler",
+	"CF":         "Cinefluorography",
+	"CP":         "Colposcopy",
+	"CR":         "Computed Radiography",
+	"CS":         "Cystoscopy",
+	"CT":         "Computed Tomography",
+	"CTPROTOCOL": "CT Protocol Performed",
+	"DD":         "Duplex Doppler",
+	"DF":         "Digital fluoroscopy",
+	"DG":         "Diaphanography",
+	"DM":         "Digital microscopy",
+	"DMS":        "Dermoscopy",
+	"DOC":        "Document",
+	"DS":         "Digital Subtraction Angiography",
+	"DX":         "Digital Radiography",
+	"EC":         "Echocardiography",
+	"ECG":        "Electrocardiography",
+	"EMG":        "Electromyography",
+	"EOG":        "Electrooculography",
+	"EPS":        "Cardiac Electrophysiology",
+	"ES":         "Endoscopy",
+	"FA":         "Fluorescein angiography",
+	"FID":        "Fiducials",
+	"FS":         "Fundoscopy",
+	"GM":         "General Microscopy",
+	"HC":         "Hard Copy",
+	"HD":         "Hemodynamic Waveform",
+	"IO":         "Intra-Oral Radiography",
+	"IOL":        "Intraocular Lens Data",
+	"IVOCT":      "Intravascular Optical Coherence Tomography",
+	"IVUS":       "Intravascular Ultrasound",
+	"KER":        "Keratometry",
+	"KO":         "Key Object Selection",
+	"LEN":        "Lensometry",
+	"LP":         "Laparoscopy",
+	"LS":         "Laser surface scan",
+	"M3D":        "Model for 3D Manufacturing",
+	"MA":         "Magnetic resonance angiography",
+	"MG":         "Mammography",
+	"MR":         "Magnetic Resonance",
+	"MS":         "Magnetic resonance spectroscopy",
+	"NM":         "Nuclear Medicine",
+	"OAM":        "Ophthalmic Axial Measurements",
+	"OCT":        "Optical Coherence Tomography (non-Ophthalmic)",
+	"OP":         "Ophthalmic Photography",
+	"OPM":        "Ophthalmic Mapping",
+	"OPR":        "Ophthalmic Refraction",
+	"OPT":        "Ophthalmic Tomography",
+	"OPTBSV":     "Ophthalmic Tomography B-scan Volume Analysis",
+	"OPTENF":     "Ophthalmic Tomography En Face",
+	"OPV":        "Ophthalmic Visual Field",
+	"OSS":        "Optical Surface Scan",
+	"OT":         "Other",
+	"PLAN":       "Plan",
+	"PR":         "Presentation State",
+	"PT":         "Positron emission tomography - PET",
+	"PX":         "Panoramic X-Ray",
+	"REG":        "Registration",
+	"RESP":       "Respiratory Waveform",
+	"RF":         "Radio Fluoroscopy",
+	"RG":         "Radiographic imaging (conventional film/screen)",
+	"RTDOSE":     "Radiotherapy Dose",
+	"RTIMAGE":    "Radiotherapy Image",
+	"RTPLAN":     "Radiotherapy Plan",
+	"RTRECORD":   "RT Treatment Record",
+	"RTSTRUCT":   "Radiotherapy Structure Set",
+	"RWV":        "Real World Value Map",
+	"SEG":        "Segmentation",
+	"SM":         "Slide Microscopy",
+	"SMR":        "Stereometric Relationship",
+	"SR":         "SR Document",
+	"SRF":        "Subjective Refraction",
+	"ST":         "Single-photon emission computed tomography - SPECT",
+	"STAIN":      "Automated Slide Stainer",
+	"TG":         "Thermography",
+	"US":         "Ultrasound",
+	"VA":         "Visual Acuity",
+	"VF":         "Videofluorography",
+	"XA":         "X-Ray Angiography",
+	"XC":         "External-camera Photography",
+}
+
+func updateCounter(counters *sync.Map, key string) {
+	val, _ := counters.LoadOrStore(key, new(int64))
+	ptr := val.(*int64)
+	atomic.AddInt64(ptr, 1)
+}
+
+// ModalityName returns the name of a DICOM modality code (e.g. "Computed Tomography" for CT)
+func ModalityName(code string) string {
+	if name, ok := dicomModalityCodes[code]; ok {
+		return name
+	}
+	return code
+}
+
+var nonAlphanumericRegex = regexp.MustCompile(`[^a-zA-Z0-9 ]+`)
+
+func clearString(str string) string {
+	return nonAlphanumericRegex.ReplaceAllString(strings.Trim(str, " "), "-")
+}
+
+func (e *engine) copyFileContents(src, dst string) (bytesWritten int64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	h := e.outputHash(dst)
+	if bytesWritten, err = io.Copy(hashWriter(out, h), in); err != nil {
+		return 0, err
+	}
+	e.recordChecksum(dst, h)
+	err = e.syncOutputFile(out)
+	return bytesWritten, err
+}
+
+func splitPath(path string) []string {
+	dir, last := filepath.Split(path)
+	if dir == "" {
+		return []string{last}
+	}
+	return append(splitPath(filepath.Clean(dir)), last)
+}
+
+func (e *engine) processDataset(dataset dicom.Dataset, path string, oOrderPath string, in_file string) error {
+	// in some special cases we want to skip this DICOM, e.g. DICOMDIR
+	val, err := dataset.FindElementByTag(tag.MediaStorageSOPClassUID)
+	if err == nil {
+		var vs string = dicom.MustGetStrings(val.Value)[0]
+		if vs == "1.2.840.10008.1.3.10" {
+			// skip MediaStorageDirectoryStorage
+			e.skipFile(in_file, ErrDICOMDIR)
+			if e.debugFlag {
+				fmt.Fprintf(os.Stderr, "[%d] ignore DICOMDIR file: \"%s\"\n\n", e.counterError, path)
+			}
+			return nil
+		}
+	}
+
+	// enhanced multi-frame objects can be split into one instance per frame
+	if e.splitFramesFlag && e.methodFlag == "copy" && getInt(&dataset, tag.NumberOfFrames, 1) > 1 && isEnhanced(&dataset) {
+		frames, err := splitFrames(in_file, &e.frameNumbers)
+		if err == nil {
+			for i := range frames {
+				if err := e.sortDataset(frames[i], path, oOrderPath, in_file, &frames[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "could not split frames, copy as a single file (%s): \"%s\"\n", err, path)
+		}
+	}
+	return e.sortDataset(dataset, path, oOrderPath, in_file, nil)
+}
+
+// sortDataset creates the output file for a data set (with the writer pool if it runs). If content
+// is not nil it is written instead of copying in_file. Returns the error if the output folder could
+// not be created or, without the writer pool, the file could not be written.
+func (e *engine) sortDataset(dataset dicom.Dataset, path string, oOrderPath string, in_file string, content *dicom.Dataset) error {
+	// go through all tags we need and pull those, use a map of tag.Tag as key and string as value
+	// use together with dicomTags (tag.Tag as key and "{bla}" as value).
+	dicomVals := make(map[tag.Tag]string, 0)
+	for key := range e.dicomTags {
+		// values of enhanced objects might only exist in the functional groups
+		if vs, ok := findElementValue(&dataset, key); ok {
+			// this is used as a filename, we should sanitize them
+			dicomVals[key] = sanitizeFilenameReplacer.Replace(vs)
+			// we should check if vs is a safe string for a directory name
+		} else {
+			dicomVals[key] = ""
+		}
+	}
+
+	// if we filter we might not like this file
+	var skipThisFile bool = false
+
+	// now create the folder structure based on outputFolderFlag, treat the last entry as filename
+	pps := e.outputFolderFlag
+	for t := range dicomVals {
+		// if we have a dicomTags[t] that contains an "==" we need to filter, only allow matching entries
+		// TODO: could be done faster if we cache the regular expressions for each tag they are needed
+		if strings.Contains(e.dicomTags[t], "==") {
+			r := strings.Split(e.dicomTags[t], "==")[1]
+			r = strings.TrimSuffix(r, "}")
+			re := regexp.MustCompile(r)
+			if !(re.MatchString(dicomVals[t])) {
+				skipThisFile = true
+				break
+			}
+		} else if strings.Contains(e.dicomTags[t], "=") {
+			r := strings.Split(e.dicomTags[t], "=")[1]
+			r = strings.TrimSuffix(r, "}")
+			re := regexp.MustCompile(r)
+			if !(re.MatchString(dicomVals[t])) {
+				skipThisFile = true
+				break
+			}
+		}
+
+		if t == tag.SeriesNumber {
+			sn, err := strconv.Atoi(dicomVals[tag.SeriesNumber])
+			if err == nil {
+				pps = strings.Replace(pps, "{SeriesNumber}", fmt.Sprintf("%03d", sn), -1)
+			} else {
+				pps = strings.Replace(pps, "{SeriesNumber}", dicomVals[tag.SeriesNumber], -1)
+			}
+		} else {
+			pps = strings.Replace(pps, e.dicomTags[t], dicomVals[t], -1)
+		}
+	}
+	if skipThisFile {
+		e.skipFile(in_file, ErrFiltered)
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "[%d] ignore file, cannot read as DICOM: \"%s\"\n\n", e.counterError, path)
+		}
+		return nil
+	}
+
+	if e.consistencyReportFlag != "" {
+		e.recordIdentifiers(&dataset)
+	}
+
+	// keep track of the patients, studies and series, the modalities only if the progress is reported
+	updateCounter(&e.listPatients, dicomVals[tag.PatientID])
+	updateCounter(&e.listStudies, dicomVals[tag.StudyInstanceUID])
+	updateCounter(&e.listSeries, dicomVals[tag.SeriesInstanceUID])
+	if e.events != nil {
+		// TODO: what if the variables do not exist? Does this fail?
+		e.listStructuresChan <- []string{dicomVals[tag.PatientID], dicomVals[tag.StudyDate], dicomVals[tag.StudyInstanceUID], dicomVals[tag.SeriesInstanceUID], dicomVals[tag.Modality]}
+	}
+
+	// the output is a DICOM node, no folders are created
+	if e.methodFlag == "cstore" {
+		return e.sendInstance(&dataset, dicomVals, in_file, content)
+	}
+	if e.methodFlag == "stow" {
+		return e.stowInstance(&dataset, dicomVals, in_file, content)
+	}
+
+	if strings.Contains(pps, "{subseries}") {
+		pps = strings.Replace(pps, "{subseries}", e.subseriesLabel(&dataset), -1)
+	}
+	if strings.Contains(pps, "{TransferSyntax}") {
+		ts := ""
+		if val, err := dataset.FindElementByTag(tag.TransferSyntaxUID); err == nil {
+			ts = transferSyntaxName(strings.TrimSpace(dicom.MustGetStrings(val.Value)[0]))
+		}
+		pps = strings.Replace(pps, "{TransferSyntax}", ts, -1)
+	}
+	pps = strings.Replace(pps, "{counter}", fmt.Sprintf("%06d", atomic.LoadInt32(&e.counter)), -1) // use the global counter
+	pps = strings.Replace(pps, " ", "-", -1)                                                       // remove spaces
+	if e.dicomdirFlag {
+		// file IDs on media are restricted to 8 levels of 8 characters
+		pps = e.dicomdirFileID(&dataset, oOrderPath)
+	}
+
+	pathPieces := splitPath(pps)
+	oOrderPatientPath := filepath.Join(append([]string{oOrderPath}, pathPieces[:len(pathPieces)-1]...)...)
+	if err := e.makeDir(oOrderPatientPath); err != nil {
+		// skip this file, the next file might be able to create its folder
+		e.skipFile(in_file, err)
+		return err
+	}
+	// filename is
+	fname := pathPieces[len(pathPieces)-1]
+
+	outputPath := oOrderPatientPath
+
+	outputPathFileName := fmt.Sprintf("%s/%s", outputPath, fname)
+	var c int = 0
+	atomic.AddInt32(&e.counter, 1)
+	for !e.reserveOutputName(outputPathFileName) {
+		c = c + 1 // make filename unique by adding a number
+		fname := fmt.Sprintf("%s_%03d%s", strings.TrimSuffix(fname, filepath.Ext(fname)), c, filepath.Ext(fname))
+		outputPathFileName = fmt.Sprintf("%s/%s", outputPath, fname)
+		//outputPathFileName := fmt.Sprintf("%s/%s_%03d.dcm", outputPath, SOPInstanceUID, c)
+	}
+	if e.debugFlag && c != 0 {
+		fmt.Fprintf(os.Stderr, "[%d] make file name unique: \"%s\"\n\n", e.counterError, outputPathFileName)
+	}
+
+	job := &writeJob{dataset: dataset, dicomVals: dicomVals, in_file: in_file, oOrderPath: oOrderPath, outputPathFileName: outputPathFileName, content: content}
+	if e.writeQueue != nil {
+		e.writeQueue <- job
+		return nil
+	}
+	// without the writer pool (serve, watch) the caller learns if the file was written
+	return e.writeOutput(job)
+}
+
+// writeOutput creates the output file of a data set and records it for the steps that need all files,
+// returns the error if the file could not be written
+func (e *engine) writeOutput(job *writeJob) error {
+	dataset, in_file, outputPathFileName, content := job.dataset, job.in_file, job.outputPathFileName, job.content
+	var bw int64 = 0
+	var err error
+	if e.methodFlag == "copy" {
+		if content != nil {
+			bw, err = e.writeDatasetContents(content, "", outputPathFileName)
+		} else if e.transformRequested() || (e.dicomdirFlag && !hasFileMeta(in_file)) {
+			// a DICOMDIR can only reference files with file meta information
+			bw, err = e.transformFileContents(in_file, outputPathFileName)
+		} else {
+			bw, err = e.copyFileContents(in_file, outputPathFileName)
+		}
+		// if we really copy the file we can also check for preserve
+		_, ok := e.preserve["timestamp"]
+		if ok {
+			t, err := times.Stat(in_file)
+			if err != nil {
+				e.warn("could not stat %s to preserve its timestamp (%s)", in_file, err)
+			} else {
+				os.Chtimes(outputPathFileName, t.AccessTime(), t.ModTime())
+			}
+		}
+	} else if e.methodFlag == "link" {
+		// TODO: this can fail, we test for the file above but here some time went by
+		err = os.Symlink(in_file, outputPathFileName)
+	} else if e.methodFlag == "emptyfile" { // TODO: do we keep this option?
+		// don't do anything else
+		var emptyfile *os.File
+		if emptyfile, err = os.Create(outputPathFileName); err == nil {
+			emptyfile.Close()
+		}
+	} else if e.methodFlag == "dirs_only" { // TODO: do we keep this option?
+		// don't do anything else
+		// remove the filename (keep the directory)
+		opfn := filepath.Dir(outputPathFileName)
+		os.MkdirAll(opfn, os.ModePerm)
+	}
+	if err != nil {
+		// the file is reported as not sorted
+		if e.events != nil {
+			e.events.Skipped(in_file, err)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// the folder was removed, create it again for the next file
+			e.forgetDir(filepath.Dir(outputPathFileName))
+		}
+	} else {
+		if e.dicomdirFlag {
+			e.recordDicomdirFile(&dataset, job.oOrderPath, outputPathFileName)
+		}
+		if e.methodFlag == "copy" {
+			e.verifyCopy(in_file, outputPathFileName)
+		}
+		e.writeDone(outputPathFileName)
+		e.recordSorted(&dataset, job.dicomVals, in_file, outputPathFileName)
+	}
+	atomic.AddInt64(&e.bytesWritten, bw)
+	e.releaseOutputName(outputPathFileName)
+	return err
+}
+
+// recordSorted does the bookkeeping of a file that was written or sent (output is empty for sent files)
+func (e *engine) recordSorted(dataset *dicom.Dataset, dicomVals map[tag.Tag]string, in_file string, output string) {
+	if e.orderSlicesFlag || e.seriesReportFlag != "" {
+		e.recordInstance(dataset, output)
+	}
+	if e.trackSeries() {
+		e.recordSeriesActivity(dataset, dicomVals, output)
+	}
+	e.markSourceSorted(in_file)
+	if e.events != nil {
+		e.events.Written(in_file, output)
+	}
+}
+
+// the path we get does not have the input path prefixed
+func (e *engine) walkFunc(path string, info os.FileInfo, err error) error {
+	if info == nil {
+		// might happen if the directory name does not exist...
+		return nil
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if e.canceled() {
+		return nil
+	}
+	in_file := filepath.Join(e.inputDataPath, path)
+
+	if e.currentIndex != nil && e.isIndexFile(path) {
+		return nil
+	}
+	// values of files that did not change since 'sdcm index' are taken from the index
+	indexed, isIndexed := e.lookupIndex(path, info)
+	if isIndexed && indexed.NotDICOM && !matchGlobs(e.includeGlobs, path) {
+		e.skipFile(in_file, ErrNotDICOM)
+		return nil
+	}
+	// files can be excluded by name, parsing large non-DICOM files takes a long time
+	if matchGlobs(e.excludeGlobs, path) {
+		e.skipFile(in_file, ErrExcluded)
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "[%d] ignore file due to -exclude: \"%s\"\n", e.counterError, path)
+		}
+		return nil // ignore this file
+	}
+	// only parse files that start like a DICOM file
+	if !e.thoroughFlag && !isIndexed && !matchGlobs(e.includeGlobs, path) && !sniffDicom(in_file) {
+		e.skipFile(in_file, ErrNotDICOM)
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "[%d] ignore file, content does not look like DICOM: \"%s\"\n", e.counterError, path)
+		}
+		return nil // ignore this file
+	}
+
+	dest_path := e.processDataPath
+
+	// Create the output path in some standard way
+	oOrderPath := dest_path
+	if e.remoteOutput() {
+		// files are sent, not written to oOrderPath
+	} else if err := e.makeDir(oOrderPath); err != nil {
+		e.skipFile(in_file, err)
+		return nil
+	}
+
+	if isIndexed && !indexed.NotDICOM {
+		atomic.AddInt32(&e.counterFromIndex, 1)
+		e.processDataset(indexedDataset(indexed), path, oOrderPath, in_file)
+		return nil
+	}
+	if e.useIndexFlag {
+		atomic.AddInt32(&e.counterIndexStale, 1)
+	}
+
+	atomic.AddInt32(&e.counterReading, 1)
+	defer atomic.AddInt32(&e.counterReading, -1)
+	dataset, err := e.readInputFile(in_file)
+
+	if err == nil {
+		if e.processDataset(dataset, path, oOrderPath, in_file) == nil {
+			return nil
+		}
+	} else {
+		e.skipFile(in_file, ErrNotDICOM)
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "[%d] ignore file, cannot read as DICOM: \"%s\"\n\n", e.counterError, path)
+		}
+	}
+
+	return nil
+}
+
+// readInputFile reads the header of an input file (without pixel data)
+func (e *engine) readInputFile(in_file string) (dicom.Dataset, error) {
+	var dataset dicom.Dataset
+	var err error
+	if e.headerEarlyExit {
+		dataset, err = e.readHeader(in_file)
+	} else {
+		dataset, err = dicom.ParseFile(in_file, nil, dicom.SkipPixelData()) // See also: dicom.Parse which has a generic io.Reader API.
+	}
+	if err != nil && isDeflatedFile(in_file) {
+		dataset, err = readDatasetFile(in_file)
+	}
+	return dataset, err
+}
+
+var sizes = []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+
+func FormatFileSize(s float64, base float64) string {
+	unitsLimit := len(sizes)
+	i := 0
+	for s >= base && i < unitsLimit {
+		s = s / base
+		i++
+	}
+
+	f := "%.0f %s"
+	if i > 1 {
+		f = "%.2f %s"
+	}
+
+	return fmt.Sprintf(f, s, sizes[i])
+}
+
+func (e *engine) sort_dicoms(source_paths []string, dest_path string) (int32, error) {
+	destination_path := dest_path
+
+	if _, err := os.Stat(destination_path); os.IsNotExist(err) && !e.remoteOutput() {
+		err := os.Mkdir(destination_path, 0755)
+		if err != nil {
+			return 0, fmt.Errorf("could not create output directory \"%s\", %s", destination_path, err.Error())
+		}
+	}
+	// the counters and the start time are set by newEngine, the progress reporter reads them already
+	e.processDataPath = dest_path
+	var files []string
+	for _, source_path := range source_paths {
+		if info, err := os.Stat(source_path); err == nil && !info.IsDir() {
+			// files are sorted after the folders
+			files = append(files, source_path)
+			continue
+		}
+		e.inputDataPath = source_path
+		e.currentIndex = nil
+		if e.useIndexFlag {
+			e.currentIndex = e.loadIndex(source_path)
+		}
+
+		if e.useDicomdirFlag && findDicomdir(source_path) != "" {
+			err := e.sortDicomdirIndex(source_path, dest_path)
+			if err == nil {
+				continue
+			}
+			if e.verboseFlag || e.debugFlag {
+				fmt.Fprintf(os.Stderr, "could not use DICOMDIR, parse all files in %s (%s)\n", source_path, err)
+			}
+		}
+		err := e.walkFiles(source_path, e.walkFunc)
+		if err != nil {
+			e.warn("could not read all files in %s (%s)", source_path, err)
+		}
+	}
+	e.currentIndex = nil
+	var err error
+	if len(files) > 0 || e.filesFromFlag != "" {
+		err = e.sortFileList(files)
+	}
+	e.finishSorting(dest_path)
+
+	return e.counter, err
+}
+
+// finishSorting runs the steps that need all files in the output folder
+func (e *engine) finishSorting(dest_path string) {
+	e.stopWriters()
+	if e.methodFlag == "cstore" {
+		e.closeAssociations()
+	}
+	if e.methodFlag == "stow" {
+		e.flushStow()
+	}
+	if e.orderSlicesFlag {
+		e.orderSlices()
+	}
+	if e.dicomdirFlag {
+		if err := e.writeDicomdir(dest_path); err != nil {
+			e.warn("could not write DICOMDIR in %s (%s)", dest_path, err)
+		}
+	}
+	if e.methodFlag == "copy" {
+		e.writeManifests(dest_path)
+		e.finishSync(dest_path)
+	}
+	// all series that are still open are complete now
+	e.seriesComplete(e.completeSeries(time.Time{}))
+	e.hooksRunning.Wait()
+	if e.consistencyReportFlag != "" {
+		if err := e.verifyIdentifiers(); err != nil {
+			e.warn("could not write consistency report %s (%s)", e.consistencyReportFlag, err)
+		}
+	}
+	if e.seriesReportFlag != "" {
+		if err := e.verifySeries(); err != nil {
+			e.warn("could not write series report %s (%s)", e.seriesReportFlag, err)
+		}
+	}
+}
+
+type SeriesInstanceUIDWithName struct {
+	SeriesInstanceUID string
+	StudyInstanceUID  string
+	PatientName       string
+	Name              string
+	Order             int
+}
+
+func isEmpty(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1) // Or f.Readdir(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err // Either not empty or error, suits both cases
+}
+
+func translateStringOrFile(outputFolderFlag string) (string, error) {
+	outputFolderFlag = strings.Trim(outputFolderFlag, " ") // remove any leading or trailing spaces
+	if outputFolderFlag[0] == '@' {                        // should we read this as a filename?
+		outputFolderFlag = outputFolderFlag[1:]
+		if _, err := os.Stat(outputFolderFlag); errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("the path to folder file \"%s\" could not be found", outputFolderFlag)
+		}
+		b, err := os.ReadFile(outputFolderFlag) // just pass the file name
+		if err != nil {
+			return "", fmt.Errorf("file %s could not be read (%s)", outputFolderFlag, err)
+		}
+		outputFolderFlag = string(b)
+		// remove lines that start with '#'
+		s_list := strings.Split(strings.ReplaceAll(outputFolderFlag, "\r\n", "\n"), "\n")
+		var new_list []string
+		for _, ss := range s_list {
+			ar := strings.Split(ss, "#")
+			new_list = append(new_list, ar[0]) // remember the part before the comment character
+		}
+		outputFolderFlag = strings.Join(new_list, "")
+	}
+	re := regexp.MustCompile(`\r?\n`) // remove new lines
+	outputFolderFlag = re.ReplaceAllString(outputFolderFlag, "")
+	outputFolderFlag = strings.Replace(outputFolderFlag, "\t", "", -1) // do not allow tabs
+	outputFolderFlag = strings.Replace(outputFolderFlag, " ", "", -1)  // do not allow spaces
+	return outputFolderFlag, nil
+}
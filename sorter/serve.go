@@ -0,0 +1,301 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// 'sdcm serve -port 11112 -aet SDCM <output folder>' accepts associations from
+// other DICOM nodes (C-ECHO and C-STORE). Each received instance is written to
+// a temporary file and sorted into the output folder like a file found on disk.
+// The server stops on SIGINT or SIGTERM, finishes the open associations and
+// runs the steps that need all files (e.g. -order-slices, -dicomdir).
+
+// serveState holds the settings and counters of 'sdcm serve'
+type serveState struct {
+	serveMode bool
+	portFlag  int
+	aetFlag   string
+
+	// number of associations and instances received by the server
+	counterAssociations int32
+	counterReceived     int32
+}
+
+// acceptContext selects the transfer syntax for a proposed presentation context
+func acceptContext(pc presentationContext) presentationContext {
+	if pc.abstractSyntax != verificationSOPClass && !strings.HasPrefix(pc.abstractSyntax, storageSOPClassPrefix) {
+		pc.result = 3 // abstract syntax not supported
+		return pc
+	}
+	for _, ts := range acceptedTransferSyntaxes {
+		for _, proposed := range pc.transferSyntaxes {
+			if ts == proposed {
+				pc.transferSyntax = ts
+				pc.result = 0
+				return pc
+			}
+		}
+	}
+	pc.result = 4 // transfer syntax not supported
+	return pc
+}
+
+// acceptAssociation reads the A-ASSOCIATE-RQ and answers with an -AC or -RJ
+func (e *engine) acceptAssociation(conn net.Conn) (*association, error) {
+	a := &association{conn: conn, reader: bufio.NewReader(conn), contexts: make(map[byte]*presentationContext, 0)}
+	conn.SetReadDeadline(time.Now().Add(associationTimeout))
+	pduType, data, err := readPDU(a.reader)
+	if err != nil {
+		return nil, err
+	}
+	if pduType != pduAssociateRQ {
+		writePDU(conn, pduAbort, []byte{0, 0, 0, 0})
+		return nil, fmt.Errorf("expected A-ASSOCIATE-RQ, got PDU type %d", pduType)
+	}
+	rq, err := parseAssociate(data)
+	if err != nil {
+		writePDU(conn, pduAbort, []byte{0, 0, 0, 0})
+		return nil, err
+	}
+	a.callingAE, a.calledAE, a.maxPDULength = rq.callingAE, rq.calledAE, rq.maxPDULength
+	if e.aetFlag != "" && rq.calledAE != e.aetFlag {
+		// permanent rejection by the service user, called AE title not recognized
+		writePDU(conn, pduAssociateRJ, []byte{0, 1, 1, 7})
+		return nil, fmt.Errorf("called AE title \"%s\" is not \"%s\"", rq.calledAE, e.aetFlag)
+	}
+	ac := associateRQ{calledAE: rq.calledAE, callingAE: rq.callingAE}
+	for _, pc := range rq.contexts {
+		accepted := acceptContext(pc)
+		a.contexts[accepted.id] = &accepted
+		ac.contexts = append(ac.contexts, accepted)
+	}
+	if err := writePDU(conn, pduAssociateAC, encodeAssociate(ac, true)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// storeReceived sorts a received file, returns the DIMSE status. If studyInstanceUID is not empty
+// the file has to belong to this study.
+func (e *engine) storeReceived(spoolFile string, dest_path string, studyInstanceUID string) uint16 {
+	dataset, err := e.readInputFile(spoolFile)
+	if err != nil {
+		e.skipFile(spoolFile, ErrNotDICOM)
+		if e.debugFlag {
+			fmt.Fprintf(os.Stderr, "[%d] cannot read received data set as DICOM (%s)\n", e.counterError, err)
+		}
+		return statusCannotUnderstand
+	}
+	if studyInstanceUID != "" {
+		if v, ok := findElementValue(&dataset, tag.StudyInstanceUID); !ok || v != studyInstanceUID {
+			e.logf("received instance of study %s, expected %s\n", v, studyInstanceUID)
+			return statusCannotUnderstand
+		}
+	}
+	if err := e.processDataset(dataset, spoolFile, dest_path, spoolFile); err != nil {
+		return statusOutOfResources
+	}
+	return statusSuccess
+}
+
+// serveAssociation receives messages until the peer releases or aborts the association
+func (e *engine) serveAssociation(conn net.Conn, spoolDir string, dest_path string) {
+	defer conn.Close()
+	a, err := e.acceptAssociation(conn)
+	if err != nil {
+		e.logf("association from %s rejected: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	atomic.AddInt32(&e.counterAssociations, 1)
+	e.logf("association from %s (%s)\n", a.callingAE, conn.RemoteAddr())
+
+	var command []byte
+	var cmd dimseCommand
+	var spool *os.File
+	var spoolName string
+	received := 0
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spoolName)
+		}
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(associationTimeout))
+		pduType, data, err := readPDU(a.reader)
+		if err != nil {
+			e.logf("association from %s closed: %s\n", a.callingAE, err)
+			return
+		}
+		switch pduType {
+		case pduReleaseRQ:
+			writePDU(conn, pduReleaseRP, []byte{0, 0, 0, 0})
+			e.logf("association from %s released, %d instance%s received\n", a.callingAE, received, map[bool]string{true: "", false: "s"}[received == 1])
+			return
+		case pduAbort:
+			e.logf("association from %s aborted\n", a.callingAE)
+			return
+		case pduDataTF:
+		default:
+			writePDU(conn, pduAbort, []byte{0, 0, 2, 2}) // unexpected PDU
+			return
+		}
+		pdvs, err := parsePDVs(data)
+		if err != nil {
+			writePDU(conn, pduAbort, []byte{0, 0, 2, 6}) // invalid PDU parameter value
+			return
+		}
+		for _, p := range pdvs {
+			pc, ok := a.contexts[p.contextID]
+			if !ok || pc.result != 0 {
+				writePDU(conn, pduAbort, []byte{0, 0, 2, 6})
+				return
+			}
+			if p.command {
+				command = append(command, p.data...)
+				if !p.last {
+					continue
+				}
+				cmd, err = decodeCommand(command)
+				command = nil
+				if err != nil {
+					writePDU(conn, pduAbort, []byte{0, 0, 2, 6})
+					return
+				}
+				switch cmd.us(tag.CommandField) {
+				case commandCEchoRQ:
+					rsp := make(dimseCommand, 0)
+					rsp.setUID(tag.AffectedSOPClassUID, verificationSOPClass)
+					rsp.setUS(tag.CommandField, commandCEchoRSP)
+					rsp.setUS(tag.MessageIDBeingRespondedTo, cmd.us(tag.MessageID))
+					rsp.setUS(tag.CommandDataSetType, commandNoDataSet)
+					rsp.setUS(tag.Status, statusSuccess)
+					if err := a.sendCommand(p.contextID, rsp); err != nil {
+						return
+					}
+				case commandCStoreRQ:
+					// the data set follows in the next PDVs
+					spoolName = filepath.Join(spoolDir, fmt.Sprintf("%d-%s.dcm", time.Now().UnixNano(), sanitizeFilenameReplacer.Replace(cmd.uid(tag.AffectedSOPInstanceUID))))
+					if spool, err = os.Create(spoolName); err != nil {
+						e.warn("could not create %s (%s)", spoolName, err)
+						writePDU(conn, pduAbort, []byte{0, 0, 0, 0})
+						return
+					}
+					spool.Write(part10Header(cmd.uid(tag.AffectedSOPClassUID), cmd.uid(tag.AffectedSOPInstanceUID), pc.transferSyntax))
+				default:
+					e.logf("association from %s: unsupported command 0x%04x\n", a.callingAE, cmd.us(tag.CommandField))
+					writePDU(conn, pduAbort, []byte{0, 0, 0, 0})
+					return
+				}
+				continue
+			}
+
+			// data set of a C-STORE-RQ
+			if spool == nil {
+				writePDU(conn, pduAbort, []byte{0, 0, 2, 2})
+				return
+			}
+			if _, err := spool.Write(p.data); err != nil {
+				e.warn("could not write %s (%s)", spoolName, err)
+			}
+			if !p.last {
+				continue
+			}
+			var status uint16 = statusOutOfResources
+			if err := spool.Close(); err == nil {
+				status = e.storeReceived(spoolName, dest_path, "")
+			}
+			os.Remove(spoolName)
+			spool = nil
+			atomic.AddInt32(&e.counterReceived, 1)
+			received++
+
+			rsp := make(dimseCommand, 0)
+			rsp.setUID(tag.AffectedSOPClassUID, cmd.uid(tag.AffectedSOPClassUID))
+			rsp.setUS(tag.CommandField, commandCStoreRSP)
+			rsp.setUS(tag.MessageIDBeingRespondedTo, cmd.us(tag.MessageID))
+			rsp.setUS(tag.CommandDataSetType, commandNoDataSet)
+			rsp.setUS(tag.Status, status)
+			rsp.setUID(tag.AffectedSOPInstanceUID, cmd.uid(tag.AffectedSOPInstanceUID))
+			if err := a.sendCommand(p.contextID, rsp); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveDicom runs the storage service (and the STOW-RS service if -http-port is set) until the run is canceled, returns the number of files sorted
+func (e *engine) serveDicom(dest_path string) (int32, error) {
+	if e.methodFlag == "link" {
+		return 0, fmt.Errorf("'sdcm serve' cannot create symbolic links to received files, use '-method copy'")
+	}
+	if _, err := os.Stat(dest_path); os.IsNotExist(err) {
+		if err := os.Mkdir(dest_path, 0755); err != nil {
+			return 0, fmt.Errorf("could not create output directory \"%s\", %s", dest_path, err.Error())
+		}
+	}
+	spoolDir, err := os.MkdirTemp("", "sdcm-serve-")
+	if err != nil {
+		return 0, fmt.Errorf("could not create a temporary directory (%s)", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	e.processDataPath = dest_path
+
+	var listener net.Listener
+	if e.portFlag > 0 {
+		if listener, err = net.Listen("tcp", fmt.Sprintf(":%d", e.portFlag)); err != nil {
+			return 0, fmt.Errorf("could not listen on port %d (%s)", e.portFlag, err)
+		}
+	}
+	var httpServer *http.Server
+	if e.httpPortFlag > 0 {
+		if httpServer, err = e.startStowServer(spoolDir, dest_path); err != nil {
+			if listener != nil {
+				listener.Close()
+			}
+			return 0, fmt.Errorf("could not listen on port %d (%s)", e.httpPortFlag, err)
+		}
+	}
+	stopped := make(chan bool)
+	go func() {
+		<-e.runContext.Done()
+		if listener != nil {
+			listener.Close()
+		}
+		stopStowServer(httpServer)
+		close(stopped)
+	}()
+
+	var wg sync.WaitGroup
+	for listener != nil {
+		conn, err := listener.Accept()
+		if err != nil {
+			break // listener closed
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.serveAssociation(conn, spoolDir, dest_path)
+		}()
+	}
+	<-stopped
+	wg.Wait()
+	e.finishSorting(dest_path)
+	return e.counter, nil
+}
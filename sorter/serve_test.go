@@ -0,0 +1,318 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+func TestAcceptContext(t *testing.T) {
+	tests := []struct {
+		name             string
+		abstractSyntax   string
+		transferSyntaxes []string
+		wantResult       byte
+		wantSyntax       string
+	}{
+		{name: "verification", abstractSyntax: verificationSOPClass, transferSyntaxes: []string{uid.ImplicitVRLittleEndian}, wantSyntax: uid.ImplicitVRLittleEndian},
+		{name: "storage prefers explicit", abstractSyntax: ctImageStorage, transferSyntaxes: []string{uid.ImplicitVRLittleEndian, uid.ExplicitVRLittleEndian}, wantSyntax: uid.ExplicitVRLittleEndian},
+		{name: "compressed storage", abstractSyntax: ctImageStorage, transferSyntaxes: []string{rleLosslessTransferSyntax}, wantSyntax: rleLosslessTransferSyntax},
+		{name: "query is not supported", abstractSyntax: "1.2.840.10008.5.1.4.1.2.2.1", transferSyntaxes: []string{uid.ImplicitVRLittleEndian}, wantResult: 3},
+		{name: "unknown transfer syntax", abstractSyntax: ctImageStorage, transferSyntaxes: []string{"1.2.3.4"}, wantResult: 4},
+	}
+	for _, tt := range tests {
+		got := acceptContext(presentationContext{id: 1, abstractSyntax: tt.abstractSyntax, transferSyntaxes: tt.transferSyntaxes})
+		if got.result != tt.wantResult || got.transferSyntax != tt.wantSyntax {
+			t.Errorf("%s: result %d with %q, want %d with %q", tt.name, got.result, got.transferSyntax, tt.wantResult, tt.wantSyntax)
+		}
+	}
+}
+
+// freePort returns a local TCP port that is not in use right now
+func freePort(t testing.TB) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startServe runs Serve until the returned function is called, the function returns the result of Serve
+func startServe(t testing.TB, opts Options) func() Result {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	type served struct {
+		result Result
+		err    error
+	}
+	done := make(chan served, 1)
+	go func() {
+		result, err := New(opts).Serve(ctx)
+		done <- served{result, err}
+	}()
+	stopped := false
+	stop := func() Result {
+		if !stopped {
+			stopped = true
+			cancel()
+		}
+		s := <-done
+		if s.err != nil {
+			t.Errorf("Serve failed (%s)", s.err)
+		}
+		return s.result
+	}
+	t.Cleanup(func() {
+		if !stopped {
+			stop()
+		}
+	})
+	return stop
+}
+
+// echo sends a C-ECHO to a DICOM node, returns the status of the response
+func echo(address, calledAET string) (uint16, error) {
+	e := newTestEngine()
+	e.cstoreAddress, e.calledAETFlag, e.aetFlag = address, calledAET, "TEST"
+	a, err := e.openAssociation([]presentationContext{{id: 1, abstractSyntax: verificationSOPClass, transferSyntaxes: []string{uid.ImplicitVRLittleEndian}}})
+	if err != nil {
+		return 0, err
+	}
+	defer releaseAssociation(a)
+	contextID, ok := a.contextID(verificationSOPClass, uid.ImplicitVRLittleEndian)
+	if !ok {
+		return 0, fmt.Errorf("verification not accepted")
+	}
+	cmd := make(dimseCommand, 0)
+	cmd.setUID(tag.AffectedSOPClassUID, verificationSOPClass)
+	cmd.setUS(tag.CommandField, commandCEchoRQ)
+	cmd.setUS(tag.MessageID, 7)
+	cmd.setUS(tag.CommandDataSetType, commandNoDataSet)
+	if err := a.sendCommand(contextID, cmd); err != nil {
+		return 0, err
+	}
+	rsp, err := a.readCommand()
+	if err != nil {
+		return 0, err
+	}
+	if rsp.us(tag.CommandField) != commandCEchoRSP || rsp.us(tag.MessageIDBeingRespondedTo) != 7 {
+		return 0, fmt.Errorf("unexpected response 0x%04x to message %d", rsp.us(tag.CommandField), rsp.us(tag.MessageIDBeingRespondedTo))
+	}
+	return rsp.us(tag.Status), nil
+}
+
+// waitForEcho repeats the C-ECHO until the server is listening
+func waitForEcho(t testing.TB, address, calledAET string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, err := echo(address, calledAET)
+		if err == nil {
+			if status != statusSuccess {
+				t.Fatalf("C-ECHO status 0x%04X", status)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no C-ECHO response from %s (%s)", address, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// listFiles returns the paths of all files below a folder relative to the folder
+func listFiles(t testing.TB, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestServeEcho(t *testing.T) {
+	port := freePort(t)
+	opts := DefaultOptions()
+	opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = t.TempDir(), port, "SDCM", true, "none"
+	stop := startServe(t, opts)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	waitForEcho(t, address, "SDCM")
+
+	tests := []struct {
+		calledAET    string
+		wantRejected bool
+	}{
+		{calledAET: "SDCM"},
+		{calledAET: "OTHER", wantRejected: true},
+		{calledAET: "SDCM"},
+	}
+	for _, tt := range tests {
+		status, err := echo(address, tt.calledAET)
+		if tt.wantRejected {
+			if !errors.Is(err, errAssociationRejected) {
+				t.Errorf("C-ECHO to %s: error %v, want %v", tt.calledAET, err, errAssociationRejected)
+			}
+			continue
+		}
+		if err != nil || status != statusSuccess {
+			t.Errorf("C-ECHO to %s: status 0x%04X, error %v", tt.calledAET, status, err)
+		}
+	}
+	if result := stop(); result.Received != 0 || result.Associations < 3 {
+		t.Errorf("%d instances received on %d associations, want 0 on at least 3", result.Received, result.Associations)
+	}
+}
+
+func TestServeCStore(t *testing.T) {
+	port := freePort(t)
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = out, port, "SDCM", true, "none"
+	opts.Folder = "{PatientID}/{SeriesNumber}/{SOPInstanceUID}.dcm"
+	stop := startServe(t, opts)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	waitForEcho(t, address, "SDCM")
+
+	// instances in different transfer syntaxes need their own presentation contexts
+	in := t.TempDir()
+	files := []struct {
+		name, series          string
+		number                int
+		transferSyntax        string
+		seriesNumber, patient string
+	}{
+		{name: "a.dcm", series: "1.2.3.1", number: 1, transferSyntax: uid.ExplicitVRLittleEndian, seriesNumber: "1", patient: "P1"},
+		{name: "b.dcm", series: "1.2.3.1", number: 2, transferSyntax: uid.ImplicitVRLittleEndian, seriesNumber: "1", patient: "P1"},
+		{name: "c.dcm", series: "1.2.3.2", number: 1, transferSyntax: uid.ExplicitVRLittleEndian, seriesNumber: "2", patient: "P2"},
+	}
+	for _, f := range files {
+		writeTestFile(t, filepath.Join(in, f.name), newTestInstance(t, f.series, f.number,
+			newTestElement(t, tag.TransferSyntaxUID, []string{f.transferSyntax}),
+			newTestElement(t, tag.SeriesNumber, []string{f.seriesNumber}),
+			newTestElement(t, tag.PatientID, []string{f.patient})))
+	}
+	if err := os.WriteFile(filepath.Join(in, "notes.txt"), []byte("not DICOM"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := DefaultOptions()
+	client.Input, client.Output, client.Method, client.CalledAET, client.Quiet = []string{in}, address, "cstore", "SDCM", true
+	result, err := New(client).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 3 || result.SendFailed != 0 || result.Skipped != 1 {
+		t.Errorf("%d sent, %d failed and %d skipped, want 3, 0 and 1 (%v)", result.Sent, result.SendFailed, result.Skipped, result.SendFailures)
+	}
+
+	served := stop()
+	if served.Received != 3 || served.Files != 3 {
+		t.Errorf("%d instances received and %d sorted, want 3 and 3", served.Received, served.Files)
+	}
+	// SeriesNumber is padded to three digits in folder names
+	want := []string{"P1/001/1.2.3.1.1.dcm", "P1/001/1.2.3.1.2.dcm", "P2/002/1.2.3.2.1.dcm"}
+	got := listFiles(t, out)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("received files %v, want %v", got, want)
+	}
+	for i, name := range want {
+		ds, err := readDatasetFile(filepath.Join(out, name))
+		if err != nil {
+			t.Errorf("could not parse %s (%s)", name, err)
+			continue
+		}
+		if ts := getString(&ds, tag.TransferSyntaxUID); ts != files[i].transferSyntax {
+			t.Errorf("%s has transfer syntax %s, want %s", name, ts, files[i].transferSyntax)
+		}
+		if got := getString(&ds, tag.MediaStorageSOPInstanceUID); got != getString(&ds, tag.SOPInstanceUID) {
+			t.Errorf("%s has MediaStorageSOPInstanceUID %s, want %s", name, got, getString(&ds, tag.SOPInstanceUID))
+		}
+	}
+}
+
+func TestServeWriteError(t *testing.T) {
+	tests := []struct {
+		name  string
+		block func(t *testing.T, out string)
+	}{
+		{
+			// the folder of the patient cannot be created
+			name: "folder",
+			block: func(t *testing.T, out string) {
+				if err := os.WriteFile(filepath.Join(out, "P1"), []byte("not a folder"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// the folder exists but the file cannot be created
+			name: "file",
+			block: func(t *testing.T, out string) {
+				if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+					t.Skip("the permissions of the folder are not enforced")
+				}
+				if err := os.Mkdir(filepath.Join(out, "P1"), 0555); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.Chmod(filepath.Join(out, "P1"), 0755) })
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			out := t.TempDir()
+			tt.block(t, out)
+			opts := DefaultOptions()
+			opts.Output, opts.Port, opts.AET, opts.Quiet, opts.Sync = out, port, "SDCM", true, "none"
+			opts.Folder = "{PatientID}/{SOPInstanceUID}.dcm"
+			stop := startServe(t, opts)
+			address := fmt.Sprintf("127.0.0.1:%d", port)
+			waitForEcho(t, address, "SDCM")
+
+			in := t.TempDir()
+			writeTestFile(t, filepath.Join(in, "a.dcm"), newTestInstance(t, "1.2.3.1", 1))
+			client := DefaultOptions()
+			client.Input, client.Output, client.Method, client.CalledAET, client.Quiet = []string{in}, address, "cstore", "SDCM", true
+			client.Retry = 0
+			result, err := New(client).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Sent != 0 || result.SendFailed != 1 || len(result.SendFailures) != 1 || !strings.Contains(result.SendFailures[0], "0xA700") {
+				t.Errorf("%d sent and %d failed (%v), want 0 and 1 with status 0xA700", result.Sent, result.SendFailed, result.SendFailures)
+			}
+			if served := stop(); served.Received != 1 || served.Files != 0 {
+				t.Errorf("%d instances received and %d sorted, want 1 and 0", served.Received, served.Files)
+			}
+		})
+	}
+}
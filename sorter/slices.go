@@ -0,0 +1,274 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// With -order-slices the files of each series (and sub-series) are renamed after
+// sorting (0001.dcm, 0002.dcm, ...) in the order of their position along the slice
+// normal. If the position is not available InstanceNumber and AcquisitionTime are
+// used. If several series share an output folder the names start with the
+// SeriesNumber (3_0001.dcm) to keep them apart.
+
+// sliceState collects the instances for -order-slices
+type sliceState struct {
+	orderSlicesFlag bool
+
+	// files written per series and output folder
+	sliceFiles      map[sliceGroup][]instanceInfo
+	sliceFilesMutex sync.Mutex
+
+	// number of folders ordered and folders with problems
+	numFoldersOrdered         int
+	numFoldersDuplicateSlices int
+	numFoldersMissingSlices   int
+}
+
+// instanceInfo keeps the values of a written file needed to order and to verify a series
+type instanceInfo struct {
+	path            string
+	seriesNumber    string
+	position        []float64 // ImagePositionPatient
+	orientation     []float64 // ImageOrientationPatient
+	instanceNumber  int
+	hasInstance     bool
+	acquisitionTime string
+	rows            string
+	columns         string
+	pixelSpacing    string
+}
+
+// sliceGroup is a series (or sub-series) in an output folder
+type sliceGroup struct {
+	dir    string
+	series string // SeriesInstanceUID and sub-series label
+}
+
+func elementFloats(e *dicom.Element) []float64 {
+	var values []float64
+	for _, s := range elementValues(e) {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil
+		}
+		values = append(values, f)
+	}
+	return values
+}
+
+// recordInstance remembers the values needed to order and verify the file written to outputPathFileName
+func (e *engine) recordInstance(ds *dicom.Dataset, outputPathFileName string) {
+	si := instanceInfo{
+		path:            outputPathFileName,
+		seriesNumber:    strings.TrimSpace(elementValueString(findElement(ds, tag.SeriesNumber))),
+		position:        elementFloats(findElement(ds, tag.ImagePositionPatient)),
+		orientation:     elementFloats(findElement(ds, tag.ImageOrientationPatient)),
+		acquisitionTime: elementValueString(findElement(ds, tag.AcquisitionTime)),
+		rows:            elementValueString(findElement(ds, tag.Rows)),
+		columns:         elementValueString(findElement(ds, tag.Columns)),
+		pixelSpacing:    strings.Join(elementValues(findElement(ds, tag.PixelSpacing)), "\\"),
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(elementValueString(findElement(ds, tag.InstanceNumber)))); err == nil {
+		si.instanceNumber = n
+		si.hasInstance = true
+	}
+	if e.orderSlicesFlag && e.methodFlag != "dirs_only" {
+		group := sliceGroup{dir: filepath.Dir(outputPathFileName), series: elementValueString(findElement(ds, tag.SeriesInstanceUID))}
+		if len(e.subseriesTags) > 0 {
+			group.series += "\\" + e.subseriesLabel(ds)
+		}
+		e.sliceFilesMutex.Lock()
+		e.sliceFiles[group] = append(e.sliceFiles[group], si)
+		e.sliceFilesMutex.Unlock()
+	}
+	if e.seriesReportFlag != "" {
+		e.recordSeriesInstance(ds, si)
+	}
+}
+
+// sliceLocations projects the positions onto the slice normal, returns nil if a position is missing
+func sliceLocations(slices []instanceInfo) []float64 {
+	var normal []float64
+	for _, s := range slices {
+		if len(s.orientation) == 6 {
+			o := s.orientation
+			normal = []float64{o[1]*o[5] - o[2]*o[4], o[2]*o[3] - o[0]*o[5], o[0]*o[4] - o[1]*o[3]}
+			break
+		}
+	}
+	if normal == nil {
+		return nil
+	}
+	locations := make([]float64, len(slices))
+	for i, s := range slices {
+		if len(s.position) != 3 {
+			return nil
+		}
+		locations[i] = s.position[0]*normal[0] + s.position[1]*normal[1] + s.position[2]*normal[2]
+	}
+	return locations
+}
+
+// orderFolder sorts the slices of a series, the new names start with prefix. Returns the number
+// of duplicate and missing slice positions.
+func (e *engine) orderFolder(slices []instanceInfo, prefix string) (duplicates int, missing int) {
+	locations := sliceLocations(slices)
+	idx := make([]int, len(slices))
+	for i := range idx {
+		idx[i] = i
+	}
+	allInstances := true
+	for _, s := range slices {
+		if !s.hasInstance {
+			allInstances = false
+			break
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		sa, sb := slices[idx[a]], slices[idx[b]]
+		if locations != nil && locations[idx[a]] != locations[idx[b]] {
+			return locations[idx[a]] < locations[idx[b]]
+		}
+		if allInstances && sa.instanceNumber != sb.instanceNumber {
+			return sa.instanceNumber < sb.instanceNumber
+		}
+		if sa.acquisitionTime != sb.acquisitionTime {
+			return sa.acquisitionTime < sb.acquisitionTime
+		}
+		return sa.path < sb.path
+	})
+
+	if locations != nil && len(idx) > 1 {
+		var spacings []float64
+		for i := 1; i < len(idx); i++ {
+			d := locations[idx[i]] - locations[idx[i-1]]
+			if d < 1e-3 {
+				duplicates++
+			} else {
+				spacings = append(spacings, d)
+			}
+		}
+		if len(spacings) > 0 {
+			sorted := append([]float64{}, spacings...)
+			sort.Float64s(sorted)
+			median := sorted[len(sorted)/2]
+			for _, d := range spacings {
+				if d > 1.5*median {
+					missing += int(math.Round(d/median)) - 1
+				}
+			}
+		}
+	}
+
+	// rename in two steps, the new names might already be in use
+	digits := 4
+	if n := len(strconv.Itoa(len(idx))); n > digits {
+		digits = n
+	}
+	tmpNames := make([]string, len(idx))
+	for i, j := range idx {
+		tmpNames[i] = fmt.Sprintf("%s.sdcm-order-%d", slices[j].path, i)
+		if err := os.Rename(slices[j].path, tmpNames[i]); err != nil {
+			e.warn("could not rename %s (%s)", slices[j].path, err)
+			tmpNames[i] = ""
+		}
+	}
+	renamed := make(map[string]string, len(idx))
+	for i, j := range idx {
+		if tmpNames[i] == "" {
+			continue
+		}
+		newName := filepath.Join(filepath.Dir(slices[j].path), fmt.Sprintf("%s%0*d%s", prefix, digits, i+1, filepath.Ext(slices[j].path)))
+		if err := os.Rename(tmpNames[i], newName); err != nil {
+			e.warn("could not rename %s (%s)", tmpNames[i], err)
+			continue
+		}
+		renamed[filepath.Base(slices[j].path)] = filepath.Base(newName)
+	}
+	if len(slices) > 0 {
+		e.renameChecksums(filepath.Clean(filepath.Dir(slices[0].path)), renamed)
+		e.renameUnsynced(filepath.Dir(slices[0].path), renamed)
+	}
+	return duplicates, missing
+}
+
+// slicePrefixes returns the start of the file names for each series of a folder, empty if the
+// folder has a single series. The SeriesNumber is used if it is unique, the position otherwise.
+func (e *engine) slicePrefixes(groups []sliceGroup) map[sliceGroup]string {
+	prefixes := make(map[sliceGroup]string, len(groups))
+	if len(groups) < 2 {
+		return prefixes
+	}
+	seen := make(map[string]bool, 0)
+	unique := true
+	for _, g := range groups {
+		n := e.sliceFiles[g][0].seriesNumber
+		if n == "" || seen[n] {
+			unique = false
+		}
+		seen[n] = true
+	}
+	for i, g := range groups {
+		if unique {
+			prefixes[g] = sanitizeFilenameReplacer.Replace(e.sliceFiles[g][0].seriesNumber) + "_"
+		} else {
+			prefixes[g] = fmt.Sprintf("%d_", i+1)
+		}
+	}
+	return prefixes
+}
+
+// orderSlices renames the files of all series, called after all files have been written
+func (e *engine) orderSlices() {
+	e.sliceFilesMutex.Lock()
+	defer e.sliceFilesMutex.Unlock()
+	var groups []sliceGroup
+	for g := range e.sliceFiles {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].dir != groups[j].dir {
+			return groups[i].dir < groups[j].dir
+		}
+		return groups[i].series < groups[j].series
+	})
+	prefixes := make(map[sliceGroup]string, 0)
+	for i := 0; i < len(groups); {
+		j := i
+		for j < len(groups) && groups[j].dir == groups[i].dir {
+			j++
+		}
+		for g, p := range e.slicePrefixes(groups[i:j]) {
+			prefixes[g] = p
+		}
+		i = j
+	}
+	for _, g := range groups {
+		dir := g.dir
+		duplicates, missing := e.orderFolder(e.sliceFiles[g], prefixes[g])
+		e.numFoldersOrdered++
+		if duplicates > 0 {
+			e.numFoldersDuplicateSlices++
+		}
+		if missing > 0 {
+			e.numFoldersMissingSlices++
+		}
+		if (duplicates > 0 || missing > 0) && (e.verboseFlag || e.debugFlag) {
+			fmt.Fprintf(os.Stderr, "%s: %d duplicate and %d missing slice positions\n", dir, duplicates, missing)
+		}
+	}
+}
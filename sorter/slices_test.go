@@ -0,0 +1,208 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSliceLocations(t *testing.T) {
+	axial := []float64{1, 0, 0, 0, 1, 0}
+	sagittal := []float64{0, 1, 0, 0, 0, 1}
+	tests := []struct {
+		name   string
+		slices []instanceInfo
+		want   []float64
+	}{
+		{
+			name:   "axial uses z",
+			slices: []instanceInfo{{position: []float64{1, 2, 3}, orientation: axial}, {position: []float64{1, 2, -4}}},
+			want:   []float64{3, -4},
+		},
+		{
+			name:   "sagittal uses x",
+			slices: []instanceInfo{{position: []float64{5, 2, 3}}, {position: []float64{-1, 2, 3}, orientation: sagittal}},
+			want:   []float64{5, -1},
+		},
+		{
+			name:   "no orientation",
+			slices: []instanceInfo{{position: []float64{1, 2, 3}}},
+		},
+		{
+			name:   "missing position",
+			slices: []instanceInfo{{position: []float64{1, 2, 3}, orientation: axial}, {orientation: axial}},
+		},
+	}
+	for _, tt := range tests {
+		if got := sliceLocations(tt.slices); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sliceLocations = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrderFolder(t *testing.T) {
+	axial := []float64{1, 0, 0, 0, 1, 0}
+	at := func(name string, z float64) instanceInfo {
+		return instanceInfo{path: name, position: []float64{0, 0, z}, orientation: axial}
+	}
+	numbered := func(name string, n int, time string) instanceInfo {
+		return instanceInfo{path: name, instanceNumber: n, hasInstance: true, acquisitionTime: time}
+	}
+	tests := []struct {
+		name           string
+		slices         []instanceInfo
+		prefix         string
+		want           map[string]string // new file name to old file name
+		wantDuplicates int
+		wantMissing    int
+	}{
+		{
+			name:   "by position along the normal",
+			slices: []instanceInfo{at("a.dcm", 3), at("b.dcm", -1), at("c.dcm", 1)},
+			want:   map[string]string{"0001.dcm": "b.dcm", "0002.dcm": "c.dcm", "0003.dcm": "a.dcm"},
+		},
+		{
+			name:   "by InstanceNumber without positions",
+			slices: []instanceInfo{numbered("a.dcm", 10, "120000"), numbered("b.dcm", 2, "120001"), numbered("c.dcm", 7, "115959")},
+			want:   map[string]string{"0001.dcm": "b.dcm", "0002.dcm": "c.dcm", "0003.dcm": "a.dcm"},
+		},
+		{
+			name: "by AcquisitionTime if an InstanceNumber is missing",
+			slices: []instanceInfo{numbered("a.dcm", 1, "120002"), numbered("b.dcm", 2, "120001"),
+				{path: "c.dcm", acquisitionTime: "120000"}},
+			want: map[string]string{"0001.dcm": "c.dcm", "0002.dcm": "b.dcm", "0003.dcm": "a.dcm"},
+		},
+		{
+			name:   "names already in use",
+			slices: []instanceInfo{at("0001.dcm", 2), at("0002.dcm", 1)},
+			want:   map[string]string{"0001.dcm": "0002.dcm", "0002.dcm": "0001.dcm"},
+		},
+		{
+			name:           "duplicate positions",
+			slices:         []instanceInfo{at("a.dcm", 1), at("b.dcm", 1), at("c.dcm", 2)},
+			want:           map[string]string{"0001.dcm": "a.dcm", "0002.dcm": "b.dcm", "0003.dcm": "c.dcm"},
+			wantDuplicates: 1,
+		},
+		{
+			name:        "missing positions",
+			slices:      []instanceInfo{at("a.dcm", 1), at("b.dcm", 2), at("c.dcm", 3), at("d.dcm", 6)},
+			want:        map[string]string{"0001.dcm": "a.dcm", "0002.dcm": "b.dcm", "0003.dcm": "c.dcm", "0004.dcm": "d.dcm"},
+			wantMissing: 2,
+		},
+		{
+			name:   "series prefix",
+			slices: []instanceInfo{at("a.dcm", 2), at("b.dcm", 1)},
+			prefix: "3_",
+			want:   map[string]string{"3_0001.dcm": "b.dcm", "3_0002.dcm": "a.dcm"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i := range tt.slices {
+				// the content of each file is its old name
+				name := tt.slices[i].path
+				tt.slices[i].path = filepath.Join(dir, name)
+				if err := os.WriteFile(tt.slices[i].path, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			duplicates, missing := newTestEngine().orderFolder(tt.slices, tt.prefix)
+			if duplicates != tt.wantDuplicates || missing != tt.wantMissing {
+				t.Errorf("%d duplicate and %d missing slices, want %d and %d", duplicates, missing, tt.wantDuplicates, tt.wantMissing)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string, len(entries))
+			for _, entry := range entries {
+				content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[entry.Name()] = string(content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlicePrefixes(t *testing.T) {
+	tests := []struct {
+		name          string
+		seriesNumbers []string
+		want          []string
+	}{
+		{name: "single series", seriesNumbers: []string{"3"}, want: []string{""}},
+		{name: "unique series numbers", seriesNumbers: []string{"3", "12"}, want: []string{"3_", "12_"}},
+		{name: "duplicate series numbers", seriesNumbers: []string{"3", "3"}, want: []string{"1_", "2_"}},
+		{name: "missing series number", seriesNumbers: []string{"3", ""}, want: []string{"1_", "2_"}},
+		{name: "series number is sanitized", seriesNumbers: []string{"1/2", "4"}, want: []string{sanitizeFilenameReplacer.Replace("1/2") + "_", "4_"}},
+	}
+	for _, tt := range tests {
+		e := newTestEngine()
+		var groups []sliceGroup
+		for i, n := range tt.seriesNumbers {
+			g := sliceGroup{dir: "out", series: string(rune('a' + i))}
+			groups = append(groups, g)
+			e.sliceFiles[g] = []instanceInfo{{seriesNumber: n}}
+		}
+		prefixes := e.slicePrefixes(groups)
+		var got []string
+		for _, g := range groups {
+			got = append(got, prefixes[g])
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: prefixes %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrderSlicesCounters(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEngine()
+	e.orderSlicesFlag = true
+	axial := []float64{1, 0, 0, 0, 1, 0}
+	for i, z := range []float64{1, 1, 2, 3, 4} {
+		path := filepath.Join(dir, string(rune('a'+i))+".dcm")
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		g := sliceGroup{dir: dir, series: "1.2.3"}
+		e.sliceFiles[g] = append(e.sliceFiles[g], instanceInfo{path: path, seriesNumber: "1", position: []float64{0, 0, z}, orientation: axial})
+	}
+	path := filepath.Join(dir, "x.dcm")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	g := sliceGroup{dir: dir, series: "1.2.4"}
+	e.sliceFiles[g] = []instanceInfo{{path: path, seriesNumber: "2"}}
+	e.orderSlices()
+
+	if e.numFoldersOrdered != 2 || e.numFoldersDuplicateSlices != 1 || e.numFoldersMissingSlices != 0 {
+		t.Errorf("%d ordered, %d with duplicate and %d with missing slices, want 2, 1 and 0",
+			e.numFoldersOrdered, e.numFoldersDuplicateSlices, e.numFoldersMissingSlices)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	want := []string{"1_0001.dcm", "1_0002.dcm", "1_0003.dcm", "1_0004.dcm", "1_0005.dcm", "2_0001.dcm"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,128 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files are parsed only if their first bytes look like DICOM: "DICM" after the
+// 128 byte preamble, or (files without preamble) a first element of group 0002
+// or 0008 in explicit or implicit VR little endian. -include and -exclude take
+// comma separated glob patterns. A pattern without '/' is matched against the
+// file name, a pattern with '/' against the same number of trailing path
+// components ("scout/*" matches any file in a folder scout) so it works for
+// folders, file arguments and -files-from alike. A leading '/' anchors the
+// pattern at the input folder (at the root for files given by name).
+
+// globState holds the -include and -exclude patterns
+type globState struct {
+	includeFlag string
+	excludeFlag string
+
+	includeGlobs []string
+	excludeGlobs []string
+}
+
+// initGlobs splits the -include and -exclude patterns
+func (e *engine) initGlobs() error {
+	for _, g := range []struct {
+		flag  string
+		globs *[]string
+	}{{e.includeFlag, &e.includeGlobs}, {e.excludeFlag, &e.excludeGlobs}} {
+		for _, pattern := range strings.Split(g.flag, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return err
+			}
+			*g.globs = append(*g.globs, pattern)
+		}
+	}
+	return nil
+}
+
+// matchGlobs returns true if one of the patterns matches the path (below the input folder or absolute)
+func matchGlobs(globs []string, path string) bool {
+	for _, pattern := range globs {
+		name := filepath.Base(path)
+		if strings.HasPrefix(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+			name = strings.TrimPrefix(filepath.ToSlash(path), "/")
+		} else if strings.Contains(pattern, "/") {
+			name = trailingComponents(filepath.ToSlash(path), strings.Count(pattern, "/")+1)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// trailingComponents returns the last n components of a slash separated path
+func trailingComponents(path string, n int) string {
+	path = strings.TrimPrefix(path, "/")
+	pieces := strings.Split(path, "/")
+	if len(pieces) <= n {
+		return path
+	}
+	return strings.Join(pieces[len(pieces)-n:], "/")
+}
+
+// hasFileMeta returns true if a file starts with the preamble and the file meta information
+func hasFileMeta(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b := make([]byte, 132)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false
+	}
+	return string(b[128:132]) == "DICM"
+}
+
+// isVRCode returns true for two upper case letters, the VR of an explicit VR element
+func isVRCode(a, b byte) bool {
+	return a >= 'A' && a <= 'Z' && b >= 'A' && b <= 'Z'
+}
+
+// sniffDicom reads the first bytes of a file and returns true if it might be a DICOM file
+func sniffDicom(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b := make([]byte, 132)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	if n == 132 && string(b[128:132]) == "DICM" {
+		return true
+	}
+	// no preamble, the data set (or the file meta information) starts at the beginning
+	if n < 8 {
+		return false
+	}
+	group := binary.LittleEndian.Uint16(b[0:2])
+	if group != 0x0002 && group != 0x0008 {
+		return false
+	}
+	if isVRCode(b[4], b[5]) {
+		return true
+	}
+	// implicit VR, the first elements of group 0008 are short and have an even length
+	length := binary.LittleEndian.Uint32(b[4:8])
+	return length%2 == 0 && length <= 1024
+}
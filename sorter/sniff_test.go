@@ -0,0 +1,123 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffDicom(t *testing.T) {
+	part10 := filepath.Join(t.TempDir(), "part10.dcm")
+	writeTestFile(t, part10, newTestInstance(t, "1.2.3.1", 1))
+	content, err := os.ReadFile(part10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preamble := append(make([]byte, 128), "DICM"...)
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{name: "part 10 file", content: content, want: true},
+		{name: "preamble only", content: preamble, want: true},
+		{name: "file meta without preamble", content: content[132:], want: true},
+		{name: "explicit VR data set", content: []byte{0x08, 0x00, 0x05, 0x00, 'C', 'S', 0x0A, 0x00, 'I', 'S', 'O', '_', 'I', 'R', ' ', '1', '0', '0'}, want: true},
+		{name: "implicit VR data set", content: []byte{0x08, 0x00, 0x16, 0x00, 0x1A, 0x00, 0x00, 0x00, '1', '.', '2'}, want: true},
+		{name: "implicit VR with an odd length", content: []byte{0x08, 0x00, 0x16, 0x00, 0x1B, 0x00, 0x00, 0x00}},
+		{name: "implicit VR with a long first element", content: []byte{0x08, 0x00, 0x16, 0x00, 0x00, 0x10, 0x00, 0x00}},
+		{name: "other group", content: []byte{0x10, 0x00, 0x10, 0x00, 'P', 'N', 0x04, 0x00, 'T', 'e', 's', 't'}},
+		{name: "text file", content: []byte("This is not a DICOM file, it only has text in it.\n")},
+		{name: "too short", content: []byte{0x08, 0x00, 0x05, 0x00}},
+		{name: "empty", content: nil},
+		{name: "DICM at the wrong offset", content: append(make([]byte, 127), "DICM"...)},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := sniffDicom(path); got != tt.want {
+			t.Errorf("%s: sniffDicom = %v, want %v", tt.name, got, tt.want)
+		}
+		if got, want := hasFileMeta(path), len(tt.content) >= 132 && bytes.Equal(tt.content[128:132], []byte("DICM")); got != want {
+			t.Errorf("%s: hasFileMeta = %v, want %v", tt.name, got, want)
+		}
+	}
+	if sniffDicom(filepath.Join(dir, "missing")) {
+		t.Error("sniffDicom is true for a missing file")
+	}
+}
+
+func TestMatchGlobs(t *testing.T) {
+	tests := []struct {
+		globs []string
+		path  string
+		want  bool
+	}{
+		{globs: []string{"*.dcm"}, path: "/data/in/a/b.dcm", want: true},
+		{globs: []string{"*.dcm"}, path: "/data/in/a/b.txt"},
+		{globs: []string{"*.txt", "*.dcm"}, path: "b.dcm", want: true},
+		{globs: []string{"IM*"}, path: "DICOM/IM000001", want: true},
+		{globs: []string{"a"}, path: "/data/in/a/b.dcm"},
+		{globs: []string{"scout/*"}, path: "/data/in/1/scout/b.dcm", want: true},
+		{globs: []string{"scout/*"}, path: "/data/in/scout/1/b.dcm"},
+		{globs: []string{"scout/*"}, path: "scout/b.dcm", want: true},
+		{globs: []string{"*/scout/*.dcm"}, path: "/data/in/1/scout/b.dcm", want: true},
+		{globs: []string{"scout/*"}, path: "b.dcm"},
+		{globs: []string{"/in/*/b.dcm"}, path: "in/1/b.dcm", want: true},
+		{globs: []string{"/in/*/b.dcm"}, path: "/in/1/b.dcm", want: true},
+		{globs: []string{"/1/b.dcm"}, path: "in/1/b.dcm"},
+		{globs: nil, path: "b.dcm"},
+	}
+	for _, tt := range tests {
+		if got := matchGlobs(tt.globs, tt.path); got != tt.want {
+			t.Errorf("matchGlobs(%q, %q) = %v, want %v", tt.globs, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestInitGlobs(t *testing.T) {
+	tests := []struct {
+		include, exclude string
+		wantInclude      []string
+		wantExclude      []string
+		wantErr          bool
+	}{
+		{include: "*.dcm, IM*,", exclude: "scout/*", wantInclude: []string{"*.dcm", "IM*"}, wantExclude: []string{"scout/*"}},
+		{},
+		{exclude: "[", wantErr: true},
+	}
+	for _, tt := range tests {
+		e := newTestEngine()
+		e.includeFlag, e.excludeFlag = tt.include, tt.exclude
+		err := e.initGlobs()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("initGlobs(%q, %q) error = %v, want error %v", tt.include, tt.exclude, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(e.includeGlobs) != len(tt.wantInclude) || len(e.excludeGlobs) != len(tt.wantExclude) {
+			t.Errorf("initGlobs(%q, %q) = %q and %q, want %q and %q", tt.include, tt.exclude, e.includeGlobs, e.excludeGlobs, tt.wantInclude, tt.wantExclude)
+			continue
+		}
+		for i := range tt.wantInclude {
+			if e.includeGlobs[i] != tt.wantInclude[i] {
+				t.Errorf("include pattern %d is %q, want %q", i, e.includeGlobs[i], tt.wantInclude[i])
+			}
+		}
+		for i := range tt.wantExclude {
+			if e.excludeGlobs[i] != tt.wantExclude[i] {
+				t.Errorf("exclude pattern %d is %q, want %q", i, e.excludeGlobs[i], tt.wantExclude[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,727 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sorter sorts DICOM files into folders named by their tags. It is the
+// engine of the sdcm command line tool and can be used by other Go programs:
+//
+//	opts := sorter.DefaultOptions()
+//	opts.Input = []string{"/data/incoming"}
+//	opts.Output = "/data/sorted"
+//	opts.Quiet = true
+//	result, err := sorter.New(opts).Run(ctx)
+//
+// The options are the command line options of sdcm. Each call of Run, Serve,
+// Index, Query or Tags keeps the state of its run to itself, several Sorters (or
+// several calls of one Sorter) can run at the same time.
+package sorter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// DefaultFolder is the folder path template used if Options.Folder is empty
+const DefaultFolder = "{PatientID}_{PatientName}/{StudyDate}_{StudyTime}/{SeriesNumber}_{SeriesDescription}/{Modality}_{SOPInstanceUID}.dcm"
+
+// Options are the settings of a Sorter, the fields match the command line options of sdcm
+type Options struct {
+	Input  []string // input folders or files
+	Output string   // output folder, host:port for Method "cstore", the DICOMweb URL for Method "stow"
+	Events Events   // receives progress, skipped and written files, can be nil
+
+	Folder    string // folder path template, read from a file if it starts with '@'
+	Method    string // copy, link, dirs_only, cstore or stow
+	FilesFrom string // file with a list of files to sort, "-" for stdin
+	Brave     bool   // write into an output folder that is not empty
+	Quiet     bool
+	Verbose   bool
+	Debug     bool
+
+	Workers      int  // number of workers that parse input files
+	ReadWorkers  int  // overrides Workers if set
+	WriteWorkers int  // number of workers that write output files (default Workers)
+	FullHeader   bool // parse the whole header of each file
+	Thorough     bool // try to parse files that do not look like DICOM
+	Include      string
+	Exclude      string
+
+	Preserve          string // "timestamp" keeps the modification time of copies
+	StripPrivate      bool
+	KeepPrivate       string
+	StripOverlays     bool
+	RemoveTags        string
+	Transcode         string // explicit or implicit
+	SplitFrames       bool
+	Subseries         string
+	OrderSlices       bool
+	SeriesReport      string // .json or .csv file
+	ConsistencyReport string // .json or .csv file
+	Dicomdir          bool
+	UseDicomdir       bool
+	Sync              string // per-file, per-directory, end or none
+	Manifest          string // root or folder
+	Verify            bool
+
+	CalledAET    string
+	AET          string
+	Associations int
+	Retry        int
+	Port         int // DICOM port of Serve, 0 to disable
+	HTTPPort     int // STOW-RS port of Serve, 0 to disable
+	StowBatch    int
+
+	Watch        bool // Run sorts new files until the context is canceled
+	WatchStable  int  // seconds
+	WatchIdle    int  // seconds
+	WatchPoll    bool
+	WatchDelete  bool
+	WatchArchive string
+
+	OnSeriesComplete string
+	OnStudyComplete  string
+	HookJobs         int
+
+	UseIndex  bool
+	IndexFile string
+	IndexTags string
+
+	Where        string // conditions of Query
+	Without      string
+	Group        string // patient, study or series
+	Columns      string
+	OutputFormat string // text, csv or json output of Query and Tags
+	Sample       int    // number of files read by Tags, 0 reads all files
+	Examples     int    // number of example values listed by Tags
+}
+
+// DefaultOptions returns the defaults of the sdcm command line options
+func DefaultOptions() Options {
+	return Options{
+		Folder:       DefaultFolder,
+		Method:       "copy",
+		Workers:      runtime.GOMAXPROCS(0),
+		Sync:         "per-file",
+		CalledAET:    "ANY-SCP",
+		AET:          "SDCM",
+		Associations: 1,
+		Retry:        2,
+		Port:         11112,
+		StowBatch:    100,
+		WatchStable:  5,
+		WatchIdle:    60,
+		HookJobs:     2,
+		Group:        "series",
+		OutputFormat: "text",
+		Examples:     3,
+	}
+}
+
+// Events receives the progress of a Sorter. The methods are called from several goroutines.
+type Events interface {
+	// Started is called once the options, inputs and output have been checked
+	Started()
+	// Progress is called four times a second while files are sorted
+	Progress(p Progress)
+	// Skipped is called for input files that are not sorted, reason is one of the Err values or the error
+	Skipped(path string, reason error)
+	// Written is called for each file created in the output folder, output is empty for files sent (cstore, stow)
+	Written(input string, output string)
+	// Warning is called for problems that do not stop the run (an option without effect, a copy that could not be verified, ...)
+	Warning(err error)
+}
+
+// NoEvents can be embedded to implement only some of the Events
+type NoEvents struct{}
+
+func (NoEvents) Started()                            {}
+func (NoEvents) Progress(p Progress)                 {}
+func (NoEvents) Skipped(path string, reason error)   {}
+func (NoEvents) Written(input string, output string) {}
+func (NoEvents) Warning(err error)                   {}
+
+// reasons for skipped files
+var (
+	ErrNotDICOM = errors.New("content does not look like DICOM")
+	ErrExcluded = errors.New("excluded by -exclude")
+	ErrFiltered = errors.New("filtered by the folder path")
+	ErrDICOMDIR = errors.New("DICOMDIR file")
+)
+
+// Progress is a snapshot of a running Sorter
+type Progress struct {
+	Files         int32 // files sorted
+	Skipped       int32 // non-DICOM files ignored or filtered
+	BytesWritten  int64
+	Elapsed       time.Duration
+	Patients      int
+	Studies       int
+	Series        int
+	Modalities    map[string]int // number of series by modality
+	Reading       int32          // files that are parsed right now
+	Queued        int            // files waiting for a writer
+	QueueCapacity int            // 0 without writer pool
+}
+
+// Result summarizes a run of a Sorter
+type Result struct {
+	Files        int32 // files sorted (or sent)
+	Skipped      int32 // non-DICOM files ignored or filtered
+	BytesWritten int64
+	Duration     time.Duration
+	Patients     int // patients, studies and series of the files sorted
+	Studies      int
+	Series       int
+
+	FoldersOrdered         int // -order-slices, series (and sub-series) per output folder
+	FoldersDuplicateSlices int
+	FoldersMissingSlices   int
+	SeriesComplete         int // -series-report
+	SeriesSuspect          int
+	ConsistencyIssues      int   // -consistency-report
+	FromIndex              int32 // -use-index
+	IndexStale             int32
+	FromDicomdir           int32 // -use-dicomdir
+	DicomdirParsed         int32
+	Received               int32 // Serve
+	Associations           int32
+	StowRequests           int32 // Serve and Method "stow"
+	SeriesCompleted        int32 // Watch
+	Hooks                  int32
+	HooksFailed            int32
+	HookFailures           []string
+	Sent                   int32 // Method "cstore" and "stow"
+	SentWarning            int32
+	SendFailed             int32
+	SendFailures           []string
+	SyncedFolders          int32 // Sync "per-directory"
+	SyncDuration           time.Duration
+	Verified               int32
+	VerifyFailed           int32
+	VerifyFailures         []string
+	Manifests              int // SHA256SUMS files written
+	NotTranscoded          int32
+}
+
+// Sorter sorts, indexes or queries input folders with a set of options
+type Sorter struct {
+	opts Options
+}
+
+// New returns a Sorter for the options, the options are checked when the Sorter runs
+func New(opts Options) *Sorter {
+	return &Sorter{opts: opts}
+}
+
+// engine is the state of one run of a Sorter, each run starts with a new engine
+type engine struct {
+	runContext context.Context
+	events     Events
+
+	createdDirs     sync.Map // output folders created by makeDir
+	filesFromFlag   string
+	splitFramesFlag bool
+	frameNumbers    frameCounter // InstanceNumbers of split frames per series
+
+	checksumState
+	cstoreState
+	dicomdirState
+	dicomdirIndexState
+	headerState
+	hookState
+	identifierState
+	indexState
+	queryState
+	sortState
+	serveState
+	sliceState
+	globState
+	stowState
+	subseriesState
+	syncState
+	tagsState
+	transcodeState
+	transformState
+	seriesReportState
+	watchState
+	writerState
+}
+
+// Run sorts the input folders and files into the output folder. With Options.Watch the input
+// folders are watched until ctx is canceled, otherwise a canceled ctx stops the run early.
+func (s *Sorter) Run(ctx context.Context) (Result, error) {
+	e := newEngine()
+	input, err := e.prepare(ctx, s.opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if e.filesFromFlag != "" && e.watchFlag {
+		return Result{}, fmt.Errorf("-files-from cannot be used with 'sdcm serve' or -watch")
+	}
+	if len(input) == 0 && e.filesFromFlag == "" {
+		return Result{}, fmt.Errorf("no input folder or file")
+	}
+	if err := e.prepareOutput(s.opts.Output); err != nil {
+		return Result{}, err
+	}
+	stopProgress := e.startProgress()
+	var runErr error
+	if e.watchFlag {
+		_, runErr = e.watchFolders(input, s.opts.Output)
+	} else {
+		_, runErr = e.sort_dicoms(input, s.opts.Output)
+		if runErr == nil {
+			runErr = ctx.Err()
+		}
+	}
+	stopProgress()
+	return e.result(), runErr
+}
+
+// Serve receives files with C-STORE (Options.Port) and STOW-RS (Options.HTTPPort) and sorts them into
+// the output folder until ctx is canceled
+func (s *Sorter) Serve(ctx context.Context) (Result, error) {
+	e := newEngine()
+	e.serveMode = true
+	if _, err := e.prepare(ctx, s.opts); err != nil {
+		return Result{}, err
+	}
+	if e.filesFromFlag != "" {
+		return Result{}, fmt.Errorf("-files-from cannot be used with 'sdcm serve' or -watch")
+	}
+	if e.portFlag <= 0 && e.httpPortFlag <= 0 {
+		return Result{}, fmt.Errorf("'sdcm serve' needs -port or -http-port")
+	}
+	if err := e.prepareOutput(s.opts.Output); err != nil {
+		return Result{}, err
+	}
+	stopProgress := e.startProgress()
+	_, err := e.serveDicom(s.opts.Output)
+	stopProgress()
+	return e.result(), err
+}
+
+// Index writes (or updates) the index of each input folder for Options.UseIndex
+func (s *Sorter) Index(ctx context.Context) error {
+	e := newEngine()
+	e.indexMode = true
+	input, err := e.prepare(ctx, s.opts)
+	if err != nil {
+		return err
+	}
+	if len(input) == 0 || (e.indexFileFlag != "" && len(input) > 1) {
+		return fmt.Errorf("'sdcm index' needs input folders, -index can only be used with a single input folder")
+	}
+	for i, in := range input {
+		if info, err := os.Stat(in); err != nil || !info.IsDir() {
+			return fmt.Errorf("input path \"%s\" is not a folder", s.opts.Input[i])
+		}
+	}
+	return e.buildIndex(input)
+}
+
+// Query writes a table of the patients, studies or series of the input folders that match
+// Options.Where and Options.Without to w
+func (s *Sorter) Query(ctx context.Context, w io.Writer) error {
+	e := newEngine()
+	e.queryMode = true
+	input, err := e.prepare(ctx, s.opts)
+	if err != nil {
+		return err
+	}
+	if len(input) == 0 || (e.indexFileFlag != "" && len(input) > 1) {
+		return fmt.Errorf("'sdcm query' needs input folders or files, -index can only be used with a single input folder")
+	}
+	return e.queryFolders(input, w)
+}
+
+// Tags writes the tags found in the input folders with their VR, the number of files, the number of
+// distinct values and example values to w
+func (s *Sorter) Tags(ctx context.Context, w io.Writer) error {
+	e := newEngine()
+	e.tagsMode = true
+	input, err := e.prepare(ctx, s.opts)
+	if err != nil {
+		return err
+	}
+	if len(input) == 0 {
+		return fmt.Errorf("'sdcm tags' needs input folders or files")
+	}
+	return e.listTags(input, w)
+}
+
+// prepare sets the options of the run and checks them, returns the absolute input paths
+func (e *engine) prepare(ctx context.Context, o Options) ([]string, error) {
+	e.runContext = ctx
+	e.events = o.Events
+
+	e.methodFlag, e.outputFolderFlag, e.filesFromFlag, e.braveFlag = o.Method, o.Folder, o.FilesFrom, o.Brave
+	e.quietFlag, e.verboseFlag, e.debugFlag = o.Quiet, o.Verbose, o.Debug
+	e.num_workers, e.readWorkersFlag, e.writeWorkersFlag = o.Workers, o.ReadWorkers, o.WriteWorkers
+	e.fullHeaderFlag, e.thoroughFlag, e.includeFlag, e.excludeFlag = o.FullHeader, o.Thorough, o.Include, o.Exclude
+	e.preserveFlag, e.stripPrivateFlag, e.keepPrivateFlag, e.stripOverlaysFlag, e.removeTagsFlag = o.Preserve, o.StripPrivate, o.KeepPrivate, o.StripOverlays, o.RemoveTags
+	e.transcodeFlag, e.splitFramesFlag, e.subseriesFlag, e.orderSlicesFlag = o.Transcode, o.SplitFrames, o.Subseries, o.OrderSlices
+	e.seriesReportFlag, e.consistencyReportFlag, e.dicomdirFlag, e.useDicomdirFlag = o.SeriesReport, o.ConsistencyReport, o.Dicomdir, o.UseDicomdir
+	e.syncFlag, e.manifestFlag, e.verifyFlag = o.Sync, o.Manifest, o.Verify
+	e.calledAETFlag, e.aetFlag, e.associationsFlag, e.retryFlag = o.CalledAET, o.AET, o.Associations, o.Retry
+	e.portFlag, e.httpPortFlag, e.stowBatchFlag = o.Port, o.HTTPPort, o.StowBatch
+	e.watchFlag, e.watchStableFlag, e.watchIdleFlag, e.watchPollFlag, e.watchDeleteFlag, e.watchArchiveFlag = o.Watch, o.WatchStable, o.WatchIdle, o.WatchPoll, o.WatchDelete, o.WatchArchive
+	e.onSeriesCompleteFlag, e.onStudyCompleteFlag, e.hookJobsFlag = o.OnSeriesComplete, o.OnStudyComplete, o.HookJobs
+	e.useIndexFlag, e.indexFileFlag, e.indexTagsFlag = o.UseIndex, o.IndexFile, o.IndexTags
+	e.whereFlag, e.withoutFlag, e.groupFlag, e.columnsFlag, e.outputFormatQueryFlag = o.Where, o.Without, o.Group, o.Columns, o.OutputFormat
+	e.tagsSampleFlag, e.tagsExamplesFlag = o.Sample, o.Examples
+
+	if e.outputFolderFlag == "" {
+		e.outputFolderFlag = DefaultFolder
+	}
+	var err error
+	if e.outputFolderFlag, err = translateStringOrFile(e.outputFolderFlag); err != nil {
+		return nil, err
+	}
+	switch e.methodFlag {
+	case "copy", "link", "dirs_only", "emptyfile", "cstore", "stow":
+	default:
+		return nil, fmt.Errorf("unknown option \"%s\" for method flag, we support only \"copy\" (default), \"link\", \"dirs_only\", \"cstore\" and \"stow\"", e.methodFlag)
+	}
+	if err := e.initSubseries(); err != nil {
+		return nil, err
+	}
+
+	// try to extract the tags requested in the outputFolderFlag
+	re := regexp.MustCompile(`{[^{}]*}`)
+	matches := re.FindAllString(e.outputFolderFlag, -1)
+	for a := range matches {
+		name := matches[a][1 : len(matches[a])-1]
+		// we could be counter here, ignore and add later
+		if name == "counter" {
+			continue
+		}
+		// the name of the transfer syntax is derived from TransferSyntaxUID
+		if name == "TransferSyntax" {
+			continue
+		}
+		// the sub-series label is computed from the tags in -subseries
+		if name == "subseries" {
+			continue
+		}
+		// feature: if we find an == sign we use a regexp to filter, for now just extract the first part
+		if strings.Contains(name, "==") {
+			name = strings.Split(name, "==")[0]
+		} else if strings.Contains(name, "=") {
+			name = strings.Split(name, "=")[0]
+		}
+
+		// TODO: we should allow tags specified by group and element as well
+		// e.g. {0010,0020} for PatientID
+		if t, err := tag.FindByName(name); err == nil {
+			e.dicomTags[t.Tag] = matches[a]
+		} else {
+			e.warn("unknown DICOM tag with name \"%s\", cannot be used as a path variable (%s)", matches[a], err)
+		}
+	}
+
+	if e.debugFlag {
+		e.quietFlag = false
+	}
+
+	// add three tags we need for book keeping, a filter of the template is kept
+	for _, t := range []tag.Tag{tag.PatientID, tag.StudyInstanceUID, tag.SeriesInstanceUID} {
+		if _, ok := e.dicomTags[t]; !ok {
+			info, _ := tag.Find(t)
+			e.dicomTags[t] = "{" + info.Name + "}"
+		}
+	}
+
+	// check preserveFlag
+	if e.preserveFlag != "" {
+		if e.methodFlag != "copy" {
+			e.warn("-preserve is only supported for method 'copy'")
+		}
+		// allowed modes are timestamp
+		pieces := strings.Split(e.preserveFlag, ",")
+		for a := range pieces {
+			if pieces[a] == "timestamp" {
+				e.preserve[pieces[a]] = true
+			} else {
+				return nil, fmt.Errorf("unknown preserve \"%s\"", pieces[a])
+			}
+		}
+	}
+
+	if err := e.initTransforms(); err != nil {
+		return nil, err
+	}
+	if err := e.initTranscode(); err != nil {
+		return nil, err
+	}
+	e.initSplitFrames()
+	if e.queryMode {
+		if err := e.initQuery(); err != nil {
+			return nil, err
+		}
+	}
+	if e.tagsMode {
+		if err := e.initTags(); err != nil {
+			return nil, err
+		}
+	}
+	// tags of the hook placeholders are read like the tags of the template
+	if err := e.initHooks(); err != nil {
+		return nil, err
+	}
+	e.initHeaderReader()
+	if err := e.initGlobs(); err != nil {
+		return nil, fmt.Errorf("invalid -include or -exclude pattern (%s)", err)
+	}
+	if err := e.initSync(); err != nil {
+		return nil, err
+	}
+	if err := e.initChecksums(); err != nil {
+		return nil, err
+	}
+	if err := e.initWatch(); err != nil {
+		return nil, err
+	}
+	if err := e.initDicomdir(); err != nil {
+		return nil, err
+	}
+
+	var input []string
+	for _, a := range o.Input {
+		in, err := filepath.Abs(a)
+		if err != nil {
+			return nil, fmt.Errorf("input path \"%s\" could not be found", a)
+		}
+		input = append(input, in)
+	}
+
+	// check num_workers
+	if e.writeWorkersFlag < 1 {
+		e.writeWorkersFlag = e.num_workers
+	}
+	if e.readWorkersFlag > 0 {
+		e.num_workers = e.readWorkersFlag
+	}
+	if e.num_workers < 1 {
+		e.num_workers = 1
+	}
+	return input, nil
+}
+
+// prepareOutput checks the output of a run and starts the writers
+func (e *engine) prepareOutput(output string) error {
+	if output == "" {
+		return fmt.Errorf("no output folder")
+	}
+	// we will error out of the output path already exists and is not empty
+	if e.methodFlag == "cstore" {
+		if err := e.initCStore(output); err != nil {
+			return err
+		}
+	} else if e.methodFlag == "stow" {
+		if err := e.initStow(output); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(output); err == nil && !e.serveMode && !e.watchFlag {
+		empty, _ := isEmpty(output)
+		if !empty && !e.braveFlag {
+			return fmt.Errorf("output path %s already exists, cowardly refusing to continue. Clear its content, specify a new directory or be -brave", output)
+		}
+	}
+	e.startWriters()
+	return nil
+}
+
+// canceled returns true if the context of the run is done
+func (e *engine) canceled() bool {
+	return e.runContext.Err() != nil
+}
+
+// skipFile counts an input file that is not sorted
+func (e *engine) skipFile(path string, reason error) {
+	atomic.AddInt32(&e.counterError, 1)
+	if e.events != nil {
+		e.events.Skipped(path, reason)
+	}
+}
+
+// warn reports a problem that does not stop the run
+func (e *engine) warn(format string, a ...any) {
+	if e.events != nil {
+		e.events.Warning(fmt.Errorf(format, a...))
+	}
+}
+
+// startProgress sends the progress to the events every 250 ms, the returned function stops it
+func (e *engine) startProgress() func() {
+	if e.events == nil {
+		return func() {}
+	}
+	e.events.Started()
+	// use a channel listStructuresChan to store global information on the parsed DICOM files
+	collected := make(chan bool)
+	go func() {
+		for entry := range e.listStructuresChan {
+			// a series can contain more than one modality, count each combination once
+			SeriesInstanceUID := entry[3]
+			key := SeriesInstanceUID + "\\" + entry[4]
+			if _, ok := e.listStructure[key]; !ok {
+				// use a mutex to separate write a read to listStructure and modalities together
+				e.listStructureMutex.Lock()
+				e.listStructure[key] = []string{entry[0], entry[1], entry[2], entry[4]}
+				if _, ok := e.modalities[entry[4]]; !ok {
+					e.modalities[entry[4]] = 1 // store the modality
+				} else {
+					e.modalities[entry[4]]++ // increment the count
+				}
+				e.listStructureMutex.Unlock()
+			}
+		}
+		close(collected)
+	}()
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				e.events.Progress(e.progress())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+		close(e.listStructuresChan) // close the channel to signal that we are done
+		<-collected
+	}
+}
+
+// progress returns a snapshot of the current run
+func (e *engine) progress() Progress {
+	p := Progress{
+		Files:        atomic.LoadInt32(&e.counter),
+		Skipped:      atomic.LoadInt32(&e.counterError),
+		BytesWritten: atomic.LoadInt64(&e.bytesWritten),
+		Elapsed:      time.Since(e.startTime),
+		Patients:     countKeys(&e.listPatients),
+		Studies:      countKeys(&e.listStudies),
+		Series:       countKeys(&e.listSeries),
+		Reading:      atomic.LoadInt32(&e.counterReading),
+		Modalities:   make(map[string]int, 0),
+	}
+	if q := e.writeQueue; q != nil {
+		p.Queued, p.QueueCapacity = len(q), cap(q)
+	}
+	e.listStructureMutex.Lock()
+	for m, n := range e.modalities {
+		p.Modalities[m] = n
+	}
+	e.listStructureMutex.Unlock()
+	return p
+}
+
+// countKeys returns the number of patients, studies or series in a counter map
+func countKeys(m *sync.Map) int {
+	n := 0
+	m.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// result collects the counters of the run
+func (e *engine) result() Result {
+	sorted := func(list []string, mutex *sync.Mutex) []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		list = append([]string{}, list...)
+		sort.Strings(list)
+		return list
+	}
+	return Result{
+		Files:                  e.counter,
+		Skipped:                e.counterError,
+		BytesWritten:           e.bytesWritten,
+		Duration:               time.Since(e.startTime),
+		Patients:               countKeys(&e.listPatients),
+		Studies:                countKeys(&e.listStudies),
+		Series:                 countKeys(&e.listSeries),
+		FoldersOrdered:         e.numFoldersOrdered,
+		FoldersDuplicateSlices: e.numFoldersDuplicateSlices,
+		FoldersMissingSlices:   e.numFoldersMissingSlices,
+		SeriesComplete:         e.numSeriesComplete,
+		SeriesSuspect:          e.numSeriesSuspect,
+		ConsistencyIssues:      e.numConsistencyIssues,
+		FromIndex:              e.counterFromIndex,
+		IndexStale:             e.counterIndexStale,
+		FromDicomdir:           e.counterIndexed,
+		DicomdirParsed:         e.counterIndexedParsed,
+		Received:               e.counterReceived,
+		Associations:           e.counterAssociations,
+		StowRequests:           e.counterStowRequests,
+		SeriesCompleted:        e.counterSeriesComplete,
+		Hooks:                  e.counterHooks,
+		HooksFailed:            e.counterHooksFailed,
+		HookFailures:           sorted(e.hookFailures, &e.hookFailuresMutex),
+		Sent:                   e.counterSent,
+		SentWarning:            e.counterSentWarning,
+		SendFailed:             e.counterSendFailed,
+		SendFailures:           sorted(e.sendFailures, &e.sendFailuresMutex),
+		SyncedFolders:          e.counterSyncedFolders,
+		SyncDuration:           e.syncDuration,
+		Verified:               e.counterVerified,
+		VerifyFailed:           e.counterVerifyFailed,
+		VerifyFailures:         sorted(e.verifyFailures, &e.verifyFailuresMutex),
+		Manifests:              len(e.manifestFiles),
+		NotTranscoded:          e.counterNotTranscoded,
+	}
+}
+
+// newEngine returns the state of a new run
+func newEngine() *engine {
+	e := &engine{runContext: context.Background()}
+	e.startTime = time.Now()
+	e.listStructure = make(map[string][]string, 0)
+	e.modalities = make(map[string]int, 0)
+	e.listStructuresChan = make(chan []string, 1000)
+	e.dicomTags = make(map[tag.Tag]string, 0)
+	e.preserve = make(map[string]bool, 0)
+	e.checksums = make(map[string]map[string]string, 0)
+	e.manifestFiles = make(map[string]bool, 0)
+	e.dicomdirEntries = make(map[string]*dicomdirEntry, 0)
+	e.dicomdirRoot = &dicomdirEntry{id: "DICOM", children: make(map[string]string, 0)}
+	e.completeStudies = make(map[string]*studyActivity, 0)
+	e.identifierPatientNames = make(map[string]valueSet, 0)
+	e.identifierBirthDates = make(map[string]valueSet, 0)
+	e.identifierStudyPatients = make(map[string]valueSet, 0)
+	e.identifierSeriesInfo = make(map[string]*identifierSeries, 0)
+	e.queryGroups = make(map[string]*queryGroup, 0)
+	e.sliceFiles = make(map[sliceGroup][]instanceInfo, 0)
+	e.unsyncedFiles = make(map[string][]string, 0)
+	e.syncedFolders = make(map[string]bool, 0)
+	e.tagsFound = make(map[tag.Tag]*tagStats, 0)
+	e.seriesInstances = make(map[string]*seriesEntry, 0)
+	e.activeSeries = make(map[string]*seriesActivity, 0)
+	return e
+}
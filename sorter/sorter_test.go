@@ -0,0 +1,273 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+
+// newTestElement returns an element of a tag in the dictionary
+func newTestElement(t testing.TB, tg tag.Tag, data interface{}) *dicom.Element {
+	t.Helper()
+	elem, err := dicom.NewElement(tg, data)
+	if err != nil {
+		t.Fatalf("could not create element %s (%s)", tg, err)
+	}
+	return elem
+}
+
+// newRawElement returns an element with the given VR, for private and repeating group tags
+func newRawElement(t testing.TB, tg tag.Tag, vr string, data interface{}) *dicom.Element {
+	t.Helper()
+	value, err := dicom.NewValue(data)
+	if err != nil {
+		t.Fatalf("could not create value of %s (%s)", tg, err)
+	}
+	return &dicom.Element{Tag: tg, ValueRepresentation: tag.GetVRKind(tg, vr), RawValueRepresentation: vr, Value: value}
+}
+
+// newTestDataset returns a data set with the elements in tag order and the file meta information,
+// the transfer syntax is explicit VR little endian if the elements do not set it
+func newTestDataset(t testing.TB, elems ...*dicom.Element) dicom.Dataset {
+	t.Helper()
+	ds := dicom.Dataset{}
+	for _, elem := range elems {
+		putElement(&ds, elem)
+	}
+	if _, err := ds.FindElementByTag(tag.TransferSyntaxUID); err != nil {
+		putElement(&ds, newTestElement(t, tag.TransferSyntaxUID, []string{uid.ExplicitVRLittleEndian}))
+	}
+	putElement(&ds, newTestElement(t, tag.FileMetaInformationVersion, []byte{0, 1}))
+	putElement(&ds, newTestElement(t, tag.MediaStorageSOPClassUID, []string{getString(&ds, tag.SOPClassUID)}))
+	putElement(&ds, newTestElement(t, tag.MediaStorageSOPInstanceUID, []string{getString(&ds, tag.SOPInstanceUID)}))
+	return ds
+}
+
+// newTestInstance returns a CT instance of a series, the SOPInstanceUID ends with the instance number
+func newTestInstance(t testing.TB, series string, number int, elems ...*dicom.Element) dicom.Dataset {
+	t.Helper()
+	return newTestDataset(t, append([]*dicom.Element{
+		newTestElement(t, tag.SOPClassUID, []string{ctImageStorage}),
+		newTestElement(t, tag.SOPInstanceUID, []string{fmt.Sprintf("%s.%d", series, number)}),
+		newTestElement(t, tag.Modality, []string{"CT"}),
+		newTestElement(t, tag.PatientName, []string{"Test^Patient"}),
+		newTestElement(t, tag.PatientID, []string{"P1"}),
+		newTestElement(t, tag.StudyInstanceUID, []string{"1.2.826.0.1.3680043.2.1125.1"}),
+		newTestElement(t, tag.SeriesInstanceUID, []string{series}),
+		newTestElement(t, tag.SeriesNumber, []string{"1"}),
+		newTestElement(t, tag.InstanceNumber, []string{fmt.Sprint(number)}),
+	}, elems...)...)
+}
+
+// writeTestFile writes a data set as a Part 10 file
+func writeTestFile(t testing.TB, path string, ds dicom.Dataset) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := dicom.Write(w, ds, dicom.SkipVRVerification(), dicom.SkipValueTypeVerification()); err != nil {
+		t.Fatalf("could not write %s (%s)", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestEngine returns the state of a quiet copy run
+func newTestEngine() *engine {
+	e := newEngine()
+	e.methodFlag = "copy"
+	e.quietFlag = true
+	e.num_workers = 2
+	e.syncFlag = "none"
+	return e
+}
+
+// elementTags lists the tags of the elements, tags in sequence items are prefixed by '>'
+func elementTags(elems []*dicom.Element, prefix string) []string {
+	var tags []string
+	for _, elem := range elems {
+		tags = append(tags, prefix+elem.Tag.String())
+		if items, ok := elem.Value.GetValue().([]*dicom.SequenceItemValue); ok {
+			for _, item := range items {
+				tags = append(tags, elementTags(item.GetValue().([]*dicom.Element), prefix+">")...)
+			}
+		}
+	}
+	return tags
+}
+
+// recordedEvents collects the events of a run
+type recordedEvents struct {
+	NoEvents
+	mutex    sync.Mutex
+	skipped  map[string]error
+	written  []string
+	warnings []string
+}
+
+func newRecordedEvents() *recordedEvents {
+	return &recordedEvents{skipped: make(map[string]error, 0)}
+}
+
+func (r *recordedEvents) Skipped(path string, reason error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.skipped[path] = reason
+}
+
+func (r *recordedEvents) Written(input string, output string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.written = append(r.written, output)
+}
+
+func (r *recordedEvents) Warning(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.warnings = append(r.warnings, err.Error())
+}
+
+// writePatients writes one file for each series of each patient
+func writePatients(t *testing.T, dir string, patients []string, series int) {
+	t.Helper()
+	for p, patient := range patients {
+		for s := 1; s <= series; s++ {
+			seriesInstanceUID := fmt.Sprintf("1.2.3.%d.%d", p+1, s)
+			ds := newTestInstance(t, seriesInstanceUID, 1,
+				newTestElement(t, tag.PatientID, []string{patient}),
+				newTestElement(t, tag.StudyInstanceUID, []string{fmt.Sprintf("1.2.3.%d", p+1)}))
+			writeTestFile(t, filepath.Join(dir, seriesInstanceUID+".dcm"), ds)
+		}
+	}
+}
+
+func TestRunCounts(t *testing.T) {
+	in := t.TempDir()
+	writePatients(t, in, []string{"P1", "P2"}, 2)
+	tests := []struct {
+		name                      string
+		folder                    string
+		events                    bool
+		files                     int32
+		patients, studies, series int
+	}{
+		{name: "without events", folder: "{PatientID}/{SeriesInstanceUID}.dcm", files: 4, patients: 2, studies: 2, series: 4},
+		{name: "with events", folder: "{PatientID}/{SeriesInstanceUID}.dcm", events: true, files: 4, patients: 2, studies: 2, series: 4},
+		// the book keeping tags do not replace a filter of the template
+		{name: "filter", folder: "{PatientID==P2}/{SOPInstanceUID}.dcm", events: true, files: 2, patients: 1, studies: 1, series: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.Folder = []string{in}, t.TempDir(), true, "none", tt.folder
+			if tt.events {
+				opts.Events = newRecordedEvents()
+			}
+			result, err := New(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != tt.files || result.Patients != tt.patients || result.Studies != tt.studies || result.Series != tt.series {
+				t.Errorf("%d files of %d patients, %d studies and %d series, want %d, %d, %d and %d",
+					result.Files, result.Patients, result.Studies, result.Series, tt.files, tt.patients, tt.studies, tt.series)
+			}
+		})
+	}
+}
+
+func TestRunWarnings(t *testing.T) {
+	in := t.TempDir()
+	writePatients(t, in, []string{"P1"}, 1)
+	events := newRecordedEvents()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.Events = []string{in}, t.TempDir(), true, "none", events
+	opts.KeepPrivate, opts.Method = "SIEMENS", "link"
+	opts.Folder = "{PatientID}/{NoSuchTag}/{SOPInstanceUID}.dcm"
+	if _, err := New(opts).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"{NoSuchTag}", "-keep-private"}
+	if len(events.warnings) != len(want) {
+		t.Fatalf("warnings %q, want one about each of %q", events.warnings, want)
+	}
+	for i, w := range want {
+		if !strings.Contains(events.warnings[i], w) {
+			t.Errorf("warning %q, want one about %s", events.warnings[i], w)
+		}
+	}
+}
+
+// two Sorters can run at the same time, each reports only its own files
+func TestRunConcurrent(t *testing.T) {
+	type run struct {
+		in, out string
+		events  *recordedEvents
+		result  Result
+		err     error
+	}
+	runs := []*run{{in: t.TempDir(), out: t.TempDir()}, {in: t.TempDir(), out: t.TempDir()}}
+	writePatients(t, runs[0].in, []string{"P1"}, 3)
+	writePatients(t, runs[1].in, []string{"P2", "P3"}, 2)
+	var wg sync.WaitGroup
+	for _, r := range runs {
+		r.events = newRecordedEvents()
+		opts := DefaultOptions()
+		opts.Input, opts.Output, opts.Quiet, opts.Sync, opts.Events = []string{r.in}, r.out, true, "none", r.events
+		opts.Folder = "{PatientID}/{SeriesInstanceUID}.dcm"
+		opts.Workers, opts.WriteWorkers = 4, 2
+		wg.Add(1)
+		go func(r *run) {
+			defer wg.Done()
+			r.result, r.err = New(opts).Run(context.Background())
+		}(r)
+	}
+	wg.Wait()
+
+	wants := []struct {
+		files    []string
+		patients int
+	}{
+		{files: []string{"P1/1.2.3.1.1.dcm", "P1/1.2.3.1.2.dcm", "P1/1.2.3.1.3.dcm"}, patients: 1},
+		{files: []string{"P2/1.2.3.1.1.dcm", "P2/1.2.3.1.2.dcm", "P3/1.2.3.2.1.dcm", "P3/1.2.3.2.2.dcm"}, patients: 2},
+	}
+	for i, r := range runs {
+		want := wants[i]
+		if r.err != nil {
+			t.Fatalf("run %d: %s", i, r.err)
+		}
+		if int(r.result.Files) != len(want.files) || r.result.Patients != want.patients {
+			t.Errorf("run %d: %d files of %d patients, want %d of %d", i, r.result.Files, r.result.Patients, len(want.files), want.patients)
+		}
+		if got := listFiles(t, r.out); !reflect.DeepEqual(got, want.files) {
+			t.Errorf("run %d: output %v, want %v", i, got, want.files)
+		}
+		if len(r.events.written) != len(want.files) {
+			t.Errorf("run %d: %d files reported, want %d", i, len(r.events.written), len(want.files))
+		}
+		for _, w := range r.events.written {
+			if !strings.HasPrefix(w, r.out+string(os.PathSeparator)) {
+				t.Errorf("run %d: reported %s of another run", i, w)
+			}
+		}
+	}
+}
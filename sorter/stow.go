@@ -0,0 +1,416 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// DICOMweb STOW-RS (store over the web). With '-method stow' the last argument
+// is the base URL of a DICOMweb service, matching instances are collected per
+// study and POSTed as multipart/related; type="application/dicom" to
+// <base URL>/studies/<StudyInstanceUID>, at most -stow-batch instances per
+// request. 'sdcm serve -http-port 8080' accepts such requests on /studies and
+// sorts the uploaded instances like files received with C-STORE.
+
+// stowState holds the pending instances and counters of STOW-RS
+type stowState struct {
+	stowBatchFlag int
+	httpPortFlag  int
+
+	// base URL of the DICOMweb service
+	stowURL string
+
+	// instances waiting to be sent, by StudyInstanceUID
+	stowPending      map[string][]stowFile
+	stowPendingMutex sync.Mutex
+
+	// number of STOW-RS requests sent or received
+	counterStowRequests int32
+}
+
+// stowFile is an instance waiting to be sent
+type stowFile struct {
+	inFile         string // the input file, used in messages
+	path           string // the file that is sent
+	temporary      bool
+	sopInstanceUID string
+	dataset        *dicom.Dataset // header of the input file for the bookkeeping after it was sent
+	dicomVals      map[tag.Tag]string
+}
+
+// DICOM JSON model (PS3.18 F.2) for the STOW-RS response, only the attributes used here
+const (
+	jsonFailedSOPSequence        = "00081198"
+	jsonReferencedSOPSequence    = "00081199"
+	jsonReferencedSOPClassUID    = "00081150"
+	jsonReferencedSOPInstanceUID = "00081155"
+	jsonFailureReason            = "00081197"
+	jsonWarningReason            = "00081196"
+)
+
+type dicomJSON map[string]dicomJSONElement
+
+type dicomJSONElement struct {
+	VR    string            `json:"vr"`
+	Value []json.RawMessage `json:"Value,omitempty"`
+}
+
+// items returns the items of a sequence attribute
+func (d dicomJSON) items(key string) []dicomJSON {
+	var items []dicomJSON
+	for _, v := range d[key].Value {
+		var item dicomJSON
+		if json.Unmarshal(v, &item) == nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// str returns the first value of a string attribute
+func (d dicomJSON) str(key string) string {
+	var s string
+	if e, ok := d[key]; ok && len(e.Value) > 0 {
+		json.Unmarshal(e.Value[0], &s)
+	}
+	return s
+}
+
+// us returns the first value of a numeric attribute, -1 if it does not exist
+func (d dicomJSON) us(key string) int {
+	n := -1
+	if e, ok := d[key]; ok && len(e.Value) > 0 {
+		json.Unmarshal(e.Value[0], &n)
+	}
+	return n
+}
+
+// jsonValue creates an attribute of the DICOM JSON model
+func jsonValue(vr string, values ...interface{}) dicomJSONElement {
+	e := dicomJSONElement{VR: vr}
+	for _, v := range values {
+		b, _ := json.Marshal(v)
+		e.Value = append(e.Value, b)
+	}
+	return e
+}
+
+// initStow checks the options for '-method stow'
+func (e *engine) initStow(address string) error {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("'-method stow' expects the URL of a DICOMweb service as the last argument (e.g. http://localhost:8080/dicomweb)")
+	}
+	if e.dicomdirFlag || e.orderSlicesFlag {
+		return fmt.Errorf("-dicomdir and -order-slices cannot be used with '-method stow'")
+	}
+	if e.stowBatchFlag < 1 {
+		e.stowBatchFlag = 1
+	}
+	e.stowURL = strings.TrimSuffix(strings.TrimSuffix(address, "/"), "/studies")
+	e.stowPending = make(map[string][]stowFile, 0)
+	return nil
+}
+
+// stowInstance adds a data set to the instances of its study, the study is sent once -stow-batch instances are collected
+func (e *engine) stowInstance(dataset *dicom.Dataset, dicomVals map[tag.Tag]string, in_file string, content *dicom.Dataset) error {
+	// dicomVals only has the tags of the folder path, the header always has the StudyInstanceUID
+	studyInstanceUID := getString(dataset, tag.StudyInstanceUID)
+	path, temporary, err := e.instanceFile(in_file, content)
+	if err != nil {
+		return err
+	}
+	_, sopInstanceUID, _, _, err := fileMeta(path)
+	if err != nil {
+		// STOW-RS needs the file meta information
+		if temporary {
+			os.Remove(path)
+		}
+		e.recordSendFailure(in_file, err)
+		return nil
+	}
+	e.stowPendingMutex.Lock()
+	e.stowPending[studyInstanceUID] = append(e.stowPending[studyInstanceUID], stowFile{inFile: in_file, path: path, temporary: temporary, sopInstanceUID: sopInstanceUID, dataset: dataset, dicomVals: dicomVals})
+	var batch []stowFile
+	if len(e.stowPending[studyInstanceUID]) >= e.stowBatchFlag {
+		batch = e.stowPending[studyInstanceUID]
+		delete(e.stowPending, studyInstanceUID)
+	}
+	e.stowPendingMutex.Unlock()
+	if batch != nil {
+		e.postStudy(studyInstanceUID, batch)
+	}
+	return nil
+}
+
+// flushStow sends the instances that are still waiting, called after all files have been read
+func (e *engine) flushStow() {
+	e.stowPendingMutex.Lock()
+	pending := e.stowPending
+	e.stowPending = make(map[string][]stowFile, 0)
+	e.stowPendingMutex.Unlock()
+	for studyInstanceUID, files := range pending {
+		e.postStudy(studyInstanceUID, files)
+	}
+}
+
+// postMultipart sends files in a single multipart/related request, the body is streamed from disk
+func postMultipart(address string, files []stowFile) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, f := range files {
+			part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/dicom"}})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			in, err := os.Open(f.path)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, in)
+			in.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	req, err := http.NewRequest(http.MethodPost, address, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf("multipart/related; type=\"application/dicom\"; boundary=%s", mw.Boundary()))
+	req.Header.Set("Accept", "application/dicom+json")
+	return http.DefaultClient.Do(req)
+}
+
+// postStudy sends the instances of a study with retries and records the result for each instance
+func (e *engine) postStudy(studyInstanceUID string, files []stowFile) {
+	defer func() {
+		for _, f := range files {
+			if f.temporary {
+				os.Remove(f.path)
+			}
+		}
+	}()
+	address := e.stowURL + "/studies"
+	if studyInstanceUID != "" {
+		address += "/" + studyInstanceUID
+	}
+
+	var resp *http.Response
+	var body []byte
+	var err error
+	for attempt := 0; attempt <= e.retryFlag; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+			e.logf("retry %d for study %s\n", attempt, studyInstanceUID)
+		}
+		resp, err = postMultipart(address, files)
+		if err != nil {
+			continue
+		}
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			// the service might be busy
+			err = fmt.Errorf("HTTP status %s", resp.Status)
+			continue
+		}
+		break
+	}
+	atomic.AddInt32(&e.counterStowRequests, 1)
+	if err == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusConflict {
+		err = fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	var result dicomJSON
+	if err == nil && resp.StatusCode != http.StatusOK {
+		// failures and warnings are listed per instance
+		if e := json.Unmarshal(body, &result); e != nil {
+			err = fmt.Errorf("HTTP status %s, could not read the response (%s)", resp.Status, e)
+		}
+	}
+	if err != nil {
+		for _, f := range files {
+			e.recordSendFailure(f.inFile, err)
+		}
+		return
+	}
+
+	failed := make(map[string]int, 0)
+	for _, item := range result.items(jsonFailedSOPSequence) {
+		failed[item.str(jsonReferencedSOPInstanceUID)] = item.us(jsonFailureReason)
+	}
+	warning := make(map[string]int, 0)
+	for _, item := range result.items(jsonReferencedSOPSequence) {
+		if reason := item.us(jsonWarningReason); reason >= 0 {
+			warning[item.str(jsonReferencedSOPInstanceUID)] = reason
+		}
+	}
+	for _, f := range files {
+		if reason, ok := failed[f.sopInstanceUID]; ok {
+			e.recordSendFailure(f.inFile, fmt.Errorf("failure reason 0x%04X", reason))
+			continue
+		}
+		if resp.StatusCode == http.StatusConflict {
+			// the request failed but the instance is not listed
+			e.recordSendFailure(f.inFile, fmt.Errorf("HTTP status %s", resp.Status))
+			continue
+		}
+		if reason, ok := warning[f.sopInstanceUID]; ok {
+			atomic.AddInt32(&e.counterSentWarning, 1)
+			e.logf("stored %s with warning 0x%04X\n", f.inFile, reason)
+		}
+		atomic.AddInt32(&e.counterSent, 1)
+		atomic.AddInt32(&e.counter, 1)
+		if info, err := os.Stat(f.path); err == nil {
+			atomic.AddInt64(&e.bytesWritten, info.Size())
+		}
+		e.recordSorted(f.dataset, f.dicomVals, f.inFile, "")
+	}
+}
+
+// stowHandler accepts STOW-RS requests on /studies and /studies/<StudyInstanceUID>
+func (e *engine) stowHandler(spoolDir string, dest_path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		studyInstanceUID := ""
+		if len(parts) >= 2 && parts[len(parts)-2] == "studies" {
+			studyInstanceUID = parts[len(parts)-1]
+		} else if parts[len(parts)-1] != "studies" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/related" || params["boundary"] == "" {
+			http.Error(w, "expected multipart/related; type=\"application/dicom\"", http.StatusUnsupportedMediaType)
+			return
+		}
+		if t := params["type"]; t != "" && t != "application/dicom" {
+			http.Error(w, fmt.Sprintf("unsupported type %s, expected application/dicom", t), http.StatusUnsupportedMediaType)
+			return
+		}
+		atomic.AddInt32(&e.counterStowRequests, 1)
+		e.logf("STOW-RS request from %s\n", r.RemoteAddr)
+
+		var referenced, failed []dicomJSON
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not read multipart body (%s)", err), http.StatusBadRequest)
+				return
+			}
+			spoolName := filepath.Join(spoolDir, fmt.Sprintf("%d-%d.dcm", time.Now().UnixNano(), i))
+			spool, err := os.Create(spoolName)
+			if err != nil {
+				e.warn("could not create %s (%s)", spoolName, err)
+				http.Error(w, "could not store the instance", http.StatusServiceUnavailable)
+				return
+			}
+			_, err = io.Copy(spool, part)
+			spool.Close()
+			var status uint16 = statusOutOfResources
+			if err == nil {
+				status = e.storeReceived(spoolName, dest_path, studyInstanceUID)
+			}
+			sopClassUID, sopInstanceUID, _, _, _ := fileMeta(spoolName)
+			os.Remove(spoolName)
+			atomic.AddInt32(&e.counterReceived, 1)
+
+			item := dicomJSON{}
+			if sopInstanceUID != "" {
+				item[jsonReferencedSOPClassUID] = jsonValue("UI", sopClassUID)
+				item[jsonReferencedSOPInstanceUID] = jsonValue("UI", sopInstanceUID)
+			}
+			if status != statusSuccess {
+				item[jsonFailureReason] = jsonValue("US", status)
+				failed = append(failed, item)
+				continue
+			}
+			referenced = append(referenced, item)
+		}
+
+		result := dicomJSON{}
+		if len(referenced) > 0 {
+			result[jsonReferencedSOPSequence] = jsonValue("SQ", toInterfaces(referenced)...)
+		}
+		if len(failed) > 0 {
+			result[jsonFailedSOPSequence] = jsonValue("SQ", toInterfaces(failed)...)
+		}
+		code := http.StatusOK
+		if len(failed) > 0 && len(referenced) > 0 {
+			code = http.StatusAccepted
+		} else if len(failed) > 0 {
+			code = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/dicom+json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(result)
+		e.logf("STOW-RS request from %s: %d stored, %d failed\n", r.RemoteAddr, len(referenced), len(failed))
+	}
+}
+
+// toInterfaces converts sequence items to values of jsonValue
+func toInterfaces(items []dicomJSON) []interface{} {
+	values := make([]interface{}, len(items))
+	for i := range items {
+		values[i] = items[i]
+	}
+	return values
+}
+
+// startStowServer listens for STOW-RS requests, the returned server is stopped with Shutdown
+func (e *engine) startStowServer(spoolDir string, dest_path string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", e.httpPortFlag))
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: e.stowHandler(spoolDir, dest_path)}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// stopStowServer waits for the running requests to finish
+func stopStowServer(server *http.Server) {
+	if server != nil {
+		server.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,241 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// newStowServer returns the engine of a serve run and a test server with its STOW-RS handler
+func newStowServer(t testing.TB, out string) (*engine, *httptest.Server) {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Output, opts.Quiet, opts.Sync = out, true, "none"
+	opts.Folder = "{StudyInstanceUID}/{SOPInstanceUID}.dcm"
+	e := newEngine()
+	e.serveMode = true
+	if _, err := e.prepare(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.prepareOutput(out); err != nil {
+		t.Fatal(err)
+	}
+	e.processDataPath = out
+	srv := httptest.NewServer(e.stowHandler(t.TempDir(), out))
+	t.Cleanup(srv.Close)
+	return e, srv
+}
+
+// testInstanceFile returns the content of a Part 10 file of a study
+func testInstanceFile(t testing.TB, study string, series string, number int) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "instance.dcm")
+	writeTestFile(t, path, newTestInstance(t, series, number, newTestElement(t, tag.StudyInstanceUID, []string{study})))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// multipartBody returns a multipart/related body with one part per file and its content type
+func multipartBody(t testing.TB, files ...[]byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range files {
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/dicom"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(f)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, fmt.Sprintf("multipart/related; type=\"application/dicom\"; boundary=%s", mw.Boundary())
+}
+
+func TestStowHandler(t *testing.T) {
+	const study = "1.2.826.0.1.3680043.2.1125.7"
+	good := testInstanceFile(t, study, "1.2.3.1", 1)
+	other := testInstanceFile(t, "1.2.826.0.1.3680043.2.1125.8", "1.2.3.2", 1)
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string // default is the multipart type of the files
+		files       [][]byte
+		wantCode    int
+		wantStored  []string // ReferencedSOPInstanceUIDs
+		wantFailed  []string // FailedSOPSequence, the files without a SOPInstanceUID are listed as ""
+	}{
+		{name: "store", method: http.MethodPost, path: "/studies", files: [][]byte{good}, wantCode: http.StatusOK, wantStored: []string{"1.2.3.1.1"}},
+		{name: "store into the study", method: http.MethodPost, path: "/dicomweb/studies/" + study, files: [][]byte{good}, wantCode: http.StatusOK, wantStored: []string{"1.2.3.1.1"}},
+		{name: "instance of another study", method: http.MethodPost, path: "/studies/" + study, files: [][]byte{other}, wantCode: http.StatusConflict, wantFailed: []string{"1.2.3.2.1"}},
+		{name: "partly stored", method: http.MethodPost, path: "/studies", files: [][]byte{good, []byte("not DICOM")}, wantCode: http.StatusAccepted, wantStored: []string{"1.2.3.1.1"}, wantFailed: []string{""}},
+		{name: "GET is not supported", method: http.MethodGet, path: "/studies", wantCode: http.StatusMethodNotAllowed},
+		{name: "unknown path", method: http.MethodPost, path: "/series", files: [][]byte{good}, wantCode: http.StatusNotFound},
+		{name: "not multipart", method: http.MethodPost, path: "/studies", contentType: "application/dicom", files: [][]byte{good}, wantCode: http.StatusUnsupportedMediaType},
+		{name: "other part type", method: http.MethodPost, path: "/studies", contentType: "multipart/related; type=\"application/dicom+xml\"; boundary=x", files: [][]byte{good}, wantCode: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newStowServer(t, t.TempDir())
+			body, contentType := multipartBody(t, tt.files...)
+			if tt.contentType != "" {
+				contentType = tt.contentType
+			}
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("HTTP status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if resp.StatusCode >= 300 && resp.StatusCode != http.StatusConflict {
+				return
+			}
+			var result dicomJSON
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			var stored, failed []string
+			for _, item := range result.items(jsonReferencedSOPSequence) {
+				stored = append(stored, item.str(jsonReferencedSOPInstanceUID))
+			}
+			for _, item := range result.items(jsonFailedSOPSequence) {
+				failed = append(failed, item.str(jsonReferencedSOPInstanceUID))
+				if reason := item.us(jsonFailureReason); reason != statusCannotUnderstand {
+					t.Errorf("failure reason 0x%04X, want 0x%04X", reason, statusCannotUnderstand)
+				}
+			}
+			if !reflect.DeepEqual(stored, tt.wantStored) || !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("stored %q and failed %q, want %q and %q", stored, failed, tt.wantStored, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestStowLoopback(t *testing.T) {
+	out := t.TempDir()
+	server, srv := newStowServer(t, out)
+
+	in := t.TempDir()
+	studies := map[string][]string{
+		"1.2.826.0.1.3680043.2.1125.1": {"1.2.3.1"},
+		"1.2.826.0.1.3680043.2.1125.2": {"1.2.3.2"},
+	}
+	var want []string
+	for study, series := range studies {
+		for _, s := range series {
+			for n := 1; n <= 3; n++ {
+				name := fmt.Sprintf("%s.%d.dcm", s, n)
+				writeTestFile(t, filepath.Join(in, name), newTestInstance(t, s, n, newTestElement(t, tag.StudyInstanceUID, []string{study})))
+				want = append(want, fmt.Sprintf("%s/%s.%d.dcm", study, s, n))
+			}
+		}
+	}
+	sort.Strings(want)
+
+	client := DefaultOptions()
+	client.Input, client.Output, client.Method, client.Quiet, client.StowBatch = []string{in}, srv.URL+"/dicomweb", "stow", true, 2
+	result, err := New(client).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three instances per study in batches of two
+	if result.Sent != 6 || result.SendFailed != 0 || result.StowRequests != 4 {
+		t.Errorf("%d sent and %d failed in %d requests, want 6 and 0 in 4 (%v)", result.Sent, result.SendFailed, result.StowRequests, result.SendFailures)
+	}
+
+	srv.Close()
+	server.finishSorting(out)
+	if served := server.result(); served.Received != 6 || served.Files != 6 || served.StowRequests != 4 {
+		t.Errorf("server received %d instances in %d requests and sorted %d, want 6 in 4 and 6", served.Received, served.StowRequests, served.Files)
+	}
+	if got := listFiles(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("received files %v, want %v", got, want)
+	}
+}
+
+func TestStowResponse(t *testing.T) {
+	item := func(sopInstanceUID string, reasonKey string, reason int) dicomJSON {
+		d := dicomJSON{jsonReferencedSOPInstanceUID: jsonValue("UI", sopInstanceUID)}
+		if reasonKey != "" {
+			d[reasonKey] = jsonValue("US", reason)
+		}
+		return d
+	}
+	tests := []struct {
+		name        string
+		code        int
+		result      dicomJSON
+		wantSent    int32
+		wantWarning int32
+		wantFailed  int32
+	}{
+		{name: "stored", code: http.StatusOK, wantSent: 2},
+		{
+			name: "warning and failure", code: http.StatusAccepted,
+			result: dicomJSON{
+				jsonReferencedSOPSequence: jsonValue("SQ", item("1.2.3.1.1", jsonWarningReason, 0xB000)),
+				jsonFailedSOPSequence:     jsonValue("SQ", item("1.2.3.1.2", jsonFailureReason, 0xA700)),
+			},
+			wantSent: 1, wantWarning: 1, wantFailed: 1,
+		},
+		{name: "conflict", code: http.StatusConflict, result: dicomJSON{jsonFailedSOPSequence: jsonValue("SQ", item("1.2.3.1.1", jsonFailureReason, 0xC000))}, wantFailed: 2},
+		{name: "client error", code: http.StatusBadRequest, wantFailed: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/dicom+json")
+				w.WriteHeader(tt.code)
+				json.NewEncoder(w).Encode(tt.result)
+			}))
+			defer srv.Close()
+
+			e := newTestEngine()
+			e.methodFlag, e.retryFlag = "stow", 0
+			if err := e.initStow(srv.URL); err != nil {
+				t.Fatal(err)
+			}
+			var files []stowFile
+			for n := 1; n <= 2; n++ {
+				path := filepath.Join(t.TempDir(), "instance.dcm")
+				ds := newTestInstance(t, "1.2.3.1", n)
+				writeTestFile(t, path, ds)
+				files = append(files, stowFile{inFile: path, path: path, sopInstanceUID: getString(&ds, tag.SOPInstanceUID), dataset: &ds,
+					dicomVals: map[tag.Tag]string{tag.StudyInstanceUID: getString(&ds, tag.StudyInstanceUID)}})
+			}
+			e.postStudy("1.2.826.0.1.3680043.2.1125.1", files)
+			if e.counterSent != tt.wantSent || e.counterSentWarning != tt.wantWarning || e.counterSendFailed != tt.wantFailed {
+				t.Errorf("%d sent, %d with warning and %d failed, want %d, %d and %d",
+					e.counterSent, e.counterSentWarning, e.counterSendFailed, tt.wantSent, tt.wantWarning, tt.wantFailed)
+			}
+		})
+	}
+}
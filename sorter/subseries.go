@@ -0,0 +1,145 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Multi-echo, multi-orientation localizers and diffusion scans often share a
+// single SeriesInstanceUID. With -subseries each file receives a label computed
+// from the listed tags, available as {subseries} in the folder path. The label
+// only depends on the values of a file so it does not change between runs.
+
+// subseriesState holds the tags of -subseries
+type subseriesState struct {
+	subseriesFlag string
+
+	// tags used to split a series, in the order they appear in the label
+	subseriesTags []tag.Tag
+}
+
+// prefixes used for numeric values in the label
+var subseriesPrefixes = map[tag.Tag]string{
+	tag.EchoTime:                   "TE",
+	tag.EchoNumbers:                "E",
+	tag.RepetitionTime:             "TR",
+	tag.InversionTime:              "TI",
+	tag.AcquisitionNumber:          "A",
+	tag.DiffusionBValue:            "B",
+	tag.TemporalPositionIdentifier: "T",
+}
+
+// initSubseries parses -subseries, a comma separated list of tags
+func (e *engine) initSubseries() error {
+	e.subseriesTags = nil
+	for _, s := range tagListRegex.FindAllString(e.subseriesFlag, -1) {
+		t, err := parseTagString(s)
+		if err != nil {
+			return fmt.Errorf("unknown tag \"%s\" in -subseries (%s)", s, err)
+		}
+		e.subseriesTags = append(e.subseriesTags, t)
+	}
+	if len(e.subseriesTags) > 0 && !strings.Contains(e.outputFolderFlag, "{subseries}") {
+		// put each sub-series into its own folder below the series folder
+		dir, file := filepath.Split(e.outputFolderFlag)
+		e.outputFolderFlag = dir + "{subseries}/" + file
+	}
+	return nil
+}
+
+// elementValues returns all values of an element as strings
+func elementValues(e *dicom.Element) []string {
+	var values []string
+	if e == nil || e.Value == nil {
+		return values
+	}
+	switch v := e.Value.GetValue().(type) {
+	case []string:
+		for _, s := range v {
+			values = append(values, strings.TrimSpace(s))
+		}
+	case []int:
+		for _, i := range v {
+			values = append(values, strconv.Itoa(i))
+		}
+	case []float64:
+		for _, f := range v {
+			values = append(values, strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	case []byte:
+		values = append(values, strings.TrimRight(string(v), " \x00"))
+	}
+	return values
+}
+
+// orientationLabel classifies an ImageOrientationPatient as AX, COR, SAG or OBL (with a short hash)
+func orientationLabel(values []string) string {
+	if len(values) != 6 {
+		return ""
+	}
+	var v [6]float64
+	for i := range values {
+		f, err := strconv.ParseFloat(values[i], 64)
+		if err != nil {
+			return ""
+		}
+		v[i] = f
+	}
+	// the slice normal is the cross product of the row and column direction
+	n := [3]float64{
+		v[1]*v[5] - v[2]*v[4],
+		v[2]*v[3] - v[0]*v[5],
+		v[0]*v[4] - v[1]*v[3],
+	}
+	labels := []string{"SAG", "COR", "AX"}
+	for i := range n {
+		if math.Abs(n[i]) > 0.9 {
+			return labels[i]
+		}
+	}
+	// oblique slices, keep different obliques apart
+	var rounded []string
+	for i := range v {
+		rounded = append(rounded, strconv.FormatFloat(math.Round(v[i]*100)/100, 'f', 2, 64))
+	}
+	h := sha256.Sum256([]byte(strings.Join(rounded, "\\")))
+	return fmt.Sprintf("OBL%x", h[:2])
+}
+
+// subseriesLabel returns the label for a data set, e.g. "AX_TE30_B1000"
+func (e *engine) subseriesLabel(ds *dicom.Dataset) string {
+	var pieces []string
+	for _, t := range e.subseriesTags {
+		values := elementValues(findElement(ds, t))
+		if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+			continue
+		}
+		var label string
+		switch t {
+		case tag.ImageOrientationPatient:
+			label = orientationLabel(values)
+		case tag.ImageType:
+			label = strings.Join(values, "-")
+		default:
+			label = subseriesPrefixes[t] + values[0]
+			if f, err := strconv.ParseFloat(values[0], 64); err == nil {
+				label = subseriesPrefixes[t] + strconv.FormatFloat(f, 'f', -1, 64)
+			}
+		}
+		if label != "" {
+			pieces = append(pieces, label)
+		}
+	}
+	return sanitizeFilenameReplacer.Replace(strings.Join(pieces, "_"))
+}
@@ -0,0 +1,217 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestInitSubseries(t *testing.T) {
+	tests := []struct {
+		subseries  string
+		folder     string
+		wantTags   []tag.Tag
+		wantFolder string
+		wantErr    bool
+	}{
+		{
+			subseries:  "",
+			folder:     "{PatientID}/{SeriesInstanceUID}/{SOPInstanceUID}.dcm",
+			wantFolder: "{PatientID}/{SeriesInstanceUID}/{SOPInstanceUID}.dcm",
+		},
+		{
+			subseries:  "EchoTime,ImageOrientationPatient",
+			folder:     "{PatientID}/{SeriesInstanceUID}/{SOPInstanceUID}.dcm",
+			wantTags:   []tag.Tag{tag.EchoTime, tag.ImageOrientationPatient},
+			wantFolder: "{PatientID}/{SeriesInstanceUID}/{subseries}/{SOPInstanceUID}.dcm",
+		},
+		{
+			// the label is kept where the folder path has it
+			subseries:  "(0008,0008) EchoNumbers",
+			folder:     "{PatientID}/{SeriesInstanceUID}_{subseries}/{SOPInstanceUID}.dcm",
+			wantTags:   []tag.Tag{tag.ImageType, tag.EchoNumbers},
+			wantFolder: "{PatientID}/{SeriesInstanceUID}_{subseries}/{SOPInstanceUID}.dcm",
+		},
+		{
+			subseries:  "EchoTime",
+			folder:     "{SOPInstanceUID}.dcm",
+			wantTags:   []tag.Tag{tag.EchoTime},
+			wantFolder: "{subseries}/{SOPInstanceUID}.dcm",
+		},
+		{
+			subseries: "EchoTime,NotATag",
+			folder:    "{SOPInstanceUID}.dcm",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		e := newTestEngine()
+		e.subseriesFlag, e.outputFolderFlag = tt.subseries, tt.folder
+		err := e.initSubseries()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: no error", tt.subseries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.subseries, err)
+			continue
+		}
+		if !reflect.DeepEqual(e.subseriesTags, tt.wantTags) {
+			t.Errorf("%q: tags %v, want %v", tt.subseries, e.subseriesTags, tt.wantTags)
+		}
+		if e.outputFolderFlag != tt.wantFolder {
+			t.Errorf("%q: folder %q, want %q", tt.subseries, e.outputFolderFlag, tt.wantFolder)
+		}
+	}
+}
+
+func TestOrientationLabel(t *testing.T) {
+	oblique := regexp.MustCompile(`^OBL[0-9a-f]{4}$`)
+	tests := []struct {
+		name   string
+		values []string
+		want   string // "OBL" for any oblique label
+	}{
+		{"axial", []string{"1", "0", "0", "0", "1", "0"}, "AX"},
+		{"coronal", []string{"1", "0", "0", "0", "0", "-1"}, "COR"},
+		{"sagittal", []string{"0", "1", "0", "0", "0", "-1"}, "SAG"},
+		{"almost axial", []string{"0.999", "0.03", "0", "-0.03", "0.999", "0.02"}, "AX"},
+		{"oblique", []string{"1", "0", "0", "0", "0.7071", "-0.7071"}, "OBL"},
+		{"too few values", []string{"1", "0", "0", "0", "1"}, ""},
+		{"not a number", []string{"1", "0", "0", "0", "x", "0"}, ""},
+	}
+	for _, tt := range tests {
+		got := orientationLabel(tt.values)
+		if tt.want == "OBL" {
+			if !oblique.MatchString(got) {
+				t.Errorf("%s: label %q, want OBL and a hash", tt.name, got)
+			}
+		} else if got != tt.want {
+			t.Errorf("%s: label %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// obliques that differ only by rounding share a label, different obliques do not
+	a := orientationLabel([]string{"1", "0", "0", "0", "0.7071", "-0.7071"})
+	b := orientationLabel([]string{"1", "0", "0", "0", "0.7072", "-0.7070"})
+	c := orientationLabel([]string{"1", "0", "0", "0", "0.6", "-0.8"})
+	if a != b {
+		t.Errorf("rounded obliques have the labels %q and %q", a, b)
+	}
+	if a == c {
+		t.Errorf("different obliques share the label %q", a)
+	}
+}
+
+func TestSubseriesLabel(t *testing.T) {
+	axial := newTestElement(t, tag.ImageOrientationPatient, []string{"1", "0", "0", "0", "1", "0"})
+	sagittal := newTestElement(t, tag.ImageOrientationPatient, []string{"0", "1", "0", "0", "0", "-1"})
+	tests := []struct {
+		name      string
+		subseries string
+		elems     []*dicom.Element
+		want      string
+	}{
+		{
+			name:      "echo time",
+			subseries: "EchoTime",
+			elems:     []*dicom.Element{newTestElement(t, tag.EchoTime, []string{"30.0"})},
+			want:      "TE30",
+		},
+		{
+			name:      "echo number",
+			subseries: "EchoNumbers",
+			elems:     []*dicom.Element{newTestElement(t, tag.EchoNumbers, []string{"2"})},
+			want:      "E2",
+		},
+		{
+			name:      "orientation",
+			subseries: "ImageOrientationPatient",
+			elems:     []*dicom.Element{sagittal},
+			want:      "SAG",
+		},
+		{
+			name:      "image type",
+			subseries: "ImageType",
+			elems:     []*dicom.Element{newTestElement(t, tag.ImageType, []string{"ORIGINAL", "PRIMARY", "M", "ND"})},
+			want:      "ORIGINAL-PRIMARY-M-ND",
+		},
+		{
+			name:      "in the order of the option",
+			subseries: "ImageOrientationPatient,EchoTime,ImageType,DiffusionBValue",
+			elems: []*dicom.Element{
+				newTestElement(t, tag.ImageType, []string{"DERIVED", "SECONDARY"}),
+				axial,
+				newTestElement(t, tag.EchoTime, []string{"4.92"}),
+				newTestElement(t, tag.DiffusionBValue, []string{"1000"}),
+			},
+			want: "AX_TE4.92_DERIVED-SECONDARY_B1000",
+		},
+		{
+			name:      "missing values are left out",
+			subseries: "ImageOrientationPatient,EchoTime,InversionTime",
+			elems:     []*dicom.Element{newTestElement(t, tag.EchoTime, []string{""}), axial},
+			want:      "AX",
+		},
+		{
+			name:      "no values",
+			subseries: "EchoTime",
+			want:      "",
+		},
+		{
+			name:      "values are safe as folder names",
+			subseries: "ImageType",
+			elems:     []*dicom.Element{newTestElement(t, tag.ImageType, []string{"ORIGINAL", "A/B"})},
+			want:      sanitizeFilenameReplacer.Replace("ORIGINAL-A/B"),
+		},
+	}
+	for _, tt := range tests {
+		e := newTestEngine()
+		e.subseriesFlag, e.outputFolderFlag = tt.subseries, "{SOPInstanceUID}.dcm"
+		if err := e.initSubseries(); err != nil {
+			t.Fatal(err)
+		}
+		ds := newTestInstance(t, "1.2.3.1", 1, tt.elems...)
+		if got := e.subseriesLabel(&ds); got != tt.want {
+			t.Errorf("%s: label %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunSubseries(t *testing.T) {
+	in := t.TempDir()
+	for n, te := range []string{"10", "20", "10", "20"} {
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("%d.dcm", n+1)),
+			newTestInstance(t, "1.2.3.1", n+1, newTestElement(t, tag.EchoTime, []string{te})))
+	}
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync = []string{in}, out, true, "none"
+	opts.Folder, opts.Subseries = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm", "EchoTime"
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 4 {
+		t.Errorf("%d files sorted, want 4", result.Files)
+	}
+	want := []string{
+		"1.2.3.1/TE10/1.2.3.1.1.dcm", "1.2.3.1/TE10/1.2.3.1.3.dcm",
+		"1.2.3.1/TE20/1.2.3.1.2.dcm", "1.2.3.1/TE20/1.2.3.1.4.dcm",
+	}
+	if got := listFiles(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("files %v, want %v", got, want)
+	}
+}
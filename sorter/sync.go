@@ -0,0 +1,192 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -sync decides when copies are flushed to disk:
+//
+//	per-file       each file is synced before the next one is written (safe, slow)
+//	per-directory  the output folder of a series is synced once the series is complete
+//	               (-watch, serve, hooks), the other folders at the end of the run
+//	end            a single sync of the output file system at the end of the run
+//	none           the operating system writes the files later
+//
+// Folders are synced in a batch with syncfs where it exists, otherwise each file
+// written into the folder and the folder itself are synced. Only the per-file
+// policy guarantees that a file that was sorted survives a crash.
+
+// syncState tracks the files that still need to be synced
+type syncState struct {
+	syncFlag string
+
+	// files written per output folder that are not synced yet (per-directory, or end without syncfs)
+	unsyncedFiles map[string][]string
+
+	// output folders that were synced at least once
+	syncedFolders map[string]bool
+	syncMutex     sync.Mutex
+
+	// number of folders synced and the time spent in the final sync
+	counterSyncedFolders int32
+	syncDuration         time.Duration
+}
+
+// initSync checks the -sync option
+func (e *engine) initSync() error {
+	switch e.syncFlag {
+	case "per-file", "per-directory", "end", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown option \"%s\" for -sync, use per-file, per-directory, end or none", e.syncFlag)
+}
+
+// syncOutputFile is called before an output file is closed
+func (e *engine) syncOutputFile(out *os.File) error {
+	if e.syncFlag == "per-file" {
+		return out.Sync()
+	}
+	return nil
+}
+
+// tracksFolders is true if written files are synced by folder
+func (e *engine) tracksFolders() bool {
+	return e.methodFlag == "copy" && (e.syncFlag == "per-directory" || (e.syncFlag == "end" && !syncfsSupported))
+}
+
+// writeDone is called after an output file was written, the file is synced with its folder
+func (e *engine) writeDone(path string) {
+	if !e.tracksFolders() {
+		return
+	}
+	folder := filepath.Dir(path)
+	e.syncMutex.Lock()
+	e.unsyncedFiles[folder] = append(e.unsyncedFiles[folder], path)
+	e.syncMutex.Unlock()
+}
+
+// renameUnsynced updates the names of files in a folder that were renamed by -order-slices
+func (e *engine) renameUnsynced(folder string, renamed map[string]string) {
+	e.syncMutex.Lock()
+	defer e.syncMutex.Unlock()
+	for i, path := range e.unsyncedFiles[folder] {
+		if name, ok := renamed[filepath.Base(path)]; ok {
+			e.unsyncedFiles[folder][i] = filepath.Join(folder, name)
+		}
+	}
+}
+
+// syncFile flushes a file (or a folder) that was written before
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncFolders syncs the files written into the folders since their last sync and the folders
+// themselves, with a single syncfs call if the system has it
+func (e *engine) syncFolders(folders []string) {
+	var files, synced []string
+	var first int32
+	e.syncMutex.Lock()
+	for _, folder := range folders {
+		written, ok := e.unsyncedFiles[folder]
+		if !ok {
+			continue
+		}
+		delete(e.unsyncedFiles, folder)
+		files = append(files, written...)
+		synced = append(synced, folder)
+		if !e.syncedFolders[folder] {
+			e.syncedFolders[folder] = true
+			first++
+		}
+	}
+	e.syncMutex.Unlock()
+	if len(synced) == 0 {
+		return
+	}
+	if syncfsSupported {
+		if err := syncFilesystem(synced[0]); err != nil {
+			e.warn("could not sync folder %s (%s)", synced[0], err)
+		}
+	} else {
+		for _, file := range files {
+			if err := syncFile(file); err != nil {
+				e.warn("could not sync %s (%s)", file, err)
+			}
+		}
+		for _, folder := range synced {
+			e.syncDirectory(folder)
+		}
+	}
+	atomic.AddInt32(&e.counterSyncedFolders, first)
+}
+
+// syncFolder syncs the folder of a complete series
+func (e *engine) syncFolder(folder string) {
+	e.syncFolders([]string{folder})
+}
+
+// syncDirectory flushes the entries of a folder
+func (e *engine) syncDirectory(folder string) {
+	// folders cannot be opened for syncing on all systems (e.g. Windows)
+	if err := syncFile(folder); err != nil && e.debugFlag {
+		e.warn("could not sync folder %s (%s)", folder, err)
+	}
+}
+
+// finishSync syncs the output that is not synced yet
+func (e *engine) finishSync(dest_path string) {
+	start := time.Now()
+	if e.syncFlag == "end" && syncfsSupported {
+		if err := syncFilesystem(dest_path); err != nil {
+			e.warn("could not sync the output folder %s (%s)", dest_path, err)
+		}
+	}
+	// per-directory folders that are not complete yet and end on systems without syncfs
+	e.syncMutex.Lock()
+	folders := make([]string, 0, len(e.unsyncedFiles))
+	for folder := range e.unsyncedFiles {
+		folders = append(folders, folder)
+	}
+	// folders synced before -order-slices renamed their files
+	var renamed []string
+	if e.orderSlicesFlag && e.syncFlag == "per-directory" {
+		for folder := range e.syncedFolders {
+			if _, ok := e.unsyncedFiles[folder]; !ok {
+				renamed = append(renamed, folder)
+			}
+		}
+	}
+	e.syncMutex.Unlock()
+	sort.Strings(folders)
+	e.syncFolders(folders)
+	sort.Strings(renamed)
+	if syncfsSupported && len(renamed) > 0 {
+		// the syncfs for the other folders covers the renamed files as well
+		if len(folders) == 0 {
+			if err := syncFilesystem(renamed[0]); err != nil {
+				e.warn("could not sync folder %s (%s)", renamed[0], err)
+			}
+		}
+		renamed = nil
+	}
+	for _, folder := range renamed {
+		e.syncDirectory(folder)
+	}
+	e.syncDuration += time.Since(start)
+}
@@ -0,0 +1,32 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncfs(2) writes all data of the file system that contains the output folder
+const syncfsSupported = true
+
+// syncFilesystem flushes the file system of a folder with a single syncfs call
+func syncFilesystem(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Syncfs(int(f.Fd()))
+}
+
+// dropCache flushes a file and removes it from the page cache, the next read comes from the disk
+func dropCache(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
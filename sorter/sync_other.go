@@ -0,0 +1,25 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package sorter
+
+import (
+	"errors"
+	"os"
+)
+
+// without syncfs the files written are synced one by one at the end
+const syncfsSupported = false
+
+// syncFilesystem is not available on this system
+func syncFilesystem(path string) error {
+	return errors.New("syncfs is not supported on this system")
+}
+
+// dropCache is not available on this system, the file might be read from the cache
+func dropCache(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTracksFolders(t *testing.T) {
+	tests := []struct {
+		method string
+		sync   string
+		want   bool
+	}{
+		{"copy", "per-file", false},
+		{"copy", "per-directory", true},
+		{"copy", "end", !syncfsSupported},
+		{"copy", "none", false},
+		{"link", "per-directory", false},
+		{"emptyfile", "end", false},
+	}
+	for _, tt := range tests {
+		e := newTestEngine()
+		e.methodFlag, e.syncFlag = tt.method, tt.sync
+		if got := e.tracksFolders(); got != tt.want {
+			t.Errorf("%s with -sync %s tracks folders %v, want %v", tt.method, tt.sync, got, tt.want)
+		}
+	}
+}
+
+// writeSyncFiles writes empty files into folders below root and reports them as written
+func writeSyncFiles(t *testing.T, e *engine, root string, files ...string) []string {
+	t.Helper()
+	var folders []string
+	seen := make(map[string]bool, 0)
+	for _, rel := range files {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		e.writeDone(path)
+		if !seen[filepath.Dir(path)] {
+			seen[filepath.Dir(path)] = true
+			folders = append(folders, filepath.Dir(path))
+		}
+	}
+	return folders
+}
+
+func TestSyncBookkeeping(t *testing.T) {
+	root := t.TempDir()
+	e := newTestEngine()
+	e.syncFlag = "per-directory"
+	folders := writeSyncFiles(t, e, root, "a/1.dcm", "a/2.dcm", "b/1.dcm", "c/1.dcm")
+	if len(e.unsyncedFiles) != 3 || len(e.unsyncedFiles[folders[0]]) != 2 {
+		t.Fatalf("unsynced files %v, want 2 files in a and one in b and c", e.unsyncedFiles)
+	}
+
+	// the folder of a complete series
+	e.syncFolder(folders[0])
+	if _, ok := e.unsyncedFiles[folders[0]]; ok || len(e.unsyncedFiles) != 2 {
+		t.Errorf("unsynced files after the sync of a: %v", e.unsyncedFiles)
+	}
+	if e.counterSyncedFolders != 1 {
+		t.Errorf("%d folders synced, want 1", e.counterSyncedFolders)
+	}
+
+	// a folder without new files is not synced again, a folder with new files is not counted again
+	e.syncFolder(folders[0])
+	writeSyncFiles(t, e, root, "a/3.dcm")
+	e.syncFolders([]string{folders[0], folders[1]})
+	if e.counterSyncedFolders != 2 {
+		t.Errorf("%d folders synced, want 2", e.counterSyncedFolders)
+	}
+
+	e.finishSync(root)
+	if len(e.unsyncedFiles) != 0 {
+		t.Errorf("unsynced files left: %v", e.unsyncedFiles)
+	}
+	if e.counterSyncedFolders != 3 {
+		t.Errorf("%d folders synced, want 3", e.counterSyncedFolders)
+	}
+	if len(e.syncedFolders) != 3 {
+		t.Errorf("synced folders %v, want a, b and c", e.syncedFolders)
+	}
+}
+
+func TestSyncNotTracked(t *testing.T) {
+	for _, policy := range []string{"per-file", "none"} {
+		e := newTestEngine()
+		e.syncFlag = policy
+		writeSyncFiles(t, e, t.TempDir(), "a/1.dcm")
+		if len(e.unsyncedFiles) != 0 {
+			t.Errorf("-sync %s tracks %v", policy, e.unsyncedFiles)
+		}
+	}
+}
+
+func TestSyncRenamed(t *testing.T) {
+	root := t.TempDir()
+	e := newTestEngine()
+	e.syncFlag = "per-directory"
+	folders := writeSyncFiles(t, e, root, "a/x.dcm", "a/y.dcm")
+	for _, name := range []string{"x.dcm", "y.dcm"} {
+		if err := os.Rename(filepath.Join(folders[0], name), filepath.Join(folders[0], "1_"+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.renameUnsynced(folders[0], map[string]string{"x.dcm": "1_x.dcm", "y.dcm": "1_y.dcm"})
+	want := []string{filepath.Join(folders[0], "1_x.dcm"), filepath.Join(folders[0], "1_y.dcm")}
+	if got := e.unsyncedFiles[folders[0]]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unsynced files %v, want %v", got, want)
+	}
+	events := newRecordedEvents()
+	e.events = events
+	e.finishSync(root)
+	if len(events.warnings) != 0 {
+		t.Errorf("warnings: %v", events.warnings)
+	}
+}
+
+func TestRunSyncPerDirectory(t *testing.T) {
+	in := t.TempDir()
+	for _, series := range []string{"1.2.3.1", "1.2.3.2", "1.2.3.3"} {
+		for n := 1; n <= 3; n++ {
+			writeTestFile(t, filepath.Join(in, fmt.Sprintf("%s.%d.dcm", series, n)), newTestInstance(t, series, n))
+		}
+	}
+	for _, orderSlices := range []bool{false, true} {
+		t.Run(fmt.Sprintf("order %v", orderSlices), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.Quiet, opts.Sync = []string{in}, t.TempDir(), true, "per-directory"
+			opts.Folder, opts.OrderSlices = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm", orderSlices
+			result, err := New(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != 9 || result.SyncedFolders != 3 {
+				t.Errorf("%d files in %d synced folders, want 9 in 3", result.Files, result.SyncedFolders)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// 'sdcm tags <input folder>' reads the whole header of all files (or of the
+// first -sample files) and lists each top-level tag with its VR, the number
+// of files that contain it, the number of distinct values and the most common
+// values. Tags with a keyword can be used in the -folder template.
+
+// tagsState collects the tags found by 'sdcm tags'
+type tagsState struct {
+	tagsMode         bool
+	tagsSampleFlag   int
+	tagsExamplesFlag int
+
+	// number of files that were read, stops reading after -sample files
+	counterScanned int32
+
+	tagsFound        map[tag.Tag]*tagStats
+	tagsFoundMutex   sync.Mutex
+	counterTagsFiles int
+}
+
+// at most this many distinct values are counted per tag
+const tagsDistinctLimit = 1000
+
+// tagStats collects the values of a tag
+type tagStats struct {
+	tag      tag.Tag
+	vr       string
+	files    int
+	values   map[string]int
+	overflow bool // more than tagsDistinctLimit distinct values
+}
+
+// initTags checks the options of 'sdcm tags'
+func (e *engine) initTags() error {
+	switch e.outputFormatQueryFlag {
+	case "text", "csv", "json":
+	default:
+		return fmt.Errorf("unknown option \"%s\" for -output-format, use text, csv or json", e.outputFormatQueryFlag)
+	}
+	if e.tagsSampleFlag < 0 || e.tagsExamplesFlag < 0 {
+		return fmt.Errorf("-sample and -examples cannot be negative")
+	}
+	return nil
+}
+
+// tagValue returns the value of an element as text, false for binary values and sequences
+func tagValue(e *dicom.Element) (string, bool) {
+	if e.Value == nil {
+		return "", true
+	}
+	switch e.Value.ValueType() {
+	case dicom.Strings, dicom.Ints, dicom.Floats:
+		return strings.Join(elementValues(e), "\\"), true
+	}
+	return "", false
+}
+
+// collectTags counts the elements of a data set
+func (e *engine) collectTags(ds *dicom.Dataset) {
+	e.tagsFoundMutex.Lock()
+	defer e.tagsFoundMutex.Unlock()
+	e.counterTagsFiles++
+	for _, elem := range ds.Elements {
+		s, ok := e.tagsFound[elem.Tag]
+		if !ok {
+			s = &tagStats{tag: elem.Tag, vr: elem.RawValueRepresentation, values: make(map[string]int, 0)}
+			e.tagsFound[elem.Tag] = s
+		}
+		s.files++
+		value, ok := tagValue(elem)
+		if !ok {
+			continue
+		}
+		if _, seen := s.values[value]; seen || len(s.values) < tagsDistinctLimit {
+			s.values[value]++
+		} else {
+			s.overflow = true
+		}
+	}
+}
+
+// tagKeyword returns the keyword of a tag, empty for private and unknown tags
+func tagKeyword(t tag.Tag) string {
+	if info, err := tag.Find(t); err == nil && t.Group%2 == 0 {
+		return info.Name
+	}
+	return ""
+}
+
+// tagExamples returns the most common values of a tag
+func (e *engine) tagExamples(s *tagStats) []string {
+	values := make([]string, 0, len(s.values))
+	for v := range s.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if s.values[values[i]] != s.values[values[j]] {
+			return s.values[values[i]] > s.values[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	if len(values) > e.tagsExamplesFlag {
+		values = values[:e.tagsExamplesFlag]
+	}
+	return values
+}
+
+// listTags reads the input folders and prints the tags found to out
+func (e *engine) listTags(source_paths []string, out io.Writer) error {
+	e.headerEarlyExit = false
+	if e.useIndexFlag {
+		// the index has only some of the tags
+		e.warn("'sdcm tags' reads all files, -use-index is ignored")
+		e.useIndexFlag = false
+	}
+	e.scanHeaders(source_paths, e.collectTags)
+	if err := e.runContext.Err(); err != nil {
+		return err
+	}
+
+	var stats []*tagStats
+	for _, s := range e.tagsFound {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return tagAfter(stats[j].tag, stats[i].tag) })
+
+	header := []string{"Tag", "Keyword", "VR", "Files", "Distinct", "Examples"}
+	rows := make([][]string, 0, len(stats))
+	for _, s := range stats {
+		distinct := strconv.Itoa(len(s.values))
+		if s.overflow {
+			distinct = fmt.Sprintf("%d+", tagsDistinctLimit)
+		} else if len(s.values) == 0 {
+			distinct = "" // binary values and sequences
+		}
+		var examples []string
+		for _, v := range e.tagExamples(s) {
+			if len([]rune(v)) > 40 && e.outputFormatQueryFlag == "text" {
+				v = string([]rune(v)[:39]) + "…"
+			}
+			examples = append(examples, v)
+		}
+		rows = append(rows, []string{fmt.Sprintf("(%04X,%04X)", s.tag.Group, s.tag.Element), tagKeyword(s.tag), s.vr, strconv.Itoa(s.files), distinct, strings.Join(examples, " | ")})
+	}
+
+	switch e.outputFormatQueryFlag {
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write(header)
+		w.WriteAll(rows)
+		if err := w.Error(); err != nil {
+			return err
+		}
+	case "json":
+		type tagRow struct {
+			Tag      string   `json:"Tag"`
+			Keyword  string   `json:"Keyword"`
+			VR       string   `json:"VR"`
+			Files    int      `json:"Files"`
+			Distinct string   `json:"Distinct"`
+			Examples []string `json:"Examples"`
+		}
+		result := make([]tagRow, 0, len(stats))
+		for i, s := range stats {
+			result = append(result, tagRow{Tag: rows[i][0], Keyword: rows[i][1], VR: rows[i][2], Files: s.files, Distinct: rows[i][4], Examples: append([]string{}, e.tagExamples(s)...)})
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	default:
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if !e.quietFlag {
+		fmt_local.Fprintf(os.Stderr, "%d tag%s in %d file%s\n", len(stats), map[bool]string{true: "", false: "s"}[len(stats) == 1], e.counterTagsFiles, map[bool]string{true: "", false: "s"}[e.counterTagsFiles == 1])
+	}
+	return nil
+}
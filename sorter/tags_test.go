@@ -0,0 +1,175 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// tagRow is a row of the json output of Tags
+type tagRow struct {
+	Tag      string
+	Keyword  string
+	VR       string
+	Files    int
+	Distinct string
+	Examples []string
+}
+
+// writeTagsInput writes two CT files and one MR file, one CT file has a private tag
+func writeTagsInput(t *testing.T) string {
+	t.Helper()
+	in := t.TempDir()
+	writeTestFile(t, filepath.Join(in, "a.dcm"), newTestInstance(t, "1.2.3.1", 1,
+		newRawElement(t, tag.Tag{Group: 0x0019, Element: 0x0010}, "LO", []string{"VENDOR"}),
+		newRawElement(t, tag.Tag{Group: 0x0019, Element: 0x1001}, "OB", []byte{1, 2, 3, 4})))
+	writeTestFile(t, filepath.Join(in, "b.dcm"), newTestInstance(t, "1.2.3.1", 2))
+	writeTestFile(t, filepath.Join(in, "c.dcm"), newTestInstance(t, "1.2.3.2", 1,
+		newTestElement(t, tag.Modality, []string{"MR"}),
+		newTestElement(t, tag.SeriesNumber, []string{"2"})))
+	return in
+}
+
+// runTags returns the json output of Tags
+func runTags(t *testing.T, opts Options) map[string]tagRow {
+	t.Helper()
+	opts.OutputFormat, opts.Quiet = "json", true
+	var out bytes.Buffer
+	if err := New(opts).Tags(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	var rows []tagRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatalf("%s (%s)", out.String(), err)
+	}
+	byTag := make(map[string]tagRow, len(rows))
+	var tags []string
+	for _, row := range rows {
+		byTag[row.Tag] = row
+		tags = append(tags, row.Tag)
+	}
+	if !sortedTags(tags) {
+		t.Errorf("tags are not in tag order: %v", tags)
+	}
+	return byTag
+}
+
+// sortedTags returns true if the "(gggg,eeee)" strings are in ascending order
+func sortedTags(tags []string) bool {
+	for i := 1; i < len(tags); i++ {
+		if tags[i-1] >= tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTags(t *testing.T) {
+	in := writeTagsInput(t)
+	opts := DefaultOptions()
+	opts.Input, opts.Examples = []string{in}, 2
+	rows := runTags(t, opts)
+
+	wantKeywords := map[string]string{
+		"(0002,0001)": "FileMetaInformationVersion",
+		"(0002,0002)": "MediaStorageSOPClassUID",
+		"(0002,0003)": "MediaStorageSOPInstanceUID",
+		"(0002,0010)": "TransferSyntaxUID",
+		"(0008,0016)": "SOPClassUID",
+		"(0008,0018)": "SOPInstanceUID",
+		"(0008,0060)": "Modality",
+		"(0010,0010)": "PatientName",
+		"(0010,0020)": "PatientID",
+		"(0019,0010)": "",
+		"(0019,1001)": "",
+		"(0020,000D)": "StudyInstanceUID",
+		"(0020,000E)": "SeriesInstanceUID",
+		"(0020,0011)": "SeriesNumber",
+		"(0020,0013)": "InstanceNumber",
+	}
+	for tg, keyword := range wantKeywords {
+		row, ok := rows[tg]
+		if !ok {
+			t.Errorf("%s %s is not listed", tg, keyword)
+			continue
+		}
+		if row.Keyword != keyword {
+			t.Errorf("%s has the keyword %q, want %q", tg, row.Keyword, keyword)
+		}
+	}
+	for tg, row := range rows {
+		// the writer can add elements to the file meta information (e.g. the group length)
+		if _, ok := wantKeywords[tg]; !ok && tg[:5] != "(0002" {
+			t.Errorf("%s %s is listed but not in the files", tg, row.Keyword)
+		}
+	}
+
+	tests := []struct {
+		tag  string
+		want tagRow
+	}{
+		// the most common value first
+		{"(0008,0060)", tagRow{VR: "CS", Files: 3, Distinct: "2", Examples: []string{"CT", "MR"}}},
+		{"(0020,000E)", tagRow{VR: "UI", Files: 3, Distinct: "2", Examples: []string{"1.2.3.1", "1.2.3.2"}}},
+		// values with the same count are sorted, at most Examples values
+		{"(0008,0018)", tagRow{VR: "UI", Files: 3, Distinct: "3", Examples: []string{"1.2.3.1.1", "1.2.3.1.2"}}},
+		{"(0020,0013)", tagRow{VR: "IS", Files: 3, Distinct: "2", Examples: []string{"1", "2"}}},
+		{"(0010,0010)", tagRow{VR: "PN", Files: 3, Distinct: "1", Examples: []string{"Test^Patient"}}},
+		{"(0019,0010)", tagRow{VR: "LO", Files: 1, Distinct: "1", Examples: []string{"VENDOR"}}},
+		// binary values are counted without values
+		{"(0019,1001)", tagRow{VR: "OB", Files: 1, Distinct: "", Examples: []string{}}},
+	}
+	for _, tt := range tests {
+		got := rows[tt.tag]
+		got.Tag, got.Keyword = "", ""
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s is %+v, want %+v", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestTagsSample(t *testing.T) {
+	in := writeTagsInput(t)
+	opts := DefaultOptions()
+	opts.Input, opts.Sample = []string{in}, 1
+	rows := runTags(t, opts)
+	if got := rows["(0008,0016)"].Files; got != 1 {
+		t.Errorf("SOPClassUID is in %d files, want 1 with Sample 1", got)
+	}
+}
+
+func TestTagsCSV(t *testing.T) {
+	in := writeTagsInput(t)
+	opts := DefaultOptions()
+	opts.Input, opts.OutputFormat, opts.Quiet = []string{in}, "csv", true
+	var out bytes.Buffer
+	if err := New(opts).Tags(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Tag", "Keyword", "VR", "Files", "Distinct", "Examples"}; !reflect.DeepEqual(records[0], want) {
+		t.Errorf("header %v, want %v", records[0], want)
+	}
+	for _, record := range records[1:] {
+		if record[0] == "(0008,0060)" {
+			if want := []string{"(0008,0060)", "Modality", "CS", "3", "2", "CT | MR"}; !reflect.DeepEqual(record, want) {
+				t.Errorf("row %v, want %v", record, want)
+			}
+			return
+		}
+	}
+	t.Error("Modality is not listed")
+}
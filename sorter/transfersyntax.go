@@ -0,0 +1,509 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+// Transfer syntax normalization for '-method copy'. Datasets are re-written in
+// the requested (uncompressed) transfer syntax. Implicit VR, big endian and
+// deflated files are always supported, compressed pixel data only for RLE
+// Lossless and 8bit JPEG Baseline. Files with other codecs are copied as they are.
+
+const (
+	jpegBaselineTransferSyntax = "1.2.840.10008.1.2.4.50"
+	rleLosslessTransferSyntax  = "1.2.840.10008.1.2.5"
+)
+
+// transcodeState holds the target and counter of -transcode
+type transcodeState struct {
+	transcodeFlag string
+
+	// target transfer syntax UID, empty if we do not transcode
+	transcodeTarget string
+
+	// number of files that could not be transcoded
+	counterNotTranscoded int32
+}
+
+var errUnsupportedTransferSyntax = errors.New("unsupported transfer syntax")
+
+// short names for {TransferSyntax}, other transfer syntaxes use the name from the dictionary
+var transferSyntaxNames = map[string]string{
+	uid.ImplicitVRLittleEndian:         "ImplicitVRLittleEndian",
+	uid.ExplicitVRLittleEndian:         "ExplicitVRLittleEndian",
+	uid.ExplicitVRBigEndian:            "ExplicitVRBigEndian",
+	uid.DeflatedExplicitVRLittleEndian: "DeflatedExplicitVRLittleEndian",
+	jpegBaselineTransferSyntax:         "JPEGBaseline",
+	"1.2.840.10008.1.2.4.51":           "JPEGExtended",
+	"1.2.840.10008.1.2.4.57":           "JPEGLossless",
+	"1.2.840.10008.1.2.4.70":           "JPEGLosslessSV1",
+	"1.2.840.10008.1.2.4.80":           "JPEGLSLossless",
+	"1.2.840.10008.1.2.4.81":           "JPEGLSNearLossless",
+	"1.2.840.10008.1.2.4.90":           "JPEG2000Lossless",
+	"1.2.840.10008.1.2.4.91":           "JPEG2000",
+	"1.2.840.10008.1.2.4.100":          "MPEG2",
+	"1.2.840.10008.1.2.4.102":          "MPEG4",
+	"1.2.840.10008.1.2.4.201":          "HTJ2KLossless",
+	"1.2.840.10008.1.2.4.203":          "HTJ2K",
+	rleLosslessTransferSyntax:          "RLELossless",
+}
+
+// transferSyntaxName returns a short name for a transfer syntax UID that can be used in a path
+func transferSyntaxName(ts string) string {
+	if n, ok := transferSyntaxNames[ts]; ok {
+		return n
+	}
+	if info, err := uid.Lookup(ts); err == nil && info.Type == uid.TypeTransferSyntax {
+		return clearString(info.Name)
+	}
+	return ts
+}
+
+// initTranscode checks the value of -transcode, we can only write uncompressed transfer syntaxes
+func (e *engine) initTranscode() error {
+	switch strings.ToLower(strings.TrimSpace(e.transcodeFlag)) {
+	case "":
+		e.transcodeTarget = ""
+	case "explicit", uid.ExplicitVRLittleEndian:
+		e.transcodeTarget = uid.ExplicitVRLittleEndian
+	case "implicit", uid.ImplicitVRLittleEndian:
+		e.transcodeTarget = uid.ImplicitVRLittleEndian
+	default:
+		return fmt.Errorf("unsupported transfer syntax \"%s\" for -transcode, use \"explicit\" (%s) or \"implicit\" (%s)", e.transcodeFlag, uid.ExplicitVRLittleEndian, uid.ImplicitVRLittleEndian)
+	}
+	if e.transcodeTarget != "" && e.methodFlag != "copy" {
+		e.warn("-transcode only works together with '-method copy'")
+	}
+	return nil
+}
+
+func parseAllElements(p *dicom.Parser) ([]*dicom.Element, error) {
+	var elems []*dicom.Element
+	for {
+		e, err := p.Next()
+		if err != nil {
+			if errors.Is(err, dicom.ErrorEndOfDICOM) || errors.Is(err, io.EOF) {
+				return elems, nil
+			}
+			return elems, err
+		}
+		elems = append(elems, e)
+	}
+}
+
+// isDeflatedFile checks the meta information of a file that could not be parsed for the deflated transfer syntax
+func isDeflatedFile(src string) bool {
+	f, err := os.Open(src)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	n, _ := io.ReadFull(f, buf)
+	if n < 132 || string(buf[128:132]) != "DICM" {
+		return false
+	}
+	return bytes.Contains(buf[132:n], []byte(uid.DeflatedExplicitVRLittleEndian))
+}
+
+// readDatasetFile parses a complete DICOM file including its pixel data (unprocessed).
+// Different to dicom.ParseFile this inflates the data set of deflated files.
+func readDatasetFile(src string) (dicom.Dataset, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	p, err := dicom.NewParser(bytes.NewReader(data), int64(len(data)), nil, dicom.SkipProcessingPixelDataValue())
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	meta := p.GetMetadata()
+	ts := ""
+	if e, err := meta.FindElementByTag(tag.TransferSyntaxUID); err == nil {
+		if v := dicom.MustGetStrings(e.Value); len(v) > 0 {
+			ts = v[0]
+		}
+	}
+	if ts != uid.DeflatedExplicitVRLittleEndian {
+		elems, err := parseAllElements(p)
+		return dicom.Dataset{Elements: append(meta.Elements, elems...)}, err
+	}
+
+	// the data set starts after preamble, magic word, group length element and the meta information
+	gl, err := meta.FindElementByTag(tag.FileMetaInformationGroupLength)
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	offset := 128 + 4 + 12 + dicom.MustGetInts(gl.Value)[0]
+	if offset > len(data) {
+		return dicom.Dataset{}, fmt.Errorf("meta information longer than file")
+	}
+	body, err := io.ReadAll(flate.NewReader(bytes.NewReader(data[offset:])))
+	if err != nil {
+		return dicom.Dataset{}, fmt.Errorf("could not inflate data set (%s)", err)
+	}
+	p, err = dicom.NewParser(bytes.NewReader(body), int64(len(body)), nil, dicom.SkipMetadataReadOnNewParserInit(), dicom.SkipProcessingPixelDataValue())
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	p.SetTransferSyntax(binary.LittleEndian, false)
+	elems, err := parseAllElements(p)
+	return dicom.Dataset{Elements: append(meta.Elements, elems...)}, err
+}
+
+func getInt(ds *dicom.Dataset, t tag.Tag, def int) int {
+	e, err := ds.FindElementByTag(t)
+	if err != nil {
+		return def
+	}
+	switch v := e.Value.GetValue().(type) {
+	case []int:
+		if len(v) > 0 {
+			return v[0]
+		}
+	case []string: // IS values like NumberOfFrames
+		if len(v) > 0 {
+			if i, err := strconv.Atoi(strings.TrimSpace(v[0])); err == nil {
+				return i
+			}
+		}
+	}
+	return def
+}
+
+func getString(ds *dicom.Dataset, t tag.Tag) string {
+	e, err := ds.FindElementByTag(t)
+	if err != nil {
+		return ""
+	}
+	if v, ok := e.Value.GetValue().([]string); ok && len(v) > 0 {
+		return strings.Trim(v[0], " \x00")
+	}
+	return ""
+}
+
+// setElement replaces the value of a top-level element or inserts a new element in tag order
+func setElement(ds *dicom.Dataset, t tag.Tag, data interface{}) error {
+	ne, err := dicom.NewElement(t, data)
+	if err != nil {
+		return err
+	}
+	putElement(ds, ne)
+	return nil
+}
+
+// addFileMeta adds the file meta information to a data set read from a file without it,
+// the parser reads such data sets as implicit VR little endian
+func addFileMeta(ds *dicom.Dataset) {
+	if _, err := ds.FindElementByTag(tag.TransferSyntaxUID); err == nil {
+		return
+	}
+	setElement(ds, tag.FileMetaInformationVersion, []byte{0, 1})
+	setElement(ds, tag.MediaStorageSOPClassUID, []string{getString(ds, tag.SOPClassUID)})
+	setElement(ds, tag.MediaStorageSOPInstanceUID, []string{getString(ds, tag.SOPInstanceUID)})
+	setElement(ds, tag.TransferSyntaxUID, []string{uid.ImplicitVRLittleEndian})
+	setElement(ds, tag.ImplementationClassUID, []string{sdcmImplementationClassUID})
+}
+
+// putElement replaces a top-level element with the same tag or inserts the element in tag order
+func putElement(ds *dicom.Dataset, ne *dicom.Element) {
+	for i, e := range ds.Elements {
+		if e.Tag == ne.Tag {
+			ds.Elements[i] = ne
+			return
+		}
+	}
+	idx := sort.Search(len(ds.Elements), func(i int) bool {
+		return ds.Elements[i].Tag.Compare(ne.Tag) > 0
+	})
+	ds.Elements = append(ds.Elements, nil)
+	copy(ds.Elements[idx+1:], ds.Elements[idx:])
+	ds.Elements[idx] = ne
+}
+
+// transcodeDataset converts the data set in place to transcodeTarget
+func (e *engine) transcodeDataset(ds *dicom.Dataset) error {
+	source := getString(ds, tag.TransferSyntaxUID)
+	if source == e.transcodeTarget {
+		return nil
+	}
+
+	var pixelElement *dicom.Element
+	for _, e := range ds.Elements {
+		if e.Tag == tag.PixelData {
+			pixelElement = e
+			break
+		}
+	}
+
+	switch source {
+	case uid.ImplicitVRLittleEndian, uid.ExplicitVRLittleEndian, uid.DeflatedExplicitVRLittleEndian:
+		// only the encoding of the elements changes, the writer takes care of that
+	case uid.ExplicitVRBigEndian:
+		if err := swapBinaryElements(ds.Elements); err != nil {
+			return err
+		}
+		if pixelElement != nil {
+			info := dicom.MustGetPixelDataInfo(pixelElement.Value)
+			if !info.IntentionallyUnprocessed {
+				return errUnsupportedTransferSyntax
+			}
+			swapBytes(info.UnprocessedValueData, getInt(ds, tag.BitsAllocated, 8)/8)
+		}
+	case rleLosslessTransferSyntax, jpegBaselineTransferSyntax:
+		if pixelElement == nil {
+			break
+		}
+		if err := decompressPixelData(ds, pixelElement, source); err != nil {
+			return err
+		}
+	default:
+		return errUnsupportedTransferSyntax
+	}
+	return setElement(ds, tag.TransferSyntaxUID, []string{e.transcodeTarget})
+}
+
+// swapBytes converts words of the given width from big to little endian
+func swapBytes(data []byte, width int) {
+	if width < 2 {
+		return
+	}
+	for i := 0; i+width <= len(data); i += width {
+		for a, b := i, i+width-1; a < b; a, b = a+1, b-1 {
+			data[a], data[b] = data[b], data[a]
+		}
+	}
+}
+
+// width of the words in binary VRs that the parser reads as strings without swapping them
+var binaryVRWidth = map[string]int{"OF": 4, "OL": 4, "OD": 8, "OV": 8}
+
+// swapBinaryElements converts the binary values of big endian elements that the parser keeps as they
+// are to little endian. Numeric VRs like US or FL and OW values (overlays, LUTs, ...) are converted by
+// the parser already, OB and UN are byte streams. Pixel data is done by the caller.
+func swapBinaryElements(elems []*dicom.Element) error {
+	for i, e := range elems {
+		if e.Tag == tag.PixelData || e.Tag.Group == tag.MetadataGroup || e.Value == nil {
+			continue
+		}
+		switch v := e.Value.GetValue().(type) {
+		case []*dicom.SequenceItemValue:
+			for _, item := range v {
+				if err := swapBinaryElements(item.GetValue().([]*dicom.Element)); err != nil {
+					return err
+				}
+			}
+		case []string:
+			// OF, OL, OD and OV are read as strings
+			width, ok := binaryVRWidth[e.RawValueRepresentation]
+			if !ok {
+				continue
+			}
+			swapped := make([]string, len(v))
+			for j := range v {
+				b := []byte(v[j])
+				swapBytes(b, width)
+				swapped[j] = string(b)
+			}
+			value, err := dicom.NewValue(swapped)
+			if err != nil {
+				return err
+			}
+			ne := *e
+			ne.Value = value
+			elems[i] = &ne
+		}
+	}
+	return nil
+}
+
+// frameFragments returns the compressed data for each frame
+func frameFragments(ds *dicom.Dataset, info dicom.PixelDataInfo) ([][]byte, error) {
+	numberOfFrames := getInt(ds, tag.NumberOfFrames, 1)
+	var fragments [][]byte
+	for _, f := range info.Frames {
+		fragments = append(fragments, f.EncapsulatedData.Data)
+	}
+	if len(fragments) == numberOfFrames {
+		return fragments, nil
+	}
+	if numberOfFrames == 1 && len(fragments) > 1 {
+		return [][]byte{bytes.Join(fragments, nil)}, nil
+	}
+	// we would need the basic offset table to know which fragments belong to a frame
+	return nil, errUnsupportedTransferSyntax
+}
+
+func decompressPixelData(ds *dicom.Dataset, pixelElement *dicom.Element, source string) error {
+	info := dicom.MustGetPixelDataInfo(pixelElement.Value)
+	if !info.IsEncapsulated {
+		return errUnsupportedTransferSyntax
+	}
+	fragments, err := frameFragments(ds, info)
+	if err != nil {
+		return err
+	}
+	rows := getInt(ds, tag.Rows, 0)
+	cols := getInt(ds, tag.Columns, 0)
+	samples := getInt(ds, tag.SamplesPerPixel, 1)
+	bitsAllocated := getInt(ds, tag.BitsAllocated, 8)
+
+	var native []byte
+	if source == rleLosslessTransferSyntax {
+		for _, f := range fragments {
+			d, err := decodeRLEFrame(f, rows, cols, samples, bitsAllocated/8)
+			if err != nil {
+				return err
+			}
+			native = append(native, d...)
+		}
+	} else {
+		for _, f := range fragments {
+			d, s, err := decodeJPEGFrame(f)
+			if err != nil {
+				return err
+			}
+			samples = s
+			native = append(native, d...)
+		}
+		bitsAllocated = 8
+		setElement(ds, tag.BitsAllocated, []int{8})
+		setElement(ds, tag.BitsStored, []int{8})
+		setElement(ds, tag.HighBit, []int{7})
+		setElement(ds, tag.SamplesPerPixel, []int{samples})
+		if samples == 3 {
+			setElement(ds, tag.PhotometricInterpretation, []string{"RGB"})
+		} else if !strings.HasPrefix(getString(ds, tag.PhotometricInterpretation), "MONOCHROME") {
+			setElement(ds, tag.PhotometricInterpretation, []string{"MONOCHROME2"})
+		}
+	}
+	if samples > 1 {
+		setElement(ds, tag.PlanarConfiguration, []int{0})
+	}
+	if len(native)%2 == 1 {
+		native = append(native, 0)
+	}
+	vr := "OB"
+	if bitsAllocated > 8 {
+		vr = "OW"
+	}
+	value, err := dicom.NewValue(dicom.PixelDataInfo{IntentionallyUnprocessed: true, UnprocessedValueData: native})
+	if err != nil {
+		return err
+	}
+	*pixelElement = dicom.Element{
+		Tag:                    tag.PixelData,
+		ValueRepresentation:    tag.GetVRKind(tag.PixelData, vr),
+		RawValueRepresentation: vr,
+		ValueLength:            uint32(len(native)),
+		Value:                  value,
+	}
+	return nil
+}
+
+// decodeRLEFrame decodes a DICOM RLE Lossless frame (PS3.5 Annex G) into little endian, interleaved samples
+func decodeRLEFrame(data []byte, rows, cols, samples, bytesPerSample int) ([]byte, error) {
+	if len(data) < 64 || bytesPerSample < 1 {
+		return nil, fmt.Errorf("RLE frame too short")
+	}
+	numSegments := int(binary.LittleEndian.Uint32(data[0:4]))
+	if numSegments != samples*bytesPerSample || numSegments > 15 {
+		return nil, fmt.Errorf("RLE frame has %d segments, expected %d", numSegments, samples*bytesPerSample)
+	}
+	numPixels := rows * cols
+	out := make([]byte, numPixels*samples*bytesPerSample)
+	for s := 0; s < numSegments; s++ {
+		start := int(binary.LittleEndian.Uint32(data[4+4*s:]))
+		end := len(data)
+		if s+1 < numSegments {
+			end = int(binary.LittleEndian.Uint32(data[4+4*(s+1):]))
+		}
+		if start > end || end > len(data) {
+			return nil, fmt.Errorf("RLE segment offsets out of range")
+		}
+		segment := unpackBits(data[start:end], numPixels)
+		sample := s / bytesPerSample
+		msb := s % bytesPerSample // segments store the most significant byte first
+		for i := range segment {
+			out[(i*samples+sample)*bytesPerSample+bytesPerSample-1-msb] = segment[i]
+		}
+	}
+	return out, nil
+}
+
+// unpackBits is the PackBits decoder used by RLE Lossless
+func unpackBits(in []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in) && len(out) < n; {
+		c := int8(in[i])
+		i++
+		if c >= 0 {
+			cnt := int(c) + 1
+			if i+cnt > len(in) {
+				cnt = len(in) - i
+			}
+			out = append(out, in[i:i+cnt]...)
+			i += cnt
+		} else if c != -128 {
+			if i < len(in) {
+				for j := 0; j < 1-int(c); j++ {
+					out = append(out, in[i])
+				}
+			}
+			i++
+		}
+	}
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// decodeJPEGFrame decodes an 8bit baseline JPEG frame, returns the pixel values and the number of samples per pixel
+func decodeJPEGFrame(data []byte) ([]byte, int, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	b := img.Bounds()
+	switch m := img.(type) {
+	case *image.Gray:
+		out := make([]byte, 0, b.Dx()*b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			out = append(out, m.Pix[(y-b.Min.Y)*m.Stride:(y-b.Min.Y)*m.Stride+b.Dx()]...)
+		}
+		return out, 1, nil
+	case *image.YCbCr:
+		out := make([]byte, 0, 3*b.Dx()*b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				yi := m.YOffset(x, y)
+				ci := m.COffset(x, y)
+				r, g, bl := color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+				out = append(out, r, g, bl)
+			}
+		}
+		return out, 3, nil
+	}
+	return nil, 0, errUnsupportedTransferSyntax
+}
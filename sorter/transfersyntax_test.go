@@ -0,0 +1,240 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/frame"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+// rleFrame encodes the segments of an RLE Lossless frame as literal runs, padded to an even length
+func rleFrame(segments ...[]byte) []byte {
+	header := make([]byte, 64)
+	binary.LittleEndian.PutUint32(header, uint32(len(segments)))
+	var body []byte
+	for i, s := range segments {
+		binary.LittleEndian.PutUint32(header[4+4*i:], uint32(64+len(body)))
+		body = append(body, byte(len(s)-1))
+		body = append(body, s...)
+	}
+	if len(body)%2 == 1 {
+		body = append(body, 0)
+	}
+	return append(header, body...)
+}
+
+func TestUnpackBits(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		n    int
+		want []byte
+	}{
+		{name: "literal run", in: []byte{2, 1, 2, 3}, n: 3, want: []byte{1, 2, 3}},
+		{name: "replicate run", in: []byte{0xFD, 7}, n: 4, want: []byte{7, 7, 7, 7}},
+		{name: "no-op byte", in: []byte{0x80, 0, 9}, n: 1, want: []byte{9}},
+		{name: "mixed runs", in: []byte{0, 5, 0xFF, 6}, n: 3, want: []byte{5, 6, 6}},
+		{name: "output limited to n", in: []byte{0xFD, 7}, n: 2, want: []byte{7, 7}},
+		{name: "truncated literal", in: []byte{4, 1, 2}, n: 5, want: []byte{1, 2}},
+	}
+	for _, tt := range tests {
+		if got := unpackBits(tt.in, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: unpackBits = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeRLEFrame(t *testing.T) {
+	tests := []struct {
+		name                string
+		frame               []byte
+		rows, cols, samples int
+		bytesPerSample      int
+		want                []byte
+		wantErr             bool
+	}{
+		{name: "8 bit", frame: rleFrame([]byte{1, 2, 3, 4}), rows: 2, cols: 2, samples: 1, bytesPerSample: 1, want: []byte{1, 2, 3, 4}},
+		{name: "16 bit is little endian", frame: rleFrame([]byte{0x01, 0x03}, []byte{0x02, 0x04}), rows: 1, cols: 2, samples: 1, bytesPerSample: 2, want: []byte{0x02, 0x01, 0x04, 0x03}},
+		{name: "RGB is interleaved", frame: rleFrame([]byte{10, 11}, []byte{20, 21}, []byte{30, 31}), rows: 1, cols: 2, samples: 3, bytesPerSample: 1, want: []byte{10, 20, 30, 11, 21, 31}},
+		{name: "too short", frame: []byte{1, 0, 0, 0}, rows: 1, cols: 1, samples: 1, bytesPerSample: 1, wantErr: true},
+		{name: "wrong number of segments", frame: rleFrame([]byte{1}), rows: 1, cols: 1, samples: 1, bytesPerSample: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := decodeRLEFrame(tt.frame, tt.rows, tt.cols, tt.samples, tt.bytesPerSample)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: decodeRLEFrame = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// pixelValue returns the native pixel data as it is stored in the file
+func pixelValue(t testing.TB, data []byte, vr string) *dicom.Element {
+	t.Helper()
+	return newRawElement(t, tag.PixelData, vr, dicom.PixelDataInfo{IntentionallyUnprocessed: true, UnprocessedValueData: data})
+}
+
+// encapsulatedPixelValue returns pixel data with one fragment per frame
+func encapsulatedPixelValue(t testing.TB, frames ...[]byte) *dicom.Element {
+	t.Helper()
+	info := dicom.PixelDataInfo{IsEncapsulated: true}
+	for _, f := range frames {
+		info.Frames = append(info.Frames, &frame.Frame{Encapsulated: true, EncapsulatedData: frame.EncapsulatedFrame{Data: f}})
+	}
+	elem := newRawElement(t, tag.PixelData, "OB", info)
+	elem.ValueLength = tag.VLUndefinedLength
+	return elem
+}
+
+// elementBytes returns the bytes of a binary element or the unprocessed pixel data
+func elementBytes(t testing.TB, elems []*dicom.Element, tg tag.Tag) []byte {
+	t.Helper()
+	for _, elem := range elems {
+		if elem.Tag == tg {
+			switch v := elem.Value.GetValue().(type) {
+			case []byte:
+				return v
+			case []string: // OF, OL, OD and OV
+				return []byte(strings.Join(v, "\\"))
+			case dicom.PixelDataInfo:
+				return v.UnprocessedValueData
+			}
+		}
+		if items, ok := elem.Value.GetValue().([]*dicom.SequenceItemValue); ok {
+			for _, item := range items {
+				if b := elementBytes(t, item.GetValue().([]*dicom.Element), tg); b != nil {
+					return b
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestTranscodeFiles(t *testing.T) {
+	lutData := tag.Tag{Group: 0x0028, Element: 0x3006}
+	floatPixelData := tag.Tag{Group: 0x7FE0, Element: 0x0008}
+	image := func(ts string, bits, samples int, pixels *dicom.Element, extra ...*dicom.Element) dicom.Dataset {
+		return newTestInstance(t, "1.2.3.4", 1, append([]*dicom.Element{
+			newTestElement(t, tag.TransferSyntaxUID, []string{ts}),
+			newTestElement(t, tag.Rows, []int{1}),
+			newTestElement(t, tag.Columns, []int{2}),
+			newTestElement(t, tag.SamplesPerPixel, []int{samples}),
+			newTestElement(t, tag.BitsAllocated, []int{bits}),
+			newTestElement(t, tag.BitsStored, []int{bits}),
+			newTestElement(t, tag.HighBit, []int{bits - 1}),
+			newTestElement(t, tag.PixelRepresentation, []int{0}),
+			pixels,
+		}, extra...)...)
+	}
+	tests := []struct {
+		name      string
+		target    string
+		ds        dicom.Dataset
+		wantTS    string
+		wantPixel []byte
+		wantBytes map[tag.Tag][]byte // other binary elements
+	}{
+		{
+			name:      "implicit to explicit",
+			target:    "explicit",
+			ds:        image(uid.ImplicitVRLittleEndian, 16, 1, pixelValue(t, []byte{1, 2, 3, 4}, "OW")),
+			wantTS:    uid.ExplicitVRLittleEndian,
+			wantPixel: []byte{1, 2, 3, 4},
+		},
+		{
+			name:   "big endian swaps pixel data and binary elements",
+			target: "explicit",
+			ds: image(uid.ExplicitVRBigEndian, 16, 1, pixelValue(t, []byte{0x01, 0x02, 0x03, 0x04}, "OW"),
+				newRawElement(t, tag.RedPaletteColorLookupTableData, "OW", []byte{0x00, 0x10, 0x00, 0x20}),
+				newTestElement(t, tag.ModalityLUTSequence, [][]*dicom.Element{{
+					newRawElement(t, lutData, "OW", []byte{0xAB, 0xCD}),
+					newRawElement(t, floatPixelData, "OF", []string{string([]byte{0x3F, 0x81, 0x02, 0x03})}),
+				}})),
+			wantTS:    uid.ExplicitVRLittleEndian,
+			wantPixel: []byte{0x02, 0x01, 0x04, 0x03},
+			wantBytes: map[tag.Tag][]byte{
+				tag.RedPaletteColorLookupTableData: {0x10, 0x00, 0x20, 0x00},
+				lutData:                            {0xCD, 0xAB},
+				floatPixelData:                     {0x03, 0x02, 0x81, 0x3F},
+			},
+		},
+		{
+			name:      "RLE 16 bit to implicit",
+			target:    "implicit",
+			ds:        image(rleLosslessTransferSyntax, 16, 1, encapsulatedPixelValue(t, rleFrame([]byte{0x01, 0x03}, []byte{0x02, 0x04}))),
+			wantTS:    uid.ImplicitVRLittleEndian,
+			wantPixel: []byte{0x02, 0x01, 0x04, 0x03},
+		},
+		{
+			name:      "RLE 8 bit RGB",
+			target:    "explicit",
+			ds:        image(rleLosslessTransferSyntax, 8, 3, encapsulatedPixelValue(t, rleFrame([]byte{10, 11}, []byte{20, 21}, []byte{30, 31}))),
+			wantTS:    uid.ExplicitVRLittleEndian,
+			wantPixel: []byte{10, 20, 30, 11, 21, 31},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "in.dcm"), filepath.Join(dir, "out.dcm")
+			writeTestFile(t, src, tt.ds)
+
+			e := newTestEngine()
+			e.transcodeFlag = tt.target
+			if err := e.initTranscode(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := e.transformFileContents(src, dst); err != nil {
+				t.Fatal(err)
+			}
+			out, err := readDatasetFile(dst)
+			if err != nil {
+				t.Fatalf("could not parse the transcoded file (%s)", err)
+			}
+			if ts := getString(&out, tag.TransferSyntaxUID); ts != tt.wantTS {
+				t.Errorf("transfer syntax %s, want %s", ts, tt.wantTS)
+			}
+			if got := elementBytes(t, out.Elements, tag.PixelData); !bytes.Equal(got, tt.wantPixel) {
+				t.Errorf("pixel data %v, want %v", got, tt.wantPixel)
+			}
+			for tg, want := range tt.wantBytes {
+				if got := elementBytes(t, out.Elements, tg); !bytes.Equal(got, want) {
+					t.Errorf("%s is %v, want %v", tg, got, want)
+				}
+			}
+			if rows := getInt(&out, tag.Rows, 0); rows != 1 {
+				t.Errorf("Rows is %d after transcoding, want 1", rows)
+			}
+		})
+	}
+}
+
+func TestTranscodeUnsupported(t *testing.T) {
+	e := newTestEngine()
+	e.transcodeFlag = "explicit"
+	if err := e.initTranscode(); err != nil {
+		t.Fatal(err)
+	}
+	ds := newTestInstance(t, "1.2.3.4", 1, newTestElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.4.90"}))
+	if err := e.transcodeDataset(&ds); err != errUnsupportedTransferSyntax {
+		t.Errorf("JPEG 2000 error = %v, want %v", err, errUnsupportedTransferSyntax)
+	}
+	e.transcodeFlag = "jpeg"
+	if err := e.initTranscode(); err == nil {
+		t.Error("expected an error for -transcode jpeg")
+	}
+}
@@ -0,0 +1,240 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Light-weight transforms applied during '-method copy'. Instead of a byte copy
+// the file is parsed completely, elements are removed and the result is written
+// as a new Part 10 file. The meta header (and its group length) is re-created by
+// the writer.
+
+// transformState holds the settings of the copy transform
+type transformState struct {
+	stripPrivateFlag  bool
+	keepPrivateFlag   string
+	stripOverlaysFlag bool
+	removeTagsFlag    string
+
+	// private creators (trimmed values of (gggg,00xx)) that survive -strip-private
+	keepPrivateCreators map[string]bool
+
+	// tags removed by -remove-tags, matched on all nesting levels
+	removeTags map[tag.Tag]bool
+}
+
+// a list of tags is a mix of keywords and group,element pairs like "PatientName,(0010,0030),0029,1010"
+var tagListRegex = regexp.MustCompile(`\(?[0-9A-Fa-f]{4},[0-9A-Fa-f]{4}\)?|[A-Za-z0-9]+`)
+
+// parseTagString accepts a DICOM keyword (PatientName) or a group,element pair (0010,0010)
+func parseTagString(s string) (tag.Tag, error) {
+	s = strings.Trim(s, " ()")
+	if strings.Contains(s, ",") {
+		pieces := strings.Split(s, ",")
+		if len(pieces) != 2 {
+			return tag.Tag{}, fmt.Errorf("could not parse \"%s\" as group,element", s)
+		}
+		g, err := strconv.ParseUint(strings.TrimSpace(pieces[0]), 16, 16)
+		if err != nil {
+			return tag.Tag{}, fmt.Errorf("could not parse group of \"%s\" (%s)", s, err)
+		}
+		e, err := strconv.ParseUint(strings.TrimSpace(pieces[1]), 16, 16)
+		if err != nil {
+			return tag.Tag{}, fmt.Errorf("could not parse element of \"%s\" (%s)", s, err)
+		}
+		return tag.Tag{Group: uint16(g), Element: uint16(e)}, nil
+	}
+	info, err := tag.FindByName(s)
+	if err != nil {
+		return tag.Tag{}, err
+	}
+	return info.Tag, nil
+}
+
+// initTransforms checks the transform options, returns an error for unknown tags
+func (e *engine) initTransforms() error {
+	e.keepPrivateCreators = make(map[string]bool, 0)
+	if e.keepPrivateFlag != "" {
+		if !e.stripPrivateFlag {
+			e.warn("-keep-private has no effect without -strip-private")
+		}
+		for _, c := range strings.Split(e.keepPrivateFlag, ",") {
+			e.keepPrivateCreators[strings.TrimSpace(c)] = true
+		}
+	}
+	e.removeTags = make(map[tag.Tag]bool, 0)
+	for _, s := range tagListRegex.FindAllString(e.removeTagsFlag, -1) {
+		t, err := parseTagString(s)
+		if err != nil {
+			return fmt.Errorf("unknown tag \"%s\" in -remove-tags (%s)", s, err)
+		}
+		e.removeTags[t] = true
+	}
+	if e.filterRequested() && e.methodFlag != "copy" {
+		e.warn("-strip-private, -strip-overlays and -remove-tags only work together with '-method copy'")
+	}
+	return nil
+}
+
+// filterRequested is true if elements have to be removed
+func (e *engine) filterRequested() bool {
+	return e.stripPrivateFlag || e.stripOverlaysFlag || len(e.removeTags) > 0
+}
+
+// transformRequested is true if copyFileContents is not enough
+func (e *engine) transformRequested() bool {
+	return e.filterRequested() || e.transcodeTarget != ""
+}
+
+func isPrivateGroup(g uint16) bool {
+	return g%2 == 1
+}
+
+// overlays are stored in the repeating groups 6000-60FF, curves in 5000-50FF
+func isOverlayOrCurveGroup(g uint16) bool {
+	return g%2 == 0 && (g&0xFF00 == 0x6000 || g&0xFF00 == 0x5000)
+}
+
+// privateCreatorName returns the value of a private creator element, in implicit VR files the value is read as UN bytes
+func privateCreatorName(e *dicom.Element) string {
+	switch v := e.Value.GetValue().(type) {
+	case []string:
+		if len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+	case []byte:
+		return strings.TrimRight(string(v), " \x00")
+	}
+	return ""
+}
+
+// filterElements returns the elements that survive the requested transforms, sequences are filtered recursively
+func (e *engine) filterElements(elems []*dicom.Element) []*dicom.Element {
+	// private creator blocks that should be kept, key is group and block (gggg,00xx)
+	keepBlock := make(map[tag.Tag]bool, 0)
+	if e.stripPrivateFlag && len(e.keepPrivateCreators) > 0 {
+		for _, elem := range elems {
+			if isPrivateGroup(elem.Tag.Group) && elem.Tag.Element >= 0x0010 && elem.Tag.Element <= 0x00FF {
+				if e.keepPrivateCreators[privateCreatorName(elem)] {
+					keepBlock[elem.Tag] = true
+				}
+			}
+		}
+	}
+
+	var result []*dicom.Element
+	for _, elem := range elems {
+		t := elem.Tag
+		if e.removeTags[t] {
+			continue
+		}
+		// group lengths outside of the meta header are retired and would be wrong after removing elements
+		if t.Element == 0x0000 && t.Group != tag.MetadataGroup {
+			continue
+		}
+		if e.stripOverlaysFlag && isOverlayOrCurveGroup(t.Group) {
+			continue
+		}
+		if e.stripPrivateFlag && isPrivateGroup(t.Group) {
+			var creator tag.Tag
+			if t.Element >= 0x0010 && t.Element <= 0x00FF {
+				creator = t // the private creator itself
+			} else {
+				creator = tag.Tag{Group: t.Group, Element: t.Element >> 8}
+			}
+			if !keepBlock[creator] {
+				continue
+			}
+		}
+		if elem.Value != nil && elem.Value.ValueType() == dicom.Sequences {
+			var items [][]*dicom.Element
+			for _, item := range elem.Value.GetValue().([]*dicom.SequenceItemValue) {
+				items = append(items, e.filterElements(item.GetValue().([]*dicom.Element)))
+			}
+			v, err := dicom.NewValue(items)
+			if err == nil {
+				elem = &dicom.Element{
+					Tag:                    elem.Tag,
+					ValueRepresentation:    elem.ValueRepresentation,
+					RawValueRepresentation: elem.RawValueRepresentation,
+					ValueLength:            elem.ValueLength,
+					Value:                  v,
+				}
+			}
+		}
+		result = append(result, elem)
+	}
+	return result
+}
+
+// transformFileContents is the copyFileContents variant that applies the transforms
+func (e *engine) transformFileContents(src, dst string) (bytesWritten int64, err error) {
+	dataset, err := readDatasetFile(src)
+	if err != nil {
+		return 0, err
+	}
+	return e.writeDatasetContents(&dataset, src, dst)
+}
+
+// writeDatasetContents applies the transforms to a data set and writes it to dst. If src is not
+// empty and the data set cannot be transcoded (without other changes) src is copied instead.
+func (e *engine) writeDatasetContents(dataset *dicom.Dataset, src, dst string) (bytesWritten int64, err error) {
+	addFileMeta(dataset)
+	if e.filterRequested() {
+		dataset.Elements = e.filterElements(dataset.Elements)
+	}
+	if e.transcodeTarget != "" {
+		if err = e.transcodeDataset(dataset); err != nil {
+			if !errors.Is(err, errUnsupportedTransferSyntax) {
+				return 0, err
+			}
+			atomic.AddInt32(&e.counterNotTranscoded, 1)
+			if e.debugFlag {
+				fmt.Fprintf(os.Stderr, "[%d] cannot transcode, keep transfer syntax %s: \"%s\"\n", e.counterNotTranscoded, getString(dataset, tag.TransferSyntaxUID), dst)
+			}
+			if src != "" && !e.filterRequested() {
+				return e.copyFileContents(src, dst)
+			}
+		}
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	h := e.outputHash(dst)
+	bw := bufio.NewWriter(hashWriter(out, h))
+	if err = dicom.Write(bw, *dataset, dicom.SkipVRVerification(), dicom.SkipValueTypeVerification(), dicom.DefaultMissingTransferSyntax()); err != nil {
+		return 0, err
+	}
+	if err = bw.Flush(); err != nil {
+		return 0, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	e.recordChecksum(dst, h)
+	err = e.syncOutputFile(out)
+	return info.Size(), err
+}
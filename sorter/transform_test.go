@@ -0,0 +1,125 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestParseTagString(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    tag.Tag
+		wantErr bool
+	}{
+		{in: "PatientName", want: tag.PatientName},
+		{in: "(0010,0020)", want: tag.PatientID},
+		{in: "0029,1010", want: tag.Tag{Group: 0x0029, Element: 0x1010}},
+		{in: " (6000,3000) ", want: tag.Tag{Group: 0x6000, Element: 0x3000}},
+		{in: "NoSuchKeyword", wantErr: true},
+		{in: "00GG,0010", wantErr: true},
+		{in: "0010,0010,0010", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTagString(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTagString(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseTagString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFilterElements(t *testing.T) {
+	creator := tag.Tag{Group: 0x0029, Element: 0x0010}
+	otherCreator := tag.Tag{Group: 0x0029, Element: 0x0011}
+	elems := func() []*dicom.Element {
+		item := []*dicom.Element{
+			newTestElement(t, tag.ReferencedSOPInstanceUID, []string{"1.2.3"}),
+			newRawElement(t, tag.Tag{Group: 0x0029, Element: 0x0010}, "LO", []string{"KEEP"}),
+			newRawElement(t, tag.Tag{Group: 0x0029, Element: 0x1001}, "LO", []string{"nested"}),
+		}
+		return []*dicom.Element{
+			newRawElement(t, tag.Tag{Group: 0x0008, Element: 0x0000}, "UL", []int{100}),
+			newTestElement(t, tag.Modality, []string{"CT"}),
+			newTestElement(t, tag.ReferencedImageSequence, [][]*dicom.Element{item}),
+			newTestElement(t, tag.PatientName, []string{"Test^Patient"}),
+			newRawElement(t, creator, "LO", []string{"KEEP "}),
+			newRawElement(t, otherCreator, "LO", []string{"DROP"}),
+			newRawElement(t, tag.Tag{Group: 0x0029, Element: 0x1010}, "LO", []string{"kept"}),
+			newRawElement(t, tag.Tag{Group: 0x0029, Element: 0x1110}, "LO", []string{"dropped"}),
+			newRawElement(t, tag.Tag{Group: 0x5000, Element: 0x0005}, "US", []int{1}),
+			newRawElement(t, tag.Tag{Group: 0x6000, Element: 0x0010}, "US", []int{2}),
+			newRawElement(t, tag.Tag{Group: 0x6000, Element: 0x3000}, "OW", []byte{0, 1, 2, 3}),
+			newRawElement(t, tag.Tag{Group: 0x6001, Element: 0x0010}, "LO", []string{"odd group"}),
+		}
+	}
+	tests := []struct {
+		name          string
+		stripPrivate  bool
+		keepPrivate   string
+		stripOverlays bool
+		removeTags    string
+		want          []string
+	}{
+		{
+			name: "group lengths only",
+			want: []string{"(0008,0060)", "(0008,1140)", ">(0008,1155)", ">(0029,0010)", ">(0029,1001)", "(0010,0010)",
+				"(0029,0010)", "(0029,0011)", "(0029,1010)", "(0029,1110)", "(5000,0005)", "(6000,0010)", "(6000,3000)", "(6001,0010)"},
+		},
+		{
+			name:         "strip private",
+			stripPrivate: true,
+			want: []string{"(0008,0060)", "(0008,1140)", ">(0008,1155)", "(0010,0010)",
+				"(5000,0005)", "(6000,0010)", "(6000,3000)"},
+		},
+		{
+			name:         "keep private creator",
+			stripPrivate: true,
+			keepPrivate:  "KEEP",
+			want: []string{"(0008,0060)", "(0008,1140)", ">(0008,1155)", ">(0029,0010)", ">(0029,1001)", "(0010,0010)",
+				"(0029,0010)", "(0029,1010)", "(5000,0005)", "(6000,0010)", "(6000,3000)"},
+		},
+		{
+			name:          "strip overlays and curves",
+			stripOverlays: true,
+			want: []string{"(0008,0060)", "(0008,1140)", ">(0008,1155)", ">(0029,0010)", ">(0029,1001)", "(0010,0010)",
+				"(0029,0010)", "(0029,0011)", "(0029,1010)", "(0029,1110)", "(6001,0010)"},
+		},
+		{
+			name:       "remove tags on all levels",
+			removeTags: "PatientName,(0008,1155),6000,3000",
+			want: []string{"(0008,0060)", "(0008,1140)", ">(0029,0010)", ">(0029,1001)",
+				"(0029,0010)", "(0029,0011)", "(0029,1010)", "(0029,1110)", "(5000,0005)", "(6000,0010)", "(6001,0010)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine()
+			e.stripPrivateFlag, e.keepPrivateFlag, e.stripOverlaysFlag, e.removeTagsFlag = tt.stripPrivate, tt.keepPrivate, tt.stripOverlays, tt.removeTags
+			if err := e.initTransforms(); err != nil {
+				t.Fatal(err)
+			}
+			got := elementTags(e.filterElements(elems()), "")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitTransformsUnknownTag(t *testing.T) {
+	e := newTestEngine()
+	e.removeTagsFlag = "PatientName,NoSuchKeyword"
+	if err := e.initTransforms(); err == nil {
+		t.Error("expected an error for an unknown keyword in -remove-tags")
+	}
+}
@@ -0,0 +1,253 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// After sorting each series (SeriesInstanceUID) can be checked for completeness:
+// gaps in InstanceNumber, irregular slice spacing, changing image size or pixel
+// spacing and mixed orientations. Series without problems are "complete", all
+// others are "suspect". The result is written to the -series-report file.
+
+// seriesReportState collects the instances of each series for -series-report
+type seriesReportState struct {
+	seriesReportFlag string
+
+	seriesInstances      map[string]*seriesEntry
+	seriesInstancesMutex sync.Mutex
+
+	// number of series without and with problems
+	numSeriesComplete int
+	numSeriesSuspect  int
+}
+
+type seriesEntry struct {
+	patientID         string
+	studyInstanceUID  string
+	seriesNumber      string
+	seriesDescription string
+	modality          string
+	folders           map[string]bool
+	instances         []instanceInfo
+}
+
+// SeriesReport is one entry of the machine-readable series report
+type SeriesReport struct {
+	PatientID         string   `json:"PatientID"`
+	StudyInstanceUID  string   `json:"StudyInstanceUID"`
+	SeriesInstanceUID string   `json:"SeriesInstanceUID"`
+	SeriesNumber      string   `json:"SeriesNumber"`
+	SeriesDescription string   `json:"SeriesDescription"`
+	Modality          string   `json:"Modality"`
+	Instances         int      `json:"Instances"`
+	Status            string   `json:"Status"`
+	Issues            []string `json:"Issues"`
+	Folders           []string `json:"Folders"`
+}
+
+func (e *engine) recordSeriesInstance(ds *dicom.Dataset, si instanceInfo) {
+	seriesInstanceUID := strings.TrimSpace(elementValueString(findElement(ds, tag.SeriesInstanceUID)))
+	e.seriesInstancesMutex.Lock()
+	defer e.seriesInstancesMutex.Unlock()
+	entry, ok := e.seriesInstances[seriesInstanceUID]
+	if !ok {
+		entry = &seriesEntry{
+			patientID:         strings.TrimSpace(elementValueString(findElement(ds, tag.PatientID))),
+			studyInstanceUID:  strings.TrimSpace(elementValueString(findElement(ds, tag.StudyInstanceUID))),
+			seriesNumber:      strings.TrimSpace(elementValueString(findElement(ds, tag.SeriesNumber))),
+			seriesDescription: strings.TrimSpace(elementValueString(findElement(ds, tag.SeriesDescription))),
+			modality:          strings.TrimSpace(elementValueString(findElement(ds, tag.Modality))),
+			folders:           make(map[string]bool, 0),
+		}
+		e.seriesInstances[seriesInstanceUID] = entry
+	}
+	entry.folders[filepath.Dir(si.path)] = true
+	entry.instances = append(entry.instances, si)
+}
+
+// distinctValues returns the sorted list of different values
+func distinctValues(instances []instanceInfo, value func(instanceInfo) string) []string {
+	m := make(map[string]bool, 0)
+	for _, si := range instances {
+		m[value(si)] = true
+	}
+	var values []string
+	for v := range m {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// checkSeries returns the list of problems found for the instances of a series
+func checkSeries(instances []instanceInfo) []string {
+	var issues []string
+
+	// InstanceNumber should increase without gaps
+	var numbers []int
+	missingNumbers := 0
+	for _, si := range instances {
+		if si.hasInstance {
+			numbers = append(numbers, si.instanceNumber)
+		} else {
+			missingNumbers++
+		}
+	}
+	if missingNumbers > 0 {
+		issues = append(issues, fmt.Sprintf("%d instances without InstanceNumber", missingNumbers))
+	}
+	if len(numbers) > 1 {
+		sort.Ints(numbers)
+		gaps, duplicates := 0, 0
+		for i := 1; i < len(numbers); i++ {
+			d := numbers[i] - numbers[i-1]
+			if d == 0 {
+				duplicates++
+			} else if d > 1 {
+				gaps += d - 1
+			}
+		}
+		if gaps > 0 {
+			issues = append(issues, fmt.Sprintf("%d InstanceNumbers missing between %d and %d", gaps, numbers[0], numbers[len(numbers)-1]))
+		}
+		if duplicates > 0 {
+			issues = append(issues, fmt.Sprintf("%d duplicate InstanceNumbers", duplicates))
+		}
+	}
+
+	// image size and pixel spacing should be the same for all images
+	if v := distinctValues(instances, func(si instanceInfo) string { return si.rows + "x" + si.columns }); len(v) > 1 {
+		issues = append(issues, fmt.Sprintf("inconsistent Rows/Columns (%s)", strings.Join(v, ", ")))
+	}
+	if v := distinctValues(instances, func(si instanceInfo) string { return si.pixelSpacing }); len(v) > 1 {
+		issues = append(issues, fmt.Sprintf("inconsistent PixelSpacing (%s)", strings.Join(v, ", ")))
+	}
+
+	// all images should share a single orientation
+	orientations := distinctValues(instances, func(si instanceInfo) string {
+		var r []string
+		for _, o := range si.orientation {
+			r = append(r, strconv.FormatFloat(math.Round(o*1000)/1000, 'f', 3, 64))
+		}
+		return strings.Join(r, "\\")
+	})
+	if len(orientations) > 1 {
+		issues = append(issues, fmt.Sprintf("%d different orientations", len(orientations)))
+		return issues // slice spacing is not defined
+	}
+
+	// the distance between neighboring slices should be the same
+	locations := sliceLocations(instances)
+	if locations != nil && len(locations) > 2 {
+		sort.Float64s(locations)
+		var spacings []float64
+		duplicates := 0
+		for i := 1; i < len(locations); i++ {
+			d := locations[i] - locations[i-1]
+			if d < 1e-3 {
+				duplicates++
+			} else {
+				spacings = append(spacings, d)
+			}
+		}
+		if duplicates > 0 {
+			issues = append(issues, fmt.Sprintf("%d duplicate slice positions", duplicates))
+		}
+		if len(spacings) > 1 {
+			sorted := append([]float64{}, spacings...)
+			sort.Float64s(sorted)
+			median := sorted[len(sorted)/2]
+			irregular := 0
+			for _, d := range spacings {
+				if math.Abs(d-median) > 0.1*median {
+					irregular++
+				}
+			}
+			if irregular > 0 {
+				issues = append(issues, fmt.Sprintf("irregular slice spacing (%d of %d distances differ from %.3gmm)", irregular, len(spacings), median))
+			}
+		}
+	}
+	return issues
+}
+
+// verifySeries checks all series and writes the report file, called after all files have been written
+func (e *engine) verifySeries() error {
+	e.seriesInstancesMutex.Lock()
+	defer e.seriesInstancesMutex.Unlock()
+
+	var uids []string
+	for uid := range e.seriesInstances {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	var report []SeriesReport
+	for _, uid := range uids {
+		entry := e.seriesInstances[uid]
+		r := SeriesReport{
+			PatientID:         entry.patientID,
+			StudyInstanceUID:  entry.studyInstanceUID,
+			SeriesInstanceUID: uid,
+			SeriesNumber:      entry.seriesNumber,
+			SeriesDescription: entry.seriesDescription,
+			Modality:          entry.modality,
+			Instances:         len(entry.instances),
+			Issues:            checkSeries(entry.instances),
+			Status:            "complete",
+		}
+		for f := range entry.folders {
+			r.Folders = append(r.Folders, f)
+		}
+		sort.Strings(r.Folders)
+		if len(r.Issues) > 0 {
+			r.Status = "suspect"
+			e.numSeriesSuspect++
+			if e.verboseFlag || e.debugFlag {
+				fmt.Fprintf(os.Stderr, "suspect series %s (%s): %s\n", uid, entry.seriesDescription, strings.Join(r.Issues, "; "))
+			}
+		} else {
+			r.Issues = []string{}
+			e.numSeriesComplete++
+		}
+		report = append(report, r)
+	}
+	return writeSeriesReport(e.seriesReportFlag, report)
+}
+
+// writeSeriesReport stores the report as JSON or, if the file name ends with .csv, as CSV
+func writeSeriesReport(filename string, report []SeriesReport) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(filename)) == ".csv" {
+		w := csv.NewWriter(f)
+		w.Write([]string{"PatientID", "StudyInstanceUID", "SeriesInstanceUID", "SeriesNumber", "SeriesDescription", "Modality", "Instances", "Status", "Issues", "Folders"})
+		for _, r := range report {
+			w.Write([]string{r.PatientID, r.StudyInstanceUID, r.SeriesInstanceUID, r.SeriesNumber, r.SeriesDescription, r.Modality, strconv.Itoa(r.Instances), r.Status, strings.Join(r.Issues, "; "), strings.Join(r.Folders, "; ")})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
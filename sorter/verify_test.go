@@ -0,0 +1,151 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestCheckSeries(t *testing.T) {
+	axial := []float64{1, 0, 0, 0, 1, 0}
+	slice := func(n int, z float64) instanceInfo {
+		return instanceInfo{instanceNumber: n, hasInstance: true, position: []float64{0, 0, z}, orientation: axial,
+			rows: "512", columns: "512", pixelSpacing: "0.5\\0.5"}
+	}
+	with := func(si instanceInfo, change func(*instanceInfo)) instanceInfo {
+		change(&si)
+		return si
+	}
+	tests := []struct {
+		name      string
+		instances []instanceInfo
+		want      []string
+	}{
+		{
+			name:      "complete",
+			instances: []instanceInfo{slice(1, 0), slice(2, 2.5), slice(3, 5), slice(4, 7.5)},
+		},
+		{
+			name:      "single instance",
+			instances: []instanceInfo{slice(1, 0)},
+		},
+		{
+			name:      "gap in InstanceNumber",
+			instances: []instanceInfo{slice(1, 0), slice(2, 1), slice(5, 2)},
+			want:      []string{"2 InstanceNumbers missing between 1 and 5"},
+		},
+		{
+			name:      "duplicate and missing InstanceNumber",
+			instances: []instanceInfo{slice(1, 0), slice(1, 1), with(slice(0, 2), func(si *instanceInfo) { si.hasInstance = false })},
+			want:      []string{"1 instances without InstanceNumber", "1 duplicate InstanceNumbers"},
+		},
+		{
+			name:      "image size",
+			instances: []instanceInfo{slice(1, 0), with(slice(2, 1), func(si *instanceInfo) { si.rows = "256" })},
+			want:      []string{"inconsistent Rows/Columns (256x512, 512x512)"},
+		},
+		{
+			name:      "pixel spacing",
+			instances: []instanceInfo{slice(1, 0), with(slice(2, 1), func(si *instanceInfo) { si.pixelSpacing = "1\\1" })},
+			want:      []string{"inconsistent PixelSpacing (0.5\\0.5, 1\\1)"},
+		},
+		{
+			name: "orientations",
+			instances: []instanceInfo{slice(1, 0), slice(2, 1),
+				with(slice(3, 2), func(si *instanceInfo) { si.orientation = []float64{0, 1, 0, 0, 0, -1} })},
+			want: []string{"2 different orientations"},
+		},
+		{
+			name:      "rounding of orientations",
+			instances: []instanceInfo{slice(1, 0), with(slice(2, 1), func(si *instanceInfo) { si.orientation = []float64{1, 0.0001, 0, 0, 1, 0} })},
+		},
+		{
+			name:      "duplicate slice positions",
+			instances: []instanceInfo{slice(1, 0), slice(2, 0), slice(3, 1), slice(4, 2)},
+			want:      []string{"1 duplicate slice positions"},
+		},
+		{
+			name:      "irregular slice spacing",
+			instances: []instanceInfo{slice(1, 0), slice(2, 1), slice(3, 2), slice(4, 4)},
+			want:      []string{"irregular slice spacing (1 of 3 distances differ from 1mm)"},
+		},
+		{
+			name:      "slice order does not matter",
+			instances: []instanceInfo{slice(3, 4), slice(1, 0), slice(2, 2)},
+		},
+	}
+	for _, tt := range tests {
+		if got := checkSeries(tt.instances); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: checkSeries = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifySeries(t *testing.T) {
+	for _, name := range []string{"report.json", "report.csv"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			e := newTestEngine()
+			e.seriesReportFlag = filepath.Join(dir, name)
+			for _, n := range []int{1, 2, 4} {
+				ds := newTestInstance(t, "1.2.3.1", n, newTestElement(t, tag.SeriesDescription, []string{"gap"}))
+				e.recordInstance(&ds, filepath.Join(dir, "a", "file.dcm"))
+			}
+			for _, n := range []int{1, 2} {
+				ds := newTestInstance(t, "1.2.3.2", n, newTestElement(t, tag.SeriesNumber, []string{"2"}))
+				e.recordInstance(&ds, filepath.Join(dir, []string{"b", "c"}[n-1], "file.dcm"))
+			}
+			if err := e.verifySeries(); err != nil {
+				t.Fatal(err)
+			}
+			if e.numSeriesComplete != 1 || e.numSeriesSuspect != 1 {
+				t.Errorf("%d complete and %d suspect series, want 1 and 1", e.numSeriesComplete, e.numSeriesSuspect)
+			}
+
+			want := []SeriesReport{
+				{PatientID: "P1", StudyInstanceUID: "1.2.826.0.1.3680043.2.1125.1", SeriesInstanceUID: "1.2.3.1", SeriesNumber: "1",
+					SeriesDescription: "gap", Modality: "CT", Instances: 3, Status: "suspect",
+					Issues: []string{"1 InstanceNumbers missing between 1 and 4"}, Folders: []string{filepath.Join(dir, "a")}},
+				{PatientID: "P1", StudyInstanceUID: "1.2.826.0.1.3680043.2.1125.1", SeriesInstanceUID: "1.2.3.2", SeriesNumber: "2",
+					Modality: "CT", Instances: 2, Status: "complete",
+					Issues: []string{}, Folders: []string{filepath.Join(dir, "b"), filepath.Join(dir, "c")}},
+			}
+			f, err := os.Open(e.seriesReportFlag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if name == "report.json" {
+				var got []SeriesReport
+				if err := json.NewDecoder(f).Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("report is %+v, want %+v", got, want)
+				}
+				return
+			}
+			records, err := csv.NewReader(f).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRecords := [][]string{
+				{"PatientID", "StudyInstanceUID", "SeriesInstanceUID", "SeriesNumber", "SeriesDescription", "Modality", "Instances", "Status", "Issues", "Folders"},
+				{"P1", "1.2.826.0.1.3680043.2.1125.1", "1.2.3.1", "1", "gap", "CT", "3", "suspect", "1 InstanceNumbers missing between 1 and 4", filepath.Join(dir, "a")},
+				{"P1", "1.2.826.0.1.3680043.2.1125.1", "1.2.3.2", "2", "", "CT", "2", "complete", "", filepath.Join(dir, "b") + "; " + filepath.Join(dir, "c")},
+			}
+			if !reflect.DeepEqual(records, wantRecords) {
+				t.Errorf("report is %q, want %q", records, wantRecords)
+			}
+		})
+	}
+}
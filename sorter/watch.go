@@ -0,0 +1,338 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// 'sdcm -watch <spool folder> <output folder>' keeps running and sorts files
+// as they appear in the spool folder. New files are detected with inotify
+// (Linux) or by scanning the spool folder every second. A file is sorted once
+// its size and modification time did not change for -watch-stable seconds.
+// Sorted source files can be deleted or moved to an archive folder. A series
+// counts as complete if no new file arrived for it in -watch-idle seconds.
+
+// watchState holds the settings of -watch and the activity of the series
+type watchState struct {
+	watchFlag        bool
+	watchStableFlag  int
+	watchIdleFlag    int
+	watchPollFlag    bool
+	watchDeleteFlag  bool
+	watchArchiveFlag string
+
+	// number of series reported as complete
+	counterSeriesComplete int32
+
+	// source files that were sorted (or sent), the watcher deletes or archives them
+	sortedSources sync.Map
+
+	activeSeries      map[string]*seriesActivity
+	activeSeriesMutex sync.Mutex
+}
+
+// watchCandidate is a file in a spool folder that waits to become stable
+type watchCandidate struct {
+	size    int64
+	modTime time.Time
+	changed time.Time // last time size or modification time changed
+}
+
+// seriesActivity is a series that received files
+type seriesActivity struct {
+	seriesInstanceUID string
+	studyInstanceUID  string
+	folder            string            // output folder of the series
+	values            map[string]string // template values of the first file, e.g. PatientID
+	instances         int
+	last              time.Time
+}
+
+// initWatch checks the options for -watch
+func (e *engine) initWatch() error {
+	if !e.watchFlag {
+		if e.watchDeleteFlag || e.watchArchiveFlag != "" {
+			return fmt.Errorf("-watch-delete and -watch-archive need -watch")
+		}
+		return nil
+	}
+	if e.watchDeleteFlag && e.watchArchiveFlag != "" {
+		return fmt.Errorf("use either -watch-delete or -watch-archive")
+	}
+	if e.methodFlag == "link" && (e.watchDeleteFlag || e.watchArchiveFlag != "") {
+		return fmt.Errorf("symbolic links would point to removed files, use '-method copy' with -watch-delete or -watch-archive")
+	}
+	if e.methodFlag == "stow" {
+		return fmt.Errorf("-watch cannot be used with '-method stow', use '-method cstore' to forward files from a spool folder")
+	}
+	if e.watchStableFlag < 0 {
+		e.watchStableFlag = 0
+	}
+	if e.watchIdleFlag < 1 {
+		e.watchIdleFlag = 1
+	}
+	if e.watchArchiveFlag != "" {
+		a, err := filepath.Abs(e.watchArchiveFlag)
+		if err != nil {
+			return err
+		}
+		e.watchArchiveFlag = a
+	}
+	return nil
+}
+
+// markSourceSorted remembers that a source file was sorted
+func (e *engine) markSourceSorted(in_file string) {
+	if e.watchFlag {
+		e.sortedSources.Store(in_file, true)
+	}
+}
+
+// recordSeriesActivity updates the last activity of the series of a sorted file
+func (e *engine) recordSeriesActivity(dataset *dicom.Dataset, dicomVals map[tag.Tag]string, outputPathFileName string) {
+	seriesInstanceUID, _ := findElementValue(dataset, tag.SeriesInstanceUID)
+	studyInstanceUID, _ := findElementValue(dataset, tag.StudyInstanceUID)
+	e.activeSeriesMutex.Lock()
+	defer e.activeSeriesMutex.Unlock()
+	s, ok := e.activeSeries[seriesInstanceUID]
+	if !ok {
+		s = &seriesActivity{seriesInstanceUID: seriesInstanceUID, studyInstanceUID: studyInstanceUID, values: make(map[string]string, 0)}
+		if outputPathFileName != "" {
+			s.folder = filepath.Dir(outputPathFileName)
+		}
+		for t, v := range dicomVals {
+			// the path entry can be a filter like {Modality==MR}, the placeholder is the keyword
+			if info, err := tag.Find(t); err == nil {
+				s.values[info.Name] = v
+			}
+		}
+		e.activeSeries[seriesInstanceUID] = s
+	}
+	s.instances++
+	s.last = time.Now()
+}
+
+// completeSeries removes and returns the series without activity since before, all series if before is zero
+func (e *engine) completeSeries(before time.Time) []*seriesActivity {
+	e.activeSeriesMutex.Lock()
+	defer e.activeSeriesMutex.Unlock()
+	var done []*seriesActivity
+	for uid, s := range e.activeSeries {
+		if before.IsZero() || s.last.Before(before) {
+			done = append(done, s)
+			delete(e.activeSeries, uid)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool { return done[i].folder < done[j].folder })
+	return done
+}
+
+// archiveSource moves a sorted file from its spool folder into the archive folder
+func (e *engine) archiveSource(root string, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(e.watchArchiveFlag, filepath.Base(root), rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(target); err == nil {
+		target = fmt.Sprintf("%s_%d", target, time.Now().UnixNano())
+	}
+	if err := os.Rename(path, target); err == nil {
+		return nil
+	}
+	// the archive might be on another file system
+	if _, err := e.copyFileContents(path, target); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// scanFolder calls found for all files below a folder
+func (e *engine) scanFolder(root string, found func(path string)) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && e.watchArchiveFlag != "" && path == e.watchArchiveFlag {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			found(path)
+		}
+		return nil
+	})
+}
+
+// watchFolders sorts the files that appear in the spool folders until the run is canceled
+func (e *engine) watchFolders(source_paths []string, dest_path string) (int32, error) {
+	if _, err := os.Stat(dest_path); os.IsNotExist(err) && !e.remoteOutput() {
+		if err := os.Mkdir(dest_path, 0755); err != nil {
+			return 0, fmt.Errorf("could not create output directory \"%s\", %s", dest_path, err.Error())
+		}
+	}
+	e.processDataPath = dest_path
+	e.inputDataPath = "" // the watcher uses absolute paths
+
+	var mutex sync.Mutex
+	candidates := make(map[string]*watchCandidate, 0)
+	inProgress := make(map[string]bool, 0)
+	processed := make(map[string]time.Time, 0) // files kept in the spool folder, by modification time
+
+	rootOf := func(path string) string {
+		for _, root := range source_paths {
+			if strings.HasPrefix(path, root+string(os.PathSeparator)) {
+				return root
+			}
+		}
+		return filepath.Dir(path)
+	}
+	addCandidate := func(path string) {
+		if e.watchArchiveFlag != "" && strings.HasPrefix(path, e.watchArchiveFlag+string(os.PathSeparator)) {
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if inProgress[path] {
+			return
+		}
+		if t, ok := processed[path]; ok && t.Equal(info.ModTime()) {
+			return
+		}
+		c, ok := candidates[path]
+		if !ok {
+			candidates[path] = &watchCandidate{size: info.Size(), modTime: info.ModTime(), changed: time.Now()}
+		} else if c.size != info.Size() || !c.modTime.Equal(info.ModTime()) {
+			c.size, c.modTime, c.changed = info.Size(), info.ModTime(), time.Now()
+		}
+	}
+
+	// workers sort the stable files
+	work := make(chan string, e.num_workers)
+	var wg sync.WaitGroup
+	for i := 0; i < e.num_workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				info, err := os.Stat(path)
+				if err == nil {
+					e.walkFunc(path, info, nil)
+				}
+				mutex.Lock()
+				delete(inProgress, path)
+				root := rootOf(path)
+				mutex.Unlock()
+				if _, ok := e.sortedSources.LoadAndDelete(path); ok && (e.watchDeleteFlag || e.watchArchiveFlag != "") {
+					if e.watchDeleteFlag {
+						err = os.Remove(path)
+					} else {
+						err = e.archiveSource(root, path)
+					}
+					if err != nil {
+						e.warn("could not remove %s from the spool folder (%s)", path, err)
+					} else {
+						continue
+					}
+				}
+				if info != nil {
+					mutex.Lock()
+					processed[path] = info.ModTime()
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	events := make(chan string, 1024)
+	polling := e.watchPollFlag
+	if !polling {
+		if err := watchNotify(e.runContext, source_paths, events); err != nil {
+			if !e.quietFlag {
+				e.warn("cannot watch the input folders (%s), scan every second instead", err)
+			}
+			polling = true
+		}
+	}
+	for _, root := range source_paths {
+		e.scanFolder(root, addCandidate)
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	lastScan := time.Now()
+loop:
+	for {
+		select {
+		case path := <-events:
+			if path == "" {
+				// events were lost, look at all files again
+				for _, root := range source_paths {
+					e.scanFolder(root, addCandidate)
+				}
+				continue
+			}
+			addCandidate(path)
+		case <-ticker.C:
+			if polling && time.Since(lastScan) >= time.Second {
+				for _, root := range source_paths {
+					e.scanFolder(root, addCandidate)
+				}
+				lastScan = time.Now()
+			}
+			// re-check the candidates and sort the stable ones
+			mutex.Lock()
+			var paths []string
+			for path := range candidates {
+				paths = append(paths, path)
+			}
+			mutex.Unlock()
+			for _, path := range paths {
+				addCandidate(path)
+			}
+			var stable []string
+			mutex.Lock()
+			for path, c := range candidates {
+				if time.Since(c.changed) >= time.Duration(e.watchStableFlag)*time.Second {
+					stable = append(stable, path)
+					delete(candidates, path)
+					inProgress[path] = true
+				} else if _, err := os.Stat(path); os.IsNotExist(err) {
+					delete(candidates, path)
+				}
+			}
+			mutex.Unlock()
+			sort.Strings(stable)
+			for _, path := range stable {
+				work <- path
+			}
+			e.seriesComplete(e.completeSeries(time.Now().Add(-time.Duration(e.watchIdleFlag) * time.Second)))
+		case <-e.runContext.Done():
+			break loop
+		}
+	}
+	ticker.Stop()
+	close(work)
+	wg.Wait()
+	// the spool folder is drained, finishSorting reports the open series as complete
+	e.finishSorting(dest_path)
+	return e.counter, nil
+}
@@ -0,0 +1,109 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchNotify sends the path of files that are written or moved into the folders (and new sub-folders)
+// to events until ctx is canceled. An empty path means that events were lost.
+func watchNotify(ctx context.Context, roots []string, events chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// a non-blocking file uses the runtime poller, Close ends a pending Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	var mutex sync.Mutex
+	dirs := make(map[int32]string, 0)
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_MODIFY
+
+	addDir := func(dir string) error {
+		wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		dirs[int32(wd)] = dir
+		mutex.Unlock()
+		return nil
+	}
+	// addTree watches a folder and its sub-folders, found is called for the files already there
+	addTree := func(root string, found func(path string)) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				return addDir(path)
+			}
+			if found != nil {
+				found(path)
+			}
+			return nil
+		})
+	}
+	for _, root := range roots {
+		if err := addTree(root, nil); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	send := func(path string) {
+		select {
+		case events <- path:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if err != nil || n <= 0 {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := string(buf[nameStart : nameStart+int(e.Len)])
+				offset = nameStart + int(e.Len)
+				for len(name) > 0 && name[len(name)-1] == 0 {
+					name = name[:len(name)-1]
+				}
+				if e.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					send("")
+					continue
+				}
+				mutex.Lock()
+				dir, ok := dirs[e.Wd]
+				mutex.Unlock()
+				if !ok || name == "" {
+					continue
+				}
+				path := filepath.Join(dir, name)
+				if e.Mask&syscall.IN_ISDIR != 0 {
+					// files can be written before the new folder is watched
+					if e.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+						addTree(path, send)
+					}
+					continue
+				}
+				send(path)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,17 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package sorter
+
+import (
+	"context"
+	"fmt"
+)
+
+// watchNotify is only available on Linux, -watch scans the folders instead
+func watchNotify(ctx context.Context, roots []string, events chan<- string) error {
+	return fmt.Errorf("file system events are not supported on this platform")
+}
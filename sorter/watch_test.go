@@ -0,0 +1,194 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startWatch runs Run with Watch until the returned function is called, the function returns the result
+func startWatch(t testing.TB, opts Options) func() Result {
+	t.Helper()
+	opts.Watch, opts.WatchPoll, opts.Quiet, opts.Sync = true, true, true, "none"
+	ctx, cancel := context.WithCancel(context.Background())
+	type watched struct {
+		result Result
+		err    error
+	}
+	done := make(chan watched, 1)
+	go func() {
+		result, err := New(opts).Run(ctx)
+		done <- watched{result, err}
+	}()
+	stopped := false
+	stop := func() Result {
+		if !stopped {
+			stopped = true
+			cancel()
+		}
+		w := <-done
+		if w.err != nil {
+			t.Errorf("Run with Watch failed (%s)", w.err)
+		}
+		return w.result
+	}
+	t.Cleanup(func() {
+		if !stopped {
+			stop()
+		}
+	})
+	return stop
+}
+
+// waitFor checks a condition until it is true, fails after 10 seconds
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatchStable(t *testing.T) {
+	spool := t.TempDir()
+	part10 := filepath.Join(t.TempDir(), "a.dcm")
+	writeTestFile(t, part10, newTestInstance(t, "1.2.3.1", 1))
+	content, err := os.ReadFile(part10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file is still being copied into the spool folder
+	path := filepath.Join(spool, "a.dcm")
+	if err := os.WriteFile(path, content[:len(content)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.WatchStable = []string{spool}, out, 1
+	opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+	stop := startWatch(t, opts)
+	time.Sleep(400 * time.Millisecond)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the sorted file", func() bool { return len(listFiles(t, out)) > 0 })
+
+	result := stop()
+	if result.Files != 1 || result.Skipped != 0 {
+		t.Errorf("%d files sorted and %d skipped, want 1 and 0", result.Files, result.Skipped)
+	}
+	if got, want := listFiles(t, out), []string{"1.2.3.1/1.2.3.1.1.dcm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files %v, want %v", got, want)
+	}
+	// the file stays in the spool folder and is not sorted again
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the spool file was removed (%s)", err)
+	}
+}
+
+func TestWatchRemoveSorted(t *testing.T) {
+	tests := []struct {
+		name        string
+		archive     bool
+		wantArchive []string
+	}{
+		{name: "delete"},
+		{name: "archive", archive: true, wantArchive: []string{"spool/sub/a.dcm"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spool := filepath.Join(t.TempDir(), "spool")
+			if err := os.MkdirAll(filepath.Join(spool, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, filepath.Join(spool, "sub", "a.dcm"), newTestInstance(t, "1.2.3.1", 1))
+			// files that are not sorted stay in the spool folder
+			if err := os.WriteFile(filepath.Join(spool, "notes.txt"), []byte("not DICOM"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			out := t.TempDir()
+			archive := filepath.Join(t.TempDir(), "archive")
+			opts := DefaultOptions()
+			opts.Input, opts.Output, opts.WatchStable = []string{spool}, out, 0
+			opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+			if tt.archive {
+				opts.WatchArchive = archive
+			} else {
+				opts.WatchDelete = true
+			}
+			stop := startWatch(t, opts)
+			waitFor(t, "the sorted file to leave the spool folder", func() bool {
+				_, err := os.Stat(filepath.Join(spool, "sub", "a.dcm"))
+				return os.IsNotExist(err)
+			})
+			result := stop()
+			if result.Files != 1 {
+				t.Errorf("%d files sorted, want 1", result.Files)
+			}
+			if _, err := os.Stat(filepath.Join(spool, "notes.txt")); err != nil {
+				t.Errorf("a file that was not sorted was removed (%s)", err)
+			}
+			if got, want := listFiles(t, out), []string{"1.2.3.1/1.2.3.1.1.dcm"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("files %v, want %v", got, want)
+			}
+			if !tt.archive {
+				if _, err := os.Stat(archive); err == nil {
+					t.Error("files were archived with WatchDelete")
+				}
+				return
+			}
+			if got := listFiles(t, archive); !reflect.DeepEqual(got, tt.wantArchive) {
+				t.Errorf("archived %v, want %v", got, tt.wantArchive)
+			}
+		})
+	}
+}
+
+func TestWatchSeriesIdle(t *testing.T) {
+	spool := t.TempDir()
+	writeTestFile(t, filepath.Join(spool, "a1.dcm"), newTestInstance(t, "1.2.3.1", 1))
+	writeTestFile(t, filepath.Join(spool, "a2.dcm"), newTestInstance(t, "1.2.3.1", 2))
+
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.WatchStable, opts.WatchIdle = []string{spool}, out, 0, 1
+	opts.Folder = "{SeriesInstanceUID}/{SOPInstanceUID}.dcm"
+	// the manifest of a folder is written when its series is complete
+	opts.Manifest = "folder"
+	stop := startWatch(t, opts)
+	manifest := func(series string) func() bool {
+		return func() bool {
+			_, err := os.Stat(filepath.Join(out, series, ManifestName))
+			return err == nil
+		}
+	}
+	waitFor(t, "the first series to complete", manifest("1.2.3.1"))
+	if got := checkManifest(t, filepath.Join(out, "1.2.3.1")); !reflect.DeepEqual(got, []string{"1.2.3.1.1.dcm", "1.2.3.1.2.dcm"}) {
+		t.Errorf("the manifest of the complete series lists %v", got)
+	}
+
+	// a series that receives files is not complete
+	writeTestFile(t, filepath.Join(spool, "b1.dcm"), newTestInstance(t, "1.2.3.2", 1))
+	waitFor(t, "the file of the second series", func() bool { return len(listFiles(t, out)) == 4 })
+	if manifest("1.2.3.2")() {
+		t.Error("the second series is complete right after its first file")
+	}
+	waitFor(t, "the second series to complete", manifest("1.2.3.2"))
+
+	result := stop()
+	if result.Files != 3 || result.SeriesCompleted != 2 {
+		t.Errorf("%d files sorted and %d series complete, want 3 and 2", result.Files, result.SeriesCompleted)
+	}
+}
@@ -0,0 +1,135 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/iafan/cwalk"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Reading and writing are done by separate pools. The walker (cwalk) hands files
+// to -read-workers parsers, a parser computes the output path and puts a
+// write job into a bounded queue that -write-workers writers empty. A slow
+// output disk fills the queue and then slows down the parsers, slow parsing
+// leaves writers idle. 'sdcm serve' and -watch write synchronously because the
+// input file is removed after it was sorted.
+
+// writerState holds the write queue and its workers
+type writerState struct {
+	readWorkersFlag  int
+	writeWorkersFlag int
+
+	// bounded queue of the writers, nil if files are written by the parsers
+	writeQueue chan *writeJob
+	writers    sync.WaitGroup
+
+	// number of files that are parsed right now
+	counterReading int32
+
+	// output file names that are taken by files in the write queue
+	reservedOutputNames sync.Map
+}
+
+// writeJob is an output file that waits to be written
+type writeJob struct {
+	dataset            dicom.Dataset
+	dicomVals          map[tag.Tag]string
+	in_file            string
+	oOrderPath         string
+	outputPathFileName string
+	content            *dicom.Dataset
+}
+
+// walkedFile is a file found by the walker that waits for a parser
+type walkedFile struct {
+	path string
+	info os.FileInfo
+}
+
+// walkFiles walks a folder and calls fn for each file from -read-workers parsers. The number of
+// workers of cwalk is a package variable, runs that set it at the same time would race, so its
+// walkers only list the folders.
+func (e *engine) walkFiles(root string, fn filepath.WalkFunc) error {
+	files := make(chan walkedFile, 2*e.num_workers)
+	var parsers sync.WaitGroup
+	var errs []error
+	var errsMutex sync.Mutex
+	for i := 0; i < e.num_workers; i++ {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for f := range files {
+				if err := fn(f.path, f.info, nil); err != nil {
+					errsMutex.Lock()
+					errs = append(errs, err)
+					errsMutex.Unlock()
+				}
+			}
+		}()
+	}
+	err := cwalk.WalkWithSymlinks(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return fn(path, info, err)
+		}
+		files <- walkedFile{path: path, info: info}
+		return nil
+	})
+	close(files)
+	parsers.Wait()
+	return errors.Join(append([]error{err}, errs...)...)
+}
+
+// startWriters starts the writer pool
+func (e *engine) startWriters() {
+	if e.serveMode || e.watchFlag || e.remoteOutput() {
+		return
+	}
+	if e.writeWorkersFlag < 1 {
+		e.writeWorkersFlag = 1
+	}
+	e.writeQueue = make(chan *writeJob, 2*e.writeWorkersFlag)
+	for i := 0; i < e.writeWorkersFlag; i++ {
+		e.writers.Add(1)
+		go func() {
+			defer e.writers.Done()
+			for job := range e.writeQueue {
+				e.writeOutput(job)
+			}
+		}()
+	}
+}
+
+// stopWriters waits until all queued files are written, the closed queue is kept for the progress
+func (e *engine) stopWriters() {
+	if e.writeQueue == nil {
+		return
+	}
+	close(e.writeQueue)
+	e.writers.Wait()
+}
+
+// reserveOutputName returns true if the output file name is free, the name is taken until releaseOutputName
+func (e *engine) reserveOutputName(name string) bool {
+	if _, loaded := e.reservedOutputNames.LoadOrStore(name, true); loaded {
+		return false
+	}
+	if _, err := os.Lstat(name); !os.IsNotExist(err) {
+		e.reservedOutputNames.Delete(name)
+		return false
+	}
+	return true
+}
+
+// releaseOutputName is called after the output file has been written
+func (e *engine) releaseOutputName(name string) {
+	e.reservedOutputNames.Delete(name)
+}
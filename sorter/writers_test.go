@@ -0,0 +1,151 @@
+// Code written 2024 by Hauke Bartsch.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sorter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+func TestReserveOutputName(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEngine()
+	name := filepath.Join(dir, "a.dcm")
+
+	// only one of the writers gets a name
+	var wg sync.WaitGroup
+	var reserved int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e.reserveOutputName(name) {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 1 {
+		t.Fatalf("the name was reserved %d times, want once", reserved)
+	}
+
+	// the name is free again once it is released, but not if the file was written
+	e.releaseOutputName(name)
+	if !e.reserveOutputName(name) {
+		t.Error("a released name cannot be reserved")
+	}
+	if err := os.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.releaseOutputName(name)
+	if e.reserveOutputName(name) {
+		t.Error("the name of an existing file was reserved")
+	}
+	if _, ok := e.reservedOutputNames.Load(name); ok {
+		t.Error("the name of an existing file stays reserved")
+	}
+}
+
+func TestWalkFiles(t *testing.T) {
+	root := t.TempDir()
+	var want []string
+	for i := 0; i < 20; i++ {
+		rel := filepath.Join(fmt.Sprintf("d%d", i%3), fmt.Sprintf("%02d.dcm", i))
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, rel), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// cwalk passes the paths relative to the root
+		want = append(want, rel)
+	}
+	sort.Strings(want)
+
+	e := newTestEngine()
+	e.num_workers = 4
+	var mutex sync.Mutex
+	var got []string
+	errFailed := errors.New("failed")
+	err := e.walkFiles(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		mutex.Lock()
+		got = append(got, path)
+		mutex.Unlock()
+		if filepath.Base(path) == "07.dcm" {
+			return errFailed
+		}
+		return nil
+	})
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walked %v, want %v", got, want)
+	}
+	if !errors.Is(err, errFailed) {
+		t.Errorf("error %v, want %v", err, errFailed)
+	}
+}
+
+func TestRunCollidingNames(t *testing.T) {
+	in := t.TempDir()
+	const n = 40
+	for i := 1; i <= n; i++ {
+		writeTestFile(t, filepath.Join(in, fmt.Sprintf("%02d.dcm", i)), newTestInstance(t, "1.2.3.1", i))
+	}
+	out := t.TempDir()
+	opts := DefaultOptions()
+	opts.Input, opts.Output, opts.Quiet, opts.Sync = []string{in}, out, true, "none"
+	// all files get the same output name
+	opts.Folder = "{PatientID}/{Modality}.dcm"
+	opts.ReadWorkers, opts.WriteWorkers = 4, 4
+	result, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != n || result.Skipped != 0 {
+		t.Errorf("%d files sorted and %d skipped, want %d and 0", result.Files, result.Skipped, n)
+	}
+
+	var want []string
+	for i := 0; i < n; i++ {
+		if i == 0 {
+			want = append(want, "P1/CT.dcm")
+		} else {
+			want = append(want, fmt.Sprintf("P1/CT_%03d.dcm", i))
+		}
+	}
+	got := listFiles(t, out)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("files %v, want %v", got, want)
+	}
+	// each input file was written once
+	seen := make(map[string]bool, 0)
+	for _, name := range got {
+		ds, err := readDatasetFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("could not parse %s (%s)", name, err)
+		}
+		uid := getString(&ds, tag.SOPInstanceUID)
+		if seen[uid] {
+			t.Errorf("%s was written twice", uid)
+		}
+		seen[uid] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%d instances written, want %d", len(seen), n)
+	}
+}